@@ -10,7 +10,7 @@ import (
 
 var configCmd = &cobra.Command{
 	Use:   "config",
-	Short: "Print the fully resolved configuration",
+	Short: "Print the fully resolved configuration, with secrets redacted",
 	RunE:  runConfig,
 }
 
@@ -23,6 +23,7 @@ func runConfig(cmd *cobra.Command, args []string) error {
 	if err != nil {
 		return err
 	}
+	cfg.Redact()
 
 	out, err := yaml.Marshal(cfg)
 	if err != nil {
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/lucasew/ts-proxy/internal/ctxwait"
+	"github.com/lucasew/ts-proxy/pkg/server"
+	"github.com/spf13/viper"
+)
+
+// configPollInterval is how often the config file is checked for changes.
+// Polling (instead of inotify) also catches editors that replace the file
+// and configmap-style symlink swaps.
+const configPollInterval = 2 * time.Second
+
+// watchReload reloads sup on SIGHUP and whenever the config file changes,
+// until ctx is cancelled. Reloads run one at a time; a burst of triggers
+// collapses into a single reload.
+func watchReload(ctx context.Context, sup *server.Supervisor) {
+	trigger := make(chan struct{}, 1)
+	notify := func() {
+		select {
+		case trigger <- struct{}{}:
+		default:
+		}
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	if path := viper.ConfigFileUsed(); path != "" {
+		go watchConfigFile(ctx, path, configPollInterval, notify)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			slog.Info("reload requested", "reason", "SIGHUP")
+			notify()
+		case <-trigger:
+			reloadConfig(sup)
+		}
+	}
+}
+
+// reloadConfig loads and validates the config again and hands it to the
+// supervisor. Any error leaves the running servers untouched.
+func reloadConfig(sup *server.Supervisor) {
+	cfg, err := loadConfig()
+	if err != nil {
+		slog.Warn("reload rejected, keeping running config", "err", err)
+		return
+	}
+	if err := sup.Reload(cfg); err != nil {
+		slog.Warn("reload rejected, keeping running config", "err", err)
+		return
+	}
+	slog.Info("config reloaded", "servers", len(cfg.Servers))
+}
+
+// watchConfigFile calls notify when path's size or modification time
+// changes. A missing file is not a change: editors often delete and
+// recreate, and the next poll sees the new file.
+func watchConfigFile(ctx context.Context, path string, interval time.Duration, notify func()) {
+	last, _ := os.Stat(path)
+	for ctxwait.Delay(ctx, interval) {
+		fi, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if last == nil || !fi.ModTime().Equal(last.ModTime()) || fi.Size() != last.Size() {
+			if last != nil {
+				slog.Info("reload requested", "reason", "config file changed", "path", path)
+				notify()
+			}
+			last = fi
+		}
+	}
+}
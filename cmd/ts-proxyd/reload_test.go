@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchConfigFileNotifiesOnChange(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ts-proxy.yaml")
+	if err := os.WriteFile(path, []byte("servers: {}\n"), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	changed := make(chan struct{}, 10)
+	go watchConfigFile(ctx, path, 10*time.Millisecond, func() { changed <- struct{}{} })
+
+	// No notification while the file is untouched.
+	select {
+	case <-changed:
+		t.Fatal("notified without a change")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := os.WriteFile(path, []byte("servers: {web: {}}\n"), 0o600); err != nil {
+		t.Fatalf("rewrite: %v", err)
+	}
+	select {
+	case <-changed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("no notification after the file changed")
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var restartCmd = &cobra.Command{
+	Use:   "restart <server>",
+	Short: "Restart one server in the running daemon",
+	Long:  "Restart one server in the running daemon: its tsnet node is closed and brought up again while every other server keeps running.",
+	Args:  cobra.ExactArgs(1),
+	RunE:  runRestart,
+}
+
+func init() {
+	rootCmd.AddCommand(restartCmd)
+}
+
+func runRestart(cmd *cobra.Command, args []string) error {
+	client, path, err := adminClient()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(cmd.Context(), adminTimeout)
+	defer cancel()
+	st, err := client.Restart(ctx, args[0])
+	if err != nil {
+		return fmt.Errorf("restart %s via %s: %w", args[0], path, err)
+	}
+	if _, err := fmt.Fprintf(os.Stdout, "%s: %s\n", st.Name, st.State); err != nil {
+		return fmt.Errorf("writing status: %w", err)
+	}
+	return nil
+}
@@ -31,6 +31,7 @@ func init() {
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default: ./ts-proxy.yaml, then $XDG_CONFIG_HOME/ts-proxy/ or ~/.config/ts-proxy/, then /etc/ts-proxy/)")
 	rootCmd.PersistentFlags().String("state-dir", "", "base state directory (default /var/lib/ts-proxy)")
 	rootCmd.PersistentFlags().Bool("stop-on-fail", false, "stop all servers if any one fails")
+	rootCmd.PersistentFlags().String("admin-socket", "", "admin API unix socket, or \"off\" (default <state-dir>/admin.sock)")
 
 	if err := viper.BindPFlag("state_dir", rootCmd.PersistentFlags().Lookup("state-dir")); err != nil {
 		panic(fmt.Errorf("binding state-dir flag: %w", err))
@@ -38,6 +39,9 @@ func init() {
 	if err := viper.BindPFlag("stop_on_fail", rootCmd.PersistentFlags().Lookup("stop-on-fail")); err != nil {
 		panic(fmt.Errorf("binding stop-on-fail flag: %w", err))
 	}
+	if err := viper.BindPFlag("admin_socket", rootCmd.PersistentFlags().Lookup("admin-socket")); err != nil {
+		panic(fmt.Errorf("binding admin-socket flag: %w", err))
+	}
 }
 
 // defaultConfigPaths is the search order when --config is not set.
@@ -97,7 +101,7 @@ func loadConfig() (*config.Config, error) {
 	// Defaults first so missing fields are filled before expansion runs.
 	cfg.SetDefaults()
 	if err := cfg.ExpandEnv(); err != nil {
-		return nil, fmt.Errorf("expanding environment variables: %w", err)
+		return nil, fmt.Errorf("expanding variables and secrets: %w", err)
 	}
 	// ExpandEnv treats a set-but-empty env var as success and substitutes "".
 	// That can wipe values that only looked non-empty because they were
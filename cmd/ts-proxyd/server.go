@@ -5,18 +5,29 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"net"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
+	"github.com/lucasew/ts-proxy/pkg/accesslog"
+	"github.com/lucasew/ts-proxy/pkg/admin"
+	"github.com/lucasew/ts-proxy/pkg/handler"
+	"github.com/lucasew/ts-proxy/pkg/metrics"
 	"github.com/lucasew/ts-proxy/pkg/server"
+	"github.com/lucasew/ts-proxy/pkg/tracing"
+	"github.com/lucasew/ts-proxy/pkg/tsproxy"
 	"github.com/spf13/cobra"
 )
 
 // ErrNoServers is returned when the config has no servers to run.
 var ErrNoServers = errors.New("no servers configured")
 
-var dryRun bool
+var (
+	dryRun  bool
+	loginQR bool
+)
 
 var serverCmd = &cobra.Command{
 	Use:   "server",
@@ -27,6 +38,7 @@ var serverCmd = &cobra.Command{
 
 func init() {
 	serverCmd.Flags().BoolVar(&dryRun, "dry-run", false, "authenticate servers and display structure, then exit")
+	serverCmd.Flags().BoolVar(&loginQR, "login-qr", false, "also show login URLs as QR codes on stderr")
 	rootCmd.AddCommand(serverCmd)
 }
 
@@ -45,6 +57,36 @@ func runServer(cmd *cobra.Command, args []string) error {
 	fmt.Fprintln(os.Stderr)
 
 	sup := server.NewSupervisor(cfg)
+	if loginQR {
+		sup.SetLoginQR(os.Stderr)
+	}
+	if cfg.AccessLog != nil {
+		accessLog, err := accesslog.New(cfg.AccessLog.Options())
+		if err != nil {
+			return fmt.Errorf("access log: %w", err)
+		}
+		defer func() {
+			if err := accessLog.Close(); err != nil {
+				tsproxy.ReportError(err, "context", "access log close")
+			}
+		}()
+		sup.SetAccessLog(accessLog)
+	}
+	if cfg.Tracing != nil {
+		provider, err := tracing.New(context.Background(), cfg.Tracing.Options())
+		if err != nil {
+			return fmt.Errorf("tracing: %w", err)
+		}
+		defer func() {
+			// Flush buffered spans; the collector gets a bounded grace period.
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := provider.Shutdown(ctx); err != nil {
+				tsproxy.ReportError(err, "context", "tracing shutdown")
+			}
+		}()
+		sup.SetTracing(provider)
+	}
 
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
@@ -64,5 +106,47 @@ func runServer(cmd *cobra.Command, args []string) error {
 		return nil
 	}
 
+	if path := cfg.AdminSocketPath(); path != "" {
+		// The API is a convenience; proxying carries on without it.
+		go func() {
+			if err := admin.Serve(ctx, path, sup); err != nil {
+				tsproxy.ReportError(err, "context", "admin api")
+			}
+		}()
+	}
+	if cfg.MetricsListen != "" {
+		h := handler.NewMetrics()
+		if cfg.HealthListen == cfg.MetricsListen {
+			h.WithHealth(sup)
+		}
+		if err := serveLocal(ctx, "metrics", cfg.MetricsListen, h); err != nil {
+			return err
+		}
+		slog.Info("metrics listening", "listen", cfg.MetricsListen, "path", metrics.Path)
+	}
+	if cfg.HealthListen != "" {
+		if cfg.HealthListen != cfg.MetricsListen {
+			if err := serveLocal(ctx, "health", cfg.HealthListen, handler.NewHealth(sup)); err != nil {
+				return err
+			}
+		}
+		slog.Info("health checks listening", "listen", cfg.HealthListen, "liveness", handler.HealthzPath, "readiness", handler.ReadyzPath)
+	}
+	go watchReload(ctx, sup)
 	return sup.Run(ctx)
 }
+
+// serveLocal serves h on a local TCP address until ctx is cancelled. Only
+// binding fails startup; later errors are reported.
+func serveLocal(ctx context.Context, name, listen string, h handler.Handler) error {
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		return fmt.Errorf("%s listen: %w", name, err)
+	}
+	go func() {
+		if err := h.Serve(ctx, ln); err != nil {
+			tsproxy.ReportError(err, "context", name+" server")
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/lucasew/ts-proxy/pkg/config"
+	"github.com/lucasew/ts-proxy/pkg/server"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// ErrServerInUse is returned when logging out a server that is running.
+var ErrServerInUse = errors.New("server is in use")
+
+// logoutTimeout bounds bringing a node up and logging it out.
+const logoutTimeout = time.Minute
+
+var stateCmd = &cobra.Command{
+	Use:   "state",
+	Short: "Inspect and clean up the per-server state directories",
+	Long: "Inspect and clean up the per-server state directories under state_dir. " +
+		"Each holds one tsnet node; renaming or removing a server leaves its node and directory behind.",
+}
+
+var stateListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the nodes in state_dir",
+	Args:  cobra.NoArgs,
+	RunE:  runStateList,
+}
+
+var stateOrphansCmd = &cobra.Command{
+	Use:   "orphans",
+	Short: "List the nodes in state_dir whose server is not in the config",
+	Args:  cobra.NoArgs,
+	RunE:  runStateOrphans,
+}
+
+var stateLogoutCmd = &cobra.Command{
+	Use:   "logout <server>",
+	Short: "Log a node out of the tailnet and remove its state directory",
+	Long: "Log a node out of the tailnet, which removes it from the machine list, and remove its state directory. " +
+		"A server that is still running, in the daemon or elsewhere, is refused; remove it from the config and reload first.",
+	Args: cobra.ExactArgs(1),
+	RunE: runStateLogout,
+}
+
+func init() {
+	stateLogoutCmd.Flags().Bool("force", false, "log out even if the state directory cannot be locked, and remove it even if the logout fails")
+	stateCmd.AddCommand(stateListCmd, stateOrphansCmd, stateLogoutCmd)
+	rootCmd.AddCommand(stateCmd)
+}
+
+// stateConfig reads state_dir and the configured server names, like
+// adminClient, without resolving the servers' secrets.
+func stateConfig() (stateDir string, servers map[string]bool, err error) {
+	cfg, err := clientConfig()
+	if err != nil {
+		return "", nil, err
+	}
+	servers = map[string]bool{}
+	for name := range viper.GetStringMap("servers") {
+		servers[name] = true
+	}
+	return cfg.StateDir, servers, nil
+}
+
+func runStateList(cmd *cobra.Command, args []string) error {
+	return printNodes(false)
+}
+
+func runStateOrphans(cmd *cobra.Command, args []string) error {
+	return printNodes(true)
+}
+
+func printNodes(orphansOnly bool) error {
+	stateDir, servers, err := stateConfig()
+	if err != nil {
+		return err
+	}
+	nodes, err := server.ListNodes(stateDir)
+	if err != nil {
+		return err
+	}
+	if orphansOnly {
+		nodes = orphans(nodes, servers)
+	}
+	if _, err := fmt.Fprint(os.Stdout, formatNodes(nodes, servers, time.Now())); err != nil {
+		return fmt.Errorf("writing nodes: %w", err)
+	}
+	return nil
+}
+
+func runStateLogout(cmd *cobra.Command, args []string) error {
+	name := args[0]
+	if err := config.ValidateSlug(name); err != nil {
+		return err
+	}
+	force, err := cmd.Flags().GetBool("force")
+	if err != nil {
+		return err
+	}
+	stateDir, _, err := stateConfig()
+	if err != nil {
+		return err
+	}
+	if err := checkNotRunning(cmd.Context(), name); err != nil {
+		return err
+	}
+	info, err := server.ReadNode(filepath.Join(stateDir, name))
+	if err != nil {
+		return err
+	}
+	lock, err := server.LockNode(info.Dir)
+	switch {
+	case errors.Is(err, server.ErrNodeLocked):
+		return fmt.Errorf("%w: another process holds %s; stop it first", ErrServerInUse, info.Dir)
+	case err != nil && !force:
+		return fmt.Errorf("%w (use --force to log out anyway)", err)
+	case err != nil:
+		slog.Warn("cannot lock state dir, logging out anyway", "server", name, "err", err)
+	}
+	defer func() { _ = lock.Unlock() }()
+
+	ctx, cancel := context.WithTimeout(cmd.Context(), logoutTimeout)
+	defer cancel()
+	if err := server.LogoutNode(ctx, info); err != nil {
+		if !force {
+			return fmt.Errorf("log out %s: %w (use --force to remove its state anyway)", name, err)
+		}
+		slog.Warn("logout failed, removing state anyway", "server", name, "err", err)
+	}
+	if err := os.RemoveAll(info.Dir); err != nil {
+		return fmt.Errorf("remove state of %s: %w", name, err)
+	}
+	if _, err := fmt.Fprintf(os.Stdout, "%s: logged out and removed %s\n", name, info.Dir); err != nil {
+		return fmt.Errorf("writing result: %w", err)
+	}
+	return nil
+}
+
+// checkNotRunning refuses servers the daemon runs, since two nodes on one
+// state dir corrupt it. Without a reachable daemon it passes; the state dir
+// lock still catches a daemon the admin API cannot reach.
+func checkNotRunning(ctx context.Context, name string) error {
+	client, _, err := adminClient()
+	if errors.Is(err, ErrAdminDisabled) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, adminTimeout)
+	defer cancel()
+	statuses, err := client.Servers(ctx)
+	if err != nil {
+		return nil
+	}
+	for _, st := range statuses {
+		if st.Name == name && st.State != server.StateStopped {
+			return fmt.Errorf("%w: %s is %s; remove it from the config and reload first", ErrServerInUse, name, st.State)
+		}
+	}
+	return nil
+}
+
+// orphans returns the nodes whose server is not in the config.
+func orphans(nodes []server.NodeInfo, servers map[string]bool) []server.NodeInfo {
+	var out []server.NodeInfo
+	for _, n := range nodes {
+		if !servers[n.Name] {
+			out = append(out, n)
+		}
+	}
+	return out
+}
+
+// formatNodes renders a table of nodes; CONFIG flags the orphaned ones.
+func formatNodes(nodes []server.NodeInfo, servers map[string]bool, now time.Time) string {
+	var b strings.Builder
+	tw := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tHOSTNAME\tNODE\tKEY EXPIRY\tCONFIG")
+	for _, n := range nodes {
+		node := n.NodeID
+		if !n.LoggedIn {
+			node = "logged out"
+		}
+		inConfig := "yes"
+		if !servers[n.Name] {
+			inConfig = "orphaned"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", n.Name, nodeHostname(n), node, keyExpiry(n, now), inConfig)
+	}
+	_ = tw.Flush()
+	return b.String()
+}
+
+func nodeHostname(n server.NodeInfo) string {
+	switch {
+	case n.FQDN != "":
+		return n.FQDN
+	case n.Hostname != "":
+		return n.Hostname
+	default:
+		return "-"
+	}
+}
+
+// keyExpiry is the KEY EXPIRY column, as of the node's last login.
+func keyExpiry(n server.NodeInfo, now time.Time) string {
+	switch {
+	case !n.LoggedIn:
+		return "-"
+	case n.Recorded.IsZero():
+		return "unknown"
+	case n.KeyExpiry.IsZero():
+		return "disabled"
+	case n.KeyExpiry.Before(now):
+		return "expired " + n.KeyExpiry.Format(time.DateOnly)
+	default:
+		return n.KeyExpiry.Format(time.DateOnly)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lucasew/ts-proxy/pkg/server"
+)
+
+func TestFormatNodes(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	recorded := now.Add(-24 * time.Hour)
+	nodes := []server.NodeInfo{
+		{
+			Name: "api", Hostname: "api", FQDN: "api.example.ts.net", NodeID: "nAPI1CNTRL", LoggedIn: true,
+			KeyExpiry: time.Date(2027, 4, 1, 0, 0, 0, 0, time.UTC), Recorded: recorded,
+		},
+		{Name: "ci", Hostname: "ci", NodeID: "nCI1CNTRL", LoggedIn: true, Recorded: recorded},
+		{Name: "gone", Hostname: "gone", LoggedIn: false},
+		{
+			Name: "old", Hostname: "old", NodeID: "nOLD1CNTRL", LoggedIn: true,
+			KeyExpiry: time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC), Recorded: recorded,
+		},
+		{Name: "web", Hostname: "web", NodeID: "nWEB1CNTRL", LoggedIn: true},
+	}
+	servers := map[string]bool{"api": true, "ci": true, "web": true}
+
+	got := formatNodes(nodes, servers, now)
+	want := `NAME  HOSTNAME            NODE        KEY EXPIRY          CONFIG
+api   api.example.ts.net  nAPI1CNTRL  2027-04-01          yes
+ci    ci                  nCI1CNTRL   disabled            yes
+gone  gone                logged out  -                   orphaned
+old   old                 nOLD1CNTRL  expired 2026-09-01  orphaned
+web   web                 nWEB1CNTRL  unknown             yes
+`
+	if got != want {
+		t.Errorf("formatNodes() =\n%s\nwant:\n%s", got, want)
+	}
+
+	var names []string
+	for _, n := range orphans(nodes, servers) {
+		names = append(names, n.Name)
+	}
+	if len(names) != 2 || names[0] != "gone" || names[1] != "old" {
+		t.Errorf("orphans = %v, want [gone old]", names)
+	}
+}
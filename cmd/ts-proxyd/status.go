@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/lucasew/ts-proxy/pkg/admin"
+	"github.com/lucasew/ts-proxy/pkg/config"
+	"github.com/lucasew/ts-proxy/pkg/server"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// ErrAdminDisabled is returned by client commands when admin_socket is off.
+var ErrAdminDisabled = errors.New("admin api is disabled (admin_socket: off)")
+
+// adminTimeout bounds a client command's round trip to the daemon. A
+// restart waits for the old node to close, so leave room for that.
+const adminTimeout = 30 * time.Second
+
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show the state of every server in the running daemon",
+	Args:  cobra.NoArgs,
+	RunE:  runStatus,
+}
+
+func init() {
+	rootCmd.AddCommand(statusCmd)
+}
+
+func runStatus(cmd *cobra.Command, args []string) error {
+	client, path, err := adminClient()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(cmd.Context(), adminTimeout)
+	defer cancel()
+	statuses, err := client.Servers(ctx)
+	if err != nil {
+		return fmt.Errorf("query daemon at %s: %w", path, err)
+	}
+	if _, err := fmt.Fprint(os.Stdout, formatStatus(statuses, time.Now())); err != nil {
+		return fmt.Errorf("writing status: %w", err)
+	}
+	return nil
+}
+
+// adminClient returns a client for the daemon's admin socket. The socket is
+// resolved from --admin-socket, admin_socket or state_dir without loading
+// the full config, so client commands work without the daemon's secrets in
+// the environment.
+func adminClient() (*admin.Client, string, error) {
+	cfg, err := clientConfig()
+	if err != nil {
+		return nil, "", err
+	}
+	path := cfg.AdminSocketPath()
+	if path == "" {
+		return nil, "", ErrAdminDisabled
+	}
+	return admin.NewClient(path), path, nil
+}
+
+// clientConfig reads just state_dir and admin_socket from the config.
+func clientConfig() (config.Config, error) {
+	if err := viper.ReadInConfig(); err != nil {
+		var notFound viper.ConfigFileNotFoundError
+		if !errors.As(err, &notFound) {
+			return config.Config{}, fmt.Errorf("reading config file: %w", err)
+		}
+	}
+	cfg := config.Config{
+		StateDir:    os.ExpandEnv(viper.GetString("state_dir")),
+		AdminSocket: os.ExpandEnv(viper.GetString("admin_socket")),
+	}
+	cfg.SetDefaults()
+	return cfg, nil
+}
+
+// stateLabel is the STATE column: the state, flagged when the supervisor
+// gave up restarting the server.
+func stateLabel(st server.Status) string {
+	if st.CrashLoop {
+		return string(st.State) + " (crash loop)"
+	}
+	return string(st.State)
+}
+
+// formatStatus renders a server table followed by each server's handlers,
+// aligned like config.FormatHandlerLine.
+func formatStatus(statuses []server.Status, now time.Time) string {
+	var b strings.Builder
+	tw := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tSTATE\tFQDN\tUPTIME\tRESTARTS")
+	for _, st := range statuses {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\n", st.Name, stateLabel(st), st.FQDN, uptime(st, now), st.Restarts)
+	}
+	_ = tw.Flush()
+
+	var all []config.HandlerConfig
+	for _, st := range statuses {
+		for _, hs := range st.Handlers {
+			all = append(all, handlerConfig(hs))
+		}
+	}
+	maxListen, maxTypeFlags := config.HandlerColumnWidths(all)
+	maxTarget := 0
+	for _, h := range all {
+		maxTarget = max(maxTarget, len(h.Target()))
+	}
+
+	for _, st := range statuses {
+		fmt.Fprintf(&b, "\n%s (%s)\n", st.Name, st.FQDN)
+		if st.LastError != "" {
+			fmt.Fprintf(&b, "  last error: %s\n", st.LastError)
+		}
+		if st.AuthURL != "" {
+			fmt.Fprintf(&b, "  log in at: %s\n", st.AuthURL)
+		}
+		for _, hs := range st.Handlers {
+			h := handlerConfig(hs)
+			fmt.Fprintf(&b, "  %-*s %-*s -> %-*s  %s\n",
+				maxListen, h.Listen,
+				maxTypeFlags, config.HandlerTypeFlags(h),
+				maxTarget, h.Target(),
+				activity(hs))
+		}
+	}
+	return b.String()
+}
+
+// handlerConfig rebuilds enough of a handler's config to reuse the config
+// package's display helpers.
+func handlerConfig(hs server.HandlerStatus) config.HandlerConfig {
+	h := config.HandlerConfig{Type: hs.Type, Listen: hs.Listen, TLS: hs.TLS, Funnel: hs.Funnel}
+	if hs.Type == "static" {
+		h.Root = hs.Upstream
+	} else {
+		h.UpstreamAddress = hs.Upstream
+	}
+	return h
+}
+
+func uptime(st server.Status, now time.Time) string {
+	if st.RunningSince.IsZero() {
+		return "-"
+	}
+	return now.Sub(st.RunningSince).Round(time.Second).String()
+}
+
+func activity(hs server.HandlerStatus) string {
+	switch {
+	case !hs.Active:
+		return "inactive"
+	case hs.Connections == 1:
+		return "1 connection"
+	default:
+		return fmt.Sprintf("%d connections", hs.Connections)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lucasew/ts-proxy/pkg/server"
+)
+
+func TestFormatStatus(t *testing.T) {
+	now := time.Date(2026, 1, 2, 15, 0, 0, 0, time.UTC)
+	statuses := []server.Status{
+		{
+			Name:         "api",
+			FQDN:         "api.example.ts.net",
+			State:        server.StateRunning,
+			RunningSince: now.Add(-90 * time.Minute),
+			Handlers: []server.HandlerStatus{
+				{Type: "tcp", Listen: ":22", Upstream: "127.0.0.1:22", Active: true, Connections: 1},
+				{Type: "http", Listen: ":443", Upstream: "127.0.0.1:8080", TLS: true, Active: true, Connections: 3},
+			},
+		},
+		{
+			Name:    "new",
+			FQDN:    "new",
+			State:   server.StateAuthenticating,
+			AuthURL: "https://login.tailscale.com/a/abc123",
+			Handlers: []server.HandlerStatus{
+				{Type: "http", Listen: ":80", Upstream: "127.0.0.1:3000"},
+			},
+		},
+		{
+			Name:      "web",
+			FQDN:      "web",
+			State:     server.StateFailed,
+			Restarts:  2,
+			LastError: "tailscale up: boom",
+			Handlers: []server.HandlerStatus{
+				{Type: "static", Listen: ":80", Upstream: "/srv/www"},
+			},
+		},
+	}
+
+	got := formatStatus(statuses, now)
+	want := `NAME  STATE           FQDN                UPTIME   RESTARTS
+api   running         api.example.ts.net  1h30m0s  0
+new   authenticating  new                 -        0
+web   failed          web                 -        2
+
+api (api.example.ts.net)
+  :22  TCP      -> 127.0.0.1:22    1 connection
+  :443 HTTP+TLS -> 127.0.0.1:8080  3 connections
+
+new (new)
+  log in at: https://login.tailscale.com/a/abc123
+  :80  HTTP     -> 127.0.0.1:3000  inactive
+
+web (web)
+  last error: tailscale up: boom
+  :80  STATIC   -> /srv/www        inactive
+`
+	if got != want {
+		t.Errorf("formatStatus mismatch\n got:\n%s\nwant:\n%s", got, want)
+	}
+	if strings.Contains(got, "\t") {
+		t.Error("output contains tabs; want spaces only")
+	}
+}
@@ -42,6 +42,9 @@ let
         ];
       }
     ) cfg.hosts;
+  }
+  // lib.optionalAttrs (cfg.healthListen != null) {
+    health_listen = cfg.healthListen;
   };
 
   configFile = yamlFormat.generate "ts-proxy.yaml" configContent;
@@ -86,6 +89,12 @@ in
         default = false;
       };
 
+      healthListen = lib.mkOption {
+        description = "Local address serving /healthz and /readyz probes, e.g. 127.0.0.1:9101";
+        type = lib.types.nullOr lib.types.str;
+        default = null;
+      };
+
       serviceName = lib.mkOption {
         description = "Name of the systemd service for the combined ts-proxy instance";
         type = lib.types.str;
@@ -0,0 +1,237 @@
+// Package access evaluates per-handler allow/deny rules and required app
+// capabilities against the identity WhoIs reports for a tailnet peer.
+package access
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+var (
+	// ErrInvalidRule is returned for rules that do not parse.
+	ErrInvalidRule = errors.New("invalid access rule")
+	// ErrInvalidCapability is returned for capability names not of the
+	// form {domain}/{name}.
+	ErrInvalidCapability = errors.New("invalid capability")
+)
+
+// capabilityPattern is the form `tailscale serve --accept-app-caps` accepts:
+// a fully qualified domain, a slash, then a path-like name.
+var capabilityPattern = regexp.MustCompile(`^([\pL\pN-]+\.)+[\pL\pN-]+/[\pL\pN-/]+$`)
+
+// TaggedDevicesLogin is the LoginName WhoIs returns for tagged nodes; it is
+// not a user and must never satisfy a login or domain rule.
+const TaggedDevicesLogin = "tagged-devices"
+
+type ruleKind int
+
+const (
+	ruleAny    ruleKind = iota // "*": any tailnet peer
+	ruleLogin                  // "user@example.com"
+	ruleDomain                 // "*@example.com"
+	ruleTag                    // "tag:server"
+	ruleNode                   // "node:laptop"
+)
+
+// Rule is one parsed allow/deny entry.
+type Rule struct {
+	kind  ruleKind
+	value string
+}
+
+// ParseRule parses a rule string. Supported forms:
+//
+//	user@example.com  exact login name
+//	*@example.com     any login in a domain
+//	tag:server        nodes carrying the ACL tag
+//	node:laptop       node by name (short name or full MagicDNS name)
+//	*                 any identified tailnet peer
+//
+// Matching is case-insensitive.
+func ParseRule(s string) (Rule, error) {
+	v := strings.ToLower(strings.TrimSpace(s))
+	switch {
+	case v == "*":
+		return Rule{kind: ruleAny}, nil
+	case strings.HasPrefix(v, "tag:"):
+		if len(v) == len("tag:") {
+			return Rule{}, fmt.Errorf("%w %q: empty tag", ErrInvalidRule, s)
+		}
+		return Rule{kind: ruleTag, value: v}, nil
+	case strings.HasPrefix(v, "node:"):
+		name := strings.TrimSuffix(strings.TrimPrefix(v, "node:"), ".")
+		if name == "" {
+			return Rule{}, fmt.Errorf("%w %q: empty node name", ErrInvalidRule, s)
+		}
+		return Rule{kind: ruleNode, value: name}, nil
+	case strings.HasPrefix(v, "*@"):
+		if len(v) == len("*@") {
+			return Rule{}, fmt.Errorf("%w %q: empty domain", ErrInvalidRule, s)
+		}
+		return Rule{kind: ruleDomain, value: v[1:]}, nil
+	case strings.Count(v, "@") == 1 && !strings.HasPrefix(v, "@") && !strings.HasSuffix(v, "@") && !strings.Contains(v, "*"):
+		return Rule{kind: ruleLogin, value: v}, nil
+	default:
+		return Rule{}, fmt.Errorf("%w %q: want *, user@domain, *@domain, tag:<name> or node:<name>", ErrInvalidRule, s)
+	}
+}
+
+// Matches reports whether the peer identity satisfies the rule. A nil
+// identity (anonymous Funnel client) matches nothing.
+func (r Rule) Matches(who *apitype.WhoIsResponse) bool {
+	if who == nil {
+		return false
+	}
+	switch r.kind {
+	case ruleAny:
+		return who.Node != nil || who.UserProfile != nil
+	case ruleLogin, ruleDomain:
+		login := userLogin(who)
+		if login == "" {
+			return false
+		}
+		if r.kind == ruleLogin {
+			return login == r.value
+		}
+		return strings.HasSuffix(login, r.value)
+	case ruleTag:
+		if who.Node == nil {
+			return false
+		}
+		for _, tag := range who.Node.Tags {
+			if strings.EqualFold(tag, r.value) {
+				return true
+			}
+		}
+		return false
+	case ruleNode:
+		if who.Node == nil {
+			return false
+		}
+		fqdn := strings.ToLower(strings.TrimSuffix(who.Node.Name, "."))
+		short, _, _ := strings.Cut(fqdn, ".")
+		return r.value == fqdn || r.value == short ||
+			r.value == strings.ToLower(who.Node.ComputedName)
+	}
+	return false
+}
+
+func userLogin(who *apitype.WhoIsResponse) string {
+	if who.UserProfile == nil {
+		return ""
+	}
+	login := strings.ToLower(who.UserProfile.LoginName)
+	if login == TaggedDevicesLogin {
+		return ""
+	}
+	return login
+}
+
+// ValidateCapability checks that name is an app capability such as
+// "example.com/cap/ts-proxy".
+func ValidateCapability(name string) error {
+	if !capabilityPattern.MatchString(name) {
+		return fmt.Errorf("%w %q: want {domain}/{name}, e.g. example.com/cap/ts-proxy", ErrInvalidCapability, name)
+	}
+	return nil
+}
+
+// HasCapability reports whether the tailnet policy grants the peer the app
+// capability. Anonymous peers have none.
+func HasCapability(who *apitype.WhoIsResponse, name string) bool {
+	return who != nil && who.CapMap.HasCapability(tailcfg.PeerCapability(name))
+}
+
+// Policy is a compiled allow/deny rule set with an optional required
+// capability.
+//
+// Deny rules win: a peer matching any deny rule is rejected. A peer lacking
+// the required capability is rejected next. Otherwise, if allow rules exist
+// the peer must match at least one; with no allow rules everyone not denied
+// is accepted.
+type Policy struct {
+	allow      []Rule
+	deny       []Rule
+	capability string
+}
+
+// NewPolicy compiles allow and deny rules and the required capability (empty
+// for none). It returns nil (no restriction) when all are empty, so callers
+// can skip enforcement cheaply.
+func NewPolicy(allow, deny []string, requireCapability string) (*Policy, error) {
+	if len(allow) == 0 && len(deny) == 0 && requireCapability == "" {
+		return nil, nil
+	}
+	p := &Policy{capability: requireCapability}
+	var errs []error
+	if requireCapability != "" {
+		if err := ValidateCapability(requireCapability); err != nil {
+			errs = append(errs, fmt.Errorf("require_capability: %w", err))
+		}
+	}
+	for _, s := range allow {
+		r, err := ParseRule(s)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("allow: %w", err))
+			continue
+		}
+		p.allow = append(p.allow, r)
+	}
+	for _, s := range deny {
+		r, err := ParseRule(s)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("deny: %w", err))
+			continue
+		}
+		p.deny = append(p.deny, r)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Allows reports whether the peer may use the handler. A nil Policy allows
+// everyone.
+func (p *Policy) Allows(who *apitype.WhoIsResponse) bool {
+	if p == nil {
+		return true
+	}
+	for _, r := range p.deny {
+		if r.Matches(who) {
+			return false
+		}
+	}
+	if p.capability != "" && !HasCapability(who, p.capability) {
+		return false
+	}
+	if len(p.allow) == 0 {
+		return true
+	}
+	for _, r := range p.allow {
+		if r.Matches(who) {
+			return true
+		}
+	}
+	return false
+}
+
+// Describe returns login and node name for access logs; empty strings for
+// anonymous peers.
+func Describe(who *apitype.WhoIsResponse) (login, node string) {
+	if who == nil {
+		return "", ""
+	}
+	if who.UserProfile != nil {
+		login = who.UserProfile.LoginName
+	}
+	if who.Node != nil {
+		node = strings.TrimSuffix(who.Node.Name, ".")
+	}
+	return login, node
+}
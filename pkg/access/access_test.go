@@ -0,0 +1,158 @@
+package access
+
+import (
+	"errors"
+	"testing"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+func user(login string) *apitype.WhoIsResponse {
+	return &apitype.WhoIsResponse{
+		Node:        &tailcfg.Node{Name: "laptop.example.ts.net.", ComputedName: "laptop"},
+		UserProfile: &tailcfg.UserProfile{LoginName: login},
+	}
+}
+
+func tagged(tags ...string) *apitype.WhoIsResponse {
+	return &apitype.WhoIsResponse{
+		Node:        &tailcfg.Node{Name: "ci-runner.example.ts.net.", Tags: tags},
+		UserProfile: &tailcfg.UserProfile{LoginName: TaggedDevicesLogin},
+	}
+}
+
+func TestParseRule(t *testing.T) {
+	valid := []string{"*", "alice@example.com", "*@example.com", "tag:server", "node:laptop", "node:laptop.example.ts.net."}
+	for _, s := range valid {
+		if _, err := ParseRule(s); err != nil {
+			t.Errorf("ParseRule(%q) = %v, want nil", s, err)
+		}
+	}
+	invalid := []string{"", "alice", "tag:", "node:", "*@", "@example.com", "a@b@c", "group:admins", "al*ce@example.com"}
+	for _, s := range invalid {
+		if _, err := ParseRule(s); !errors.Is(err, ErrInvalidRule) {
+			t.Errorf("ParseRule(%q) = %v, want ErrInvalidRule", s, err)
+		}
+	}
+}
+
+func TestRuleMatches(t *testing.T) {
+	tests := []struct {
+		rule string
+		who  *apitype.WhoIsResponse
+		want bool
+	}{
+		{"*", user("alice@example.com"), true},
+		{"*", tagged("tag:ci"), true},
+		{"*", nil, false},
+		{"alice@example.com", user("Alice@Example.com"), true},
+		{"alice@example.com", user("bob@example.com"), false},
+		{"*@example.com", user("bob@example.com"), true},
+		{"*@example.com", user("bob@example.com.evil"), false},
+		{"*@example.com", user("bob@notexample.com"), false},
+		{"*@example.com", nil, false},
+		{"tag:ci", tagged("tag:ci", "tag:prod"), true},
+		{"tag:ci", tagged("tag:prod"), false},
+		{"tag:ci", user("alice@example.com"), false},
+		{"node:laptop", user("alice@example.com"), true},
+		{"node:laptop.example.ts.net", user("alice@example.com"), true},
+		{"node:desktop", user("alice@example.com"), false},
+		// Tagged nodes report a pseudo login that must not satisfy user rules.
+		{"tagged-devices@example.com", tagged("tag:ci"), false},
+	}
+	for _, tt := range tests {
+		r, err := ParseRule(tt.rule)
+		if err != nil {
+			t.Fatalf("ParseRule(%q): %v", tt.rule, err)
+		}
+		if got := r.Matches(tt.who); got != tt.want {
+			t.Errorf("rule %q matches %+v = %v, want %v", tt.rule, tt.who, got, tt.want)
+		}
+	}
+}
+
+func TestPolicyAllows(t *testing.T) {
+	tests := []struct {
+		name  string
+		allow []string
+		deny  []string
+		who   *apitype.WhoIsResponse
+		want  bool
+	}{
+		{"deny only rejects match", nil, []string{"bob@example.com"}, user("bob@example.com"), false},
+		{"deny only accepts others", nil, []string{"bob@example.com"}, user("alice@example.com"), true},
+		{"deny only accepts anonymous", nil, []string{"bob@example.com"}, nil, true},
+		{"allow accepts match", []string{"*@example.com"}, nil, user("alice@example.com"), true},
+		{"allow rejects non-match", []string{"*@example.com"}, nil, user("eve@other.com"), false},
+		{"allow rejects anonymous", []string{"*"}, nil, nil, false},
+		{"deny beats allow", []string{"*@example.com"}, []string{"bob@example.com"}, user("bob@example.com"), false},
+		{"tag allow", []string{"tag:ci"}, nil, tagged("tag:ci"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewPolicy(tt.allow, tt.deny, "")
+			if err != nil {
+				t.Fatalf("NewPolicy: %v", err)
+			}
+			if got := p.Allows(tt.who); got != tt.want {
+				t.Errorf("Allows = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewPolicyEmptyAndErrors(t *testing.T) {
+	p, err := NewPolicy(nil, nil, "")
+	if err != nil || p != nil {
+		t.Fatalf("NewPolicy with no rules = %v, %v; want nil, nil", p, err)
+	}
+	if !p.Allows(nil) {
+		t.Error("nil policy should allow everyone")
+	}
+
+	_, err = NewPolicy([]string{"bad", "*"}, []string{"also bad"}, "")
+	if !errors.Is(err, ErrInvalidRule) {
+		t.Fatalf("NewPolicy with bad rules = %v, want ErrInvalidRule", err)
+	}
+}
+
+func TestRequireCapability(t *testing.T) {
+	const capName = "example.com/cap/ts-proxy"
+	p, err := NewPolicy(nil, []string{"mallory@example.com"}, capName)
+	if err != nil {
+		t.Fatalf("NewPolicy: %v", err)
+	}
+	granted := user("alice@example.com")
+	granted.CapMap = tailcfg.PeerCapMap{capName: {`{"role":"admin"}`}}
+	if !p.Allows(granted) {
+		t.Error("peer with the capability denied")
+	}
+	if p.Allows(user("bob@example.com")) {
+		t.Error("peer without the capability allowed")
+	}
+	if p.Allows(nil) {
+		t.Error("anonymous peer allowed")
+	}
+	denied := user("mallory@example.com")
+	denied.CapMap = granted.CapMap
+	if p.Allows(denied) {
+		t.Error("deny rule should win over a granted capability")
+	}
+}
+
+func TestValidateCapability(t *testing.T) {
+	for _, s := range []string{"example.com/cap/ts-proxy", "tailscale.com/cap/drive", "a.b/c"} {
+		if err := ValidateCapability(s); err != nil {
+			t.Errorf("ValidateCapability(%q) = %v, want nil", s, err)
+		}
+	}
+	for _, s := range []string{"", "ts-proxy", "example/cap", "example.com/", "/cap/x", "example.com/cap x"} {
+		if err := ValidateCapability(s); !errors.Is(err, ErrInvalidCapability) {
+			t.Errorf("ValidateCapability(%q) = %v, want ErrInvalidCapability", s, err)
+		}
+	}
+	if _, err := NewPolicy(nil, nil, "nope"); !errors.Is(err, ErrInvalidCapability) {
+		t.Errorf("NewPolicy with bad capability = %v, want ErrInvalidCapability", err)
+	}
+}
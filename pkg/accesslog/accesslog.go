@@ -0,0 +1,230 @@
+// Package accesslog writes one record per completed HTTP request or TCP
+// session, with the tailnet identity behind it, as JSON lines or in the
+// Combined Log Format.
+package accesslog
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lucasew/ts-proxy/pkg/tsproxy"
+)
+
+// Formats accepted by Options.Format.
+const (
+	FormatJSON     = "json"
+	FormatCombined = "combined"
+)
+
+// OutputStdout writes the log to standard output.
+const OutputStdout = "stdout"
+
+// Rotation defaults for file outputs.
+const (
+	DefaultMaxSizeMB  = 100
+	DefaultMaxBackups = 5
+)
+
+// Origins of a request or session.
+const (
+	OriginTailnet = "tailnet"
+	// OriginFunnel marks clients WhoIs cannot identify, i.e. Funnel
+	// traffic from the Internet.
+	OriginFunnel = "funnel"
+)
+
+// ErrUnknownFormat is returned for formats other than json and combined.
+var ErrUnknownFormat = errors.New("unknown access log format")
+
+// Options configures a Logger.
+type Options struct {
+	// Format is FormatJSON (default) or FormatCombined.
+	Format string
+	// Output is OutputStdout (default) or a file path.
+	Output string
+	// MaxSizeMB rotates a file output once it reaches this size;
+	// DefaultMaxSizeMB when zero.
+	MaxSizeMB int
+	// MaxBackups is how many rotated files to keep; DefaultMaxBackups
+	// when zero.
+	MaxBackups int
+}
+
+// ValidateFormat checks that format is supported. Empty means json.
+func ValidateFormat(format string) error {
+	switch format {
+	case "", FormatJSON, FormatCombined:
+		return nil
+	default:
+		return fmt.Errorf("%w %q: want %s or %s", ErrUnknownFormat, format, FormatJSON, FormatCombined)
+	}
+}
+
+// Entry is one access record. HTTP entries carry the request fields and
+// Status; TCP entries carry Upstream, BytesIn and Error.
+type Entry struct {
+	Time     time.Time `json:"time"`
+	Server   string    `json:"server"`
+	Handler  string    `json:"handler"`
+	Protocol string    `json:"protocol"`
+	Remote   string    `json:"remote"`
+	Origin   string    `json:"origin"`
+	User     string    `json:"user,omitempty"`
+	Node     string    `json:"node,omitempty"`
+
+	Method    string `json:"method,omitempty"`
+	Host      string `json:"host,omitempty"`
+	URI       string `json:"uri,omitempty"`
+	Proto     string `json:"proto,omitempty"`
+	Status    int    `json:"status,omitempty"`
+	Referer   string `json:"referer,omitempty"`
+	UserAgent string `json:"user_agent,omitempty"`
+
+	Upstream string `json:"upstream,omitempty"`
+	BytesIn  int64  `json:"bytes_in,omitempty"`
+	// BytesOut is what was sent to the client.
+	BytesOut int64         `json:"bytes_out"`
+	Duration time.Duration `json:"-"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// MarshalJSON adds the duration in milliseconds.
+func (e Entry) MarshalJSON() ([]byte, error) {
+	type plain Entry
+	return json.Marshal(struct {
+		plain
+		DurationMS float64 `json:"duration_ms"`
+	}{plain(e), float64(e.Duration.Microseconds()) / 1000})
+}
+
+// Logger serializes entries to one output.
+type Logger struct {
+	format string
+	mu     sync.Mutex
+	w      io.Writer
+	closer io.Closer
+}
+
+// New opens the output described by opts.
+func New(opts Options) (*Logger, error) {
+	if err := ValidateFormat(opts.Format); err != nil {
+		return nil, err
+	}
+	l := &Logger{format: opts.Format}
+	if l.format == "" {
+		l.format = FormatJSON
+	}
+	if opts.Output == "" || opts.Output == OutputStdout {
+		l.w = os.Stdout
+		return l, nil
+	}
+	maxSize := opts.MaxSizeMB
+	if maxSize <= 0 {
+		maxSize = DefaultMaxSizeMB
+	}
+	backups := opts.MaxBackups
+	if backups <= 0 {
+		backups = DefaultMaxBackups
+	}
+	f, err := OpenRotatingFile(opts.Output, int64(maxSize)<<20, backups)
+	if err != nil {
+		return nil, err
+	}
+	l.w, l.closer = f, f
+	return l, nil
+}
+
+// NewWriter returns a logger writing to w, for tests and embedding.
+func NewWriter(w io.Writer, format string) (*Logger, error) {
+	if err := ValidateFormat(format); err != nil {
+		return nil, err
+	}
+	if format == "" {
+		format = FormatJSON
+	}
+	return &Logger{format: format, w: w}, nil
+}
+
+// Log writes e. Write failures are reported, not returned: a full disk
+// must not fail proxied traffic.
+func (l *Logger) Log(e Entry) {
+	var line []byte
+	if l.format == FormatCombined {
+		line = []byte(combined(e))
+	} else {
+		var err error
+		if line, err = json.Marshal(e); err != nil {
+			tsproxy.ReportError(err, "context", "access log encode")
+			return
+		}
+		line = append(line, '\n')
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.w.Write(line); err != nil {
+		tsproxy.ReportError(err, "context", "access log write")
+	}
+}
+
+// Close closes a file output.
+func (l *Logger) Close() error {
+	if l.closer == nil {
+		return nil
+	}
+	return l.closer.Close()
+}
+
+// combined renders e in the Combined Log Format. TCP sessions use a
+// "TCP <upstream>" request line and "-" as status.
+func combined(e Entry) string {
+	host := e.Remote
+	if i := strings.LastIndexByte(host, ':'); i >= 0 {
+		host = strings.Trim(host[:i], "[]")
+	}
+	request, status := fmt.Sprintf("%s %s %s", e.Method, e.URI, e.Proto), strconv.Itoa(e.Status)
+	if e.Protocol == "tcp" {
+		request, status = "TCP "+e.Upstream, "-"
+	}
+	return fmt.Sprintf("%s - %s [%s] %q %s %d %q %q\n",
+		host, dash(e.User), e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		request, status, e.BytesOut, dash(e.Referer), dash(e.UserAgent))
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// Handler logs for one proxy handler. A nil *Handler logs nothing, so
+// handlers built without an access log need no checks.
+type Handler struct {
+	logger          *Logger
+	server, handler string
+}
+
+// ForHandler returns the logger for the handler listening on listen in
+// server. It returns nil when l is nil.
+func (l *Logger) ForHandler(server, listen string) *Handler {
+	if l == nil {
+		return nil
+	}
+	return &Handler{logger: l, server: server, handler: listen}
+}
+
+// Log fills in the server and handler and writes e.
+func (h *Handler) Log(e Entry) {
+	if h == nil {
+		return
+	}
+	e.Server, e.Handler = h.server, h.handler
+	h.logger.Log(e)
+}
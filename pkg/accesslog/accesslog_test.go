@@ -0,0 +1,202 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testTime = time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+
+func TestLogJSON(t *testing.T) {
+	var buf bytes.Buffer
+	l, err := NewWriter(&buf, "")
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+	l.ForHandler("web", ":443").Log(Entry{
+		Time:     testTime,
+		Protocol: "http",
+		Remote:   "100.64.0.7:51234",
+		Origin:   OriginTailnet,
+		User:     "alice@example.com",
+		Method:   "GET",
+		URI:      "/",
+		Status:   200,
+		BytesOut: 612,
+		Duration: 3200 * time.Microsecond,
+	})
+	var got map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("unmarshal %q: %v", buf.String(), err)
+	}
+	for key, want := range map[string]any{
+		"server":      "web",
+		"handler":     ":443",
+		"origin":      "tailnet",
+		"user":        "alice@example.com",
+		"status":      float64(200),
+		"bytes_out":   float64(612),
+		"duration_ms": 3.2,
+		"time":        "2026-10-18T12:00:00Z",
+	} {
+		if got[key] != want {
+			t.Errorf("%s = %v, want %v", key, got[key], want)
+		}
+	}
+	if _, ok := got["bytes_in"]; ok {
+		t.Errorf("bytes_in present in HTTP entry: %v", got)
+	}
+	if !strings.HasSuffix(buf.String(), "}\n") {
+		t.Errorf("entry %q does not end with a newline", buf.String())
+	}
+}
+
+func TestLogCombined(t *testing.T) {
+	tests := []struct {
+		name string
+		e    Entry
+		want string
+	}{
+		{
+			name: "http",
+			e: Entry{
+				Time: testTime, Protocol: "http", Remote: "100.64.0.7:51234",
+				User: "alice@example.com", Method: "GET", URI: "/a?b=1", Proto: "HTTP/1.1",
+				Status: 404, BytesOut: 9, UserAgent: "curl/8",
+			},
+			want: `100.64.0.7 - alice@example.com [18/Oct/2026:12:00:00 +0000] "GET /a?b=1 HTTP/1.1" 404 9 "-" "curl/8"` + "\n",
+		},
+		{
+			name: "tcp funnel ipv6",
+			e: Entry{
+				Time: testTime, Protocol: "tcp", Remote: "[2001:db8::1]:4000",
+				Upstream: "127.0.0.1:22", BytesOut: 100,
+			},
+			want: `2001:db8::1 - - [18/Oct/2026:12:00:00 +0000] "TCP 127.0.0.1:22" - 100 "-" "-"` + "\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			l, err := NewWriter(&buf, FormatCombined)
+			if err != nil {
+				t.Fatalf("NewWriter: %v", err)
+			}
+			l.Log(tt.e)
+			if buf.String() != tt.want {
+				t.Errorf("got  %q\nwant %q", buf.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestNilHandlerLogsNothing(t *testing.T) {
+	var l *Logger
+	h := l.ForHandler("web", ":80")
+	if h != nil {
+		t.Fatalf("ForHandler on nil logger = %v, want nil", h)
+	}
+	h.Log(Entry{})
+}
+
+func TestValidateFormat(t *testing.T) {
+	if err := ValidateFormat("xml"); !errors.Is(err, ErrUnknownFormat) {
+		t.Errorf("ValidateFormat(xml) = %v, want ErrUnknownFormat", err)
+	}
+	if _, err := New(Options{Format: "xml"}); !errors.Is(err, ErrUnknownFormat) {
+		t.Errorf("New(xml) = %v, want ErrUnknownFormat", err)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "access.log")
+	f, err := OpenRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatalf("OpenRotatingFile: %v", err)
+	}
+	defer f.Close()
+	for _, line := range []string{"aaaaaa\n", "bbbbbb\n", "cccccc\n", "dddddd\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	for name, want := range map[string]string{
+		path:        "dddddd\n",
+		path + ".1": "cccccc\n",
+		path + ".2": "bbbbbb\n",
+	} {
+		b, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatalf("ReadFile: %v", err)
+		}
+		if string(b) != want {
+			t.Errorf("%s = %q, want %q", filepath.Base(name), b, want)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("backup beyond max_backups kept: %v", err)
+	}
+}
+
+// A rotation that cannot shift the backups must not leave the log closed.
+func TestRotatingFileRotateFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	// A non-empty directory in the backup slot makes the rotation fail.
+	if err := os.MkdirAll(filepath.Join(path+".1", "busy"), 0750); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	f, err := OpenRotatingFile(path, 10, 1)
+	if err != nil {
+		t.Fatalf("OpenRotatingFile: %v", err)
+	}
+	defer f.Close()
+	for _, line := range []string{"aaaaaa\n", "bbbbbb\n", "cccccc\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatalf("Write after failed rotation: %v", err)
+		}
+	}
+	if b, _ := os.ReadFile(path); string(b) != "aaaaaa\nbbbbbb\ncccccc\n" {
+		t.Errorf("current = %q, want every line kept", b)
+	}
+
+	// Once the slot is free, rotation resumes.
+	if err := os.RemoveAll(path + ".1"); err != nil {
+		t.Fatalf("RemoveAll: %v", err)
+	}
+	if _, err := f.Write([]byte("dddddd\n")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if b, _ := os.ReadFile(path); string(b) != "dddddd\n" {
+		t.Errorf("current after recovery = %q, want %q", b, "dddddd\n")
+	}
+	if b, _ := os.ReadFile(path + ".1"); string(b) != "aaaaaa\nbbbbbb\ncccccc\n" {
+		t.Errorf("backup after recovery = %q, want the earlier lines", b)
+	}
+}
+
+func TestRotatingFileAppendsToExisting(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	if err := os.WriteFile(path, []byte("old\n"), 0640); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	f, err := OpenRotatingFile(path, 6, 1)
+	if err != nil {
+		t.Fatalf("OpenRotatingFile: %v", err)
+	}
+	defer f.Close()
+	if _, err := f.Write([]byte("new\n")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if b, _ := os.ReadFile(path + ".1"); string(b) != "old\n" {
+		t.Errorf("backup = %q, want the pre-existing content", b)
+	}
+	if b, _ := os.ReadFile(path); string(b) != "new\n" {
+		t.Errorf("current = %q, want %q", b, "new\n")
+	}
+}
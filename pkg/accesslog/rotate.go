@@ -0,0 +1,111 @@
+package accesslog
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/lucasew/ts-proxy/pkg/tsproxy"
+)
+
+// RotatingFile is an append-only file that is renamed to path.1 once it
+// would grow past maxSize; older backups shift to path.2 and so on, and the
+// oldest beyond maxBackups is removed.
+type RotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mu sync.Mutex
+	// f is nil between a rotation closing it and the next open.
+	f    *os.File
+	size int64
+}
+
+// OpenRotatingFile opens (or creates, mode 0640) the file at path.
+func OpenRotatingFile(path string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return nil, fmt.Errorf("create access log dir: %w", err)
+	}
+	rf := &RotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *RotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return fmt.Errorf("open access log: %w", err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return fmt.Errorf("stat access log: %w", err)
+	}
+	rf.f, rf.size = f, fi.Size()
+	return nil
+}
+
+// Write appends p, rotating first if p would push the file past maxSize.
+// A single write is never split across files. A failed rotation is
+// reported and p goes to the reopened current file, so the log keeps
+// working until the cause is fixed.
+func (rf *RotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.f != nil && rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize {
+		if err := rf.rotate(); err != nil {
+			tsproxy.ReportError(err, "context", "access log rotate", "path", rf.path)
+		}
+	}
+	if rf.f == nil {
+		if err := rf.open(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// rotate closes the current file and shifts it into the backups. The
+// caller opens path again afterwards, whether or not the shift worked.
+func (rf *RotatingFile) rotate() error {
+	err := rf.f.Close()
+	rf.f = nil
+	if err != nil {
+		return fmt.Errorf("close access log: %w", err)
+	}
+	backup := func(i int) string { return fmt.Sprintf("%s.%d", rf.path, i) }
+	if err := os.Remove(backup(rf.maxBackups)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove old access log: %w", err)
+	}
+	for i := rf.maxBackups - 1; i >= 1; i-- {
+		if err := os.Rename(backup(i), backup(i+1)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("rotate access log: %w", err)
+		}
+	}
+	if rf.maxBackups > 0 {
+		if err := os.Rename(rf.path, backup(1)); err != nil {
+			return fmt.Errorf("rotate access log: %w", err)
+		}
+	} else if err := os.Truncate(rf.path, 0); err != nil {
+		return fmt.Errorf("truncate access log: %w", err)
+	}
+	return nil
+}
+
+// Close closes the current file.
+func (rf *RotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.f == nil {
+		return nil
+	}
+	err := rf.f.Close()
+	rf.f = nil
+	return err
+}
@@ -0,0 +1,151 @@
+// Package admin serves the supervisor's control API: JSON status for every
+// server and per-server start, stop and restart actions. It listens on a
+// unix socket only reachable by the daemon's user.
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/lucasew/ts-proxy/pkg/server"
+	"github.com/lucasew/ts-proxy/pkg/tsproxy"
+)
+
+// ErrSocketInUse is returned when another process is serving the socket.
+var ErrSocketInUse = errors.New("admin socket in use")
+
+// Supervisor is the part of server.Supervisor the API drives.
+type Supervisor interface {
+	Status() []server.Status
+	ServerStatus(name string) (server.Status, error)
+	StartServer(name string) error
+	StopServer(name string) error
+	RestartServer(name string) error
+}
+
+// errorResponse is the body of every non-2xx answer.
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// NewHandler returns the API:
+//
+//	GET  /v1/servers                  status of every server
+//	GET  /v1/servers/{name}           status of one server
+//	POST /v1/servers/{name}/start     start a stopped server
+//	POST /v1/servers/{name}/stop      stop a server
+//	POST /v1/servers/{name}/restart   stop and start a server
+//
+// Actions answer with the server's status after the action.
+func NewHandler(sup Supervisor) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/servers", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, sup.Status())
+	})
+	mux.HandleFunc("GET /v1/servers/{name}", func(w http.ResponseWriter, r *http.Request) {
+		st, err := sup.ServerStatus(r.PathValue("name"))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, st)
+	})
+	actions := map[string]func(string) error{
+		"start":   sup.StartServer,
+		"stop":    sup.StopServer,
+		"restart": sup.RestartServer,
+	}
+	for action, fn := range actions {
+		mux.HandleFunc("POST /v1/servers/{name}/"+action, func(w http.ResponseWriter, r *http.Request) {
+			name := r.PathValue("name")
+			if err := fn(name); err != nil {
+				writeError(w, err)
+				return
+			}
+			st, err := sup.ServerStatus(name)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, st)
+		})
+	}
+	return mux
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, server.ErrUnknownServer):
+		status = http.StatusNotFound
+	case errors.Is(err, server.ErrServerRunning):
+		status = http.StatusConflict
+	case errors.Is(err, server.ErrNotSupervising):
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		tsproxy.ReportError(err, "context", "admin response")
+	}
+}
+
+// Serve listens on the unix socket at path and serves the API for sup
+// until ctx is cancelled. A stale socket left by a crashed daemon is
+// replaced; one that still accepts connections is an error.
+func Serve(ctx context.Context, path string, sup Supervisor) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("create admin socket dir: %w", err)
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		_ = conn.Close()
+		return fmt.Errorf("%w: %s", ErrSocketInUse, path)
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("remove stale admin socket: %w", err)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("listen admin socket: %w", err)
+	}
+	// Listen honours the umask; the API can stop servers, so tighten it.
+	if err := os.Chmod(path, 0600); err != nil {
+		_ = ln.Close()
+		return fmt.Errorf("chmod admin socket: %w", err)
+	}
+	slog.Info("admin api listening", "socket", path)
+
+	srv := &http.Server{
+		Handler:           NewHandler(sup),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+		defer cancel()
+		// Closing the listener also unlinks the socket file.
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			tsproxy.ReportError(err, "context", "admin server shutdown")
+		}
+	}()
+
+	err = srv.Serve(ln)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,210 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lucasew/ts-proxy/pkg/server"
+)
+
+// fakeSupervisor records actions and reports every known server as
+// running or stopped.
+type fakeSupervisor struct {
+	states  map[string]server.State
+	actions []string
+}
+
+func newFake() *fakeSupervisor {
+	return &fakeSupervisor{states: map[string]server.State{
+		"api": server.StateRunning,
+		"web": server.StateStopped,
+	}}
+}
+
+func (f *fakeSupervisor) Status() []server.Status {
+	return []server.Status{f.status("api"), f.status("web")}
+}
+
+func (f *fakeSupervisor) status(name string) server.Status {
+	return server.Status{
+		Name:  name,
+		FQDN:  name + ".example.ts.net",
+		State: f.states[name],
+		Handlers: []server.HandlerStatus{
+			{Type: "http", Listen: ":80", Upstream: "127.0.0.1:8080", Active: true, Connections: 2},
+		},
+	}
+}
+
+func (f *fakeSupervisor) ServerStatus(name string) (server.Status, error) {
+	if _, ok := f.states[name]; !ok {
+		return server.Status{}, fmt.Errorf("%w %q", server.ErrUnknownServer, name)
+	}
+	return f.status(name), nil
+}
+
+func (f *fakeSupervisor) action(name, action string, to server.State) error {
+	if _, ok := f.states[name]; !ok {
+		return fmt.Errorf("%w %q", server.ErrUnknownServer, name)
+	}
+	if action == "start" && f.states[name] == server.StateRunning {
+		return server.ErrServerRunning
+	}
+	f.actions = append(f.actions, action+" "+name)
+	f.states[name] = to
+	return nil
+}
+
+func (f *fakeSupervisor) StartServer(name string) error {
+	return f.action(name, "start", server.StateRunning)
+}
+
+func (f *fakeSupervisor) StopServer(name string) error {
+	return f.action(name, "stop", server.StateStopped)
+}
+
+func (f *fakeSupervisor) RestartServer(name string) error {
+	return f.action(name, "restart", server.StateRunning)
+}
+
+func do(t *testing.T, h http.Handler, method, path string) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+	return rec
+}
+
+func TestListServers(t *testing.T) {
+	h := NewHandler(newFake())
+	rec := do(t, h, http.MethodGet, "/v1/servers")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	var got []server.Status
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(got) != 2 || got[0].Name != "api" || got[0].State != server.StateRunning {
+		t.Fatalf("servers = %+v", got)
+	}
+	if hs := got[0].Handlers; len(hs) != 1 || hs[0].Connections != 2 || !hs[0].Active {
+		t.Errorf("handlers = %+v", hs)
+	}
+}
+
+func TestServerActions(t *testing.T) {
+	sup := newFake()
+	h := NewHandler(sup)
+
+	rec := do(t, h, http.MethodPost, "/v1/servers/web/start")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("start status = %d, want 200: %s", rec.Code, rec.Body)
+	}
+	var st server.Status
+	if err := json.Unmarshal(rec.Body.Bytes(), &st); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if st.Name != "web" || st.State != server.StateRunning {
+		t.Errorf("status after start = %+v", st)
+	}
+
+	if rec := do(t, h, http.MethodPost, "/v1/servers/api/start"); rec.Code != http.StatusConflict {
+		t.Errorf("start running server = %d, want 409", rec.Code)
+	}
+	if rec := do(t, h, http.MethodPost, "/v1/servers/api/restart"); rec.Code != http.StatusOK {
+		t.Errorf("restart = %d, want 200", rec.Code)
+	}
+	if rec := do(t, h, http.MethodPost, "/v1/servers/api/stop"); rec.Code != http.StatusOK {
+		t.Errorf("stop = %d, want 200", rec.Code)
+	}
+	want := []string{"start web", "restart api", "stop api"}
+	if fmt.Sprint(sup.actions) != fmt.Sprint(want) {
+		t.Errorf("actions = %v, want %v", sup.actions, want)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	h := NewHandler(newFake())
+	tests := []struct {
+		method, path string
+		want         int
+	}{
+		{http.MethodGet, "/v1/servers/nope", http.StatusNotFound},
+		{http.MethodPost, "/v1/servers/nope/restart", http.StatusNotFound},
+		{http.MethodGet, "/v1/servers/api/restart", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/v1/servers/api/explode", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		rec := do(t, h, tt.method, tt.path)
+		if rec.Code != tt.want {
+			t.Errorf("%s %s = %d, want %d", tt.method, tt.path, rec.Code, tt.want)
+		}
+	}
+
+	rec := do(t, h, http.MethodGet, "/v1/servers/nope")
+	var body errorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body.Error == "" {
+		t.Errorf("error body = %q (%v)", rec.Body, err)
+	}
+}
+
+func TestServeUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "admin.sock")
+	// A stale socket file from a crashed daemon must not block startup.
+	if err := os.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- Serve(ctx, path, newFake()) }()
+
+	client := NewClient(path)
+	var servers []server.Status
+	var err error
+	for range 50 {
+		if servers, err = client.Servers(ctx); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("Servers over socket: %v", err)
+	}
+	if len(servers) != 2 || servers[0].FQDN != "api.example.ts.net" {
+		t.Errorf("servers = %+v", servers)
+	}
+	st, err := client.Restart(ctx, "web")
+	if err != nil || st.Name != "web" || st.State != server.StateRunning {
+		t.Errorf("Restart(web) = %+v, %v", st, err)
+	}
+	if _, err := client.Restart(ctx, "nope"); !errors.Is(err, ErrRequestFailed) || !strings.Contains(err.Error(), "unknown server") {
+		t.Errorf("Restart(nope) = %v, want ErrRequestFailed with the API message", err)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("socket mode = %v (%v), want 0600", fi.Mode().Perm(), err)
+	}
+
+	if err := Serve(context.Background(), path, newFake()); !errors.Is(err, ErrSocketInUse) {
+		t.Errorf("second Serve = %v, want ErrSocketInUse", err)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Serve = %v, want nil after cancel", err)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("socket not removed on shutdown: %v", err)
+	}
+}
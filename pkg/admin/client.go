@@ -0,0 +1,78 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/lucasew/ts-proxy/pkg/server"
+	"github.com/lucasew/ts-proxy/pkg/tsproxy"
+)
+
+// ErrRequestFailed is returned when the API answers with an error status.
+var ErrRequestFailed = errors.New("admin request failed")
+
+// maxResponseBody caps how much of an API response the client reads.
+const maxResponseBody = 4 << 20
+
+// Client talks to a running daemon's admin API.
+type Client struct {
+	http *http.Client
+}
+
+// NewClient returns a client for the unix socket at socketPath.
+func NewClient(socketPath string) *Client {
+	return &Client{http: &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socketPath)
+		},
+	}}}
+}
+
+// Servers returns the status of every server.
+func (c *Client) Servers(ctx context.Context) ([]server.Status, error) {
+	var out []server.Status
+	err := c.do(ctx, http.MethodGet, "/v1/servers", &out)
+	return out, err
+}
+
+// Restart restarts the named server and returns its status.
+func (c *Client) Restart(ctx context.Context, name string) (server.Status, error) {
+	var out server.Status
+	err := c.do(ctx, http.MethodPost, "/v1/servers/"+url.PathEscape(name)+"/restart", &out)
+	return out, err
+}
+
+func (c *Client) do(ctx context.Context, method, path string, out any) error {
+	// The host is ignored; every request goes to the socket.
+	req, err := http.NewRequestWithContext(ctx, method, "http://admin"+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			tsproxy.ReportError(err, "context", "admin response body close")
+		}
+	}()
+	body := io.LimitReader(resp.Body, maxResponseBody)
+	if resp.StatusCode != http.StatusOK {
+		var e errorResponse
+		if err := json.NewDecoder(body).Decode(&e); err != nil || e.Error == "" {
+			return fmt.Errorf("%w: %s", ErrRequestFailed, resp.Status)
+		}
+		return fmt.Errorf("%w: %s", ErrRequestFailed, e.Error)
+	}
+	if err := json.NewDecoder(body).Decode(out); err != nil {
+		return fmt.Errorf("decode admin response: %w", err)
+	}
+	return nil
+}
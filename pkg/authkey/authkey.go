@@ -0,0 +1,204 @@
+// Package authkey mints Tailscale auth keys through the control API with an
+// OAuth client, so nodes can be provisioned without long-lived keys.
+package authkey
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lucasew/ts-proxy/pkg/tsproxy"
+)
+
+// Defaults for Options.
+const (
+	DefaultBaseURL = "https://api.tailscale.com"
+	// DefaultTailnet is the tailnet of the OAuth client.
+	DefaultTailnet = "-"
+	DefaultExpiry  = 5 * time.Minute
+)
+
+// tokenMargin refreshes access tokens this long before they expire.
+const tokenMargin = time.Minute
+
+// ErrAPI is returned when the control API answers with an error status.
+var ErrAPI = errors.New("tailscale api error")
+
+// Options configures a Minter.
+type Options struct {
+	ClientID     string
+	ClientSecret string
+	// Tags are applied to nodes that log in with a minted key; OAuth
+	// clients can only create tagged keys.
+	Tags []string
+	// Tailnet is DefaultTailnet when empty.
+	Tailnet string
+	// BaseURL is the control API; DefaultBaseURL when empty.
+	BaseURL string
+	// Expiry is how long a minted key stays valid; DefaultExpiry when zero.
+	Expiry time.Duration
+	// Client makes the API calls; http.DefaultClient when nil.
+	Client *http.Client
+}
+
+// Minter creates single-use, pre-approved auth keys. Access tokens are
+// cached until shortly before they expire, so repeated mints, e.g. for
+// restarts, fetch one token.
+type Minter struct {
+	opts Options
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// New creates a minter for opts, filling in defaults.
+func New(opts Options) *Minter {
+	if opts.Tailnet == "" {
+		opts.Tailnet = DefaultTailnet
+	}
+	if opts.BaseURL == "" {
+		opts.BaseURL = DefaultBaseURL
+	}
+	opts.BaseURL = strings.TrimSuffix(opts.BaseURL, "/")
+	if opts.Expiry <= 0 {
+		opts.Expiry = DefaultExpiry
+	}
+	if opts.Client == nil {
+		opts.Client = http.DefaultClient
+	}
+	return &Minter{opts: opts}
+}
+
+// keyRequest is the body of POST /api/v2/tailnet/{tailnet}/keys.
+type keyRequest struct {
+	Capabilities  keyCapabilities `json:"capabilities"`
+	ExpirySeconds int64           `json:"expirySeconds"`
+	Description   string          `json:"description,omitempty"`
+}
+
+type keyCapabilities struct {
+	Devices struct {
+		Create struct {
+			Reusable      bool     `json:"reusable"`
+			Ephemeral     bool     `json:"ephemeral"`
+			Preauthorized bool     `json:"preauthorized"`
+			Tags          []string `json:"tags"`
+		} `json:"create"`
+	} `json:"devices"`
+}
+
+// Key describes the node a key is minted for.
+type Key struct {
+	// Ephemeral nodes are removed soon after they go offline.
+	Ephemeral bool
+	// Tags override Options.Tags when set.
+	Tags []string
+}
+
+// Mint creates a new auth key for one node login.
+func (m *Minter) Mint(ctx context.Context, k Key) (string, error) {
+	token, err := m.accessToken(ctx)
+	if err != nil {
+		return "", err
+	}
+	var body keyRequest
+	create := &body.Capabilities.Devices.Create
+	create.Preauthorized = true
+	create.Ephemeral = k.Ephemeral
+	create.Tags = m.opts.Tags
+	if len(k.Tags) > 0 {
+		create.Tags = k.Tags
+	}
+	body.ExpirySeconds = int64(m.opts.Expiry / time.Second)
+	body.Description = "ts-proxy"
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return "", fmt.Errorf("encode key request: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		m.opts.BaseURL+"/api/v2/tailnet/"+url.PathEscape(m.opts.Tailnet)+"/keys", bytes.NewReader(payload))
+	if err != nil {
+		return "", fmt.Errorf("key request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	var resp struct {
+		Key string `json:"key"`
+	}
+	if err := m.do(req, &resp); err != nil {
+		return "", fmt.Errorf("create auth key: %w", err)
+	}
+	if resp.Key == "" {
+		return "", fmt.Errorf("create auth key: %w: response has no key", ErrAPI)
+	}
+	return resp.Key, nil
+}
+
+// accessToken returns a cached access token or fetches a new one with the
+// client credentials grant.
+func (m *Minter) accessToken(ctx context.Context) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.token != "" && time.Now().Before(m.expires) {
+		return m.token, nil
+	}
+	form := url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {m.opts.ClientID},
+		"client_secret": {m.opts.ClientSecret},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		m.opts.BaseURL+"/api/v2/oauth/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", fmt.Errorf("token request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	var resp struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := m.do(req, &resp); err != nil {
+		return "", fmt.Errorf("oauth token: %w", err)
+	}
+	if resp.AccessToken == "" {
+		return "", fmt.Errorf("oauth token: %w: response has no access_token", ErrAPI)
+	}
+	m.token = resp.AccessToken
+	m.expires = time.Now().Add(time.Duration(resp.ExpiresIn)*time.Second - tokenMargin)
+	return m.token, nil
+}
+
+// do sends req and decodes a JSON answer into out.
+func (m *Minter) do(req *http.Request, out any) error {
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", "ts-proxy")
+	resp, err := m.opts.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			tsproxy.ReportError(err, "context", "oauth response body close")
+		}
+	}()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("read response: %w", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%w: %s: %s", ErrAPI, resp.Status, strings.TrimSpace(string(body)))
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("decode response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package authkey
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// controlAPI stands in for the Tailscale API: it hands out access tokens for
+// one OAuth client and creates keys for requests bearing them.
+type controlAPI struct {
+	tokens, keys atomic.Int32
+	lastKey      keyRequest
+	lastTailnet  string
+}
+
+func (c *controlAPI) handler(t *testing.T) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/v2/oauth/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("client_id") != "client" || r.FormValue("client_secret") != "secret" ||
+			r.FormValue("grant_type") != "client_credentials" {
+			http.Error(w, `{"message":"invalid client"}`, http.StatusUnauthorized)
+			return
+		}
+		n := c.tokens.Add(1)
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"access_token": fmt.Sprintf("tskey-api-%d", n),
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+		})
+	})
+	mux.HandleFunc("POST /api/v2/tailnet/{tailnet}/keys", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer tskey-api-1" {
+			http.Error(w, `{"message":"unauthorized"}`, http.StatusUnauthorized)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&c.lastKey); err != nil {
+			t.Errorf("decode key request: %v", err)
+		}
+		c.lastTailnet = r.PathValue("tailnet")
+		n := c.keys.Add(1)
+		_ = json.NewEncoder(w).Encode(map[string]any{"id": "k", "key": fmt.Sprintf("tskey-auth-%d", n)})
+	})
+	return mux
+}
+
+func TestMint(t *testing.T) {
+	api := &controlAPI{}
+	srv := httptest.NewServer(api.handler(t))
+	defer srv.Close()
+	m := New(Options{
+		ClientID:     "client",
+		ClientSecret: "secret",
+		Tags:         []string{"tag:proxy"},
+		BaseURL:      srv.URL + "/",
+		Expiry:       10 * time.Minute,
+	})
+
+	for i := 1; i <= 2; i++ {
+		key, err := m.Mint(t.Context(), Key{})
+		if err != nil {
+			t.Fatalf("Mint: %v", err)
+		}
+		if want := fmt.Sprintf("tskey-auth-%d", i); key != want {
+			t.Errorf("Mint = %q, want %q", key, want)
+		}
+	}
+	if n := api.tokens.Load(); n != 1 {
+		t.Errorf("fetched %d access tokens, want 1 reused", n)
+	}
+	create := api.lastKey.Capabilities.Devices.Create
+	if create.Reusable || create.Ephemeral || !create.Preauthorized || !slices.Equal(create.Tags, []string{"tag:proxy"}) {
+		t.Errorf("key capabilities = %+v, want single-use, pre-approved, tag:proxy", create)
+	}
+	if api.lastKey.ExpirySeconds != 600 {
+		t.Errorf("expirySeconds = %d, want 600", api.lastKey.ExpirySeconds)
+	}
+	if api.lastTailnet != DefaultTailnet {
+		t.Errorf("tailnet = %q, want %q", api.lastTailnet, DefaultTailnet)
+	}
+
+	if _, err := m.Mint(t.Context(), Key{Ephemeral: true, Tags: []string{"tag:preview"}}); err != nil {
+		t.Fatalf("Mint ephemeral: %v", err)
+	}
+	create = api.lastKey.Capabilities.Devices.Create
+	if !create.Ephemeral || !slices.Equal(create.Tags, []string{"tag:preview"}) {
+		t.Errorf("key capabilities = %+v, want ephemeral tag:preview", create)
+	}
+}
+
+func TestMintErrors(t *testing.T) {
+	api := &controlAPI{}
+	srv := httptest.NewServer(api.handler(t))
+	defer srv.Close()
+
+	_, err := New(Options{ClientID: "client", ClientSecret: "wrong", BaseURL: srv.URL}).Mint(t.Context(), Key{})
+	if !errors.Is(err, ErrAPI) {
+		t.Errorf("Mint with a bad secret = %v, want ErrAPI", err)
+	}
+	if api.keys.Load() != 0 {
+		t.Error("created a key without an access token")
+	}
+
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	if _, err := New(Options{ClientID: "client", ClientSecret: "secret", BaseURL: down.URL}).Mint(t.Context(), Key{}); err == nil {
+		t.Error("Mint against an unreachable API succeeded")
+	}
+}
@@ -3,10 +3,21 @@ package config
 import (
 	"errors"
 	"fmt"
+	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
 	"regexp"
 	"sort"
 	"strings"
+	"time"
+
+	"github.com/lucasew/ts-proxy/pkg/access"
+	"github.com/lucasew/ts-proxy/pkg/accesslog"
+	"github.com/lucasew/ts-proxy/pkg/authkey"
+	"github.com/lucasew/ts-proxy/pkg/identity"
+	"github.com/lucasew/ts-proxy/pkg/jwt"
+	"github.com/lucasew/ts-proxy/pkg/tracing"
 )
 
 var slugPattern = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
@@ -21,31 +32,266 @@ var (
 	ErrUnknownHandlerType = errors.New("unknown type")
 	ErrListenRequired     = errors.New("listen address is required")
 	ErrUpstreamRequired   = errors.New("upstream_address is required")
+	ErrRootRequired       = errors.New("root is required")
+	ErrNegativeCacheAge   = errors.New("cache_max_age cannot be negative")
+	ErrUDPNetwork         = errors.New("udp handlers require a udp upstream_network")
+	ErrUDPNoTLS           = errors.New("tls and funnel are not supported for udp handlers")
+	ErrNegativeTimeout    = errors.New("idle_timeout cannot be negative")
+	ErrRoutesUnsupported  = errors.New("routes are only supported on http handlers")
+	ErrRoutePath          = errors.New("route path must start with /")
+	ErrRouteOverlap       = errors.New("overlapping route")
+	ErrUpstreamConflict   = errors.New("set either upstream_address or upstream_addresses, not both")
+	ErrUnknownStrategy    = errors.New("unknown load_balancing strategy")
+	ErrBalancingType      = errors.New("load balancing and health checks are only supported on tcp and http handlers")
+	ErrHealthCheck        = errors.New("invalid health_check")
+	ErrAccessUnsupported  = errors.New("allow, deny and require_capability are only supported on tcp, http and metrics handlers")
+	ErrHeadersUnsupported = errors.New("identity_headers are only supported on http handlers")
+	ErrJWTUnsupported     = errors.New("identity_jwt is only supported on http handlers")
+	ErrNegativeTTL        = errors.New("ttl cannot be negative")
+	ErrAuthTimeout        = errors.New("auth_timeout cannot be negative")
+	ErrAuthUnsupported    = errors.New("forward_auth is only supported on http handlers")
+	ErrForwardAuth        = errors.New("invalid forward_auth")
+	ErrFunnelPaths        = errors.New("invalid funnel_paths")
+	ErrMetricsFunnel      = errors.New("metrics handlers cannot use funnel")
+	ErrAccessLog          = errors.New("invalid access_log")
+	ErrTracing            = errors.New("invalid tracing")
+	ErrRestartPolicy      = errors.New("invalid restart_policy")
+	ErrRestartMode        = errors.New("unknown restart mode")
+	ErrHook               = errors.New("invalid hook")
 	ErrDuplicateListen    = errors.New("duplicate listen address")
 	ErrUndefinedEnvVar    = errors.New("references undefined environment variable(s)")
+	ErrSecret             = errors.New("cannot resolve secret")
+	ErrSecretRef          = errors.New("${file:...} and ${cmd:...} are only allowed in secret fields")
+	ErrAuthKeyConflict    = errors.New("set only one of auth_key, auth_key_file and oauth")
+	ErrOAuth              = errors.New("invalid oauth")
+	ErrInvalidTag         = errors.New("tags must look like tag:name")
+	ErrControlURL         = errors.New("control_url must be an http(s) URL")
 )
 
 // Config is the top-level configuration for ts-proxy.
 type Config struct {
-	StateDir   string                  `mapstructure:"state_dir" yaml:"state_dir"`
-	StopOnFail bool                    `mapstructure:"stop_on_fail" yaml:"stop_on_fail"`
-	Tokens     map[string]TokenConfig  `mapstructure:"tokens" yaml:"tokens"`
-	Servers    map[string]ServerConfig `mapstructure:"servers" yaml:"servers"`
+	StateDir   string `mapstructure:"state_dir" yaml:"state_dir"`
+	StopOnFail bool   `mapstructure:"stop_on_fail" yaml:"stop_on_fail"`
+	// RestartPolicy paces restarts of failed servers when StopOnFail is
+	// false.
+	RestartPolicy RestartPolicyConfig `mapstructure:"restart_policy" yaml:"restart_policy"`
+	// AdminSocket is the admin API unix socket; empty means
+	// <state_dir>/admin.sock and AdminSocketOff disables the API.
+	AdminSocket string `mapstructure:"admin_socket" yaml:"admin_socket,omitempty"`
+	// MetricsListen, when set, serves Prometheus metrics on this local
+	// address; a handler of type "metrics" serves them on the tailnet.
+	MetricsListen string `mapstructure:"metrics_listen" yaml:"metrics_listen,omitempty"`
+	// HealthListen, when set, serves /healthz and /readyz on this local
+	// address; it may equal MetricsListen to share one listener.
+	HealthListen string `mapstructure:"health_listen" yaml:"health_listen,omitempty"`
+	// AccessLog, when set, records every HTTP request and TCP session.
+	AccessLog *AccessLogConfig `mapstructure:"access_log" yaml:"access_log,omitempty"`
+	// Tracing, when set, exports OpenTelemetry spans for HTTP requests.
+	Tracing *TracingConfig `mapstructure:"tracing" yaml:"tracing,omitempty"`
+	// Hooks run a command or call a webhook when servers change state.
+	Hooks   []HookConfig            `mapstructure:"hooks" yaml:"hooks,omitempty"`
+	Tokens  map[string]TokenConfig  `mapstructure:"tokens" yaml:"tokens"`
+	Servers map[string]ServerConfig `mapstructure:"servers" yaml:"servers"`
+}
+
+// HookConfig runs Command or POSTs to Webhook when a server enters one of
+// the On states.
+type HookConfig struct {
+	// On lists the states that fire the hook: HookOnFailed and/or
+	// HookOnRunning (default both).
+	On []string `mapstructure:"on" yaml:"on"`
+	// Servers limits the hook to these servers; empty means all.
+	Servers []string `mapstructure:"servers" yaml:"servers,omitempty"`
+	// Command is the program and its arguments, run without a shell.
+	Command []string `mapstructure:"command" yaml:"command,omitempty"`
+	// Webhook is an http(s) URL that receives the event as JSON.
+	Webhook string `mapstructure:"webhook" yaml:"webhook,omitempty"`
+	// Timeout bounds each run (default 10s).
+	Timeout time.Duration `mapstructure:"timeout" yaml:"timeout,omitempty"`
+}
+
+// States a hook can fire on.
+const (
+	HookOnFailed  = "failed"
+	HookOnRunning = "running"
+)
+
+// DefaultHookTimeout bounds a hook run when HookConfig.Timeout is zero.
+const DefaultHookTimeout = 10 * time.Second
+
+// AccessLogConfig configures the access log. Zero values take the
+// accesslog package defaults.
+type AccessLogConfig struct {
+	// Format is json (default) or combined.
+	Format string `mapstructure:"format" yaml:"format,omitempty"`
+	// Output is stdout (default) or a file path.
+	Output string `mapstructure:"output" yaml:"output,omitempty"`
+	// MaxSizeMB and MaxBackups control rotation of file outputs.
+	MaxSizeMB  int `mapstructure:"max_size_mb" yaml:"max_size_mb,omitempty"`
+	MaxBackups int `mapstructure:"max_backups" yaml:"max_backups,omitempty"`
+}
+
+// Options converts the config to accesslog options.
+func (a AccessLogConfig) Options() accesslog.Options {
+	return accesslog.Options{
+		Format:     a.Format,
+		Output:     a.Output,
+		MaxSizeMB:  a.MaxSizeMB,
+		MaxBackups: a.MaxBackups,
+	}
+}
+
+// AdminSocketOff disables the admin API when used as admin_socket.
+const AdminSocketOff = "off"
+
+// AdminSocketPath returns the admin API socket path, or "" when disabled.
+func (c *Config) AdminSocketPath() string {
+	switch c.AdminSocket {
+	case AdminSocketOff:
+		return ""
+	case "":
+		return filepath.Join(c.StateDir, "admin.sock")
+	default:
+		return c.AdminSocket
+	}
+}
+
+// RestartPolicyConfig configures how failed servers are restarted. Zero
+// values are filled in by SetDefaults.
+type RestartPolicyConfig struct {
+	// InitialDelay is the wait before the first restart (default 5s); each
+	// further consecutive failure multiplies it by Multiplier (default 2),
+	// up to MaxDelay (default 5m).
+	InitialDelay time.Duration `mapstructure:"initial_delay" yaml:"initial_delay"`
+	MaxDelay     time.Duration `mapstructure:"max_delay" yaml:"max_delay"`
+	Multiplier   float64       `mapstructure:"multiplier" yaml:"multiplier"`
+	// Jitter spreads each delay by up to this fraction either way (default
+	// 0.2; 0 disables it).
+	Jitter *float64 `mapstructure:"jitter" yaml:"jitter"`
+	// StableAfter resets the delay to InitialDelay once a server has been
+	// running this long (default 1m).
+	StableAfter time.Duration `mapstructure:"stable_after" yaml:"stable_after"`
+	// MaxRestarts, when positive, gives up on a server that fails more
+	// than this many times within Window (default 10m). The server stays
+	// failed until restarted through the admin API or a reload restarts it;
+	// the rest of the process keeps running.
+	MaxRestarts int           `mapstructure:"max_restarts" yaml:"max_restarts,omitempty"`
+	Window      time.Duration `mapstructure:"window" yaml:"window"`
+}
+
+// Restart policy defaults, applied by SetDefaults to zero fields.
+const (
+	DefaultRestartInitialDelay = 5 * time.Second
+	DefaultRestartMaxDelay     = 5 * time.Minute
+	DefaultRestartMultiplier   = 2
+	DefaultRestartJitter       = 0.2
+	DefaultRestartStableAfter  = time.Minute
+	DefaultRestartWindow       = 10 * time.Minute
+)
+
+// TracingConfig configures OTLP trace export.
+type TracingConfig struct {
+	// Endpoint is the collector as host:port or URL.
+	Endpoint string `mapstructure:"endpoint" yaml:"endpoint"`
+	// Protocol is grpc (default) or http.
+	Protocol string `mapstructure:"protocol" yaml:"protocol,omitempty"`
+	Insecure bool   `mapstructure:"insecure" yaml:"insecure,omitempty"`
+	// Headers are sent with every export, e.g. collector credentials.
+	Headers map[string]string `mapstructure:"headers" yaml:"headers,omitempty"`
+	// SampleRatio is the fraction of new traces recorded (default 1); 0
+	// records only traces whose caller sampled them.
+	SampleRatio *float64 `mapstructure:"sample_ratio" yaml:"sample_ratio,omitempty"`
+	ServiceName string   `mapstructure:"service_name" yaml:"service_name,omitempty"`
+}
+
+// Options converts the config to tracing options.
+func (t TracingConfig) Options() tracing.Options {
+	return tracing.Options{
+		Endpoint:    t.Endpoint,
+		Protocol:    t.Protocol,
+		Insecure:    t.Insecure,
+		Headers:     t.Headers,
+		SampleRatio: t.SampleRatio,
+		ServiceName: t.ServiceName,
+	}
 }
 
 // TokenConfig defines a Tailscale authentication token.
 // One token can be referenced by many servers (1:n relationship).
 type TokenConfig struct {
 	AuthKey string `mapstructure:"auth_key" yaml:"auth_key"`
+	// AuthKeyFile is read into AuthKey by ExpandEnv, trimmed, e.g. from
+	// $CREDENTIALS_DIRECTORY or a sops/agenix-decrypted file.
+	AuthKeyFile string `mapstructure:"auth_key_file" yaml:"auth_key_file,omitempty"`
+	// OAuth, instead of a fixed key, mints a fresh single-use key each
+	// time a server using the token needs to log in.
+	OAuth *OAuthConfig `mapstructure:"oauth" yaml:"oauth,omitempty"`
+}
+
+// OAuthConfig is a Tailscale OAuth client allowed to create auth keys.
+type OAuthConfig struct {
+	ClientID     string `mapstructure:"client_id" yaml:"client_id"`
+	ClientSecret string `mapstructure:"client_secret" yaml:"client_secret"`
+	// Tags are applied to the nodes; OAuth keys must be tagged.
+	Tags []string `mapstructure:"tags" yaml:"tags"`
+	// Tailnet defaults to the OAuth client's own ("-").
+	Tailnet string `mapstructure:"tailnet" yaml:"tailnet,omitempty"`
+	// APIURL is the control API (default https://api.tailscale.com).
+	APIURL string `mapstructure:"api_url" yaml:"api_url,omitempty"`
+	// KeyExpiry is how long a minted key stays valid (default 5m).
+	KeyExpiry time.Duration `mapstructure:"key_expiry" yaml:"key_expiry,omitempty"`
+}
+
+// Options converts the config to authkey options.
+func (o OAuthConfig) Options() authkey.Options {
+	return authkey.Options{
+		ClientID:     o.ClientID,
+		ClientSecret: o.ClientSecret,
+		Tags:         o.Tags,
+		Tailnet:      o.Tailnet,
+		BaseURL:      o.APIURL,
+		Expiry:       o.KeyExpiry,
+	}
 }
 
 // ServerConfig defines a single Tailscale node with its handlers.
 type ServerConfig struct {
-	Hostname string          `mapstructure:"hostname" yaml:"hostname"`
-	Token    string          `mapstructure:"token" yaml:"token"`
+	Hostname string `mapstructure:"hostname" yaml:"hostname"`
+	Token    string `mapstructure:"token" yaml:"token"`
+	// Ephemeral nodes are removed from the tailnet soon after they go
+	// offline.
+	Ephemeral bool `mapstructure:"ephemeral" yaml:"ephemeral,omitempty"`
+	// AdvertiseTags are requested for the node; the control server decides
+	// whether it may adopt them.
+	AdvertiseTags []string `mapstructure:"advertise_tags" yaml:"advertise_tags,omitempty"`
+	// ControlURL is the coordination server, e.g. a Headscale instance;
+	// empty means Tailscale's.
+	ControlURL string `mapstructure:"control_url" yaml:"control_url,omitempty"`
+	// AuthTimeout fails the server when it has not logged in after this
+	// long, e.g. because nobody opened the login URL; zero waits forever.
+	AuthTimeout time.Duration `mapstructure:"auth_timeout" yaml:"auth_timeout,omitempty"`
+	// Restart is RestartOnFailure (default), RestartAlways or RestartNever.
+	Restart string `mapstructure:"restart" yaml:"restart"`
+	// Critical servers stop the whole process when they fail, like
+	// StopOnFail does for every server.
+	Critical bool `mapstructure:"critical" yaml:"critical,omitempty"`
+	// Optional servers do not count towards readiness.
+	Optional bool            `mapstructure:"optional" yaml:"optional,omitempty"`
 	Handlers []HandlerConfig `mapstructure:"handlers" yaml:"handlers"`
 }
 
+// Restart modes for ServerConfig.Restart.
+const (
+	// RestartOnFailure restarts a failed server until it crash loops.
+	RestartOnFailure = "on-failure"
+	// RestartAlways is RestartOnFailure without restart_policy.max_restarts:
+	// it never gives up. Servers only exit on failure or shutdown, so there
+	// is no clean exit to restart after.
+	RestartAlways = "always"
+	// RestartNever leaves a failed server failed.
+	RestartNever = "never"
+)
+
 // HandlerConfig defines how a handler listens and where it forwards traffic.
 type HandlerConfig struct {
 	Type            string `mapstructure:"type" yaml:"type"`
@@ -54,6 +300,135 @@ type HandlerConfig struct {
 	UpstreamNetwork string `mapstructure:"upstream_network" yaml:"upstream_network"`
 	Funnel          bool   `mapstructure:"funnel" yaml:"funnel"`
 	TLS             bool   `mapstructure:"tls" yaml:"tls"`
+
+	// Static handler fields (type: static).
+	Root             string `mapstructure:"root" yaml:"root,omitempty"`
+	SPA              bool   `mapstructure:"spa" yaml:"spa,omitempty"`
+	DirectoryListing bool   `mapstructure:"directory_listing" yaml:"directory_listing,omitempty"`
+	CacheMaxAge      int    `mapstructure:"cache_max_age" yaml:"cache_max_age,omitempty"`
+
+	// UDP handler fields (type: udp).
+	IdleTimeout time.Duration `mapstructure:"idle_timeout" yaml:"idle_timeout,omitempty"`
+
+	// Load balancing (type: tcp and http). UpstreamAddresses replaces
+	// UpstreamAddress with several backends. On http handlers only the
+	// fallback upstream is balanced; routes keep a single address.
+	UpstreamAddresses []string           `mapstructure:"upstream_addresses" yaml:"upstream_addresses,omitempty"`
+	LoadBalancing     string             `mapstructure:"load_balancing" yaml:"load_balancing,omitempty"`
+	HealthCheck       *HealthCheckConfig `mapstructure:"health_check" yaml:"health_check,omitempty"`
+
+	// Access rules (type: tcp, http and metrics), see package access for
+	// syntax.
+	// Deny wins; with allow rules set, only matching peers get through.
+	Allow []string `mapstructure:"allow" yaml:"allow,omitempty"`
+	Deny  []string `mapstructure:"deny" yaml:"deny,omitempty"`
+	// RequireCapability admits only peers granted this app capability in
+	// the tailnet policy; http handlers forward its values upstream in
+	// Tailscale-App-Capabilities.
+	RequireCapability string `mapstructure:"require_capability" yaml:"require_capability,omitempty"`
+
+	// IdentityHeaders maps header names to templates over the peer identity
+	// (type: http), see package identity for the fields.
+	IdentityHeaders map[string]string `mapstructure:"identity_headers" yaml:"identity_headers,omitempty"`
+	// IdentityJWT attaches a signed identity assertion to each request
+	// (type: http).
+	IdentityJWT *IdentityJWTConfig `mapstructure:"identity_jwt" yaml:"identity_jwt,omitempty"`
+	// ForwardAuth asks an external endpoint to approve each request
+	// (type: http).
+	ForwardAuth *ForwardAuthConfig `mapstructure:"forward_auth" yaml:"forward_auth,omitempty"`
+	// FunnelPaths are the only path prefixes anonymous Funnel clients may
+	// reach on a funnel http handler; everything else needs a tailnet
+	// identity. Empty keeps the whole handler public.
+	FunnelPaths []string `mapstructure:"funnel_paths" yaml:"funnel_paths,omitempty"`
+
+	// Routes dispatch http requests to different upstreams by path prefix
+	// (and optionally host). UpstreamAddress, when set, is the fallback for
+	// requests no route matches.
+	Routes []RouteConfig `mapstructure:"routes" yaml:"routes,omitempty"`
+}
+
+// HealthCheckConfig enables active upstream probing. Zero values take the
+// handler package defaults.
+type HealthCheckConfig struct {
+	Interval time.Duration `mapstructure:"interval" yaml:"interval,omitempty"`
+	Timeout  time.Duration `mapstructure:"timeout" yaml:"timeout,omitempty"`
+	// Path probes with HTTP GET when set; otherwise a TCP connect is enough.
+	Path               string `mapstructure:"path" yaml:"path,omitempty"`
+	UnhealthyThreshold int    `mapstructure:"unhealthy_threshold" yaml:"unhealthy_threshold,omitempty"`
+	HealthyThreshold   int    `mapstructure:"healthy_threshold" yaml:"healthy_threshold,omitempty"`
+}
+
+// IdentityJWTConfig configures signed identity assertions. The signing key
+// is generated on first use under the server's state directory.
+type IdentityJWTConfig struct {
+	// Algorithm is ed25519 (default) or rs256.
+	Algorithm string `mapstructure:"algorithm" yaml:"algorithm"`
+	// Header carries the token (default Tailscale-Identity-Token).
+	Header string `mapstructure:"header" yaml:"header,omitempty"`
+	// TTL is the token lifetime (default 1m).
+	TTL      time.Duration `mapstructure:"ttl" yaml:"ttl,omitempty"`
+	Audience string        `mapstructure:"audience" yaml:"audience,omitempty"`
+}
+
+// ForwardAuthConfig configures a Traefik ForwardAuth-style subrequest.
+type ForwardAuthConfig struct {
+	// Address is the http(s) URL of the auth endpoint.
+	Address string `mapstructure:"address" yaml:"address"`
+	// ResponseHeaders are copied from a 2xx answer to the proxied request.
+	ResponseHeaders []string      `mapstructure:"response_headers" yaml:"response_headers,omitempty"`
+	Timeout         time.Duration `mapstructure:"timeout" yaml:"timeout,omitempty"`
+}
+
+// Upstreams returns every backend address of the handler: upstream_addresses
+// when set, else upstream_address (if any).
+func (h HandlerConfig) Upstreams() []string {
+	if len(h.UpstreamAddresses) > 0 {
+		return h.UpstreamAddresses
+	}
+	if h.UpstreamAddress != "" {
+		return []string{h.UpstreamAddress}
+	}
+	return nil
+}
+
+// RouteConfig maps a path prefix on an http handler to its own upstream,
+// a single address that is not load balanced or health checked.
+type RouteConfig struct {
+	Path            string `mapstructure:"path" yaml:"path"`
+	Host            string `mapstructure:"host" yaml:"host,omitempty"`
+	StripPrefix     bool   `mapstructure:"strip_prefix" yaml:"strip_prefix,omitempty"`
+	UpstreamAddress string `mapstructure:"upstream_address" yaml:"upstream_address"`
+	UpstreamNetwork string `mapstructure:"upstream_network" yaml:"upstream_network"`
+}
+
+// routeKey identifies the requests a route matches, so two routes with the
+// same key are ambiguous. Trailing slashes do not change what a prefix
+// matches ("/api" and "/api/" both cover /api/...), and hosts are
+// case-insensitive.
+func (r RouteConfig) routeKey() string {
+	p := strings.TrimRight(r.Path, "/")
+	if p == "" {
+		p = "/"
+	}
+	return strings.ToLower(r.Host) + p
+}
+
+// IsHTTP reports whether the handler speaks HTTP (and therefore gets the
+// :80/:443 listen defaults).
+func (h HandlerConfig) IsHTTP() bool {
+	return h.Type == "http" || h.Type == "static" || h.Type == "metrics"
+}
+
+// Target returns what the handler serves: the upstream address for proxies,
+// or the root directory for static handlers.
+func (h HandlerConfig) Target() string {
+	switch h.Type {
+	case "static":
+		return h.Root
+	case "metrics":
+		return "(metrics)"
+	}
+	return strings.Join(h.Upstreams(), ", ")
 }
 
 // ValidateSlug checks that a name contains only letters, numbers, and underscores.
@@ -72,6 +447,34 @@ func (c *Config) SetDefaults() {
 	if c.StateDir == "" {
 		c.StateDir = "/var/lib/ts-proxy"
 	}
+	rp := &c.RestartPolicy
+	if rp.InitialDelay == 0 {
+		rp.InitialDelay = DefaultRestartInitialDelay
+	}
+	if rp.MaxDelay == 0 {
+		rp.MaxDelay = max(DefaultRestartMaxDelay, rp.InitialDelay)
+	}
+	if rp.Multiplier == 0 {
+		rp.Multiplier = DefaultRestartMultiplier
+	}
+	if rp.Jitter == nil {
+		rp.Jitter = new(DefaultRestartJitter)
+	}
+	if rp.StableAfter == 0 {
+		rp.StableAfter = DefaultRestartStableAfter
+	}
+	if rp.Window == 0 {
+		rp.Window = DefaultRestartWindow
+	}
+	for i := range c.Hooks {
+		h := &c.Hooks[i]
+		if len(h.On) == 0 {
+			h.On = []string{HookOnFailed, HookOnRunning}
+		}
+		if h.Timeout == 0 {
+			h.Timeout = DefaultHookTimeout
+		}
+	}
 	if c.Tokens == nil {
 		c.Tokens = make(map[string]TokenConfig)
 	}
@@ -82,6 +485,9 @@ func (c *Config) SetDefaults() {
 		if srv.Hostname == "" {
 			srv.Hostname = name
 		}
+		if srv.Restart == "" {
+			srv.Restart = RestartOnFailure
+		}
 		for i := range srv.Handlers {
 			h := &srv.Handlers[i]
 			// Funnel always terminates TLS at the Tailscale edge. Force TLS so
@@ -91,9 +497,26 @@ func (c *Config) SetDefaults() {
 				h.TLS = true
 			}
 			if h.UpstreamNetwork == "" {
-				h.UpstreamNetwork = "tcp"
+				switch h.Type {
+				case "static", "metrics":
+				case "udp":
+					h.UpstreamNetwork = "udp"
+				default:
+					h.UpstreamNetwork = "tcp"
+				}
+			}
+			if h.IdentityJWT != nil && h.IdentityJWT.Algorithm == "" {
+				h.IdentityJWT.Algorithm = jwt.AlgorithmEd25519
 			}
-			if h.Listen == "" && h.Type == "http" {
+			if len(h.UpstreamAddresses) > 0 && h.LoadBalancing == "" {
+				h.LoadBalancing = "round_robin"
+			}
+			for j := range h.Routes {
+				if h.Routes[j].UpstreamNetwork == "" {
+					h.Routes[j].UpstreamNetwork = h.UpstreamNetwork
+				}
+			}
+			if h.Listen == "" && h.IsHTTP() {
 				if h.TLS {
 					h.Listen = ":443"
 				} else {
@@ -106,31 +529,78 @@ func (c *Config) SetDefaults() {
 }
 
 // ExpandEnv expands environment variable references (using ${VAR} or $VAR syntax)
-// in all string fields of the configuration.
+// in all string fields of the configuration. In the secret fields (token
+// auth_key and oauth client_secret, tracing headers and hook webhooks)
+// ${file:/path} is replaced by the trimmed contents of the file and
+// ${cmd:command} by the trimmed output of command, run with /bin/sh -c, so
+// secrets need not be exported into the environment. Each distinct
+// reference is resolved once per call; elsewhere it is an ErrSecretRef.
+// Token auth_key_file values are read into auth_key.
 //
 // Supported fields:
 //   - state_dir
+//   - admin_socket
+//   - metrics_listen
+//   - health_listen
+//   - access_log.output
+//   - tracing.endpoint
+//   - tracing.headers.<name>
+//   - hooks[].webhook
 //   - tokens.<name>.auth_key
+//   - tokens.<name>.auth_key_file
+//   - tokens.<name>.oauth.client_id
+//   - tokens.<name>.oauth.client_secret
+//   - tokens.<name>.oauth.api_url
 //   - servers.<name>.hostname
 //   - servers.<name>.token
+//   - servers.<name>.control_url
+//   - servers.<name>.advertise_tags[]
 //   - servers.<name>.handlers[].type
 //   - servers.<name>.handlers[].listen
 //   - servers.<name>.handlers[].upstream_address
 //   - servers.<name>.handlers[].upstream_network
+//   - servers.<name>.handlers[].upstream_addresses[]
+//   - servers.<name>.handlers[].health_check.path
+//   - servers.<name>.handlers[].forward_auth.address
+//   - servers.<name>.handlers[].allow[]
+//   - servers.<name>.handlers[].deny[]
+//   - servers.<name>.handlers[].root
+//   - servers.<name>.handlers[].routes[].path
+//   - servers.<name>.handlers[].routes[].host
+//   - servers.<name>.handlers[].routes[].upstream_address
+//   - servers.<name>.handlers[].routes[].upstream_network
 //
-// It collects errors for every field that references an undefined variable and
-// returns them joined with errors.Join (so all problems are reported at once).
+// It collects errors for every field that references an undefined variable or
+// an unreadable secret and returns them joined with errors.Join (so all
+// problems are reported at once).
 func (c *Config) ExpandEnv() error {
+	refs := map[string]resolvedRef{}
 	// Helper that expands a single value and reports missing vars with context.
-	expand := func(context string, original string) (string, error) {
+	expandField := func(context string, original string, secret bool) (string, error) {
 		if original == "" {
 			return "", nil
 		}
 
 		missing := []string{}
 		seen := map[string]bool{}
+		var refErrs []error
 
 		expanded := os.Expand(original, func(key string) string {
+			if isRef(key) {
+				if !secret {
+					refErrs = append(refErrs, fmt.Errorf("%s: %w", context, ErrSecretRef))
+					return ""
+				}
+				r, ok := refs[key]
+				if !ok {
+					r.value, r.err = resolveRef(key)
+					refs[key] = r
+				}
+				if r.err != nil {
+					refErrs = append(refErrs, fmt.Errorf("%s: %w", context, r.err))
+				}
+				return r.value
+			}
 			if seen[key] {
 				val, ok := os.LookupEnv(key)
 				if !ok {
@@ -148,10 +618,16 @@ func (c *Config) ExpandEnv() error {
 		})
 
 		if len(missing) > 0 {
-			return expanded, fmt.Errorf("%s: %w: %s (original: %q)",
-				context, ErrUndefinedEnvVar, strings.Join(missing, ", "), original)
+			refErrs = append(refErrs, fmt.Errorf("%s: %w: %s (original: %q)",
+				context, ErrUndefinedEnvVar, strings.Join(missing, ", "), original))
 		}
-		return expanded, nil
+		return expanded, errors.Join(refErrs...)
+	}
+	expand := func(context, original string) (string, error) {
+		return expandField(context, original, false)
+	}
+	expandSecret := func(context, original string) (string, error) {
+		return expandField(context, original, true)
 	}
 
 	var expandErrs []error
@@ -165,12 +641,55 @@ func (c *Config) ExpandEnv() error {
 	var err error
 	c.StateDir, err = expand("state_dir", c.StateDir)
 	collect(err)
+	c.AdminSocket, err = expand("admin_socket", c.AdminSocket)
+	collect(err)
+	c.MetricsListen, err = expand("metrics_listen", c.MetricsListen)
+	collect(err)
+	c.HealthListen, err = expand("health_listen", c.HealthListen)
+	collect(err)
+	if c.AccessLog != nil {
+		c.AccessLog.Output, err = expand("access_log output", c.AccessLog.Output)
+		collect(err)
+	}
+	for i := range c.Hooks {
+		c.Hooks[i].Webhook, err = expandSecret(fmt.Sprintf("hooks[%d] webhook", i), c.Hooks[i].Webhook)
+		collect(err)
+	}
+	if c.Tracing != nil {
+		c.Tracing.Endpoint, err = expand("tracing endpoint", c.Tracing.Endpoint)
+		collect(err)
+		for name, value := range c.Tracing.Headers {
+			c.Tracing.Headers[name], err = expandSecret(fmt.Sprintf("tracing header %q", name), value)
+			collect(err)
+		}
+	}
 
 	// Tokens
 	for name, token := range c.Tokens {
-		token.AuthKey, err = expand(fmt.Sprintf("token %q auth_key", name), token.AuthKey)
-		c.Tokens[name] = token
+		token.AuthKey, err = expandSecret(fmt.Sprintf("token %q auth_key", name), token.AuthKey)
+		collect(err)
+		token.AuthKeyFile, err = expand(fmt.Sprintf("token %q auth_key_file", name), token.AuthKeyFile)
 		collect(err)
+		if token.OAuth != nil {
+			prefix := fmt.Sprintf("token %q oauth", name)
+			token.OAuth.ClientID, err = expand(prefix+" client_id", token.OAuth.ClientID)
+			collect(err)
+			token.OAuth.ClientSecret, err = expandSecret(prefix+" client_secret", token.OAuth.ClientSecret)
+			collect(err)
+			token.OAuth.APIURL, err = expand(prefix+" api_url", token.OAuth.APIURL)
+			collect(err)
+		}
+		if token.AuthKeyFile != "" {
+			if token.AuthKey != "" {
+				collect(fmt.Errorf("token %q: %w", name, ErrAuthKeyConflict))
+			} else {
+				token.AuthKey, err = readSecretFile(token.AuthKeyFile)
+				if err != nil {
+					collect(fmt.Errorf("token %q auth_key_file: %w", name, err))
+				}
+			}
+		}
+		c.Tokens[name] = token
 	}
 
 	// Servers + handlers
@@ -181,6 +700,14 @@ func (c *Config) ExpandEnv() error {
 		srv.Token, err = expand(fmt.Sprintf("server %q token", sname), srv.Token)
 		collect(err)
 
+		srv.ControlURL, err = expand(fmt.Sprintf("server %q control_url", sname), srv.ControlURL)
+		collect(err)
+
+		for i := range srv.AdvertiseTags {
+			srv.AdvertiseTags[i], err = expand(fmt.Sprintf("server %q advertise_tags[%d]", sname, i), srv.AdvertiseTags[i])
+			collect(err)
+		}
+
 		for i := range srv.Handlers {
 			h := &srv.Handlers[i]
 			prefix := fmt.Sprintf("server %q handler[%d]", sname, i)
@@ -196,6 +723,49 @@ func (c *Config) ExpandEnv() error {
 
 			h.UpstreamNetwork, err = expand(prefix+" upstream_network", h.UpstreamNetwork)
 			collect(err)
+
+			h.Root, err = expand(prefix+" root", h.Root)
+			collect(err)
+
+			for j := range h.UpstreamAddresses {
+				h.UpstreamAddresses[j], err = expand(fmt.Sprintf("%s upstream_addresses[%d]", prefix, j), h.UpstreamAddresses[j])
+				collect(err)
+			}
+
+			if h.ForwardAuth != nil {
+				h.ForwardAuth.Address, err = expand(prefix+" forward_auth address", h.ForwardAuth.Address)
+				collect(err)
+			}
+			if h.HealthCheck != nil {
+				h.HealthCheck.Path, err = expand(prefix+" health_check path", h.HealthCheck.Path)
+				collect(err)
+			}
+
+			for j := range h.Allow {
+				h.Allow[j], err = expand(fmt.Sprintf("%s allow[%d]", prefix, j), h.Allow[j])
+				collect(err)
+			}
+			for j := range h.Deny {
+				h.Deny[j], err = expand(fmt.Sprintf("%s deny[%d]", prefix, j), h.Deny[j])
+				collect(err)
+			}
+
+			for j := range h.Routes {
+				r := &h.Routes[j]
+				rprefix := fmt.Sprintf("%s route[%d]", prefix, j)
+
+				r.Path, err = expand(rprefix+" path", r.Path)
+				collect(err)
+
+				r.Host, err = expand(rprefix+" host", r.Host)
+				collect(err)
+
+				r.UpstreamAddress, err = expand(rprefix+" upstream_address", r.UpstreamAddress)
+				collect(err)
+
+				r.UpstreamNetwork, err = expand(rprefix+" upstream_network", r.UpstreamNetwork)
+				collect(err)
+			}
 		}
 
 		c.Servers[sname] = srv
@@ -204,12 +774,90 @@ func (c *Config) ExpandEnv() error {
 	return errors.Join(expandErrs...)
 }
 
+// Redacted replaces secret values in the config Redact prints.
+const Redacted = "<redacted>"
+
+// Redact replaces the secret fields ExpandEnv may have resolved with
+// Redacted, so the config can be printed. Empty fields stay empty.
+func (c *Config) Redact() {
+	redact := func(s *string) {
+		if *s != "" {
+			*s = Redacted
+		}
+	}
+	for i := range c.Hooks {
+		redact(&c.Hooks[i].Webhook)
+	}
+	if c.Tracing != nil {
+		for name, value := range c.Tracing.Headers {
+			redact(&value)
+			c.Tracing.Headers[name] = value
+		}
+	}
+	for name, token := range c.Tokens {
+		redact(&token.AuthKey)
+		if token.OAuth != nil {
+			oauth := *token.OAuth
+			redact(&oauth.ClientSecret)
+			token.OAuth = &oauth
+		}
+		c.Tokens[name] = token
+	}
+}
+
+// RestartOnly returns the top-level fields that differ between c and next
+// and that a reload cannot apply: they are only read at startup.
+func (c *Config) RestartOnly(next *Config) []string {
+	var changed []string
+	for _, f := range []struct {
+		name      string
+		old, next any
+	}{
+		{"admin_socket", c.AdminSocket, next.AdminSocket},
+		{"metrics_listen", c.MetricsListen, next.MetricsListen},
+		{"health_listen", c.HealthListen, next.HealthListen},
+		{"access_log", c.AccessLog, next.AccessLog},
+		{"tracing", c.Tracing, next.Tracing},
+	} {
+		if !reflect.DeepEqual(f.old, f.next) {
+			changed = append(changed, f.name)
+		}
+	}
+	return changed
+}
+
 // Validate checks that the config is well-formed.
 func (c *Config) Validate() error {
-	for name := range c.Tokens {
+	if c.AccessLog != nil {
+		if err := validateAccessLog(c.AccessLog); err != nil {
+			return err
+		}
+	}
+	if c.Tracing != nil {
+		if err := validateTracing(c.Tracing); err != nil {
+			return err
+		}
+	}
+	if err := validateRestartPolicy(c.RestartPolicy); err != nil {
+		return err
+	}
+	for i, h := range c.Hooks {
+		if err := c.validateHook(h); err != nil {
+			return fmt.Errorf("hooks[%d]: %w", i, err)
+		}
+	}
+	for name, tok := range c.Tokens {
 		if err := ValidateSlug(name); err != nil {
 			return fmt.Errorf("token %q: %w", name, err)
 		}
+		if tok.OAuth != nil {
+			if tok.AuthKey != "" || tok.AuthKeyFile != "" {
+				return fmt.Errorf("token %q: %w", name, ErrAuthKeyConflict)
+			}
+			if err := validateOAuth(tok.OAuth); err != nil {
+				return fmt.Errorf("token %q: %w", name, err)
+			}
+		}
 	}
 	for name, srv := range c.Servers {
 		if err := ValidateSlug(name); err != nil {
@@ -220,23 +868,121 @@ func (c *Config) Validate() error {
 				return fmt.Errorf("server %q: %w %q", name, ErrUndefinedToken, srv.Token)
 			}
 		}
+		for _, tag := range srv.AdvertiseTags {
+			if !isTag(tag) {
+				return fmt.Errorf("server %q: advertise_tags: %w: %q", name, ErrInvalidTag, tag)
+			}
+		}
+		if srv.ControlURL != "" && !isHTTPURL(srv.ControlURL) {
+			return fmt.Errorf("server %q: %w: %q", name, ErrControlURL, srv.ControlURL)
+		}
+		if srv.AuthTimeout < 0 {
+			return fmt.Errorf("server %q: %w", name, ErrAuthTimeout)
+		}
+		switch srv.Restart {
+		case "", RestartOnFailure, RestartAlways, RestartNever:
+		default:
+			return fmt.Errorf("server %q: %w %q: want %s, %s or %s", name, ErrRestartMode, srv.Restart, RestartOnFailure, RestartAlways, RestartNever)
+		}
 		if len(srv.Handlers) == 0 {
 			return fmt.Errorf("server %q: %w", name, ErrNoHandlers)
 		}
 		seen := make(map[string]bool)
 		for i, h := range srv.Handlers {
+			if len(h.Routes) > 0 && h.Type != "http" {
+				return fmt.Errorf("server %q: handler[%d]: %w", name, i, ErrRoutesUnsupported)
+			}
+			if len(h.Allow) > 0 || len(h.Deny) > 0 || h.RequireCapability != "" {
+				if h.Type != "tcp" && h.Type != "http" && h.Type != "metrics" {
+					return fmt.Errorf("server %q: handler[%d]: %w", name, i, ErrAccessUnsupported)
+				}
+				if _, err := access.NewPolicy(h.Allow, h.Deny, h.RequireCapability); err != nil {
+					return fmt.Errorf("server %q: handler[%d]: %w", name, i, err)
+				}
+			}
+			if len(h.IdentityHeaders) > 0 {
+				if h.Type != "http" {
+					return fmt.Errorf("server %q: handler[%d]: %w", name, i, ErrHeadersUnsupported)
+				}
+				if _, err := identity.ParseHeaders(h.IdentityHeaders); err != nil {
+					return fmt.Errorf("server %q: handler[%d]: identity_headers: %w", name, i, err)
+				}
+			}
+			if j := h.IdentityJWT; j != nil {
+				if h.Type != "http" {
+					return fmt.Errorf("server %q: handler[%d]: %w", name, i, ErrJWTUnsupported)
+				}
+				if err := validateIdentityJWT(j); err != nil {
+					return fmt.Errorf("server %q: handler[%d]: identity_jwt: %w", name, i, err)
+				}
+			}
+			if len(h.FunnelPaths) > 0 {
+				if err := validateFunnelPaths(h); err != nil {
+					return fmt.Errorf("server %q: handler[%d]: %w", name, i, err)
+				}
+			}
+			if fa := h.ForwardAuth; fa != nil {
+				if h.Type != "http" {
+					return fmt.Errorf("server %q: handler[%d]: %w", name, i, ErrAuthUnsupported)
+				}
+				if err := validateForwardAuth(fa); err != nil {
+					return fmt.Errorf("server %q: handler[%d]: %w", name, i, err)
+				}
+			}
+			if err := validateBalancing(h); err != nil {
+				return fmt.Errorf("server %q: handler[%d]: %w", name, i, err)
+			}
 			switch h.Type {
-			case "tcp", "http":
+			case "tcp":
+				if len(h.Upstreams()) == 0 {
+					return fmt.Errorf("server %q: handler[%d]: %w", name, i, ErrUpstreamRequired)
+				}
+			case "http":
+				// With routes, upstream_address is only the fallback.
+				if len(h.Upstreams()) == 0 && len(h.Routes) == 0 {
+					return fmt.Errorf("server %q: handler[%d]: %w", name, i, ErrUpstreamRequired)
+				}
+				if err := validateRoutes(h.Routes); err != nil {
+					return fmt.Errorf("server %q: handler[%d]: %w", name, i, err)
+				}
+			case "udp":
+				if h.UpstreamAddress == "" {
+					return fmt.Errorf("server %q: handler[%d]: %w", name, i, ErrUpstreamRequired)
+				}
+				switch h.UpstreamNetwork {
+				case "udp", "udp4", "udp6":
+				default:
+					return fmt.Errorf("server %q: handler[%d]: %w, got %q", name, i, ErrUDPNetwork, h.UpstreamNetwork)
+				}
+				if h.TLS || h.Funnel {
+					return fmt.Errorf("server %q: handler[%d]: %w", name, i, ErrUDPNoTLS)
+				}
+				if h.IdleTimeout < 0 {
+					return fmt.Errorf("server %q: handler[%d]: %w", name, i, ErrNegativeTimeout)
+				}
+			case "static":
+				if h.Root == "" {
+					return fmt.Errorf("server %q: handler[%d]: %w", name, i, ErrRootRequired)
+				}
+				if h.CacheMaxAge < 0 {
+					return fmt.Errorf("server %q: handler[%d]: %w", name, i, ErrNegativeCacheAge)
+				}
+			case "metrics":
+				if h.Funnel {
+					return fmt.Errorf("server %q: handler[%d]: %w", name, i, ErrMetricsFunnel)
+				}
 			default:
 				return fmt.Errorf("server %q: handler[%d]: %w %q", name, i, ErrUnknownHandlerType, h.Type)
 			}
 			if h.Listen == "" {
 				return fmt.Errorf("server %q: handler[%d]: %w", name, i, ErrListenRequired)
 			}
-			if h.UpstreamAddress == "" {
-				return fmt.Errorf("server %q: handler[%d]: %w", name, i, ErrUpstreamRequired)
-			}
+			// TCP and UDP ports are separate namespaces: a DNS server may
+			// listen on :53 for both.
 			key := h.Listen
+			if h.Type == "udp" {
+				key = "udp/" + key
+			}
 			if seen[key] {
 				return fmt.Errorf("server %q: handler[%d]: %w %q", name, i, ErrDuplicateListen, h.Listen)
 			}
@@ -246,6 +992,204 @@ func (c *Config) Validate() error {
 	return nil
 }
 
+// validateIdentityJWT checks the algorithm, header name and ttl.
+func validateIdentityJWT(j *IdentityJWTConfig) error {
+	if err := jwt.ValidateAlgorithm(j.Algorithm); err != nil {
+		return err
+	}
+	if j.Header != "" && !identity.ValidHeaderName(j.Header) {
+		return fmt.Errorf("%w %q", identity.ErrInvalidHeader, j.Header)
+	}
+	if j.TTL < 0 {
+		return ErrNegativeTTL
+	}
+	return nil
+}
+
+// validateFunnelPaths checks that funnel_paths sits on a funnel http
+// handler and every prefix is absolute.
+func validateFunnelPaths(h HandlerConfig) error {
+	if h.Type != "http" || !h.Funnel {
+		return fmt.Errorf("%w: only supported on http handlers with funnel: true", ErrFunnelPaths)
+	}
+	for _, p := range h.FunnelPaths {
+		if !strings.HasPrefix(p, "/") {
+			return fmt.Errorf("%w: path must start with /, got %q", ErrFunnelPaths, p)
+		}
+	}
+	return nil
+}
+
+// validateForwardAuth checks the endpoint URL, copied header names and
+// timeout.
+func validateForwardAuth(fa *ForwardAuthConfig) error {
+	u, err := url.Parse(fa.Address)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%w: address must be an http(s) URL, got %q", ErrForwardAuth, fa.Address)
+	}
+	for _, name := range fa.ResponseHeaders {
+		if !identity.ValidHeaderName(name) {
+			return fmt.Errorf("%w: %w %q", ErrForwardAuth, identity.ErrInvalidHeader, name)
+		}
+	}
+	if fa.Timeout < 0 {
+		return fmt.Errorf("%w: timeout cannot be negative", ErrForwardAuth)
+	}
+	return nil
+}
+
+// validateBalancing checks upstream_addresses, load_balancing and
+// health_check, which only tcp and http handlers support.
+func validateBalancing(h HandlerConfig) error {
+	if len(h.UpstreamAddresses) == 0 && h.LoadBalancing == "" && h.HealthCheck == nil {
+		return nil
+	}
+	if h.Type != "tcp" && h.Type != "http" {
+		return ErrBalancingType
+	}
+	if h.UpstreamAddress != "" && len(h.UpstreamAddresses) > 0 {
+		return ErrUpstreamConflict
+	}
+	for j, addr := range h.UpstreamAddresses {
+		if addr == "" {
+			return fmt.Errorf("upstream_addresses[%d]: %w", j, ErrUpstreamRequired)
+		}
+	}
+	switch h.LoadBalancing {
+	case "", "round_robin", "least_connections", "random":
+	default:
+		return fmt.Errorf("%w %q", ErrUnknownStrategy, h.LoadBalancing)
+	}
+	if hc := h.HealthCheck; hc != nil {
+		if hc.Path != "" && !strings.HasPrefix(hc.Path, "/") {
+			return fmt.Errorf("%w: path must start with /, got %q", ErrHealthCheck, hc.Path)
+		}
+		if hc.Interval < 0 || hc.Timeout < 0 {
+			return fmt.Errorf("%w: interval and timeout cannot be negative", ErrHealthCheck)
+		}
+		if hc.UnhealthyThreshold < 0 || hc.HealthyThreshold < 0 {
+			return fmt.Errorf("%w: thresholds cannot be negative", ErrHealthCheck)
+		}
+	}
+	return nil
+}
+
+func validateAccessLog(a *AccessLogConfig) error {
+	if err := accesslog.ValidateFormat(a.Format); err != nil {
+		return fmt.Errorf("%w: %w", ErrAccessLog, err)
+	}
+	if a.MaxSizeMB < 0 || a.MaxBackups < 0 {
+		return fmt.Errorf("%w: max_size_mb and max_backups cannot be negative", ErrAccessLog)
+	}
+	return nil
+}
+
+func (c *Config) validateHook(h HookConfig) error {
+	if (len(h.Command) == 0) == (h.Webhook == "") {
+		return fmt.Errorf("%w: set either command or webhook", ErrHook)
+	}
+	if h.Webhook != "" && !isHTTPURL(h.Webhook) {
+		return fmt.Errorf("%w: webhook must be an http(s) URL, got %q", ErrHook, h.Webhook)
+	}
+	for _, state := range h.On {
+		if state != HookOnFailed && state != HookOnRunning {
+			return fmt.Errorf("%w: on %q: want %s or %s", ErrHook, state, HookOnFailed, HookOnRunning)
+		}
+	}
+	for _, name := range h.Servers {
+		if _, ok := c.Servers[name]; !ok {
+			return fmt.Errorf("%w: unknown server %q", ErrHook, name)
+		}
+	}
+	if h.Timeout < 0 {
+		return fmt.Errorf("%w: timeout cannot be negative", ErrHook)
+	}
+	return nil
+}
+
+// isTag reports whether s is an ACL tag such as "tag:proxy".
+func isTag(s string) bool {
+	name, ok := strings.CutPrefix(s, "tag:")
+	return ok && name != ""
+}
+
+// isHTTPURL reports whether s is an absolute http or https URL.
+func isHTTPURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// validateOAuth checks an oauth block; tags are required to mint keys.
+func validateOAuth(o *OAuthConfig) error {
+	if o.ClientID == "" || o.ClientSecret == "" {
+		return fmt.Errorf("%w: client_id and client_secret are required", ErrOAuth)
+	}
+	if len(o.Tags) == 0 {
+		return fmt.Errorf("%w: at least one tag is required", ErrOAuth)
+	}
+	for _, tag := range o.Tags {
+		if !isTag(tag) {
+			return fmt.Errorf("%w: tag %q must look like tag:name", ErrOAuth, tag)
+		}
+	}
+	if o.APIURL != "" && !isHTTPURL(o.APIURL) {
+		return fmt.Errorf("%w: api_url %q must be an http(s) URL", ErrOAuth, o.APIURL)
+	}
+	if o.KeyExpiry < 0 {
+		return fmt.Errorf("%w: key_expiry cannot be negative", ErrOAuth)
+	}
+	return nil
+}
+
+// validateRestartPolicy accepts zero values, which SetDefaults replaces.
+func validateRestartPolicy(p RestartPolicyConfig) error {
+	switch {
+	case p.InitialDelay < 0 || p.MaxDelay < 0 || p.StableAfter < 0 || p.Window < 0 || p.MaxRestarts < 0:
+		return fmt.Errorf("%w: delays, window and max_restarts cannot be negative", ErrRestartPolicy)
+	case p.MaxDelay > 0 && p.MaxDelay < p.InitialDelay:
+		return fmt.Errorf("%w: max_delay %v is below initial_delay %v", ErrRestartPolicy, p.MaxDelay, p.InitialDelay)
+	case p.Multiplier != 0 && p.Multiplier < 1:
+		return fmt.Errorf("%w: multiplier must be at least 1, got %v", ErrRestartPolicy, p.Multiplier)
+	case p.Jitter != nil && (*p.Jitter < 0 || *p.Jitter > 1):
+		return fmt.Errorf("%w: jitter must be between 0 and 1, got %v", ErrRestartPolicy, *p.Jitter)
+	}
+	return nil
+}
+
+func validateTracing(t *TracingConfig) error {
+	if t.Endpoint == "" {
+		return fmt.Errorf("%w: endpoint is required", ErrTracing)
+	}
+	if err := tracing.ValidateProtocol(t.Protocol); err != nil {
+		return fmt.Errorf("%w: %w", ErrTracing, err)
+	}
+	if r := t.SampleRatio; r != nil && (*r < 0 || *r > 1) {
+		return fmt.Errorf("%w: sample_ratio must be between 0 and 1, got %v", ErrTracing, *r)
+	}
+	return nil
+}
+
+// validateRoutes checks each route and rejects pairs that would match exactly
+// the same requests. Nested prefixes (/api and /api/v2) are fine: the longest
+// prefix wins at request time.
+func validateRoutes(routes []RouteConfig) error {
+	seen := make(map[string]int)
+	for j, r := range routes {
+		if !strings.HasPrefix(r.Path, "/") {
+			return fmt.Errorf("route[%d]: %w, got %q", j, ErrRoutePath, r.Path)
+		}
+		if r.UpstreamAddress == "" {
+			return fmt.Errorf("route[%d]: %w", j, ErrUpstreamRequired)
+		}
+		key := r.routeKey()
+		if prev, ok := seen[key]; ok {
+			return fmt.Errorf("route[%d]: %w with route[%d] (host %q, path %q)", j, ErrRouteOverlap, prev, r.Host, r.Path)
+		}
+		seen[key] = j
+	}
+	return nil
+}
+
 // ServerNames returns sorted server names for deterministic iteration.
 func (c *Config) ServerNames() []string {
 	names := make([]string, 0, len(c.Servers))
@@ -286,12 +1230,31 @@ func HandlerColumnWidths(handlers []HandlerConfig) (maxListen, maxTypeFlags int)
 	return maxListen, maxTypeFlags
 }
 
-// FormatHandlerLine returns one indented handler line for DisplayString-style output.
+// FormatHandlerLine returns one indented handler line for DisplayString-style
+// output, followed by one further-indented line per route.
 func FormatHandlerLine(h HandlerConfig, maxListen, maxTypeFlags int) string {
-	return fmt.Sprintf("  %-*s %-*s -> %s\n",
+	target := h.Target()
+	if target == "" && len(h.Routes) > 0 {
+		target = "(routes only)"
+	}
+	line := fmt.Sprintf("  %-*s %-*s -> %s\n",
 		maxListen, h.Listen,
 		maxTypeFlags, HandlerTypeFlags(h),
-		h.UpstreamAddress)
+		target)
+	for _, r := range h.Routes {
+		match := r.Path
+		if r.Host != "" {
+			match = r.Host + r.Path
+		}
+		if r.StripPrefix {
+			match += " (strip)"
+		}
+		line += fmt.Sprintf("    %s -> %s\n", match, r.UpstreamAddress)
+	}
+	if len(h.FunnelPaths) > 0 {
+		line += fmt.Sprintf("    public: %s\n", strings.Join(h.FunnelPaths, ", "))
+	}
+	return line
 }
 
 // DisplayString returns a human-readable representation of configured servers.
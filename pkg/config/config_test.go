@@ -3,8 +3,16 @@ package config
 import (
 	"errors"
 	"os"
+	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/lucasew/ts-proxy/pkg/access"
+	"github.com/lucasew/ts-proxy/pkg/identity"
+	"github.com/lucasew/ts-proxy/pkg/jwt"
+	"gopkg.in/yaml.v3"
 )
 
 func TestValidateSlug(t *testing.T) {
@@ -61,84 +69,678 @@ func TestConfigValidate(t *testing.T) {
 		wantErr error
 	}{
 		{
-			name:   "valid config",
-			modify: func(c *Config) {},
+			name:   "valid config",
+			modify: func(c *Config) {},
+		},
+		{
+			name: "invalid server slug",
+			modify: func(c *Config) {
+				c.Servers["bad-name"] = c.Servers["web"]
+				delete(c.Servers, "web")
+			},
+			wantErr: ErrNameInvalid,
+		},
+		{
+			name: "invalid token slug",
+			modify: func(c *Config) {
+				c.Tokens["bad-token"] = c.Tokens["default"]
+				delete(c.Tokens, "default")
+				c.Servers["web"] = ServerConfig{
+					Token:    "bad-token",
+					Handlers: c.Servers["web"].Handlers,
+				}
+			},
+			wantErr: ErrNameInvalid,
+		},
+		{
+			name: "missing token reference",
+			modify: func(c *Config) {
+				srv := c.Servers["web"]
+				srv.Token = "nonexistent"
+				c.Servers["web"] = srv
+			},
+			wantErr: ErrUndefinedToken,
+		},
+		{
+			name: "no handlers",
+			modify: func(c *Config) {
+				srv := c.Servers["web"]
+				srv.Handlers = nil
+				c.Servers["web"] = srv
+			},
+			wantErr: ErrNoHandlers,
+		},
+		{
+			name: "unknown handler type",
+			modify: func(c *Config) {
+				srv := c.Servers["web"]
+				srv.Handlers[0].Type = "grpc"
+				c.Servers["web"] = srv
+			},
+			wantErr: ErrUnknownHandlerType,
+		},
+		{
+			name: "missing listen",
+			modify: func(c *Config) {
+				srv := c.Servers["web"]
+				srv.Handlers[0].Listen = ""
+				c.Servers["web"] = srv
+			},
+			wantErr: ErrListenRequired,
+		},
+		{
+			name: "missing upstream_address",
+			modify: func(c *Config) {
+				srv := c.Servers["web"]
+				srv.Handlers[0].UpstreamAddress = ""
+				c.Servers["web"] = srv
+			},
+			wantErr: ErrUpstreamRequired,
+		},
+		{
+			name: "duplicate listen address",
+			modify: func(c *Config) {
+				srv := c.Servers["web"]
+				srv.Handlers = append(srv.Handlers, HandlerConfig{
+					Type: "tcp", Listen: ":80", UpstreamAddress: "localhost:9090", UpstreamNetwork: "tcp",
+				})
+				c.Servers["web"] = srv
+			},
+			wantErr: ErrDuplicateListen,
+		},
+		{
+			name: "static handler without upstream",
+			modify: func(c *Config) {
+				srv := c.Servers["web"]
+				srv.Handlers[0] = HandlerConfig{Type: "static", Listen: ":80", Root: "/srv/www"}
+				c.Servers["web"] = srv
+			},
+		},
+		{
+			name: "static handler missing root",
+			modify: func(c *Config) {
+				srv := c.Servers["web"]
+				srv.Handlers[0] = HandlerConfig{Type: "static", Listen: ":80"}
+				c.Servers["web"] = srv
+			},
+			wantErr: ErrRootRequired,
+		},
+		{
+			name: "static handler negative cache_max_age",
+			modify: func(c *Config) {
+				srv := c.Servers["web"]
+				srv.Handlers[0] = HandlerConfig{Type: "static", Listen: ":80", Root: "/srv/www", CacheMaxAge: -1}
+				c.Servers["web"] = srv
+			},
+			wantErr: ErrNegativeCacheAge,
+		},
+		{
+			name: "udp handler",
+			modify: func(c *Config) {
+				srv := c.Servers["web"]
+				srv.Handlers = append(srv.Handlers, HandlerConfig{
+					Type: "udp", Listen: ":53", UpstreamAddress: "127.0.0.1:53", UpstreamNetwork: "udp",
+				})
+				c.Servers["web"] = srv
+			},
+		},
+		{
+			name: "udp and tcp may share a port",
+			modify: func(c *Config) {
+				srv := c.Servers["web"]
+				srv.Handlers = append(srv.Handlers,
+					HandlerConfig{Type: "tcp", Listen: ":53", UpstreamAddress: "127.0.0.1:53", UpstreamNetwork: "tcp"},
+					HandlerConfig{Type: "udp", Listen: ":53", UpstreamAddress: "127.0.0.1:53", UpstreamNetwork: "udp"},
+				)
+				c.Servers["web"] = srv
+			},
+		},
+		{
+			name: "duplicate udp listen",
+			modify: func(c *Config) {
+				srv := c.Servers["web"]
+				srv.Handlers = append(srv.Handlers,
+					HandlerConfig{Type: "udp", Listen: ":53", UpstreamAddress: "127.0.0.1:53", UpstreamNetwork: "udp"},
+					HandlerConfig{Type: "udp", Listen: ":53", UpstreamAddress: "127.0.0.1:54", UpstreamNetwork: "udp"},
+				)
+				c.Servers["web"] = srv
+			},
+			wantErr: ErrDuplicateListen,
+		},
+		{
+			name: "udp handler with tcp upstream",
+			modify: func(c *Config) {
+				srv := c.Servers["web"]
+				srv.Handlers[0] = HandlerConfig{Type: "udp", Listen: ":53", UpstreamAddress: "127.0.0.1:53", UpstreamNetwork: "tcp"}
+				c.Servers["web"] = srv
+			},
+			wantErr: ErrUDPNetwork,
+		},
+		{
+			name: "udp handler with funnel",
+			modify: func(c *Config) {
+				srv := c.Servers["web"]
+				srv.Handlers[0] = HandlerConfig{Type: "udp", Listen: ":53", UpstreamAddress: "127.0.0.1:53", UpstreamNetwork: "udp", Funnel: true}
+				c.Servers["web"] = srv
+			},
+			wantErr: ErrUDPNoTLS,
+		},
+		{
+			name: "http routes without fallback upstream",
+			modify: func(c *Config) {
+				srv := c.Servers["web"]
+				srv.Handlers[0].UpstreamAddress = ""
+				srv.Handlers[0].Routes = []RouteConfig{
+					{Path: "/api", UpstreamAddress: "localhost:3000"},
+					{Path: "/api/v2", UpstreamAddress: "localhost:3001"},
+					{Path: "/api", Host: "admin.example.com", UpstreamAddress: "localhost:3002"},
+				}
+				c.Servers["web"] = srv
+			},
+		},
+		{
+			name: "overlapping routes",
+			modify: func(c *Config) {
+				srv := c.Servers["web"]
+				srv.Handlers[0].Routes = []RouteConfig{
+					{Path: "/api", UpstreamAddress: "localhost:3000"},
+					{Path: "/api/", UpstreamAddress: "localhost:3001"},
+				}
+				c.Servers["web"] = srv
+			},
+			wantErr: ErrRouteOverlap,
+		},
+		{
+			name: "route path without leading slash",
+			modify: func(c *Config) {
+				srv := c.Servers["web"]
+				srv.Handlers[0].Routes = []RouteConfig{{Path: "api", UpstreamAddress: "localhost:3000"}}
+				c.Servers["web"] = srv
+			},
+			wantErr: ErrRoutePath,
+		},
+		{
+			name: "route missing upstream",
+			modify: func(c *Config) {
+				srv := c.Servers["web"]
+				srv.Handlers[0].Routes = []RouteConfig{{Path: "/api"}}
+				c.Servers["web"] = srv
+			},
+			wantErr: ErrUpstreamRequired,
+		},
+		{
+			name: "routes on tcp handler",
+			modify: func(c *Config) {
+				srv := c.Servers["web"]
+				srv.Handlers[0].Type = "tcp"
+				srv.Handlers[0].Routes = []RouteConfig{{Path: "/api", UpstreamAddress: "localhost:3000"}}
+				c.Servers["web"] = srv
+			},
+			wantErr: ErrRoutesUnsupported,
+		},
+		{
+			name: "allow and deny rules",
+			modify: func(c *Config) {
+				srv := c.Servers["web"]
+				srv.Handlers[0].Allow = []string{"*@example.com", "tag:ci"}
+				srv.Handlers[0].Deny = []string{"mallory@example.com"}
+				c.Servers["web"] = srv
+			},
+		},
+		{
+			name: "invalid access rule",
+			modify: func(c *Config) {
+				srv := c.Servers["web"]
+				srv.Handlers[0].Allow = []string{"group:admins"}
+				c.Servers["web"] = srv
+			},
+			wantErr: access.ErrInvalidRule,
+		},
+		{
+			name: "require_capability",
+			modify: func(c *Config) {
+				srv := c.Servers["web"]
+				srv.Handlers[0].RequireCapability = "example.com/cap/ts-proxy"
+				c.Servers["web"] = srv
+			},
+		},
+		{
+			name: "invalid require_capability",
+			modify: func(c *Config) {
+				srv := c.Servers["web"]
+				srv.Handlers[0].RequireCapability = "ts-proxy"
+				c.Servers["web"] = srv
+			},
+			wantErr: access.ErrInvalidCapability,
+		},
+		{
+			name: "identity_headers",
+			modify: func(c *Config) {
+				srv := c.Servers["web"]
+				srv.Handlers[0].IdentityHeaders = map[string]string{"x-webauth-user": "{{.User}}"}
+				c.Servers["web"] = srv
+			},
+		},
+		{
+			name: "identity_headers unknown field",
+			modify: func(c *Config) {
+				srv := c.Servers["web"]
+				srv.Handlers[0].IdentityHeaders = map[string]string{"x-webauth-user": "{{.Email}}"}
+				c.Servers["web"] = srv
+			},
+			wantErr: identity.ErrInvalidTemplate,
+		},
+		{
+			name: "identity_headers on tcp handler",
+			modify: func(c *Config) {
+				srv := c.Servers["web"]
+				srv.Handlers[0].Type = "tcp"
+				srv.Handlers[0].IdentityHeaders = map[string]string{"x-webauth-user": "{{.User}}"}
+				c.Servers["web"] = srv
+			},
+			wantErr: ErrHeadersUnsupported,
+		},
+		{
+			name: "identity_jwt",
+			modify: func(c *Config) {
+				srv := c.Servers["web"]
+				srv.Handlers[0].IdentityJWT = &IdentityJWTConfig{Algorithm: "rs256", TTL: 5 * time.Minute}
+				c.Servers["web"] = srv
+			},
+		},
+		{
+			name: "identity_jwt unknown algorithm",
+			modify: func(c *Config) {
+				srv := c.Servers["web"]
+				srv.Handlers[0].IdentityJWT = &IdentityJWTConfig{Algorithm: "hs256"}
+				c.Servers["web"] = srv
+			},
+			wantErr: jwt.ErrUnknownAlgorithm,
+		},
+		{
+			name: "identity_jwt negative ttl",
+			modify: func(c *Config) {
+				srv := c.Servers["web"]
+				srv.Handlers[0].IdentityJWT = &IdentityJWTConfig{TTL: -time.Second}
+				c.Servers["web"] = srv
+			},
+			wantErr: ErrNegativeTTL,
+		},
+		{
+			name: "identity_jwt on tcp handler",
+			modify: func(c *Config) {
+				srv := c.Servers["web"]
+				srv.Handlers[0].Type = "tcp"
+				srv.Handlers[0].IdentityJWT = &IdentityJWTConfig{}
+				c.Servers["web"] = srv
+			},
+			wantErr: ErrJWTUnsupported,
+		},
+		{
+			name: "forward_auth",
+			modify: func(c *Config) {
+				srv := c.Servers["web"]
+				srv.Handlers[0].ForwardAuth = &ForwardAuthConfig{
+					Address:         "http://127.0.0.1:9091/api/verify",
+					ResponseHeaders: []string{"Remote-User", "Remote-Groups"},
+				}
+				c.Servers["web"] = srv
+			},
+		},
+		{
+			name: "forward_auth without scheme",
+			modify: func(c *Config) {
+				srv := c.Servers["web"]
+				srv.Handlers[0].ForwardAuth = &ForwardAuthConfig{Address: "127.0.0.1:9091"}
+				c.Servers["web"] = srv
+			},
+			wantErr: ErrForwardAuth,
+		},
+		{
+			name: "forward_auth bad response header",
+			modify: func(c *Config) {
+				srv := c.Servers["web"]
+				srv.Handlers[0].ForwardAuth = &ForwardAuthConfig{Address: "http://auth", ResponseHeaders: []string{"Remote User"}}
+				c.Servers["web"] = srv
+			},
+			wantErr: identity.ErrInvalidHeader,
+		},
+		{
+			name: "forward_auth on static handler",
+			modify: func(c *Config) {
+				srv := c.Servers["web"]
+				srv.Handlers[0] = HandlerConfig{Type: "static", Root: "/srv", ForwardAuth: &ForwardAuthConfig{Address: "http://auth"}}
+				c.Servers["web"] = srv
+			},
+			wantErr: ErrAuthUnsupported,
+		},
+		{
+			name: "funnel_paths",
+			modify: func(c *Config) {
+				srv := c.Servers["web"]
+				srv.Handlers[0].Funnel = true
+				srv.Handlers[0].TLS = true
+				srv.Handlers[0].FunnelPaths = []string{"/hooks", "/public/"}
+				c.Servers["web"] = srv
+			},
+		},
+		{
+			name: "funnel_paths without funnel",
+			modify: func(c *Config) {
+				srv := c.Servers["web"]
+				srv.Handlers[0].FunnelPaths = []string{"/hooks"}
+				c.Servers["web"] = srv
+			},
+			wantErr: ErrFunnelPaths,
+		},
+		{
+			name: "funnel_paths relative",
+			modify: func(c *Config) {
+				srv := c.Servers["web"]
+				srv.Handlers[0].Funnel = true
+				srv.Handlers[0].FunnelPaths = []string{"hooks"}
+				c.Servers["web"] = srv
+			},
+			wantErr: ErrFunnelPaths,
+		},
+		{
+			name: "access rules on static handler",
+			modify: func(c *Config) {
+				srv := c.Servers["web"]
+				srv.Handlers[0] = HandlerConfig{Type: "static", Root: "/srv", Allow: []string{"*"}}
+				c.Servers["web"] = srv
+			},
+			wantErr: ErrAccessUnsupported,
+		},
+		{
+			name: "upstream_addresses with health check",
+			modify: func(c *Config) {
+				srv := c.Servers["web"]
+				srv.Handlers[0].UpstreamAddress = ""
+				srv.Handlers[0].UpstreamAddresses = []string{"localhost:8080", "localhost:8081"}
+				srv.Handlers[0].LoadBalancing = "least_connections"
+				srv.Handlers[0].HealthCheck = &HealthCheckConfig{Path: "/healthz"}
+				c.Servers["web"] = srv
+			},
+		},
+		{
+			name: "upstream_address and upstream_addresses",
+			modify: func(c *Config) {
+				srv := c.Servers["web"]
+				srv.Handlers[0].UpstreamAddresses = []string{"localhost:8081"}
+				c.Servers["web"] = srv
+			},
+			wantErr: ErrUpstreamConflict,
+		},
+		{
+			name: "unknown load balancing strategy",
+			modify: func(c *Config) {
+				srv := c.Servers["web"]
+				srv.Handlers[0].LoadBalancing = "weighted"
+				c.Servers["web"] = srv
+			},
+			wantErr: ErrUnknownStrategy,
+		},
+		{
+			name: "health check path without slash",
+			modify: func(c *Config) {
+				srv := c.Servers["web"]
+				srv.Handlers[0].HealthCheck = &HealthCheckConfig{Path: "healthz"}
+				c.Servers["web"] = srv
+			},
+			wantErr: ErrHealthCheck,
+		},
+		{
+			name: "load balancing on static handler",
+			modify: func(c *Config) {
+				srv := c.Servers["web"]
+				srv.Handlers[0] = HandlerConfig{Type: "static", Listen: ":80", Root: "/srv", UpstreamAddresses: []string{"a:1"}}
+				c.Servers["web"] = srv
+			},
+			wantErr: ErrBalancingType,
+		},
+		{
+			name: "metrics handler",
+			modify: func(c *Config) {
+				srv := c.Servers["web"]
+				srv.Handlers = append(srv.Handlers, HandlerConfig{Type: "metrics", Listen: ":9100"})
+				c.Servers["web"] = srv
+			},
+		},
+		{
+			name: "metrics handler on funnel",
+			modify: func(c *Config) {
+				srv := c.Servers["web"]
+				srv.Handlers = append(srv.Handlers, HandlerConfig{Type: "metrics", Listen: ":8443", Funnel: true, TLS: true})
+				c.Servers["web"] = srv
+			},
+			wantErr: ErrMetricsFunnel,
+		},
+		{
+			name: "metrics handler with access rules",
+			modify: func(c *Config) {
+				srv := c.Servers["web"]
+				srv.Handlers = append(srv.Handlers, HandlerConfig{Type: "metrics", Listen: ":9100", Allow: []string{"tag:prometheus"}})
+				c.Servers["web"] = srv
+			},
+		},
+		{
+			name: "access log",
+			modify: func(c *Config) {
+				c.AccessLog = &AccessLogConfig{Format: "combined", Output: "/var/log/ts-proxy/access.log"}
+			},
 		},
 		{
-			name: "invalid server slug",
+			name: "access log unknown format",
 			modify: func(c *Config) {
-				c.Servers["bad-name"] = c.Servers["web"]
-				delete(c.Servers, "web")
+				c.AccessLog = &AccessLogConfig{Format: "xml"}
 			},
-			wantErr: ErrNameInvalid,
+			wantErr: ErrAccessLog,
 		},
 		{
-			name: "invalid token slug",
+			name: "access log negative rotation",
 			modify: func(c *Config) {
-				c.Tokens["bad-token"] = c.Tokens["default"]
-				delete(c.Tokens, "default")
-				c.Servers["web"] = ServerConfig{
-					Token:    "bad-token",
-					Handlers: c.Servers["web"].Handlers,
-				}
+				c.AccessLog = &AccessLogConfig{MaxBackups: -1}
 			},
-			wantErr: ErrNameInvalid,
+			wantErr: ErrAccessLog,
 		},
 		{
-			name: "missing token reference",
+			name: "restart mode and critical",
 			modify: func(c *Config) {
 				srv := c.Servers["web"]
-				srv.Token = "nonexistent"
+				srv.Restart = RestartNever
+				srv.Critical = true
 				c.Servers["web"] = srv
 			},
-			wantErr: ErrUndefinedToken,
 		},
 		{
-			name: "no handlers",
+			name: "unknown restart mode",
 			modify: func(c *Config) {
 				srv := c.Servers["web"]
-				srv.Handlers = nil
+				srv.Restart = "sometimes"
 				c.Servers["web"] = srv
 			},
-			wantErr: ErrNoHandlers,
+			wantErr: ErrRestartMode,
 		},
 		{
-			name: "unknown handler type",
+			name: "oauth token",
+			modify: func(c *Config) {
+				c.Tokens["ci"] = TokenConfig{OAuth: &OAuthConfig{
+					ClientID: "k123", ClientSecret: "tskey-client-secret", Tags: []string{"tag:proxy"},
+				}}
+			},
+		},
+		{
+			name: "oauth and auth_key",
+			modify: func(c *Config) {
+				c.Tokens["ci"] = TokenConfig{AuthKey: "tskey-auth", OAuth: &OAuthConfig{
+					ClientID: "k123", ClientSecret: "tskey-client-secret", Tags: []string{"tag:proxy"},
+				}}
+			},
+			wantErr: ErrAuthKeyConflict,
+		},
+		{
+			name: "oauth without tags",
+			modify: func(c *Config) {
+				c.Tokens["ci"] = TokenConfig{OAuth: &OAuthConfig{ClientID: "k123", ClientSecret: "s"}}
+			},
+			wantErr: ErrOAuth,
+		},
+		{
+			name: "oauth bad tag",
+			modify: func(c *Config) {
+				c.Tokens["ci"] = TokenConfig{OAuth: &OAuthConfig{
+					ClientID: "k123", ClientSecret: "s", Tags: []string{"proxy"},
+				}}
+			},
+			wantErr: ErrOAuth,
+		},
+		{
+			name: "ephemeral tagged node on headscale",
 			modify: func(c *Config) {
 				srv := c.Servers["web"]
-				srv.Handlers[0].Type = "grpc"
+				srv.Ephemeral = true
+				srv.AdvertiseTags = []string{"tag:preview"}
+				srv.ControlURL = "https://headscale.example.com"
 				c.Servers["web"] = srv
 			},
-			wantErr: ErrUnknownHandlerType,
 		},
 		{
-			name: "missing listen",
+			name: "advertise_tags without tag prefix",
 			modify: func(c *Config) {
 				srv := c.Servers["web"]
-				srv.Handlers[0].Listen = ""
+				srv.AdvertiseTags = []string{"preview"}
 				c.Servers["web"] = srv
 			},
-			wantErr: ErrListenRequired,
+			wantErr: ErrInvalidTag,
 		},
 		{
-			name: "missing upstream_address",
+			name: "control_url not a url",
 			modify: func(c *Config) {
 				srv := c.Servers["web"]
-				srv.Handlers[0].UpstreamAddress = ""
+				srv.ControlURL = "headscale.example.com"
 				c.Servers["web"] = srv
 			},
-			wantErr: ErrUpstreamRequired,
+			wantErr: ErrControlURL,
 		},
 		{
-			name: "duplicate listen address",
+			name: "negative auth_timeout",
 			modify: func(c *Config) {
 				srv := c.Servers["web"]
-				srv.Handlers = append(srv.Handlers, HandlerConfig{
-					Type: "tcp", Listen: ":80", UpstreamAddress: "localhost:9090", UpstreamNetwork: "tcp",
-				})
+				srv.AuthTimeout = -time.Second
 				c.Servers["web"] = srv
 			},
-			wantErr: ErrDuplicateListen,
+			wantErr: ErrAuthTimeout,
+		},
+		{
+			name: "hooks",
+			modify: func(c *Config) {
+				c.Hooks = []HookConfig{
+					{On: []string{HookOnFailed}, Command: []string{"/usr/local/bin/alert"}, Servers: []string{"web"}},
+					{Webhook: "https://chat.example.com/hook"},
+				}
+			},
+		},
+		{
+			name: "hook with command and webhook",
+			modify: func(c *Config) {
+				c.Hooks = []HookConfig{{Command: []string{"true"}, Webhook: "https://chat.example.com/hook"}}
+			},
+			wantErr: ErrHook,
+		},
+		{
+			name: "hook on unknown state",
+			modify: func(c *Config) {
+				c.Hooks = []HookConfig{{On: []string{"exploded"}, Command: []string{"true"}}}
+			},
+			wantErr: ErrHook,
+		},
+		{
+			name: "hook for unknown server",
+			modify: func(c *Config) {
+				c.Hooks = []HookConfig{{Servers: []string{"nope"}, Command: []string{"true"}}}
+			},
+			wantErr: ErrHook,
+		},
+		{
+			name: "hook webhook not http",
+			modify: func(c *Config) {
+				c.Hooks = []HookConfig{{Webhook: "ftp://example.com"}}
+			},
+			wantErr: ErrHook,
+		},
+		{
+			name: "restart policy",
+			modify: func(c *Config) {
+				c.RestartPolicy = RestartPolicyConfig{InitialDelay: time.Second, MaxDelay: time.Minute, MaxRestarts: 5}
+			},
+		},
+		{
+			name: "restart policy max below initial delay",
+			modify: func(c *Config) {
+				c.RestartPolicy = RestartPolicyConfig{InitialDelay: time.Minute, MaxDelay: time.Second}
+			},
+			wantErr: ErrRestartPolicy,
+		},
+		{
+			name: "restart policy multiplier below 1",
+			modify: func(c *Config) {
+				c.RestartPolicy = RestartPolicyConfig{Multiplier: 0.5}
+			},
+			wantErr: ErrRestartPolicy,
+		},
+		{
+			name: "restart policy negative max restarts",
+			modify: func(c *Config) {
+				c.RestartPolicy = RestartPolicyConfig{MaxRestarts: -1}
+			},
+			wantErr: ErrRestartPolicy,
+		},
+		{
+			name: "restart policy jitter 0",
+			modify: func(c *Config) {
+				c.RestartPolicy = RestartPolicyConfig{Jitter: new(0.0)}
+			},
+		},
+		{
+			name: "restart policy jitter above 1",
+			modify: func(c *Config) {
+				c.RestartPolicy = RestartPolicyConfig{Jitter: new(1.5)}
+			},
+			wantErr: ErrRestartPolicy,
+		},
+		{
+			name: "tracing",
+			modify: func(c *Config) {
+				c.Tracing = &TracingConfig{Endpoint: "otel-collector:4317", SampleRatio: new(0.5)}
+			},
+		},
+		{
+			name: "tracing sample ratio 0",
+			modify: func(c *Config) {
+				c.Tracing = &TracingConfig{Endpoint: "otel-collector:4317", SampleRatio: new(0.0)}
+			},
+		},
+		{
+			name: "tracing without endpoint",
+			modify: func(c *Config) {
+				c.Tracing = &TracingConfig{Protocol: "http"}
+			},
+			wantErr: ErrTracing,
+		},
+		{
+			name: "tracing unknown protocol",
+			modify: func(c *Config) {
+				c.Tracing = &TracingConfig{Endpoint: "otel-collector:4317", Protocol: "zipkin"}
+			},
+			wantErr: ErrTracing,
+		},
+		{
+			name: "tracing sample ratio above 1",
+			modify: func(c *Config) {
+				c.Tracing = &TracingConfig{Endpoint: "otel-collector:4317", SampleRatio: new(2.0)}
+			},
+			wantErr: ErrTracing,
 		},
 		{
 			name: "empty token ref is allowed",
@@ -209,6 +811,36 @@ func TestSetDefaults(t *testing.T) {
 	if srv.Handlers[2].Listen != ":2222" {
 		t.Errorf("TCP handler listen = %q, want :2222", srv.Handlers[2].Listen)
 	}
+
+	if j := cfg.RestartPolicy.Jitter; j == nil || *j != DefaultRestartJitter {
+		t.Errorf("RestartPolicy.Jitter = %v, want %v", j, DefaultRestartJitter)
+	}
+	off := Config{RestartPolicy: RestartPolicyConfig{Jitter: new(0.0)}}
+	off.SetDefaults()
+	if *off.RestartPolicy.Jitter != 0 {
+		t.Errorf("explicit jitter 0 became %v", *off.RestartPolicy.Jitter)
+	}
+}
+
+// UDP handlers relay to a UDP upstream unless told otherwise; the TCP
+// default would make every session dial fail.
+func TestUDPHandlerDefaultsToUDPUpstream(t *testing.T) {
+	cfg := Config{
+		Servers: map[string]ServerConfig{
+			"dns": {
+				Handlers: []HandlerConfig{
+					{Type: "udp", Listen: ":53", UpstreamAddress: "127.0.0.1:5353"},
+				},
+			},
+		},
+	}
+	cfg.SetDefaults()
+	if got := cfg.Servers["dns"].Handlers[0].UpstreamNetwork; got != "udp" {
+		t.Errorf("udp handler upstream_network = %q, want udp", got)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Validate: %v", err)
+	}
 }
 
 func TestExpandEnv(t *testing.T) {
@@ -232,6 +864,177 @@ func TestExpandEnv(t *testing.T) {
 	}
 }
 
+func TestExpandSecretReferences(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "authkey")
+	if err := os.WriteFile(keyFile, []byte("tskey-from-file\n"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	t.Setenv("TEST_CREDENTIALS_DIRECTORY", dir)
+
+	cfg := Config{
+		Tokens: map[string]TokenConfig{
+			"file":      {AuthKey: "${file:" + keyFile + "}"},
+			"cmd":       {AuthKey: "${cmd:printf ' tskey-from-cmd '}"},
+			"keyfile":   {AuthKeyFile: "${TEST_CREDENTIALS_DIRECTORY}/authkey"},
+			"mixed":     {AuthKey: "prefix-${cmd:echo middle}-suffix"},
+			"unchanged": {AuthKey: "tskey-literal"},
+		},
+	}
+	if err := cfg.ExpandEnv(); err != nil {
+		t.Fatalf("ExpandEnv: %v", err)
+	}
+	for name, want := range map[string]string{
+		"file":      "tskey-from-file",
+		"cmd":       "tskey-from-cmd",
+		"keyfile":   "tskey-from-file",
+		"mixed":     "prefix-middle-suffix",
+		"unchanged": "tskey-literal",
+	} {
+		if got := cfg.Tokens[name].AuthKey; got != want {
+			t.Errorf("token %s auth_key = %q, want %q", name, got, want)
+		}
+	}
+}
+
+// ${file:...} and ${cmd:...} only work in secret fields, and a reference
+// used twice runs once.
+func TestExpandSecretRefFields(t *testing.T) {
+	counter := filepath.Join(t.TempDir(), "runs")
+	ref := "${cmd:echo run >> " + counter + "; echo tskey-shared}"
+	cfg := Config{
+		Tokens: map[string]TokenConfig{
+			"a": {AuthKey: ref},
+			"b": {AuthKey: ref},
+		},
+	}
+	if err := cfg.ExpandEnv(); err != nil {
+		t.Fatalf("ExpandEnv: %v", err)
+	}
+	if cfg.Tokens["a"].AuthKey != "tskey-shared" || cfg.Tokens["b"].AuthKey != "tskey-shared" {
+		t.Errorf("auth keys = %q, %q; want tskey-shared", cfg.Tokens["a"].AuthKey, cfg.Tokens["b"].AuthKey)
+	}
+	if b, _ := os.ReadFile(counter); string(b) != "run\n" {
+		t.Errorf("command ran %d times, want once", strings.Count(string(b), "run"))
+	}
+
+	marker := filepath.Join(t.TempDir(), "ran")
+	cfg = Config{
+		Servers: map[string]ServerConfig{
+			"web": {Handlers: []HandlerConfig{{
+				Type:   "tcp",
+				Listen: "${cmd:touch " + marker + "}",
+				Allow:  []string{"${file:/etc/hostname}"},
+			}}},
+		},
+	}
+	err := cfg.ExpandEnv()
+	if !errors.Is(err, ErrSecretRef) {
+		t.Fatalf("ExpandEnv = %v, want ErrSecretRef", err)
+	}
+	for _, want := range []string{"listen", "allow[0]"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not mention %s", err, want)
+		}
+	}
+	if _, err := os.Stat(marker); !os.IsNotExist(err) {
+		t.Error("command in a non-secret field was run")
+	}
+}
+
+func TestRedact(t *testing.T) {
+	cfg := Config{
+		Hooks:   []HookConfig{{Webhook: "https://hooks.example.com/T000/secret"}},
+		Tracing: &TracingConfig{Headers: map[string]string{"authorization": "Bearer x"}},
+		Tokens: map[string]TokenConfig{
+			"key":   {AuthKey: "tskey-secret", AuthKeyFile: "/run/secrets/key"},
+			"oauth": {OAuth: &OAuthConfig{ClientID: "id", ClientSecret: "tskey-client-secret"}},
+			"empty": {},
+		},
+	}
+	cfg.Redact()
+	out, err := yaml.Marshal(cfg)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	for _, secret := range []string{"T000", "Bearer", "tskey-"} {
+		if strings.Contains(string(out), secret) {
+			t.Errorf("redacted config contains %q:\n%s", secret, out)
+		}
+	}
+	if cfg.Tokens["key"].AuthKeyFile != "/run/secrets/key" || cfg.Tokens["oauth"].OAuth.ClientID != "id" {
+		t.Error("Redact changed fields that are not secret")
+	}
+	if cfg.Tokens["empty"].AuthKey != "" {
+		t.Errorf("empty auth_key = %q, want it left empty", cfg.Tokens["empty"].AuthKey)
+	}
+}
+
+func TestRestartOnly(t *testing.T) {
+	cfg := Config{
+		MetricsListen: "127.0.0.1:9090",
+		AccessLog:     &AccessLogConfig{Output: "stdout"},
+		Servers:       map[string]ServerConfig{"web": {Hostname: "web"}},
+	}
+	same := cfg
+	same.AccessLog = &AccessLogConfig{Output: "stdout"}
+	same.Servers = map[string]ServerConfig{"web": {Hostname: "renamed"}}
+	if changed := cfg.RestartOnly(&same); len(changed) != 0 {
+		t.Errorf("RestartOnly = %v, want none for server changes", changed)
+	}
+	next := same
+	next.MetricsListen = "127.0.0.1:9091"
+	next.AccessLog = &AccessLogConfig{Output: "stderr"}
+	next.Tracing = &TracingConfig{}
+	want := []string{"metrics_listen", "access_log", "tracing"}
+	if changed := cfg.RestartOnly(&next); !slices.Equal(changed, want) {
+		t.Errorf("RestartOnly = %v, want %v", changed, want)
+	}
+}
+
+// Every unresolvable secret is reported, not just the first.
+func TestExpandSecretErrors(t *testing.T) {
+	dir := t.TempDir()
+	empty := filepath.Join(dir, "empty")
+	if err := os.WriteFile(empty, []byte("\n"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	cfg := Config{
+		Tokens: map[string]TokenConfig{
+			"missing":  {AuthKey: "${file:" + filepath.Join(dir, "nope") + "}"},
+			"empty":    {AuthKeyFile: empty},
+			"failing":  {AuthKey: "${cmd:echo oops >&2; exit 3}"},
+			"conflict": {AuthKey: "tskey-inline", AuthKeyFile: empty},
+		},
+	}
+	err := cfg.ExpandEnv()
+	if !errors.Is(err, ErrSecret) || !errors.Is(err, ErrAuthKeyConflict) {
+		t.Fatalf("ExpandEnv = %v, want ErrSecret and ErrAuthKeyConflict", err)
+	}
+	for _, want := range []string{`token "missing"`, `token "empty"`, `token "failing"`, "oops", `token "conflict"`} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not mention %s", err, want)
+		}
+	}
+}
+
+func TestAdminSocketPath(t *testing.T) {
+	tests := []struct {
+		socket string
+		want   string
+	}{
+		{"", "/var/lib/ts-proxy/admin.sock"},
+		{"/run/ts-proxy/admin.sock", "/run/ts-proxy/admin.sock"},
+		{AdminSocketOff, ""},
+	}
+	for _, tt := range tests {
+		cfg := Config{StateDir: "/var/lib/ts-proxy", AdminSocket: tt.socket}
+		if got := cfg.AdminSocketPath(); got != tt.want {
+			t.Errorf("AdminSocketPath(%q) = %q, want %q", tt.socket, got, tt.want)
+		}
+	}
+}
+
 func TestDisplayString(t *testing.T) {
 	cfg := validConfig()
 	s := cfg.DisplayString()
@@ -249,6 +1052,39 @@ func TestDisplayString(t *testing.T) {
 	}
 }
 
+// Static handlers are HTTP servers: they get the same :80/:443 listen
+// defaults, and DisplayString shows the served directory as the target.
+func TestStaticHandlerDefaults(t *testing.T) {
+	cfg := Config{
+		Servers: map[string]ServerConfig{
+			"docs": {
+				Handlers: []HandlerConfig{
+					{Type: "static", Root: "/srv/docs"},
+					{Type: "static", Root: "/srv/docs", Funnel: true},
+				},
+			},
+		},
+	}
+	cfg.SetDefaults()
+
+	hs := cfg.Servers["docs"].Handlers
+	if hs[0].Listen != ":80" {
+		t.Errorf("static handler listen = %q, want :80", hs[0].Listen)
+	}
+	if hs[1].Listen != ":443" {
+		t.Errorf("static funnel handler listen = %q, want :443", hs[1].Listen)
+	}
+	if hs[0].UpstreamNetwork != "" {
+		t.Errorf("static handler upstream_network = %q, want empty", hs[0].UpstreamNetwork)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	if s := cfg.DisplayString(); !strings.Contains(s, "STATIC") || !strings.Contains(s, "-> /srv/docs") {
+		t.Errorf("DisplayString = %q, want STATIC handler pointing at /srv/docs", s)
+	}
+}
+
 // Regression: TCP handler with no listen after defaults should fail validation
 func TestTCPHandlerNoListenDefault(t *testing.T) {
 	cfg := Config{
@@ -422,3 +1258,85 @@ func TestServerNames(t *testing.T) {
 		t.Errorf("expected sorted names, got %v", names)
 	}
 }
+
+// Routes inherit the handler's upstream_network and show up under their
+// handler in DisplayString.
+func TestRouteDefaultsAndDisplay(t *testing.T) {
+	cfg := Config{
+		Servers: map[string]ServerConfig{
+			"web": {
+				Handlers: []HandlerConfig{{
+					Type:            "http",
+					UpstreamNetwork: "unix",
+					Routes: []RouteConfig{
+						{Path: "/api", UpstreamAddress: "/run/api.sock", StripPrefix: true},
+						{Path: "/metrics", UpstreamAddress: "127.0.0.1:9100", UpstreamNetwork: "tcp"},
+					},
+				}},
+			},
+		},
+	}
+	cfg.SetDefaults()
+	routes := cfg.Servers["web"].Handlers[0].Routes
+	if routes[0].UpstreamNetwork != "unix" {
+		t.Errorf("route[0] upstream_network = %q, want inherited unix", routes[0].UpstreamNetwork)
+	}
+	if routes[1].UpstreamNetwork != "tcp" {
+		t.Errorf("route[1] upstream_network = %q, want explicit tcp", routes[1].UpstreamNetwork)
+	}
+
+	s := cfg.DisplayString()
+	for _, want := range []string{"(routes only)", "/api (strip) -> /run/api.sock", "/metrics -> 127.0.0.1:9100"} {
+		if !strings.Contains(s, want) {
+			t.Errorf("DisplayString missing %q: %q", want, s)
+		}
+	}
+}
+
+func TestUpstreamAddressesDefaultsAndDisplay(t *testing.T) {
+	t.Setenv("TEST_TS_REPLICA", "10.0.0.2:8080")
+	cfg := Config{
+		Servers: map[string]ServerConfig{
+			"web": {
+				Handlers: []HandlerConfig{{
+					Type:              "tcp",
+					Listen:            ":22",
+					UpstreamAddresses: []string{"10.0.0.1:8080", "${TEST_TS_REPLICA}"},
+				}},
+			},
+		},
+	}
+	cfg.SetDefaults()
+	if err := cfg.ExpandEnv(); err != nil {
+		t.Fatalf("ExpandEnv: %v", err)
+	}
+	h := cfg.Servers["web"].Handlers[0]
+	if h.LoadBalancing != "round_robin" {
+		t.Errorf("load_balancing = %q, want round_robin default", h.LoadBalancing)
+	}
+	if h.UpstreamAddresses[1] != "10.0.0.2:8080" {
+		t.Errorf("upstream_addresses[1] = %q, want expanded env value", h.UpstreamAddresses[1])
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	if s := cfg.DisplayString(); !strings.Contains(s, "-> 10.0.0.1:8080, 10.0.0.2:8080") {
+		t.Errorf("DisplayString = %q, want both backends", s)
+	}
+}
+
+func TestDisplayStringFunnelPaths(t *testing.T) {
+	cfg := Config{
+		Servers: map[string]ServerConfig{
+			"web": {
+				Handlers: []HandlerConfig{
+					{Type: "http", UpstreamAddress: "localhost:8080", Funnel: true, FunnelPaths: []string{"/hooks", "/"}},
+				},
+			},
+		},
+	}
+	cfg.SetDefaults()
+	if s := cfg.DisplayString(); !strings.Contains(s, "    public: /hooks, /\n") {
+		t.Errorf("DisplayString = %q, want funnel paths listed", s)
+	}
+}
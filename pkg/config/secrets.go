@@ -0,0 +1,92 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/lucasew/ts-proxy/pkg/tsproxy"
+)
+
+// Prefixes of secret references inside ${...}: ${file:/path} reads a file
+// and ${cmd:command} runs a command with /bin/sh -c.
+const (
+	refFile = "file:"
+	refCmd  = "cmd:"
+)
+
+// SecretCommandTimeout bounds a ${cmd:...} reference.
+const SecretCommandTimeout = 30 * time.Second
+
+// resolvedRef is the outcome of resolving one reference, kept so a
+// reference used in several fields is resolved only once.
+type resolvedRef struct {
+	value string
+	err   error
+}
+
+// isRef reports whether key is a ${file:...} or ${cmd:...} reference
+// rather than a variable name.
+func isRef(key string) bool {
+	return strings.HasPrefix(key, refFile) || strings.HasPrefix(key, refCmd)
+}
+
+// resolveRef resolves a reference for which isRef is true.
+func resolveRef(key string) (string, error) {
+	if path, found := strings.CutPrefix(key, refFile); found {
+		return readSecretFile(path)
+	}
+	return runSecretCommand(strings.TrimPrefix(key, refCmd))
+}
+
+// readSecretFile returns the trimmed contents of path, warning when other
+// users can read it.
+func readSecretFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrSecret, err)
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			tsproxy.ReportError(err, "context", "secret file close", "path", path)
+		}
+	}()
+	fi, err := f.Stat()
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrSecret, err)
+	}
+	if fi.Mode().Perm()&0o004 != 0 {
+		slog.Warn("secret file is world-readable", "path", path, "mode", fi.Mode().Perm().String())
+	}
+	var b bytes.Buffer
+	if _, err := b.ReadFrom(f); err != nil {
+		return "", fmt.Errorf("%w: read %s: %w", ErrSecret, path, err)
+	}
+	value := strings.TrimSpace(b.String())
+	if value == "" {
+		return "", fmt.Errorf("%w: %s is empty", ErrSecret, path)
+	}
+	return value, nil
+}
+
+// runSecretCommand returns the trimmed standard output of command.
+func runSecretCommand(command string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), SecretCommandTimeout)
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%w: command %q: %w: %s", ErrSecret, command, err, strings.TrimSpace(stderr.String()))
+	}
+	value := strings.TrimSpace(stdout.String())
+	if value == "" {
+		return "", fmt.Errorf("%w: command %q printed nothing", ErrSecret, command)
+	}
+	return value, nil
+}
@@ -0,0 +1,384 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lucasew/ts-proxy/internal/ctxwait"
+	"github.com/lucasew/ts-proxy/pkg/tsproxy"
+)
+
+// Load balancing strategies accepted by NewBalancer.
+const (
+	StrategyRoundRobin       = "round_robin"
+	StrategyLeastConnections = "least_connections"
+	StrategyRandom           = "random"
+)
+
+// Health check defaults, applied by NewBalancer to zero HealthCheck fields.
+const (
+	DefaultHealthCheckInterval           = 10 * time.Second
+	DefaultHealthCheckTimeout            = 2 * time.Second
+	DefaultHealthCheckUnhealthyThreshold = 3
+	DefaultHealthCheckHealthyThreshold   = 2
+)
+
+// ErrNoHealthyUpstream is returned when every backend has been ejected by
+// health checks (or every dial attempt failed).
+var ErrNoHealthyUpstream = errors.New("no healthy upstream")
+
+// ErrUnknownUpstream is returned when an HTTP transport asks to dial a host
+// that is not one of the balancer's backend keys.
+var ErrUnknownUpstream = errors.New("unknown upstream")
+
+// HealthCheck configures active probing of balancer backends.
+type HealthCheck struct {
+	// Interval between probe rounds.
+	Interval time.Duration
+	// Timeout for a single probe.
+	Timeout time.Duration
+	// Path, when set, probes with HTTP GET and requires a 2xx/3xx answer.
+	// Otherwise a probe is a plain connect.
+	Path string
+	// UnhealthyThreshold consecutive failures eject a backend.
+	UnhealthyThreshold int
+	// HealthyThreshold consecutive successes reinstate it.
+	HealthyThreshold int
+}
+
+// BalancerOptions configures a Balancer.
+type BalancerOptions struct {
+	Network   string
+	Addresses []string
+	Strategy  string
+	// HealthCheck enables active probing; nil means every backend is
+	// always considered healthy.
+	HealthCheck *HealthCheck
+}
+
+// Balancer spreads connections or requests over a set of upstream
+// addresses, skipping backends that active health checks have ejected.
+type Balancer struct {
+	network  string
+	strategy string
+	health   *HealthCheck
+	backends []*backend
+	byKey    map[string]*backend
+	next     atomic.Uint64
+}
+
+type backend struct {
+	address string
+	// key is a synthetic host used as the HTTP URL host so the shared
+	// http.Transport pools connections per backend; dial maps it back.
+	key     string
+	active  atomic.Int64
+	healthy atomic.Bool
+
+	// Consecutive probe results; only touched by the health check loop.
+	fails     int
+	successes int
+}
+
+// NewBalancer creates a balancer over opts.Addresses. An empty strategy
+// means round robin.
+func NewBalancer(opts BalancerOptions) *Balancer {
+	if opts.Network == "" {
+		opts.Network = "tcp"
+	}
+	if opts.Strategy == "" {
+		opts.Strategy = StrategyRoundRobin
+	}
+	if hc := opts.HealthCheck; hc != nil {
+		c := *hc
+		if c.Interval <= 0 {
+			c.Interval = DefaultHealthCheckInterval
+		}
+		if c.Timeout <= 0 {
+			c.Timeout = DefaultHealthCheckTimeout
+		}
+		if c.UnhealthyThreshold <= 0 {
+			c.UnhealthyThreshold = DefaultHealthCheckUnhealthyThreshold
+		}
+		if c.HealthyThreshold <= 0 {
+			c.HealthyThreshold = DefaultHealthCheckHealthyThreshold
+		}
+		opts.HealthCheck = &c
+	}
+	lb := &Balancer{
+		network:  opts.Network,
+		strategy: opts.Strategy,
+		health:   opts.HealthCheck,
+		byKey:    make(map[string]*backend, len(opts.Addresses)),
+	}
+	for i, addr := range opts.Addresses {
+		b := &backend{address: addr, key: fmt.Sprintf("upstream-%d", i)}
+		b.healthy.Store(true)
+		lb.backends = append(lb.backends, b)
+		lb.byKey[b.key] = b
+	}
+	return lb
+}
+
+// singleUpstream is the balancer for handlers with one fixed address.
+func singleUpstream(network, address string) *Balancer {
+	return NewBalancer(BalancerOptions{Network: network, Addresses: []string{address}})
+}
+
+// Addresses returns the configured backend addresses.
+func (lb *Balancer) Addresses() []string {
+	out := make([]string, len(lb.backends))
+	for i, b := range lb.backends {
+		out[i] = b.address
+	}
+	return out
+}
+
+// String returns the backend addresses joined by commas, for logs.
+func (lb *Balancer) String() string {
+	return strings.Join(lb.Addresses(), ",")
+}
+
+// Healthy reports whether address is currently in rotation.
+func (lb *Balancer) Healthy(address string) bool {
+	for _, b := range lb.backends {
+		if b.address == address {
+			return b.healthy.Load()
+		}
+	}
+	return false
+}
+
+// pick selects a healthy backend according to the strategy, skipping any in
+// exclude (backends that already failed to dial for this attempt).
+func (lb *Balancer) pick(exclude map[*backend]bool) (*backend, error) {
+	candidates := make([]*backend, 0, len(lb.backends))
+	for _, b := range lb.backends {
+		if b.healthy.Load() && !exclude[b] {
+			candidates = append(candidates, b)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, ErrNoHealthyUpstream
+	}
+	switch lb.strategy {
+	case StrategyLeastConnections:
+		// Ties rotate so equal backends share load instead of the first
+		// one taking everything while idle.
+		start := int(lb.next.Add(1) % uint64(len(candidates)))
+		best := candidates[start]
+		for i := 1; i < len(candidates); i++ {
+			b := candidates[(start+i)%len(candidates)]
+			if b.active.Load() < best.active.Load() {
+				best = b
+			}
+		}
+		return best, nil
+	case StrategyRandom:
+		return candidates[rand.IntN(len(candidates))], nil
+	default:
+		return candidates[int((lb.next.Add(1)-1)%uint64(len(candidates)))], nil
+	}
+}
+
+// acquire marks one more connection/request on b; the returned func undoes it.
+func (b *backend) acquire() func() {
+	b.active.Add(1)
+	var once sync.Once
+	return func() { once.Do(func() { b.active.Add(-1) }) }
+}
+
+// DialContext connects to a backend chosen by the strategy, trying the next
+// one when a dial fails. The returned conn counts towards its backend's
+// active connections until closed.
+func (lb *Balancer) DialContext(ctx context.Context, timeout time.Duration) (net.Conn, error) {
+	tried := make(map[*backend]bool)
+	var errs []error
+	for {
+		b, err := lb.pick(tried)
+		if err != nil {
+			if len(errs) > 0 {
+				return nil, errors.Join(errs...)
+			}
+			return nil, err
+		}
+		tried[b] = true
+		d := net.Dialer{Timeout: timeout}
+		conn, err := d.DialContext(ctx, lb.network, b.address)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			errs = append(errs, fmt.Errorf("%s: %w", b.address, err))
+			continue
+		}
+		return newBalancedConn(conn, b.acquire()), nil
+	}
+}
+
+// dialKey dials the backend behind an HTTP URL host produced by key.
+func (lb *Balancer) dialKey(ctx context.Context, hostport string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = hostport
+	}
+	b, ok := lb.byKey[host]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownUpstream, hostport)
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, lb.network, b.address)
+	if err != nil {
+		return nil, fmt.Errorf("%w %s: %w", errUpstreamDial, b.address, err)
+	}
+	return conn, nil
+}
+
+// errUpstreamDial marks dialKey failures, after which HTTPHandler tries the
+// next backend: nothing has reached the upstream yet.
+var errUpstreamDial = errors.New("dial upstream")
+
+// balancedConn releases its backend's active slot on the first Close.
+type balancedConn struct {
+	net.Conn
+	release func()
+}
+
+// newBalancedConn wraps conn, keeping CloseWrite only when conn has it so
+// closeWrite's full-close fallback is never hidden behind the wrapper.
+func newBalancedConn(conn net.Conn, release func()) net.Conn {
+	bc := &balancedConn{Conn: conn, release: release}
+	if cw, ok := conn.(closeWriter); ok {
+		return &halfClosingConn{balancedConn: bc, cw: cw}
+	}
+	return bc
+}
+
+func (c *balancedConn) Close() error {
+	c.release()
+	return c.Conn.Close()
+}
+
+// halfClosingConn is a balancedConn over a conn that supports half-close,
+// so TCPHandler keeps its half-close semantics through the balancer.
+type halfClosingConn struct {
+	*balancedConn
+	cw closeWriter
+}
+
+func (c *halfClosingConn) CloseWrite() error {
+	return c.cw.CloseWrite()
+}
+
+// RunHealthChecks probes every backend each interval until ctx is
+// cancelled. It returns immediately when health checks are disabled.
+func (lb *Balancer) RunHealthChecks(ctx context.Context) {
+	if lb.health == nil {
+		return
+	}
+	for {
+		lb.checkAll(ctx)
+		if !ctxwait.Delay(ctx, lb.health.Interval) {
+			return
+		}
+	}
+}
+
+func (lb *Balancer) checkAll(ctx context.Context) {
+	var wg sync.WaitGroup
+	results := make([]error, len(lb.backends))
+	for i, b := range lb.backends {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = lb.probe(ctx, b)
+		}()
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return
+	}
+	for i, b := range lb.backends {
+		lb.record(b, results[i])
+	}
+}
+
+// record applies one probe result and flips the backend's state once a
+// threshold of consecutive results is reached.
+func (lb *Balancer) record(b *backend, err error) {
+	if err != nil {
+		b.successes = 0
+		b.fails++
+		if b.healthy.Load() && b.fails >= lb.health.UnhealthyThreshold {
+			b.healthy.Store(false)
+			slog.Warn("upstream unhealthy", "upstream", b.address, "err", err)
+		}
+		return
+	}
+	b.fails = 0
+	b.successes++
+	if !b.healthy.Load() && b.successes >= lb.health.HealthyThreshold {
+		b.healthy.Store(true)
+		slog.Info("upstream healthy", "upstream", b.address)
+	}
+}
+
+// ErrHealthCheckStatus is returned for HTTP probes answered outside 2xx/3xx.
+var ErrHealthCheckStatus = errors.New("unhealthy status")
+
+func (lb *Balancer) probe(ctx context.Context, b *backend) error {
+	ctx, cancel := context.WithTimeout(ctx, lb.health.Timeout)
+	defer cancel()
+
+	var d net.Dialer
+	if lb.health.Path == "" {
+		conn, err := d.DialContext(ctx, lb.network, b.address)
+		if err != nil {
+			return err
+		}
+		if err := conn.Close(); err != nil {
+			tsproxy.ReportError(err, "context", "health check close", "upstream", b.address)
+		}
+		return nil
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return d.DialContext(ctx, lb.network, b.address)
+			},
+			DisableKeepAlives: true,
+		},
+		// A redirect is an answer; following it could probe another host.
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+b.key+lb.health.Path, nil)
+	if err != nil {
+		return err
+	}
+	// Present the real address as Host so name-based upstreams answer the
+	// probe like they answer proxied traffic (unix sockets keep the key).
+	if lb.network != "unix" {
+		req.Host = b.address
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	if err := resp.Body.Close(); err != nil {
+		tsproxy.ReportError(err, "context", "health check body close", "upstream", b.address)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return fmt.Errorf("%w: %d", ErrHealthCheckStatus, resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,304 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lucasew/ts-proxy/pkg/metrics"
+)
+
+// pickN returns the addresses of n consecutive picks.
+func pickN(t *testing.T, lb *Balancer, n int) []string {
+	t.Helper()
+	out := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		b, err := lb.pick(nil)
+		if err != nil {
+			t.Fatalf("pick %d: %v", i, err)
+		}
+		out = append(out, b.address)
+	}
+	return out
+}
+
+func TestBalancerRoundRobin(t *testing.T) {
+	lb := NewBalancer(BalancerOptions{Addresses: []string{"a:1", "b:1", "c:1"}})
+	got := pickN(t, lb, 6)
+	want := []string{"a:1", "b:1", "c:1", "a:1", "b:1", "c:1"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("picks = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestBalancerLeastConnections(t *testing.T) {
+	lb := NewBalancer(BalancerOptions{
+		Addresses: []string{"a:1", "b:1"},
+		Strategy:  StrategyLeastConnections,
+	})
+	busy := lb.backends[0]
+	release := busy.acquire()
+	for _, addr := range pickN(t, lb, 4) {
+		if addr != "b:1" {
+			t.Fatalf("picked %s while a:1 has an active connection, want b:1", addr)
+		}
+	}
+	release()
+	release() // idempotent
+	if n := busy.active.Load(); n != 0 {
+		t.Fatalf("active after double release = %d, want 0", n)
+	}
+}
+
+func TestBalancerRandomStaysInSet(t *testing.T) {
+	lb := NewBalancer(BalancerOptions{
+		Addresses: []string{"a:1", "b:1"},
+		Strategy:  StrategyRandom,
+	})
+	for _, addr := range pickN(t, lb, 50) {
+		if addr != "a:1" && addr != "b:1" {
+			t.Fatalf("random picked unknown backend %q", addr)
+		}
+	}
+}
+
+func TestBalancerSkipsUnhealthy(t *testing.T) {
+	lb := NewBalancer(BalancerOptions{Addresses: []string{"a:1", "b:1"}})
+	lb.backends[0].healthy.Store(false)
+	for _, addr := range pickN(t, lb, 4) {
+		if addr != "b:1" {
+			t.Fatalf("picked ejected backend %s", addr)
+		}
+	}
+	lb.backends[1].healthy.Store(false)
+	if _, err := lb.pick(nil); !errors.Is(err, ErrNoHealthyUpstream) {
+		t.Fatalf("pick with all ejected = %v, want ErrNoHealthyUpstream", err)
+	}
+}
+
+// DialContext moves on to the next backend when one refuses, so a dead
+// replica costs one failed dial, not a failed client connection.
+func TestBalancerDialFailsOver(t *testing.T) {
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	deadAddr := dead.Addr().String()
+	_ = dead.Close()
+
+	live, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer live.Close()
+
+	lb := NewBalancer(BalancerOptions{Addresses: []string{deadAddr, live.Addr().String()}})
+	conn, err := lb.DialContext(t.Context(), time.Second)
+	if err != nil {
+		t.Fatalf("DialContext: %v", err)
+	}
+	if n := lb.backends[1].active.Load(); n != 1 {
+		t.Errorf("live backend active = %d, want 1 while conn is open", n)
+	}
+	if err := conn.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if n := lb.backends[1].active.Load(); n != 0 {
+		t.Errorf("live backend active = %d after close, want 0", n)
+	}
+}
+
+func TestBalancedConnHalfClose(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	lb := NewBalancer(BalancerOptions{Addresses: []string{ln.Addr().String()}})
+	conn, err := lb.DialContext(t.Context(), time.Second)
+	if err != nil {
+		t.Fatalf("DialContext: %v", err)
+	}
+	defer conn.Close()
+	if _, ok := conn.(closeWriter); !ok {
+		t.Error("balanced TCP conn does not support CloseWrite")
+	}
+
+	// Without CloseWrite underneath, the wrapper must not offer one that
+	// closes the whole conn.
+	a, b := net.Pipe()
+	defer b.Close()
+	pipe := newBalancedConn(a, func() {})
+	defer pipe.Close()
+	if _, ok := pipe.(closeWriter); ok {
+		t.Error("balanced pipe offers CloseWrite")
+	}
+}
+
+func TestBalancerHealthCheckEjectsAndReinstates(t *testing.T) {
+	var healthy atomic.Bool
+	healthy.Store(true)
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer up.Close()
+	addr := up.Listener.Addr().String()
+
+	lb := NewBalancer(BalancerOptions{
+		Addresses: []string{addr},
+		HealthCheck: &HealthCheck{
+			Interval:           10 * time.Millisecond,
+			Path:               "/healthz",
+			UnhealthyThreshold: 2,
+			HealthyThreshold:   2,
+		},
+	})
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	go lb.RunHealthChecks(ctx)
+
+	waitHealthy := func(want bool) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for lb.Healthy(addr) != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("Healthy(%s) = %v, want %v", addr, !want, want)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	healthy.Store(false)
+	waitHealthy(false)
+	healthy.Store(true)
+	waitHealthy(true)
+}
+
+func TestBalancerRecordThresholds(t *testing.T) {
+	lb := NewBalancer(BalancerOptions{
+		Addresses:   []string{"a:1"},
+		HealthCheck: &HealthCheck{UnhealthyThreshold: 2, HealthyThreshold: 3},
+	})
+	b := lb.backends[0]
+	errProbe := errors.New("probe failed")
+
+	lb.record(b, errProbe)
+	if !b.healthy.Load() {
+		t.Fatal("ejected after 1 failure, want threshold 2")
+	}
+	lb.record(b, errProbe)
+	if b.healthy.Load() {
+		t.Fatal("still healthy after 2 failures")
+	}
+	lb.record(b, nil)
+	lb.record(b, nil)
+	if b.healthy.Load() {
+		t.Fatal("reinstated after 2 successes, want threshold 3")
+	}
+	lb.record(b, nil)
+	if !b.healthy.Load() {
+		t.Fatal("not reinstated after 3 successes")
+	}
+}
+
+func TestServeHTTPBalancesRequests(t *testing.T) {
+	addrA, gotA, cleanupA := startUpstream(t)
+	defer cleanupA()
+	addrB, gotB, cleanupB := startUpstream(t)
+	defer cleanupB()
+
+	h := NewHTTP(HTTPOptions{
+		Hostname: "app.example.ts.net",
+		Upstream: NewBalancer(BalancerOptions{Addresses: []string{addrA, addrB}}),
+	})
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Host = "app.example.ts.net"
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusNoContent {
+			t.Fatalf("request %d status = %d, want %d", i, rec.Code, http.StatusNoContent)
+		}
+	}
+	up := recvUpstream(t, gotA)
+	if up.Host != "app.example.ts.net" {
+		t.Errorf("upstream Host = %q, want request host, not backend key", up.Host)
+	}
+	recvUpstream(t, gotB)
+}
+
+func TestServeHTTPFailsOverDeadBackend(t *testing.T) {
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	deadAddr := dead.Addr().String()
+	_ = dead.Close()
+
+	var served atomic.Int32
+	live := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if string(body) != "payload" {
+			t.Errorf("upstream body = %q, want the client's body after a failed dial", body)
+		}
+		served.Add(1)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer live.Close()
+
+	h := NewHTTP(HTTPOptions{
+		Hostname: "app.example.ts.net",
+		Upstream: NewBalancer(BalancerOptions{Addresses: []string{deadAddr, live.Listener.Addr().String()}}),
+		Metrics:  metrics.ForHandler("http_failover_test", ":443"),
+	})
+	// Round robin sends one of the two requests to the dead backend first.
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("payload"))
+		req.Host = "app.example.ts.net"
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusNoContent {
+			t.Fatalf("request %d status = %d, want %d", i, rec.Code, http.StatusNoContent)
+		}
+	}
+	if n := served.Load(); n != 2 {
+		t.Errorf("live backend served %d requests, want 2", n)
+	}
+
+	rec := httptest.NewRecorder()
+	NewMetrics().mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, metrics.Path, nil))
+	// Each failed dial counts, however many the round robin made.
+	series := `ts_proxy_tcp_dial_failures_total{handler=":443",server="http_failover_test"} `
+	if body := rec.Body.String(); !strings.Contains(body, series) || strings.Contains(body, series+"0\n") {
+		t.Errorf("metrics do not count the failed dials in %q", series)
+	}
+}
+
+func TestServeHTTPNoHealthyUpstreamIs503(t *testing.T) {
+	lb := NewBalancer(BalancerOptions{Addresses: []string{"127.0.0.1:9"}})
+	lb.backends[0].healthy.Store(false)
+	h := NewHTTP(HTTPOptions{Hostname: "app.example.ts.net", Upstream: lb})
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want 503 when every backend is ejected", rec.Code)
+	}
+}
@@ -0,0 +1,125 @@
+package handler
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/lucasew/ts-proxy/pkg/tsproxy"
+)
+
+// DefaultForwardAuthTimeout bounds a forward-auth subrequest when
+// ForwardAuth.Timeout is zero.
+const DefaultForwardAuthTimeout = 10 * time.Second
+
+// Headers describing the original request to the auth endpoint, as Traefik
+// ForwardAuth sends them.
+const (
+	HeaderXForwardedMethod = "X-Forwarded-Method"
+	HeaderXForwardedURI    = "X-Forwarded-Uri"
+)
+
+// maxForwardAuthBody caps how much of a denial body is relayed to the client.
+const maxForwardAuthBody = 1 << 20
+
+// ErrForwardAuthUnavailable answers requests when the auth endpoint cannot
+// be reached; they fail closed with 502. Denials are not errors.
+var ErrForwardAuthUnavailable = errors.New("forward auth unavailable")
+
+// ForwardAuth asks an external endpoint whether to proxy each request.
+type ForwardAuth struct {
+	// Address is the auth endpoint URL.
+	Address string
+	// ResponseHeaders are copied from a 2xx auth response onto the
+	// proxied request. Client-supplied copies are always removed.
+	ResponseHeaders []string
+	// Timeout bounds the subrequest; DefaultForwardAuthTimeout when zero.
+	Timeout time.Duration
+
+	client *http.Client
+}
+
+// hopHeaders are connection-specific and never copied between the client,
+// the auth endpoint and the upstream.
+var hopHeaders = []string{
+	"Connection", "Proxy-Connection", "Keep-Alive", "Proxy-Authenticate",
+	"Proxy-Authorization", "Te", "Trailer", "Transfer-Encoding", "Upgrade",
+	"Content-Length",
+}
+
+func (fa *ForwardAuth) init() {
+	if fa.Timeout <= 0 {
+		fa.Timeout = DefaultForwardAuthTimeout
+	}
+	fa.client = &http.Client{
+		Timeout: fa.Timeout,
+		// A redirect is the endpoint's answer (usually "go log in") and
+		// goes back to the client, not followed here.
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+}
+
+// check sends the auth subrequest for r, whose headers have already been
+// sanitized and enriched with identity. It returns true when r may be
+// proxied; otherwise the auth endpoint's answer has been written to w.
+func (fa *ForwardAuth) check(w http.ResponseWriter, r *http.Request, tls bool) bool {
+	deleteHeaderVariants(r.Header, fa.ResponseHeaders...)
+
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, fa.Address, nil)
+	if err != nil {
+		tsproxy.ReportError(err, "context", "forward auth request", "address", fa.Address)
+		http.Error(w, ErrForwardAuthUnavailable.Error(), http.StatusBadGateway)
+		return false
+	}
+	req.Header = r.Header.Clone()
+	for _, h := range hopHeaders {
+		req.Header.Del(h)
+	}
+	req.Header.Set(HeaderXForwardedMethod, r.Method)
+	req.Header.Set(HeaderXForwardedURI, r.URL.RequestURI())
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		req.Header.Set(HeaderXForwardedFor, host)
+	}
+	if tls {
+		req.Header.Set(HeaderXForwardedProto, SchemeHTTPS)
+	} else {
+		req.Header.Set(HeaderXForwardedProto, SchemeHTTP)
+	}
+
+	resp, err := fa.client.Do(req)
+	if err != nil {
+		tsproxy.ReportError(err, "context", "forward auth request", "address", fa.Address)
+		http.Error(w, ErrForwardAuthUnavailable.Error(), http.StatusBadGateway)
+		return false
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			tsproxy.ReportError(err, "context", "forward auth body close")
+		}
+	}()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		for _, name := range fa.ResponseHeaders {
+			if v := resp.Header.Values(name); len(v) > 0 {
+				r.Header[http.CanonicalHeaderKey(name)] = v
+			}
+		}
+		return true
+	}
+
+	// Denied: relay the endpoint's answer (status, Location, cookies,
+	// body) so login redirects and error pages reach the client.
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	for _, h := range hopHeaders {
+		w.Header().Del(h)
+	}
+	w.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(w, io.LimitReader(resp.Body, maxForwardAuthBody)); err != nil {
+		tsproxy.ReportError(err, "context", "forward auth relay")
+	}
+	return false
+}
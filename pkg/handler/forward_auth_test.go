@@ -0,0 +1,118 @@
+package handler
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+// newForwardAuthHandler proxies to upstream after asking auth, with alice as
+// the identified peer.
+func newForwardAuthHandler(upstream, auth string) *HTTPHandler {
+	return NewHTTP(HTTPOptions{
+		Hostname:        "app.example.ts.net",
+		UpstreamAddress: upstream,
+		ForwardAuth: &ForwardAuth{
+			Address:         auth,
+			ResponseHeaders: []string{"X-Auth-Role"},
+		},
+		WhoIs: func(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+			return &apitype.WhoIsResponse{UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com"}}, nil
+		},
+	})
+}
+
+func TestForwardAuthAllows(t *testing.T) {
+	addr, got, cleanup := startUpstream(t)
+	defer cleanup()
+	authReqs := make(chan *http.Request, 1)
+	auth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authReqs <- r.Clone(context.Background())
+		w.Header().Set("X-Auth-Role", "admin")
+		w.Header().Set("X-Not-Copied", "1")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer auth.Close()
+
+	h := newForwardAuthHandler(addr, auth.URL+"/verify")
+	req := httptest.NewRequest(http.MethodPost, "/api/items?id=1", nil)
+	req.Host = "app.example.ts.net"
+	req.Header.Set("X-Auth-Role", "spoofed")
+	req.Header.Set("Cookie", "session=abc")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusNoContent)
+	}
+
+	ar := <-authReqs
+	if ar.Method != http.MethodGet || ar.URL.Path != "/verify" {
+		t.Errorf("auth subrequest = %s %s, want GET /verify", ar.Method, ar.URL.Path)
+	}
+	for k, want := range map[string]string{
+		HeaderXForwardedMethod:   http.MethodPost,
+		HeaderXForwardedURI:      "/api/items?id=1",
+		HeaderXForwardedHost:     "app.example.ts.net",
+		HeaderXForwardedProto:    SchemeHTTP,
+		TailscaleUserLoginHeader: "alice@example.com",
+		"Cookie":                 "session=abc",
+	} {
+		if v := ar.Header.Get(k); v != want {
+			t.Errorf("auth subrequest %s = %q, want %q", k, v, want)
+		}
+	}
+	if v := ar.Header.Get("X-Auth-Role"); v != "" {
+		t.Errorf("client-supplied X-Auth-Role reached the auth endpoint: %q", v)
+	}
+
+	up := recvUpstream(t, got)
+	if v := up.Header.Values("X-Auth-Role"); len(v) != 1 || v[0] != "admin" {
+		t.Errorf("upstream X-Auth-Role = %q, want [admin]", v)
+	}
+	if v := up.Header.Get("X-Not-Copied"); v != "" {
+		t.Errorf("unlisted auth response header copied: %q", v)
+	}
+}
+
+func TestForwardAuthDenialIsRelayed(t *testing.T) {
+	auth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "https://login.example.com/?rd=app", http.StatusFound)
+	}))
+	defer auth.Close()
+
+	// The upstream must never be contacted: point it at a closed port.
+	h := newForwardAuthHandler("127.0.0.1:9", auth.URL)
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Host = "app.example.ts.net"
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusFound {
+		t.Fatalf("status = %d, want the auth endpoint's 302", rec.Code)
+	}
+	if loc := rec.Header().Get("Location"); loc != "https://login.example.com/?rd=app" {
+		t.Errorf("Location = %q, want the login redirect", loc)
+	}
+}
+
+func TestForwardAuthUnreachableFailsClosed(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	dead := "http://" + ln.Addr().String()
+	_ = ln.Close()
+
+	h := newForwardAuthHandler("127.0.0.1:9", dead)
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Host = "app.example.ts.net"
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("status = %d, want 502 when the auth endpoint is down", rec.Code)
+	}
+}
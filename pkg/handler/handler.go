@@ -12,5 +12,16 @@ type Handler interface {
 	Serve(ctx context.Context, ln net.Listener) error
 }
 
+// PacketHandler serves datagrams on a net.PacketConn.
+type PacketHandler interface {
+	ServePacket(ctx context.Context, pc net.PacketConn) error
+}
+
+// ConnCounter is implemented by handlers that can report their live
+// connections: TCP sessions, HTTP client connections or UDP peer sessions.
+type ConnCounter interface {
+	ActiveConnections() int
+}
+
 // WhoIsFunc resolves a remote address to Tailscale user information.
 type WhoIsFunc func(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error)
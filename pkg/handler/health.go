@@ -0,0 +1,62 @@
+package handler
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+// Paths of the health endpoints.
+const (
+	HealthzPath = "/healthz"
+	ReadyzPath  = "/readyz"
+)
+
+// HealthChecker reports process health: Live fails when the process should
+// be restarted, Ready when it should not receive traffic yet.
+type HealthChecker interface {
+	Live() error
+	Ready() error
+}
+
+// HealthHandler serves HealthzPath and ReadyzPath for orchestrator probes.
+// A passing check answers 200 "ok"; a failing one 503 with the reason.
+type HealthHandler struct {
+	mux   *http.ServeMux
+	conns atomic.Int64
+}
+
+// NewHealth creates a health handler backed by c.
+func NewHealth(c HealthChecker) *HealthHandler {
+	h := &HealthHandler{mux: http.NewServeMux()}
+	mountHealth(h.mux, c)
+	return h
+}
+
+func (h *HealthHandler) Serve(ctx context.Context, ln net.Listener) error {
+	return serveHTTP(ctx, ln, h.mux, &h.conns)
+}
+
+// ActiveConnections returns the number of open client connections.
+func (h *HealthHandler) ActiveConnections() int {
+	return int(h.conns.Load())
+}
+
+func mountHealth(mux *http.ServeMux, c HealthChecker) {
+	mux.Handle("GET "+HealthzPath, healthProbe(c.Live))
+	mux.Handle("GET "+ReadyzPath, healthProbe(c.Ready))
+}
+
+func healthProbe(check func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		if err := check(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = io.WriteString(w, "ok\n")
+	}
+}
@@ -0,0 +1,86 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lucasew/ts-proxy/pkg/access"
+	"github.com/lucasew/ts-proxy/pkg/metrics"
+	"tailscale.com/client/local"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+type fakeHealth struct{ live, ready error }
+
+func (f fakeHealth) Live() error  { return f.live }
+func (f fakeHealth) Ready() error { return f.ready }
+
+func TestHealthEndpoints(t *testing.T) {
+	h := NewHealth(fakeHealth{ready: errors.New("server web: not ready: authenticating")})
+	for _, tc := range []struct {
+		path     string
+		wantCode int
+		wantBody string
+	}{
+		{HealthzPath, http.StatusOK, "ok"},
+		{ReadyzPath, http.StatusServiceUnavailable, "server web: not ready: authenticating"},
+	} {
+		rec := httptest.NewRecorder()
+		h.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.path, nil))
+		if rec.Code != tc.wantCode || strings.TrimSpace(rec.Body.String()) != tc.wantBody {
+			t.Errorf("GET %s = %d %q, want %d %q", tc.path, rec.Code, rec.Body.String(), tc.wantCode, tc.wantBody)
+		}
+	}
+}
+
+// With access rules, only allowed peers may scrape the per-user series.
+func TestMetricsRestrict(t *testing.T) {
+	policy, err := access.NewPolicy([]string{"tag:prometheus"}, nil, "")
+	if err != nil {
+		t.Fatalf("NewPolicy: %v", err)
+	}
+	h := NewMetrics().Restrict(func(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+		switch remoteAddr {
+		case "100.64.0.1:1":
+			return &apitype.WhoIsResponse{
+				UserProfile: &tailcfg.UserProfile{LoginName: access.TaggedDevicesLogin},
+				Node:        &tailcfg.Node{Tags: []string{"tag:prometheus"}},
+			}, nil
+		case "100.64.0.2:1":
+			return &apitype.WhoIsResponse{UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com"}}, nil
+		}
+		return nil, local.ErrPeerNotFound
+	}, policy)
+	for _, tc := range []struct {
+		remote string
+		want   int
+	}{
+		{"100.64.0.1:1", http.StatusOK},
+		{"100.64.0.2:1", http.StatusForbidden},
+		{"203.0.113.9:1", http.StatusForbidden},
+	} {
+		req := httptest.NewRequest(http.MethodGet, metrics.Path, nil)
+		req.RemoteAddr = tc.remote
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tc.want {
+			t.Errorf("scrape from %s = %d, want %d", tc.remote, rec.Code, tc.want)
+		}
+	}
+}
+
+func TestMetricsWithHealth(t *testing.T) {
+	h := NewMetrics().WithHealth(fakeHealth{})
+	for _, path := range []string{HealthzPath, ReadyzPath} {
+		rec := httptest.NewRecorder()
+		h.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("GET %s = %d, want 200", path, rec.Code)
+		}
+	}
+}
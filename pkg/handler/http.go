@@ -2,18 +2,32 @@ package handler
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"io"
 	"log/slog"
+	"mime"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"path"
+	"slices"
+	"sort"
 	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/lucasew/ts-proxy/pkg/access"
+	"github.com/lucasew/ts-proxy/pkg/accesslog"
+	"github.com/lucasew/ts-proxy/pkg/identity"
+	"github.com/lucasew/ts-proxy/pkg/jwt"
+	"github.com/lucasew/ts-proxy/pkg/metrics"
+	"github.com/lucasew/ts-proxy/pkg/tracing"
 	"github.com/lucasew/ts-proxy/pkg/tsproxy"
 	"tailscale.com/client/local"
 	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
 )
 
 const (
@@ -22,14 +36,19 @@ const (
 	TailscaleUserProfilePicHeader = "Tailscale-User-Profile-Pic"
 	TailscaleHeadersInfoHeader    = "Tailscale-Headers-Info"
 
-	// taggedDevicesLogin is the LoginName WhoIs returns for tagged nodes.
-	// Official Tailscale serve omits identity headers for tagged devices.
-	taggedDevicesLogin = "tagged-devices"
+	// TailscaleAppCapabilitiesHeader carries the peer's values for the
+	// handler's app capability as JSON, like `tailscale serve
+	// --accept-app-caps`: {"example.com/cap/app":[{...}]}.
+	TailscaleAppCapabilitiesHeader = "Tailscale-App-Capabilities"
 
 	HeaderXForwardedProto = "X-Forwarded-Proto"
 	HeaderXForwardedHost  = "X-Forwarded-Host"
 	HeaderXForwardedFor   = "X-Forwarded-For"
 
+	// HeaderXForwardedPrefix carries the path prefix removed by a
+	// strip_prefix route, so upstreams can build absolute links.
+	HeaderXForwardedPrefix = "X-Forwarded-Prefix"
+
 	SchemeHTTP  = "http"
 	SchemeHTTPS = "https"
 )
@@ -41,43 +60,270 @@ type HTTPOptions struct {
 	UpstreamAddress string
 	UpstreamNetwork string
 	WhoIs           WhoIsFunc
+	// Routes send matching requests to their own upstream. Requests no
+	// route matches go to UpstreamAddress, or get 404 when it is empty.
+	Routes []HTTPRoute
+	// Upstream, when set, balances the fallback route over several
+	// backends and replaces UpstreamAddress/UpstreamNetwork.
+	Upstream *Balancer
+	// Access restricts which tailnet identities may use the handler;
+	// others get 403. Nil allows everyone.
+	Access *access.Policy
+	// AppCapability, when set, forwards the peer's grant values for that
+	// capability in TailscaleAppCapabilitiesHeader.
+	AppCapability string
+	// IdentityHeaders are extra identity headers for auth-proxy upstreams.
+	// Client-supplied copies are always stripped; values are only set for
+	// identified tailnet peers.
+	IdentityHeaders *identity.Headers
+	// IdentityJWT, when set, attaches a signed identity assertion to every
+	// request from an identified peer and serves the public keys on JWKSPath.
+	IdentityJWT *IdentityJWT
+	// ForwardAuth, when set, must approve each request (after Access)
+	// before it is proxied.
+	ForwardAuth *ForwardAuth
+	// FunnelPaths, when set, are the only path prefixes anonymous (Funnel)
+	// clients may reach; everything else requires a tailnet identity.
+	// Funnel clients are those WhoIs does not know, so FunnelPaths needs
+	// WhoIs: without it every request fails with ErrFunnelUnknown.
+	FunnelPaths []string
+	// Metrics records requests and upstream latency; nil records nothing.
+	Metrics *metrics.Handler
+	// AccessLog gets one record per completed request; nil logs nothing.
+	AccessLog *accesslog.Handler
+	// Tracing exports a span per request and per upstream round trip;
+	// nil traces nothing.
+	Tracing *tracing.Handler
+}
+
+// ErrFunnelUnknown answers requests to a handler with FunnelPaths but no
+// WhoIs, which cannot tell Funnel clients from tailnet ones; they fail
+// closed with 500.
+var ErrFunnelUnknown = errors.New("funnel_paths needs whois to tell funnel requests apart")
+
+// JWKSPath is where HTTP handlers with IdentityJWT publish their public keys.
+const JWKSPath = "/.well-known/jwks.json"
+
+// Identity JWT defaults, applied by NewHTTP to zero IdentityJWT fields.
+const (
+	DefaultIdentityJWTHeader = "Tailscale-Identity-Token"
+	DefaultIdentityJWTTTL    = time.Minute
+)
+
+// IdentityJWT configures signed identity assertions.
+type IdentityJWT struct {
+	Signer *jwt.Signer
+	// Header carries the token; DefaultIdentityJWTHeader when empty.
+	Header string
+	// TTL is the token lifetime; DefaultIdentityJWTTTL when zero.
+	TTL time.Duration
+	// Audience is the optional "aud" claim.
+	Audience string
+}
+
+// HTTPRoute sends requests under a path prefix (and optionally for one Host)
+// to a dedicated upstream.
+type HTTPRoute struct {
+	// Path is matched on segment boundaries: "/api" matches /api and
+	// /api/users but not /apiary.
+	Path string
+	// Host, when set, restricts the route to requests for that host and
+	// exempts them from the canonical-hostname redirect.
+	Host string
+	// StripPrefix removes Path from the request before proxying and sends
+	// it to the upstream in X-Forwarded-Prefix.
+	StripPrefix     bool
+	UpstreamAddress string
+	UpstreamNetwork string
 }
 
 // HTTPHandler is an HTTP reverse proxy that enriches requests with Tailscale user headers.
 type HTTPHandler struct {
 	opts  HTTPOptions
-	proxy *httputil.ReverseProxy
+	conns atomic.Int64
+	// routes is ordered so the first match is the most specific: longest
+	// prefix first, host-bound before host-less at equal length. The
+	// UpstreamAddress fallback (if any) is the last entry.
+	routes []*httpRoute
+}
+
+type httpRoute struct {
+	HTTPRoute
+	upstream *Balancer
+	proxy    *httputil.ReverseProxy
 }
 
+// backendContextKey carries the backend picked for a request from ServeHTTP
+// to the reverse proxy's Director.
+type backendContextKey struct{}
+
+// failoverContextKey carries a *failover from serve to the reverse proxy's
+// ErrorHandler.
+type failoverContextKey struct{}
+
+// failover records a failed dial so serve can retry the request on the next
+// backend instead of answering 502.
+type failover struct {
+	err error
+}
+
+// retry reports whether err is a dial failure serve should retry, and
+// records it.
+func (f *failover) retry(req *http.Request, err error) bool {
+	if req.Context().Err() != nil || !errors.Is(err, errUpstreamDial) {
+		return false
+	}
+	f.err = err
+	return true
+}
+
+// keepOpenBody ignores Close so a request body survives a failed round
+// trip for the retry; the server closes the real body when serve returns.
+type keepOpenBody struct {
+	io.Reader
+}
+
+func (keepOpenBody) Close() error { return nil }
+
 // NewHTTP creates an HTTP reverse proxy handler.
 func NewHTTP(opts HTTPOptions) *HTTPHandler {
 	if opts.UpstreamNetwork == "" {
 		opts.UpstreamNetwork = "tcp"
 	}
+	if j := opts.IdentityJWT; j != nil {
+		c := *j
+		if c.Header == "" {
+			c.Header = DefaultIdentityJWTHeader
+		}
+		if c.TTL <= 0 {
+			c.TTL = DefaultIdentityJWTTTL
+		}
+		opts.IdentityJWT = &c
+	}
+	opts.FunnelPaths = slices.Clone(opts.FunnelPaths)
+	for i, p := range opts.FunnelPaths {
+		opts.FunnelPaths[i] = normalizeRoutePath(p)
+	}
+	if fa := opts.ForwardAuth; fa != nil {
+		c := *fa
+		c.init()
+		opts.ForwardAuth = &c
+	}
+	routes := make([]*httpRoute, 0, len(opts.Routes)+1)
+	for _, r := range opts.Routes {
+		if r.UpstreamNetwork == "" {
+			r.UpstreamNetwork = opts.UpstreamNetwork
+		}
+		r.Path = normalizeRoutePath(r.Path)
+		routes = append(routes, newHTTPRoute(opts.Hostname, r, singleUpstream(r.UpstreamNetwork, r.UpstreamAddress), opts.Metrics, opts.Tracing))
+	}
+	sort.SliceStable(routes, func(i, j int) bool {
+		if len(routes[i].Path) != len(routes[j].Path) {
+			return len(routes[i].Path) > len(routes[j].Path)
+		}
+		return routes[i].Host != "" && routes[j].Host == ""
+	})
+	// Without routes the fallback is always present, even with an empty
+	// address, so handlers built without an upstream keep proxying (and
+	// failing with 502) like before routes existed.
+	if opts.Upstream != nil {
+		fallback := HTTPRoute{Path: "/", UpstreamNetwork: opts.Upstream.network}
+		routes = append(routes, newHTTPRoute(opts.Hostname, fallback, opts.Upstream, opts.Metrics, opts.Tracing))
+	} else if opts.UpstreamAddress != "" || len(opts.Routes) == 0 {
+		fallback := HTTPRoute{Path: "/", UpstreamNetwork: opts.UpstreamNetwork, UpstreamAddress: opts.UpstreamAddress}
+		routes = append(routes, newHTTPRoute(opts.Hostname, fallback, singleUpstream(opts.UpstreamNetwork, opts.UpstreamAddress), opts.Metrics, opts.Tracing))
+	}
+	return &HTTPHandler{
+		opts:   opts,
+		routes: routes,
+	}
+}
+
+// newHTTPRoute builds a route whose reverse proxy dials the backend picked
+// for each request.
+func newHTTPRoute(hostname string, r HTTPRoute, upstream *Balancer, m *metrics.Handler, t *tracing.Handler) *httpRoute {
 	u := &url.URL{
 		Scheme: SchemeHTTP,
-		Host:   opts.Hostname,
+		Host:   hostname,
 	}
 	proxy := httputil.NewSingleHostReverseProxy(u)
-	proxy.Transport = &http.Transport{
-		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
-			var d net.Dialer
-			return d.DialContext(ctx, opts.UpstreamNetwork, opts.UpstreamAddress)
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		director(req)
+		// The URL host is the backend key: it selects the transport's
+		// connection pool and is mapped back to the address when dialing.
+		// The outbound Host header still comes from the client request.
+		if b, ok := req.Context().Value(backendContextKey{}).(*backend); ok {
+			req.URL.Host = b.key
+		}
+	}
+	var transport http.RoundTripper = &http.Transport{
+		DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+			conn, err := upstream.dialKey(ctx, addr)
+			if err != nil && ctx.Err() == nil {
+				m.DialFailed()
+			}
+			return conn, err
 		},
 	}
-	return &HTTPHandler{
-		opts:  opts,
-		proxy: proxy,
+	if m != nil {
+		transport = timedTransport{RoundTripper: transport, metrics: m}
+	}
+	if t != nil {
+		transport = tracedTransport{RoundTripper: transport, tracing: t}
+	}
+	proxy.Transport = transport
+	proxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
+		if f, ok := req.Context().Value(failoverContextKey{}).(*failover); ok && f.retry(req, err) {
+			return
+		}
+		tsproxy.ReportError(err, "context", "http proxy error", "upstream", upstream.String())
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	return &httpRoute{HTTPRoute: r, upstream: upstream, proxy: proxy}
+}
+
+// normalizeRoutePath drops trailing slashes so "/api/" and "/api" behave the
+// same; the root stays "/".
+func normalizeRoutePath(p string) string {
+	p = strings.TrimRight(p, "/")
+	if p == "" {
+		return "/"
 	}
+	return p
 }
 
 func (h *HTTPHandler) Serve(ctx context.Context, ln net.Listener) error {
+	for _, route := range h.routes {
+		go route.upstream.RunHealthChecks(ctx)
+	}
+	return serveHTTP(ctx, ln, h, &h.conns)
+}
+
+// ActiveConnections returns the number of open client connections.
+func (h *HTTPHandler) ActiveConnections() int {
+	return int(h.conns.Load())
+}
+
+// serveHTTP runs an http.Server for handler on ln until ctx is cancelled,
+// then drains in-flight requests. Shared by every HTTP-speaking handler so
+// timeouts and shutdown behaviour stay identical. conns tracks open client
+// connections.
+func serveHTTP(ctx context.Context, ln net.Listener, handler http.Handler, conns *atomic.Int64) error {
 	srv := &http.Server{
-		Handler:           h,
+		Handler:           handler,
 		ReadHeaderTimeout: 15 * time.Second,
 		ReadTimeout:       30 * time.Second,
 		WriteTimeout:      30 * time.Second,
 		IdleTimeout:       60 * time.Second,
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			switch state {
+			case http.StateNew:
+				conns.Add(1)
+			case http.StateHijacked, http.StateClosed:
+				conns.Add(-1)
+			}
+		},
 	}
 
 	go func() {
@@ -99,8 +345,27 @@ func (h *HTTPHandler) Serve(ctx context.Context, ln net.Listener) error {
 }
 
 func (h *HTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	o := observers{metrics: h.opts.Metrics, accessLog: h.opts.AccessLog, tracing: h.opts.Tracing}
+	o.observe(w, r, h.serve)
+}
+
+func (h *HTTPHandler) serve(w *exchange, r *http.Request) {
+	if h.opts.IdentityJWT != nil && r.URL.Path == JWKSPath {
+		h.serveJWKS(w, r)
+		return
+	}
+	route := h.match(r)
+	var userInfo *apitype.WhoIsResponse
+	// funnel is set for anonymous clients, which WhoIs does not know.
+	funnel := false
+	if h.opts.WhoIs == nil && len(h.opts.FunnelPaths) > 0 {
+		tsproxy.ReportError(ErrFunnelUnknown, "context", "http funnel paths", "host", h.opts.Hostname)
+		http.Error(w, ErrFunnelUnknown.Error(), http.StatusInternalServerError)
+		return
+	}
 	if h.opts.WhoIs != nil {
-		userInfo, err := h.opts.WhoIs(r.Context(), r.RemoteAddr)
+		var err error
+		userInfo, err = h.opts.WhoIs(r.Context(), r.RemoteAddr)
 		if err != nil {
 			// Public Funnel (and other non-tailnet) clients have no peer
 			// identity. Match Tailscale serve: continue without identity
@@ -110,14 +375,150 @@ func (h *HTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				http.Error(w, "whois failed", http.StatusInternalServerError)
 				return
 			}
-			userInfo = nil
+			userInfo, funnel = nil, true
 		}
-		if h.handleRedirect(w, r) {
+		w.who = userInfo
+		// Host-bound routes serve their own host as-is; everything else is
+		// redirected to the canonical tailnet name.
+		if (route == nil || route.Host == "") && h.handleRedirect(w, r) {
 			return
 		}
 		h.enrichHeaders(r, userInfo)
 	}
-	h.proxy.ServeHTTP(w, r)
+	if funnel && !h.funnelAllowed(r) {
+		slog.Info("funnel denied", "remote", r.RemoteAddr, "url", r.URL.String())
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	if !h.opts.Access.Allows(userInfo) {
+		login, node := access.Describe(userInfo)
+		slog.Info("access denied", "user", login, "node", node, "remote", r.RemoteAddr, "url", r.URL.String())
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	if fa := h.opts.ForwardAuth; fa != nil && !fa.check(w, r, h.opts.EnableTLS) {
+		return
+	}
+	if route == nil {
+		http.NotFound(w, r)
+		return
+	}
+	route.apply(r)
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = keepOpenBody{r.Body}
+	}
+	// Like Balancer.DialContext, a backend that refuses the connection is
+	// skipped and the next healthy one tried.
+	tried := make(map[*backend]bool)
+	var errs []error
+	for {
+		b, err := route.upstream.pick(tried)
+		if err != nil {
+			if len(errs) > 0 {
+				tsproxy.ReportError(errors.Join(errs...), "context", "http dial upstream", "upstream", route.upstream.String())
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			http.Error(w, "no healthy upstream", http.StatusServiceUnavailable)
+			return
+		}
+		tried[b] = true
+		w.upstream = b.address
+		f := &failover{}
+		ctx := context.WithValue(r.Context(), backendContextKey{}, b)
+		ctx = context.WithValue(ctx, failoverContextKey{}, f)
+		release := b.acquire()
+		route.proxy.ServeHTTP(w, r.WithContext(ctx))
+		release()
+		if f.err == nil {
+			return
+		}
+		errs = append(errs, f.err)
+	}
+}
+
+// funnelAllowed reports whether an anonymous client may request r. The path
+// is cleaned first so "/hooks/../admin" cannot escape a public prefix on an
+// upstream that resolves dot segments.
+func (h *HTTPHandler) funnelAllowed(r *http.Request) bool {
+	if len(h.opts.FunnelPaths) == 0 {
+		return true
+	}
+	p := cleanPath(r.URL.Path)
+	for _, prefix := range h.opts.FunnelPaths {
+		if hasPathPrefix(p, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// match returns the most specific route for r, or nil. Like funnelAllowed
+// it matches the cleaned path, so "/api/../admin" is not sent to /api.
+func (h *HTTPHandler) match(r *http.Request) *httpRoute {
+	host := r.Host
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	p := cleanPath(r.URL.Path)
+	for _, route := range h.routes {
+		if route.Host != "" && !strings.EqualFold(route.Host, host) {
+			continue
+		}
+		if hasPathPrefix(p, route.Path) {
+			return route
+		}
+	}
+	return nil
+}
+
+// cleanPath resolves dot segments in a request path, keeping a trailing
+// slash like http.ServeMux does.
+func cleanPath(p string) string {
+	np := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && np != "/" {
+		np += "/"
+	}
+	return np
+}
+
+// hasPathPrefix reports whether p is prefix or lies below it, matching whole
+// path segments only.
+func hasPathPrefix(p, prefix string) bool {
+	if prefix == "/" {
+		return true
+	}
+	if !strings.HasPrefix(p, prefix) {
+		return false
+	}
+	return len(p) == len(prefix) || p[len(prefix)] == '/'
+}
+
+// apply rewrites r for the route's upstream. Client-supplied
+// X-Forwarded-Prefix is always dropped so upstreams can trust it.
+func (route *httpRoute) apply(r *http.Request) {
+	deleteHeaderVariants(r.Header, HeaderXForwardedPrefix)
+	if !route.StripPrefix || route.Path == "/" {
+		return
+	}
+	// Strip from the path the route was matched on; an escaped form of a
+	// path that needed cleaning no longer applies.
+	if p := cleanPath(r.URL.Path); p != r.URL.Path {
+		r.URL.Path, r.URL.RawPath = p, ""
+	}
+	r.URL.Path = stripPathPrefix(r.URL.Path, route.Path)
+	if r.URL.RawPath != "" {
+		r.URL.RawPath = stripPathPrefix(r.URL.RawPath, route.Path)
+	}
+	r.Header.Set(HeaderXForwardedPrefix, route.Path)
+}
+
+func stripPathPrefix(p, prefix string) string {
+	p = strings.TrimPrefix(p, prefix)
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+	return p
 }
 
 func (h *HTTPHandler) handleRedirect(w http.ResponseWriter, r *http.Request) bool {
@@ -155,16 +556,20 @@ func (h *HTTPHandler) enrichHeaders(r *http.Request, userInfo *apitype.WhoIsResp
 	}
 	r.Header.Set(HeaderXForwardedHost, h.opts.Hostname)
 
-	login := ""
-	if userInfo != nil && userInfo.UserProfile != nil {
-		login = userInfo.UserProfile.LoginName
+	// The access log, when configured, records requests in full once they
+	// complete.
+	if h.opts.AccessLog == nil {
+		login := ""
+		if userInfo != nil && userInfo.UserProfile != nil {
+			login = userInfo.UserProfile.LoginName
+		}
+		slog.Info("request",
+			"method", r.Method,
+			"user", login,
+			"host", r.Host,
+			"url", r.URL.String(),
+		)
 	}
-	slog.Info("request",
-		"method", r.Method,
-		"user", login,
-		"host", r.Host,
-		"url", r.URL.String(),
-	)
 
 	// Always strip client-supplied identity headers. Only set them when
 	// WhoIs returned a real user (not funnel/public and not tagged devices).
@@ -178,6 +583,99 @@ func (h *HTTPHandler) enrichHeaders(r *http.Request, userInfo *apitype.WhoIsResp
 			TailscaleHeadersInfoHeader,
 		)
 	}
+	setAppCapabilitiesHeader(r, userInfo, h.opts.AppCapability)
+	h.setIdentityHeaders(r, userInfo)
+	h.setIdentityJWT(r, userInfo)
+}
+
+// setIdentityJWT replaces any client-supplied token header with a freshly
+// signed assertion for identified peers.
+func (h *HTTPHandler) setIdentityJWT(r *http.Request, userInfo *apitype.WhoIsResponse) {
+	j := h.opts.IdentityJWT
+	if j == nil {
+		return
+	}
+	deleteHeaderVariants(r.Header, j.Header)
+	if userInfo == nil {
+		return
+	}
+	f := identity.FieldsFrom(userInfo, r.RemoteAddr)
+	now := time.Now()
+	claims := jwt.Claims{
+		Issuer:    SchemeHTTPS + "://" + h.opts.Hostname,
+		Subject:   f.Login,
+		Audience:  j.Audience,
+		IssuedAt:  now.Unix(),
+		NotBefore: now.Unix(),
+		Expiry:    now.Add(j.TTL).Unix(),
+		Login:     f.Login,
+		Name:      f.Name,
+		Node:      f.Node,
+		IP:        f.IP,
+	}
+	if claims.Subject == "" {
+		claims.Subject = f.Node
+	}
+	if userInfo.Node != nil {
+		claims.Tags = userInfo.Node.Tags
+	}
+	token, err := j.Signer.Sign(claims)
+	if err != nil {
+		tsproxy.ReportError(err, "context", "identity jwt")
+		return
+	}
+	r.Header.Set(j.Header, token)
+}
+
+// serveJWKS publishes the identity JWT public keys. They are public by
+// design, so no identity or access check applies.
+func (h *HTTPHandler) serveJWKS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	b, err := h.opts.IdentityJWT.Signer.JWKS()
+	if err != nil {
+		tsproxy.ReportError(err, "context", "jwks encode")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/jwk-set+json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	if _, err := w.Write(b); err != nil {
+		tsproxy.ReportError(err, "context", "jwks write")
+	}
+}
+
+// setIdentityHeaders applies the configured identity_headers mapping after
+// removing any client-supplied variants of those names.
+func (h *HTTPHandler) setIdentityHeaders(r *http.Request, userInfo *apitype.WhoIsResponse) {
+	deleteHeaderVariants(r.Header, h.opts.IdentityHeaders.Names()...)
+	if userInfo == nil {
+		return
+	}
+	err := h.opts.IdentityHeaders.Render(identity.FieldsFrom(userInfo, r.RemoteAddr), r.Header.Set)
+	if err != nil {
+		tsproxy.ReportError(err, "context", "identity headers")
+	}
+}
+
+// setAppCapabilitiesHeader replaces any client-supplied capabilities header
+// with the peer's grant values for capability, if it has any.
+func setAppCapabilitiesHeader(r *http.Request, userInfo *apitype.WhoIsResponse, capability string) {
+	deleteHeaderVariants(r.Header, TailscaleAppCapabilitiesHeader)
+	if capability == "" || !access.HasCapability(userInfo, capability) {
+		return
+	}
+	c := tailcfg.PeerCapability(capability)
+	b, err := json.Marshal(map[tailcfg.PeerCapability][]tailcfg.RawMessage{c: userInfo.CapMap[c]})
+	if err != nil {
+		tsproxy.ReportError(err, "context", "app capabilities encode", "capability", capability)
+		return
+	}
+	// Same encoding as tailscale serve: RFC 2047 for non-ASCII values.
+	r.Header.Set(TailscaleAppCapabilitiesHeader, mime.QEncoding.Encode("utf-8", string(b)))
 }
 
 // hasTailscaleUserIdentity reports whether WhoIs yielded a user identity we
@@ -188,7 +686,7 @@ func hasTailscaleUserIdentity(userInfo *apitype.WhoIsResponse) bool {
 		return false
 	}
 	login := userInfo.UserProfile.LoginName
-	return login != "" && login != taggedDevicesLogin
+	return login != "" && login != access.TaggedDevicesLogin
 }
 
 // deleteHeaderVariants removes every header key whose name matches any of
@@ -2,14 +2,27 @@ package handler
 
 import (
 	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"slices"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/lucasew/ts-proxy/pkg/access"
+	"github.com/lucasew/ts-proxy/pkg/accesslog"
+	"github.com/lucasew/ts-proxy/pkg/identity"
+	"github.com/lucasew/ts-proxy/pkg/jwt"
+	"github.com/lucasew/ts-proxy/pkg/metrics"
+	"github.com/lucasew/ts-proxy/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
 	"tailscale.com/client/local"
 	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/tailcfg"
@@ -205,7 +218,7 @@ func TestServeHTTPTaggedDeviceOmitsIdentity(t *testing.T) {
 	up := proxyWithWhoIs(t, func(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
 		return &apitype.WhoIsResponse{
 			UserProfile: &tailcfg.UserProfile{
-				LoginName: taggedDevicesLogin,
+				LoginName: access.TaggedDevicesLogin,
 			},
 		}, nil
 	}, "100.64.0.3:1", "spoofed@example.com")
@@ -233,7 +246,7 @@ func TestHasTailscaleUserIdentity(t *testing.T) {
 	if hasTailscaleUserIdentity(&apitype.WhoIsResponse{UserProfile: &tailcfg.UserProfile{}}) {
 		t.Error("empty login should be false")
 	}
-	if hasTailscaleUserIdentity(&apitype.WhoIsResponse{UserProfile: &tailcfg.UserProfile{LoginName: taggedDevicesLogin}}) {
+	if hasTailscaleUserIdentity(&apitype.WhoIsResponse{UserProfile: &tailcfg.UserProfile{LoginName: access.TaggedDevicesLogin}}) {
 		t.Error("tagged-devices should be false")
 	}
 	if !hasTailscaleUserIdentity(&apitype.WhoIsResponse{UserProfile: &tailcfg.UserProfile{LoginName: "a@b.c"}}) {
@@ -507,3 +520,649 @@ func TestSetTailscaleHeadersSanitization(t *testing.T) {
 		})
 	}
 }
+
+func TestServeHTTPRoutesLongestPrefix(t *testing.T) {
+	appAddr, appGot, appCleanup := startUpstream(t)
+	defer appCleanup()
+	apiAddr, apiGot, apiCleanup := startUpstream(t)
+	defer apiCleanup()
+	v2Addr, v2Got, v2Cleanup := startUpstream(t)
+	defer v2Cleanup()
+
+	h := NewHTTP(HTTPOptions{
+		Hostname:        "app.example.ts.net",
+		UpstreamAddress: appAddr,
+		Routes: []HTTPRoute{
+			{Path: "/api", UpstreamAddress: apiAddr, StripPrefix: true},
+			{Path: "/api/v2/", UpstreamAddress: v2Addr},
+		},
+	})
+
+	tests := []struct {
+		target   string
+		got      chan *http.Request
+		wantPath string
+		prefix   string
+	}{
+		{"/api/users?x=1", apiGot, "/users", "/api"},
+		{"/api", apiGot, "/", "/api"},
+		{"/api/v2/items", v2Got, "/api/v2/items", ""},
+		{"/apiary", appGot, "/apiary", ""},
+		{"/", appGot, "/", ""},
+		// Dot segments are resolved before matching, as upstreams would.
+		{"/api/../admin", appGot, "/api/../admin", ""},
+		{"/other/../api/users/", apiGot, "/users/", "/api"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			req.Header.Set("X_Forwarded_Prefix", "/spoofed")
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != http.StatusNoContent {
+				t.Fatalf("status = %d, want %d", rec.Code, http.StatusNoContent)
+			}
+			up := recvUpstream(t, tt.got)
+			if up.URL.Path != tt.wantPath {
+				t.Errorf("upstream path = %q, want %q", up.URL.Path, tt.wantPath)
+			}
+			if v := up.Header.Get(HeaderXForwardedPrefix); v != tt.prefix {
+				t.Errorf("X-Forwarded-Prefix = %q, want %q", v, tt.prefix)
+			}
+			for k := range up.Header {
+				if strings.Contains(k, "_") {
+					t.Errorf("spoofed header variant %q reached upstream", k)
+				}
+			}
+		})
+	}
+}
+
+func TestServeHTTPRoutesWithoutFallback(t *testing.T) {
+	apiAddr, _, cleanup := startUpstream(t)
+	defer cleanup()
+
+	h := NewHTTP(HTTPOptions{
+		Hostname: "app.example.ts.net",
+		Routes:   []HTTPRoute{{Path: "/api", UpstreamAddress: apiAddr}},
+	})
+	req := httptest.NewRequest(http.MethodGet, "/other", nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("unmatched path status = %d, want 404 when no upstream_address fallback", rec.Code)
+	}
+}
+
+// Host-bound routes win over host-less ones and are served under their own
+// host instead of being redirected to the canonical tailnet name.
+func TestServeHTTPRoutesHostMatch(t *testing.T) {
+	appAddr, appGot, appCleanup := startUpstream(t)
+	defer appCleanup()
+	adminAddr, adminGot, adminCleanup := startUpstream(t)
+	defer adminCleanup()
+
+	h := NewHTTP(HTTPOptions{
+		Hostname:        "app.example.ts.net",
+		UpstreamAddress: appAddr,
+		WhoIs: func(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+			return nil, local.ErrPeerNotFound
+		},
+		Routes: []HTTPRoute{
+			{Path: "/", Host: "admin.internal", UpstreamAddress: adminAddr},
+		},
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/dash", nil)
+	req.Host = "ADMIN.internal:443"
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("host route status = %d, want %d (no canonical redirect)", rec.Code, http.StatusNoContent)
+	}
+	recvUpstream(t, adminGot)
+
+	req = httptest.NewRequest(http.MethodGet, "/dash", nil)
+	req.Host = "app.example.ts.net"
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("canonical host status = %d, want %d", rec.Code, http.StatusNoContent)
+	}
+	recvUpstream(t, appGot)
+
+	req = httptest.NewRequest(http.MethodGet, "/dash", nil)
+	req.Host = "other.example"
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusMovedPermanently {
+		t.Errorf("unknown host status = %d, want redirect to canonical host", rec.Code)
+	}
+}
+
+func TestHasPathPrefix(t *testing.T) {
+	tests := []struct {
+		path, prefix string
+		want         bool
+	}{
+		{"/anything", "/", true},
+		{"/api", "/api", true},
+		{"/api/", "/api", true},
+		{"/api/x", "/api", true},
+		{"/apix", "/api", false},
+		{"/ap", "/api", false},
+	}
+	for _, tt := range tests {
+		if got := hasPathPrefix(tt.path, tt.prefix); got != tt.want {
+			t.Errorf("hasPathPrefix(%q, %q) = %v, want %v", tt.path, tt.prefix, got, tt.want)
+		}
+	}
+}
+
+func TestServeHTTPAccessPolicy(t *testing.T) {
+	addr, got, cleanup := startUpstream(t)
+	defer cleanup()
+
+	policy, err := access.NewPolicy([]string{"*@example.com"}, []string{"mallory@example.com"}, "")
+	if err != nil {
+		t.Fatalf("NewPolicy: %v", err)
+	}
+	logins := map[string]string{
+		"100.64.0.1:1": "alice@example.com",
+		"100.64.0.2:1": "mallory@example.com",
+		"100.64.0.3:1": "eve@other.com",
+	}
+	h := NewHTTP(HTTPOptions{
+		Hostname:        "app.example.ts.net",
+		UpstreamAddress: addr,
+		Access:          policy,
+		WhoIs: func(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+			login, ok := logins[remoteAddr]
+			if !ok {
+				return nil, local.ErrPeerNotFound
+			}
+			return &apitype.WhoIsResponse{UserProfile: &tailcfg.UserProfile{LoginName: login}}, nil
+		},
+	})
+
+	tests := []struct {
+		remote string
+		want   int
+	}{
+		{"100.64.0.1:1", http.StatusNoContent},
+		{"100.64.0.2:1", http.StatusForbidden},
+		{"100.64.0.3:1", http.StatusForbidden},
+		{"203.0.113.9:1", http.StatusForbidden}, // anonymous Funnel client
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Host = "app.example.ts.net"
+		req.RemoteAddr = tt.remote
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%s (%s) status = %d, want %d", tt.remote, logins[tt.remote], rec.Code, tt.want)
+		}
+	}
+	recvUpstream(t, got)
+}
+
+func TestServeHTTPRequireCapability(t *testing.T) {
+	const capName = "example.com/cap/ts-proxy"
+	addr, got, cleanup := startUpstream(t)
+	defer cleanup()
+
+	policy, err := access.NewPolicy(nil, nil, capName)
+	if err != nil {
+		t.Fatalf("NewPolicy: %v", err)
+	}
+	caps := map[string]tailcfg.PeerCapMap{
+		"100.64.0.1:1": {capName: {`{"role":"admin"}`}, "example.com/cap/other": {`{"x":1}`}},
+		"100.64.0.2:1": {"example.com/cap/other": {`{"x":1}`}},
+	}
+	h := NewHTTP(HTTPOptions{
+		Hostname:        "app.example.ts.net",
+		UpstreamAddress: addr,
+		Access:          policy,
+		AppCapability:   capName,
+		WhoIs: func(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+			c, ok := caps[remoteAddr]
+			if !ok {
+				return nil, local.ErrPeerNotFound
+			}
+			return &apitype.WhoIsResponse{
+				UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com"},
+				CapMap:      c,
+			}, nil
+		},
+	})
+
+	for remote, want := range map[string]int{
+		"100.64.0.2:1":  http.StatusForbidden,
+		"203.0.113.9:1": http.StatusForbidden,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Host = "app.example.ts.net"
+		req.RemoteAddr = remote
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Errorf("%s status = %d, want %d", remote, rec.Code, want)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Host = "app.example.ts.net"
+	req.RemoteAddr = "100.64.0.1:1"
+	req.Header.Set(TailscaleAppCapabilitiesHeader, `{"spoofed":[]}`)
+	req.Header["Tailscale_App_Capabilities"] = []string{`{"spoofed":[]}`}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("granted peer status = %d, want %d", rec.Code, http.StatusNoContent)
+	}
+	up := recvUpstream(t, got)
+	if vals := up.Header.Values(TailscaleAppCapabilitiesHeader); len(vals) != 1 || vals[0] != `{"example.com/cap/ts-proxy":[{"role":"admin"}]}` {
+		t.Errorf("%s = %q, want only the required capability's values", TailscaleAppCapabilitiesHeader, vals)
+	}
+	if v := up.Header.Get("Tailscale_App_Capabilities"); v != "" {
+		t.Errorf("underscore variant survived: %q", v)
+	}
+}
+
+func TestServeHTTPIdentityHeaders(t *testing.T) {
+	addr, got, cleanup := startUpstream(t)
+	defer cleanup()
+
+	headers, err := identity.ParseHeaders(map[string]string{
+		"x-webauth-user": "{{.User}}",
+		"Remote-Email":   "{{.Login}}",
+	})
+	if err != nil {
+		t.Fatalf("ParseHeaders: %v", err)
+	}
+	h := NewHTTP(HTTPOptions{
+		Hostname:        "app.example.ts.net",
+		UpstreamAddress: addr,
+		IdentityHeaders: headers,
+		WhoIs: func(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+			if remoteAddr != "100.64.0.1:1" {
+				return nil, local.ErrPeerNotFound
+			}
+			return &apitype.WhoIsResponse{UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com"}}, nil
+		},
+	})
+
+	serve := func(remote string) *http.Request {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Host = "app.example.ts.net"
+		req.RemoteAddr = remote
+		req.Header.Set("X-Webauth-User", "admin")
+		req.Header["X_WEBAUTH_USER"] = []string{"admin"}
+		req.Header["Remote_Email"] = []string{"admin@example.com"}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusNoContent {
+			t.Fatalf("status = %d, want %d", rec.Code, http.StatusNoContent)
+		}
+		return recvUpstream(t, got)
+	}
+
+	up := serve("100.64.0.1:1")
+	if v := up.Header.Values("X-Webauth-User"); len(v) != 1 || v[0] != "alice" {
+		t.Errorf("X-Webauth-User = %q, want [alice]", v)
+	}
+	if v := up.Header.Get("Remote-Email"); v != "alice@example.com" {
+		t.Errorf("Remote-Email = %q, want alice@example.com", v)
+	}
+	if _, ok := up.Header["X_WEBAUTH_USER"]; ok {
+		t.Error("underscore variant of X-Webauth-User survived")
+	}
+
+	// Anonymous Funnel clients get every configured header stripped.
+	up = serve("203.0.113.9:1")
+	for k := range up.Header {
+		if strings.EqualFold(strings.ReplaceAll(k, "_", "-"), "X-Webauth-User") ||
+			strings.EqualFold(strings.ReplaceAll(k, "_", "-"), "Remote-Email") {
+			t.Errorf("spoofed %s reached upstream for anonymous client", k)
+		}
+	}
+}
+
+func TestServeHTTPIdentityJWT(t *testing.T) {
+	addr, got, cleanup := startUpstream(t)
+	defer cleanup()
+
+	signer, err := jwt.LoadOrCreate(t.TempDir(), jwt.AlgorithmEd25519)
+	if err != nil {
+		t.Fatalf("LoadOrCreate: %v", err)
+	}
+	h := NewHTTP(HTTPOptions{
+		Hostname:        "app.example.ts.net",
+		UpstreamAddress: addr,
+		IdentityJWT:     &IdentityJWT{Signer: signer, Audience: "grafana"},
+		WhoIs: func(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+			if remoteAddr != "100.64.0.1:1" {
+				return nil, local.ErrPeerNotFound
+			}
+			return &apitype.WhoIsResponse{
+				Node:        &tailcfg.Node{Name: "laptop.example.ts.net.", Tags: []string{"tag:dev"}},
+				UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com", DisplayName: "Alice"},
+			}, nil
+		},
+	})
+
+	serve := func(remote string) *http.Request {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Host = "app.example.ts.net"
+		req.RemoteAddr = remote
+		req.Header.Set(DefaultIdentityJWTHeader, "forged")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusNoContent {
+			t.Fatalf("status = %d, want %d", rec.Code, http.StatusNoContent)
+		}
+		return recvUpstream(t, got)
+	}
+
+	up := serve("100.64.0.1:1")
+	token := up.Header.Get(DefaultIdentityJWTHeader)
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("%s = %q, want a compact JWS", DefaultIdentityJWTHeader, token)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !ed25519.Verify(signer.Public().(ed25519.PublicKey), []byte(parts[0]+"."+parts[1]), sig) {
+		t.Fatalf("token signature does not verify (decode err %v)", err)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatalf("decode payload: %v", err)
+	}
+	var claims jwt.Claims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		t.Fatalf("unmarshal claims: %v", err)
+	}
+	if claims.Subject != "alice@example.com" || claims.Issuer != "https://app.example.ts.net" ||
+		claims.Audience != "grafana" || claims.Node != "laptop.example.ts.net" || claims.IP != "100.64.0.1" {
+		t.Errorf("claims = %+v", claims)
+	}
+	if ttl := claims.Expiry - claims.IssuedAt; ttl != int64(DefaultIdentityJWTTTL/time.Second) {
+		t.Errorf("token lifetime = %ds, want %s", ttl, DefaultIdentityJWTTTL)
+	}
+
+	// Anonymous clients get no token, and a forged one never passes through.
+	up = serve("203.0.113.9:1")
+	if v := up.Header.Get(DefaultIdentityJWTHeader); v != "" {
+		t.Errorf("%s = %q for anonymous client, want unset", DefaultIdentityJWTHeader, v)
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, JWKSPath, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("JWKS status = %d, want 200", rec.Code)
+	}
+	want, _ := signer.JWKS()
+	if rec.Body.String() != string(want) {
+		t.Errorf("JWKS body = %s, want %s", rec.Body.String(), want)
+	}
+}
+
+func TestServeHTTPFunnelPaths(t *testing.T) {
+	addr, got, cleanup := startUpstream(t)
+	defer cleanup()
+
+	paths := []string{"/hooks/", "/status"}
+	h := NewHTTP(HTTPOptions{
+		Hostname:        "app.example.ts.net",
+		EnableTLS:       true,
+		UpstreamAddress: addr,
+		FunnelPaths:     paths,
+		WhoIs: func(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+			if remoteAddr == "100.64.0.1:1" {
+				return &apitype.WhoIsResponse{UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com"}}, nil
+			}
+			return nil, local.ErrPeerNotFound
+		},
+	})
+	if paths[0] != "/hooks/" {
+		t.Errorf("NewHTTP modified the caller's FunnelPaths: %v", paths)
+	}
+
+	tests := []struct {
+		remote, target string
+		want           int
+	}{
+		{"203.0.113.9:1", "/hooks", http.StatusNoContent},
+		{"203.0.113.9:1", "/hooks/github", http.StatusNoContent},
+		{"203.0.113.9:1", "/status", http.StatusNoContent},
+		{"203.0.113.9:1", "/", http.StatusForbidden},
+		{"203.0.113.9:1", "/admin", http.StatusForbidden},
+		{"203.0.113.9:1", "/hooksx", http.StatusForbidden},
+		{"203.0.113.9:1", "/hooks/../admin", http.StatusForbidden},
+		{"203.0.113.9:1", "/hooks/%2e%2e/admin", http.StatusForbidden},
+		{"100.64.0.1:1", "/admin", http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+		req.Host = "app.example.ts.net"
+		req.RemoteAddr = tt.remote
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%s %s status = %d, want %d", tt.remote, tt.target, rec.Code, tt.want)
+		}
+		if rec.Code == http.StatusNoContent {
+			recvUpstream(t, got)
+		}
+	}
+}
+
+// Without WhoIs a Funnel client looks like a tailnet one, so FunnelPaths
+// fails closed with a clear error instead of denying everyone with 403.
+func TestServeHTTPFunnelPathsWithoutWhoIs(t *testing.T) {
+	h := NewHTTP(HTTPOptions{
+		Hostname:        "app.example.ts.net",
+		UpstreamAddress: "127.0.0.1:1",
+		FunnelPaths:     []string{"/hooks/"},
+	})
+	req := httptest.NewRequest(http.MethodGet, "/admin", nil)
+	req.RemoteAddr = "100.64.0.1:1"
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusInternalServerError || !strings.Contains(rec.Body.String(), ErrFunnelUnknown.Error()) {
+		t.Errorf("status = %d, body = %q; want 500 with ErrFunnelUnknown", rec.Code, rec.Body.String())
+	}
+}
+
+func TestServeHTTPMetrics(t *testing.T) {
+	addr, got, cleanup := startUpstream(t)
+	defer cleanup()
+
+	policy, err := access.NewPolicy([]string{"alice@example.com"}, nil, "")
+	if err != nil {
+		t.Fatalf("NewPolicy: %v", err)
+	}
+	h := NewHTTP(HTTPOptions{
+		Hostname:        "app.example.ts.net",
+		UpstreamAddress: addr,
+		Access:          policy,
+		Metrics:         metrics.ForHandler("http_metrics_test", ":443"),
+		WhoIs: func(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+			if remoteAddr == "100.64.0.1:1" {
+				return &apitype.WhoIsResponse{UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com"}}, nil
+			}
+			return nil, local.ErrPeerNotFound
+		},
+	})
+	for _, remote := range []string{"100.64.0.1:1", "203.0.113.9:1"} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Host = "app.example.ts.net"
+		req.RemoteAddr = remote
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	recvUpstream(t, got)
+
+	rec := httptest.NewRecorder()
+	NewMetrics().mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, metrics.Path, nil))
+	body := rec.Body.String()
+	for _, want := range []string{
+		`ts_proxy_http_requests_total{code="204",handler=":443",server="http_metrics_test",user="alice@example.com"} 1`,
+		`ts_proxy_http_requests_total{code="403",handler=":443",server="http_metrics_test",user="anonymous"} 1`,
+		`ts_proxy_http_upstream_duration_seconds_count{handler=":443",server="http_metrics_test"} 1`,
+	} {
+		if !strings.Contains(body, want+"\n") {
+			t.Errorf("metrics missing %q", want)
+		}
+	}
+}
+
+func TestServeHTTPAccessLog(t *testing.T) {
+	addr, got, cleanup := startUpstream(t)
+	defer cleanup()
+
+	var buf strings.Builder
+	logger, err := accesslog.NewWriter(&buf, accesslog.FormatJSON)
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+	h := NewHTTP(HTTPOptions{
+		Hostname:        "app.example.ts.net",
+		UpstreamAddress: addr,
+		FunnelPaths:     []string{"/public"},
+		AccessLog:       logger.ForHandler("web", ":443"),
+		WhoIs: func(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+			if remoteAddr == "100.64.0.1:1" {
+				return &apitype.WhoIsResponse{
+					UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com"},
+					Node:        &tailcfg.Node{Name: "laptop.example.ts.net."},
+				}, nil
+			}
+			return nil, local.ErrPeerNotFound
+		},
+	})
+	for _, remote := range []string{"100.64.0.1:1", "203.0.113.9:1"} {
+		req := httptest.NewRequest(http.MethodGet, "/private?q=1", nil)
+		req.Host = "app.example.ts.net"
+		req.RemoteAddr = remote
+		req.Header.Set("User-Agent", "test-agent")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	recvUpstream(t, got)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d access log lines, want 2:\n%s", len(lines), buf.String())
+	}
+	var tailnet, funnel map[string]any
+	if err := json.Unmarshal([]byte(lines[0]), &tailnet); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &funnel); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	for key, want := range map[string]any{
+		"server":     "web",
+		"handler":    ":443",
+		"protocol":   "http",
+		"origin":     accesslog.OriginTailnet,
+		"user":       "alice@example.com",
+		"node":       "laptop.example.ts.net",
+		"method":     "GET",
+		"uri":        "/private?q=1",
+		"status":     float64(http.StatusNoContent),
+		"user_agent": "test-agent",
+		"upstream":   addr,
+	} {
+		if tailnet[key] != want {
+			t.Errorf("tailnet %s = %v, want %v", key, tailnet[key], want)
+		}
+	}
+	for key, want := range map[string]any{
+		"origin": accesslog.OriginFunnel,
+		"status": float64(http.StatusForbidden),
+		"remote": "203.0.113.9:1",
+	} {
+		if funnel[key] != want {
+			t.Errorf("funnel %s = %v, want %v", key, funnel[key], want)
+		}
+	}
+	if funnel["bytes_out"].(float64) == 0 {
+		t.Errorf("funnel bytes_out = 0, want the size of the 403 body")
+	}
+	if _, ok := funnel["user"]; ok {
+		t.Errorf("funnel entry has a user: %v", funnel)
+	}
+}
+
+func TestServeHTTPTracing(t *testing.T) {
+	addr, got, cleanup := startUpstream(t)
+	defer cleanup()
+
+	recorder := tracetest.NewSpanRecorder()
+	provider := tracing.NewWithProcessor(recorder)
+	h := NewHTTP(HTTPOptions{
+		Hostname:        "app.example.ts.net",
+		UpstreamAddress: addr,
+		Tracing:         provider.ForHandler("web", ":443"),
+		WhoIs: func(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+			return &apitype.WhoIsResponse{UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com"}}, nil
+		},
+	})
+	const clientTrace = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Host = "app.example.ts.net"
+	req.RemoteAddr = "100.64.0.1:1"
+	req.Header.Set("Traceparent", "00-"+clientTrace+"-00f067aa0ba902b7-01")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	up := recvUpstream(t, got)
+	traceparent := up.Header.Get("Traceparent")
+	if !strings.HasPrefix(traceparent, "00-"+clientTrace+"-") || strings.Contains(traceparent, "00f067aa0ba902b7") {
+		t.Errorf("upstream traceparent = %q, want the client trace with the proxy span as parent", traceparent)
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("recorded %d spans, want server and upstream", len(spans))
+	}
+	upstream, server := spans[0], spans[1]
+	if server.SpanKind() != trace.SpanKindServer || upstream.SpanKind() != trace.SpanKindClient {
+		t.Fatalf("span kinds = %v, %v; want server and client", server.SpanKind(), upstream.SpanKind())
+	}
+	if server.Parent().SpanID().String() != "00f067aa0ba902b7" {
+		t.Errorf("server span parent = %v, want the client span", server.Parent().SpanID())
+	}
+	if upstream.Parent().SpanID() != server.SpanContext().SpanID() {
+		t.Errorf("upstream span is not a child of the server span")
+	}
+	if !strings.HasSuffix(traceparent, "-"+upstream.SpanContext().SpanID().String()+"-01") {
+		t.Errorf("upstream traceparent = %q, want parent %v", traceparent, upstream.SpanContext().SpanID())
+	}
+	attrs := map[attribute.Key]attribute.Value{}
+	for _, kv := range server.Attributes() {
+		attrs[kv.Key] = kv.Value
+	}
+	for key, want := range map[attribute.Key]string{
+		tracing.AttrServer:   "web",
+		tracing.AttrUser:     "alice@example.com",
+		tracing.AttrOrigin:   "tailnet",
+		tracing.AttrUpstream: addr,
+	} {
+		if attrs[key].AsString() != want {
+			t.Errorf("server span %s = %q, want %q", key, attrs[key].AsString(), want)
+		}
+	}
+	if code := attrs["http.response.status_code"].AsInt64(); code != http.StatusNoContent {
+		t.Errorf("server span status = %d, want %d", code, http.StatusNoContent)
+	}
+	var events []string
+	for _, e := range upstream.Events() {
+		events = append(events, e.Name)
+	}
+	if !slices.Contains(events, "first response byte") {
+		t.Errorf("upstream span events = %v, want first response byte", events)
+	}
+}
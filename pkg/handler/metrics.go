@@ -0,0 +1,79 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/lucasew/ts-proxy/pkg/access"
+	"github.com/lucasew/ts-proxy/pkg/metrics"
+	"github.com/lucasew/ts-proxy/pkg/tsproxy"
+	"tailscale.com/client/local"
+	"tailscale.com/client/tailscale/apitype"
+)
+
+// MetricsHandler serves the Prometheus metrics of the whole process on
+// metrics.Path.
+type MetricsHandler struct {
+	mux    *http.ServeMux
+	conns  atomic.Int64
+	whoIs  WhoIsFunc
+	access *access.Policy
+}
+
+// NewMetrics creates a metrics handler.
+func NewMetrics() *MetricsHandler {
+	mux := http.NewServeMux()
+	mux.Handle("GET "+metrics.Path, metrics.HTTPHandler())
+	return &MetricsHandler{mux: mux}
+}
+
+// WithHealth also serves HealthzPath and ReadyzPath from c, so metrics and
+// probes can share one listener.
+func (h *MetricsHandler) WithHealth(c HealthChecker) *MetricsHandler {
+	mountHealth(h.mux, c)
+	return h
+}
+
+// Restrict limits scrapes to peers policy allows, identified with whoIs.
+// The per-user labels are not for the whole tailnet to read. A nil policy
+// allows everyone.
+func (h *MetricsHandler) Restrict(whoIs WhoIsFunc, policy *access.Policy) *MetricsHandler {
+	h.whoIs = whoIs
+	h.access = policy
+	return h
+}
+
+func (h *MetricsHandler) Serve(ctx context.Context, ln net.Listener) error {
+	return serveHTTP(ctx, ln, h, &h.conns)
+}
+
+func (h *MetricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.access != nil {
+		var who *apitype.WhoIsResponse
+		if h.whoIs != nil {
+			var err error
+			who, err = h.whoIs(r.Context(), r.RemoteAddr)
+			if err != nil && !errors.Is(err, local.ErrPeerNotFound) {
+				tsproxy.ReportError(err, "context", "metrics whois error")
+				http.Error(w, "whois failed", http.StatusInternalServerError)
+				return
+			}
+		}
+		if !h.access.Allows(who) {
+			login, node := access.Describe(who)
+			slog.Info("access denied", "user", login, "node", node, "remote", r.RemoteAddr, "url", r.URL.String())
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+	}
+	h.mux.ServeHTTP(w, r)
+}
+
+// ActiveConnections returns the number of open client connections.
+func (h *MetricsHandler) ActiveConnections() int {
+	return int(h.conns.Load())
+}
@@ -0,0 +1,175 @@
+package handler
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/lucasew/ts-proxy/pkg/access"
+	"github.com/lucasew/ts-proxy/pkg/accesslog"
+	"github.com/lucasew/ts-proxy/pkg/metrics"
+	"github.com/lucasew/ts-proxy/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"tailscale.com/client/tailscale/apitype"
+)
+
+// exchange wraps the ResponseWriter of one request to record what the
+// client was sent and who asked, for metrics and the access log.
+type exchange struct {
+	http.ResponseWriter
+	status   int
+	bytes    int64
+	who      *apitype.WhoIsResponse
+	upstream string
+}
+
+func (e *exchange) WriteHeader(code int) {
+	if e.status == 0 && code >= 200 {
+		e.status = code
+	}
+	e.ResponseWriter.WriteHeader(code)
+}
+
+func (e *exchange) Write(b []byte) (int, error) {
+	if e.status == 0 {
+		e.status = http.StatusOK
+	}
+	n, err := e.ResponseWriter.Write(b)
+	e.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach Flush and Hijack, which the
+// reverse proxy needs for streaming and protocol upgrades.
+func (e *exchange) Unwrap() http.ResponseWriter {
+	return e.ResponseWriter
+}
+
+// code is the status sent to the client; 200 when the handler wrote nothing.
+func (e *exchange) code() int {
+	if e.status == 0 {
+		return http.StatusOK
+	}
+	return e.status
+}
+
+// observers record HTTP requests; nil fields record nothing.
+type observers struct {
+	metrics   *metrics.Handler
+	accessLog *accesslog.Handler
+	tracing   *tracing.Handler
+}
+
+// observe runs serve for one request inside a span, then records it in
+// metrics and the access log from what serve left in the exchange.
+func (o observers) observe(w http.ResponseWriter, r *http.Request, serve func(*exchange, *http.Request)) {
+	ex := &exchange{ResponseWriter: w}
+	start := time.Now()
+	uri := r.RequestURI
+	r, span := o.tracing.Start(r)
+	serve(ex, r)
+	elapsed := time.Since(start)
+	span.SetAttributes(traceAttributes(ex.who, ex.upstream)...)
+	tracing.End(span, ex.code())
+	o.metrics.ObserveHTTP(ex.code(), userLabel(ex.who), elapsed)
+	if o.accessLog != nil {
+		e := accesslog.Entry{
+			Time:      start,
+			Protocol:  "http",
+			Method:    r.Method,
+			Host:      r.Host,
+			URI:       uri,
+			Proto:     r.Proto,
+			Status:    ex.code(),
+			Referer:   r.Referer(),
+			UserAgent: r.UserAgent(),
+			Upstream:  ex.upstream,
+			BytesOut:  ex.bytes,
+			Duration:  elapsed,
+		}
+		identify(&e, r.RemoteAddr, ex.who)
+		o.accessLog.Log(e)
+	}
+}
+
+// userLabel is the metrics label for the peer: its login, UserTagged for
+// tagged devices or UserAnonymous for unidentified (Funnel) clients.
+func userLabel(who *apitype.WhoIsResponse) string {
+	switch {
+	case who == nil || who.UserProfile == nil:
+		return metrics.UserAnonymous
+	case who.UserProfile.LoginName == access.TaggedDevicesLogin:
+		return metrics.UserTagged
+	default:
+		return who.UserProfile.LoginName
+	}
+}
+
+// identify fills in the peer fields of an access log entry. Peers WhoIs
+// could not identify are Funnel clients.
+func identify(e *accesslog.Entry, remote string, who *apitype.WhoIsResponse) {
+	e.Remote = remote
+	if who == nil {
+		e.Origin = accesslog.OriginFunnel
+		return
+	}
+	e.Origin = accesslog.OriginTailnet
+	e.User, e.Node = access.Describe(who)
+}
+
+// timedTransport records how long the upstream takes to answer with
+// response headers.
+type timedTransport struct {
+	http.RoundTripper
+	metrics *metrics.Handler
+}
+
+func (t timedTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.RoundTripper.RoundTrip(r)
+	if err == nil {
+		t.metrics.ObserveUpstream(time.Since(start))
+	}
+	return resp, err
+}
+
+// traceAttributes describe the peer and the upstream that served it.
+func traceAttributes(who *apitype.WhoIsResponse, upstream string) []attribute.KeyValue {
+	origin := accesslog.OriginTailnet
+	if who == nil {
+		origin = accesslog.OriginFunnel
+	}
+	attrs := []attribute.KeyValue{
+		tracing.AttrUser.String(userLabel(who)),
+		tracing.AttrOrigin.String(origin),
+	}
+	if _, node := access.Describe(who); node != "" {
+		attrs = append(attrs, tracing.AttrNode.String(node))
+	}
+	if upstream != "" {
+		attrs = append(attrs, tracing.AttrUpstream.String(upstream))
+	}
+	return attrs
+}
+
+// tracedTransport wraps each upstream round trip in a client span and
+// passes the trace context on in traceparent. The span ends when response
+// headers arrive.
+type tracedTransport struct {
+	http.RoundTripper
+	tracing *tracing.Handler
+}
+
+func (t tracedTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	upstream := r.URL.Host
+	if b, ok := r.Context().Value(backendContextKey{}).(*backend); ok {
+		upstream = b.address
+	}
+	r, span := t.tracing.StartUpstream(r, upstream)
+	resp, err := t.RoundTripper.RoundTrip(r)
+	if err != nil {
+		tracing.Fail(span, err)
+		return nil, err
+	}
+	tracing.End(span, resp.StatusCode)
+	return resp, nil
+}
@@ -0,0 +1,243 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/lucasew/ts-proxy/pkg/accesslog"
+	"github.com/lucasew/ts-proxy/pkg/metrics"
+	"github.com/lucasew/ts-proxy/pkg/tracing"
+	"github.com/lucasew/ts-proxy/pkg/tsproxy"
+	"tailscale.com/client/local"
+)
+
+const (
+	HeaderCacheControl        = "Cache-Control"
+	HeaderETag                = "ETag"
+	HeaderXContentTypeOptions = "X-Content-Type-Options"
+
+	// indexFile is served for directory requests and as the SPA fallback.
+	indexFile = "index.html"
+
+	// cacheControlRevalidate makes browsers revalidate on every use. HTML
+	// entry points always get this so a new deploy is picked up immediately;
+	// Last-Modified/ETag keep the revalidation cheap (304).
+	cacheControlRevalidate = "no-cache"
+)
+
+// StaticOptions configures a static file handler.
+type StaticOptions struct {
+	// Root is the local directory to serve.
+	Root string
+	// SPA serves Root/index.html for paths that do not exist, so client-side
+	// routers can handle them. Only paths without an extension and requests
+	// that accept HTML fall back; a missing asset such as /app.js stays 404.
+	SPA bool
+	// DirectoryListing enables auto-generated listings for directories
+	// without an index.html.
+	DirectoryListing bool
+	// CacheMaxAge is the max-age (seconds) sent for non-HTML assets. Zero
+	// means assets are revalidated on every use like HTML.
+	CacheMaxAge int
+	// WhoIs identifies peers for metrics, the access log and spans; nil
+	// treats every request as anonymous.
+	WhoIs WhoIsFunc
+	// Metrics records requests; nil records nothing.
+	Metrics *metrics.Handler
+	// AccessLog gets one record per completed request; nil logs nothing.
+	AccessLog *accesslog.Handler
+	// Tracing exports a span per request; nil exports nothing.
+	Tracing *tracing.Handler
+}
+
+// StaticHandler serves a local directory over HTTP.
+type StaticHandler struct {
+	opts  StaticOptions
+	fs    http.FileSystem
+	files http.Handler
+	conns atomic.Int64
+}
+
+// NewStatic creates a handler that serves files from opts.Root.
+func NewStatic(opts StaticOptions) *StaticHandler {
+	fsys := staticFS{root: http.Dir(opts.Root), listing: opts.DirectoryListing}
+	return &StaticHandler{
+		opts:  opts,
+		fs:    fsys,
+		files: http.FileServer(fsys),
+	}
+}
+
+func (h *StaticHandler) Serve(ctx context.Context, ln net.Listener) error {
+	return serveHTTP(ctx, ln, h, &h.conns)
+}
+
+// ActiveConnections returns the number of open client connections.
+func (h *StaticHandler) ActiveConnections() int {
+	return int(h.conns.Load())
+}
+
+func (h *StaticHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	o := observers{metrics: h.opts.Metrics, accessLog: h.opts.AccessLog, tracing: h.opts.Tracing}
+	o.observe(w, r, h.serve)
+}
+
+func (h *StaticHandler) serve(w *exchange, r *http.Request) {
+	if h.opts.WhoIs != nil {
+		// Identity only labels the request here, so a failed lookup is
+		// reported but does not stop the file from being served.
+		who, err := h.opts.WhoIs(r.Context(), r.RemoteAddr)
+		if err != nil && !errors.Is(err, local.ErrPeerNotFound) {
+			tsproxy.ReportError(err, "context", "static whois error")
+		}
+		w.who = who
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set(HeaderXContentTypeOptions, "nosniff")
+
+	upath := path.Clean("/" + r.URL.Path)
+	f, err := h.fs.Open(upath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) && h.opts.SPA && spaRoute(r, upath) {
+			h.serveIndex(w, r)
+			return
+		}
+		writeFSError(w, r, err)
+		return
+	}
+	info, err := f.Stat()
+	closeFile(f)
+	if err != nil {
+		writeFSError(w, r, err)
+		return
+	}
+
+	if info.IsDir() || isHTML(upath) {
+		w.Header().Set(HeaderCacheControl, cacheControlRevalidate)
+	} else {
+		w.Header().Set(HeaderCacheControl, h.assetCacheControl())
+		w.Header().Set(HeaderETag, weakETag(info))
+	}
+	h.files.ServeHTTP(w, r)
+}
+
+// serveIndex answers with Root/index.html regardless of the request path.
+func (h *StaticHandler) serveIndex(w http.ResponseWriter, r *http.Request) {
+	f, err := h.fs.Open("/" + indexFile)
+	if err != nil {
+		writeFSError(w, r, err)
+		return
+	}
+	defer closeFile(f)
+	info, err := f.Stat()
+	if err != nil {
+		writeFSError(w, r, err)
+		return
+	}
+	w.Header().Set(HeaderCacheControl, cacheControlRevalidate)
+	http.ServeContent(w, r, indexFile, info.ModTime(), f)
+}
+
+// spaRoute reports whether a missing path should get the SPA index:
+// client-side routes such as /users/42 have no extension, and browsers
+// navigating anywhere accept HTML. A missing /assets/app.js stays a 404
+// instead of answering a script request with HTML.
+func spaRoute(r *http.Request, upath string) bool {
+	return path.Ext(upath) == "" || strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+func (h *StaticHandler) assetCacheControl() string {
+	if h.opts.CacheMaxAge <= 0 {
+		return cacheControlRevalidate
+	}
+	return "public, max-age=" + strconv.Itoa(h.opts.CacheMaxAge)
+}
+
+func isHTML(name string) bool {
+	ext := strings.ToLower(path.Ext(name))
+	return ext == ".html" || ext == ".htm"
+}
+
+// weakETag derives a validator from size and modification time, which is
+// what http.FileServer already uses for Last-Modified; no file hashing.
+func weakETag(info fs.FileInfo) string {
+	return fmt.Sprintf(`W/"%x-%x"`, info.Size(), info.ModTime().UnixNano())
+}
+
+// writeFSError maps filesystem errors to responses without leaking paths.
+func writeFSError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		http.NotFound(w, r)
+	case errors.Is(err, fs.ErrPermission):
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	default:
+		tsproxy.ReportError(err, "context", "static file error", "path", r.URL.Path)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
+// wellKnownDir holds site metadata such as security.txt or ACME
+// challenges, so it is served despite its leading dot.
+const wellKnownDir = ".well-known"
+
+// staticFS wraps http.Dir with the policy the handler promises: dotfiles
+// (.git, .env, ...) are never served, except the top-level .well-known
+// directory (RFC 8615), and directories without an index.html
+// look nonexistent unless listing is enabled. Returning fs.ErrNotExist for
+// those lets the SPA fallback and plain 404 paths treat them uniformly.
+type staticFS struct {
+	root    http.FileSystem
+	listing bool
+}
+
+func (s staticFS) Open(name string) (http.File, error) {
+	for i, part := range strings.Split(name, "/") {
+		if i == 1 && part == wellKnownDir {
+			continue
+		}
+		if strings.HasPrefix(part, ".") {
+			return nil, fs.ErrNotExist
+		}
+	}
+	f, err := s.root.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if s.listing {
+		return f, nil
+	}
+	info, err := f.Stat()
+	if err != nil {
+		closeFile(f)
+		return nil, err
+	}
+	if !info.IsDir() {
+		return f, nil
+	}
+	index, err := s.root.Open(path.Join(name, indexFile))
+	if err != nil {
+		closeFile(f)
+		return nil, fs.ErrNotExist
+	}
+	closeFile(index)
+	return f, nil
+}
+
+func closeFile(f http.File) {
+	if err := f.Close(); err != nil {
+		tsproxy.ReportError(err, "context", "static file close error")
+	}
+}
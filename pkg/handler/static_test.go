@@ -0,0 +1,281 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lucasew/ts-proxy/pkg/accesslog"
+	"github.com/lucasew/ts-proxy/pkg/metrics"
+	"github.com/lucasew/ts-proxy/pkg/tracing"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+// writeTree creates files (relative path -> content) under a temp dir.
+func writeTree(t *testing.T, files map[string]string) string {
+	t.Helper()
+	root := t.TempDir()
+	for name, content := range files {
+		p := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatalf("mkdir %s: %v", name, err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+	return root
+}
+
+func serveStatic(h *StaticHandler, method, target string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestStaticServesFilesAndIndex(t *testing.T) {
+	root := writeTree(t, map[string]string{
+		"index.html":      "<h1>home</h1>",
+		"assets/app.js":   "console.log(1)",
+		"docs/index.html": "<h1>docs</h1>",
+	})
+	h := NewStatic(StaticOptions{Root: root, CacheMaxAge: 3600})
+
+	rec := serveStatic(h, http.MethodGet, "/")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "home") {
+		t.Fatalf("GET / = %d %q, want index.html", rec.Code, rec.Body.String())
+	}
+	if cc := rec.Header().Get(HeaderCacheControl); cc != "no-cache" {
+		t.Errorf("index Cache-Control = %q, want no-cache", cc)
+	}
+
+	rec = serveStatic(h, http.MethodGet, "/assets/app.js")
+	if rec.Code != http.StatusOK || rec.Body.String() != "console.log(1)" {
+		t.Fatalf("GET /assets/app.js = %d %q", rec.Code, rec.Body.String())
+	}
+	if cc := rec.Header().Get(HeaderCacheControl); cc != "public, max-age=3600" {
+		t.Errorf("asset Cache-Control = %q, want public, max-age=3600", cc)
+	}
+	etag := rec.Header().Get(HeaderETag)
+	if !strings.HasPrefix(etag, `W/"`) {
+		t.Fatalf("asset ETag = %q, want weak validator", etag)
+	}
+	if rec.Header().Get("Last-Modified") == "" {
+		t.Error("asset response missing Last-Modified")
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/assets/app.js", nil)
+	req.Header.Set("If-None-Match", etag)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotModified {
+		t.Errorf("conditional GET status = %d, want 304", rec.Code)
+	}
+
+	rec = serveStatic(h, http.MethodGet, "/docs/")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "docs") {
+		t.Errorf("GET /docs/ = %d %q, want docs index", rec.Code, rec.Body.String())
+	}
+}
+
+func TestStaticAssetsRevalidateByDefault(t *testing.T) {
+	root := writeTree(t, map[string]string{"app.css": "body{}"})
+	h := NewStatic(StaticOptions{Root: root})
+
+	rec := serveStatic(h, http.MethodGet, "/app.css")
+	if cc := rec.Header().Get(HeaderCacheControl); cc != "no-cache" {
+		t.Errorf("Cache-Control = %q, want no-cache when cache_max_age is unset", cc)
+	}
+}
+
+func TestStaticMissingPath(t *testing.T) {
+	root := writeTree(t, map[string]string{"index.html": "<h1>app</h1>"})
+
+	plain := NewStatic(StaticOptions{Root: root})
+	if rec := serveStatic(plain, http.MethodGet, "/users/42"); rec.Code != http.StatusNotFound {
+		t.Errorf("non-SPA unknown path status = %d, want 404", rec.Code)
+	}
+
+	spa := NewStatic(StaticOptions{Root: root, SPA: true})
+	rec := serveStatic(spa, http.MethodGet, "/users/42")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "app") {
+		t.Fatalf("SPA unknown path = %d %q, want index.html", rec.Code, rec.Body.String())
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("SPA fallback Content-Type = %q, want text/html", ct)
+	}
+	if cc := rec.Header().Get(HeaderCacheControl); cc != "no-cache" {
+		t.Errorf("SPA fallback Cache-Control = %q, want no-cache", cc)
+	}
+
+	// A missing asset must not come back as HTML with a 200.
+	if rec := serveStatic(spa, http.MethodGet, "/assets/app.js"); rec.Code != http.StatusNotFound {
+		t.Errorf("SPA missing asset status = %d, want 404", rec.Code)
+	}
+	// Unless a browser navigates there, e.g. a route with a dot in it.
+	req := httptest.NewRequest(http.MethodGet, "/releases/v1.2", nil)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+	rec = httptest.NewRecorder()
+	spa.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "app") {
+		t.Errorf("SPA navigation to a dotted path = %d %q, want index.html", rec.Code, rec.Body.String())
+	}
+}
+
+// Static handlers are observed like http handlers: a span, request metrics
+// and an access log record per request.
+func TestStaticObserved(t *testing.T) {
+	root := writeTree(t, map[string]string{"index.html": "<h1>app</h1>"})
+	var buf strings.Builder
+	logger, err := accesslog.NewWriter(&buf, accesslog.FormatJSON)
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+	recorder := tracetest.NewSpanRecorder()
+	provider := tracing.NewWithProcessor(recorder)
+	h := NewStatic(StaticOptions{
+		Root:      root,
+		Metrics:   metrics.ForHandler("static_metrics_test", ":80"),
+		AccessLog: logger.ForHandler("docs", ":80"),
+		Tracing:   provider.ForHandler("docs", ":80"),
+		WhoIs: func(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+			return &apitype.WhoIsResponse{
+				UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com"},
+				Node:        &tailcfg.Node{Name: "laptop.example.ts.net."},
+			}, nil
+		},
+	})
+	serveStatic(h, http.MethodGet, "/missing.css")
+
+	var entry map[string]any
+	if err := json.Unmarshal([]byte(buf.String()), &entry); err != nil {
+		t.Fatalf("access log %q: %v", buf.String(), err)
+	}
+	if entry["server"] != "docs" || entry["status"] != float64(http.StatusNotFound) || entry["user"] != "alice@example.com" {
+		t.Errorf("access log entry = %v, want server docs, status 404, user alice@example.com", entry)
+	}
+	if spans := recorder.Ended(); len(spans) != 1 {
+		t.Errorf("recorded %d spans, want 1", len(spans))
+	}
+
+	rec := httptest.NewRecorder()
+	NewMetrics().mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, metrics.Path, nil))
+	want := `ts_proxy_http_requests_total{code="404",handler=":80",server="static_metrics_test",user="alice@example.com"} 1`
+	if !strings.Contains(rec.Body.String(), want+"\n") {
+		t.Errorf("metrics missing %q", want)
+	}
+}
+
+func TestStaticDirectoryListing(t *testing.T) {
+	root := writeTree(t, map[string]string{"files/report.pdf": "pdf"})
+
+	hidden := NewStatic(StaticOptions{Root: root})
+	if rec := serveStatic(hidden, http.MethodGet, "/files/"); rec.Code != http.StatusNotFound {
+		t.Errorf("listing disabled status = %d, want 404", rec.Code)
+	}
+
+	listed := NewStatic(StaticOptions{Root: root, DirectoryListing: true})
+	rec := serveStatic(listed, http.MethodGet, "/files/")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "report.pdf") {
+		t.Errorf("listing enabled = %d %q, want entry report.pdf", rec.Code, rec.Body.String())
+	}
+}
+
+func TestStaticHidesDotfilesAndTraversal(t *testing.T) {
+	root := writeTree(t, map[string]string{
+		"index.html":  "<h1>app</h1>",
+		".env":        "SECRET=1",
+		".git/config": "[core]",
+
+		".well-known/security.txt":        "Contact: mailto:security@example.com",
+		".well-known/.env":                "SECRET=2",
+		"assets/.well-known/security.txt": "Contact: nested",
+	})
+	h := NewStatic(StaticOptions{Root: root, DirectoryListing: true})
+
+	for _, target := range []string{"/.env", "/.git/config", "/../" + filepath.Base(root) + "/.env"} {
+		rec := serveStatic(h, http.MethodGet, target)
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("GET %s status = %d, want 404", target, rec.Code)
+		}
+		if strings.Contains(rec.Body.String(), "SECRET") || strings.Contains(rec.Body.String(), "[core]") {
+			t.Errorf("GET %s leaked file content", target)
+		}
+	}
+
+	rec := serveStatic(h, http.MethodGet, "/.well-known/security.txt")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "Contact:") {
+		t.Errorf("GET /.well-known/security.txt = %d %q, want the file", rec.Code, rec.Body.String())
+	}
+	for _, target := range []string{"/.well-known/.env", "/assets/.well-known/security.txt"} {
+		if rec := serveStatic(h, http.MethodGet, target); rec.Code != http.StatusNotFound {
+			t.Errorf("GET %s status = %d, want 404", target, rec.Code)
+		}
+	}
+
+	// SPA mode must not turn a hidden file into a fallback that reveals it.
+	spa := NewStatic(StaticOptions{Root: root, SPA: true})
+	if rec := serveStatic(spa, http.MethodGet, "/.env"); strings.Contains(rec.Body.String(), "SECRET") {
+		t.Error("SPA fallback leaked .env content")
+	}
+}
+
+func TestStaticRejectsWrites(t *testing.T) {
+	root := writeTree(t, map[string]string{"index.html": "x"})
+	h := NewStatic(StaticOptions{Root: root})
+
+	rec := serveStatic(h, http.MethodPost, "/")
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST status = %d, want 405", rec.Code)
+	}
+	if allow := rec.Header().Get("Allow"); allow != "GET, HEAD" {
+		t.Errorf("Allow = %q, want GET, HEAD", allow)
+	}
+}
+
+func TestStaticCountsConnections(t *testing.T) {
+	h := NewStatic(StaticOptions{Root: writeTree(t, map[string]string{"index.html": "hi"})})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- h.Serve(ctx, ln) }()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// A keep-alive client holds its connection open between requests.
+	client := &http.Client{Transport: &http.Transport{}}
+	resp, err := client.Get("http://" + ln.Addr().String() + "/")
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+	if n := h.ActiveConnections(); n != 1 {
+		t.Errorf("ActiveConnections with an idle keep-alive = %d, want 1", n)
+	}
+
+	client.CloseIdleConnections()
+	deadline := time.Now().Add(2 * time.Second)
+	for h.ActiveConnections() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := h.ActiveConnections(); n != 0 {
+		t.Errorf("ActiveConnections after close = %d, want 0", n)
+	}
+}
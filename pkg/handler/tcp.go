@@ -7,10 +7,16 @@ import (
 	"log/slog"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/lucasew/ts-proxy/internal/ctxwait"
+	"github.com/lucasew/ts-proxy/pkg/access"
+	"github.com/lucasew/ts-proxy/pkg/accesslog"
+	"github.com/lucasew/ts-proxy/pkg/metrics"
 	"github.com/lucasew/ts-proxy/pkg/tsproxy"
+	"tailscale.com/client/local"
+	"tailscale.com/client/tailscale/apitype"
 )
 
 // DefaultTCPDialTimeout is how long handleConn waits when dialing upstream
@@ -38,9 +44,18 @@ var bufferPool = sync.Pool{
 
 // TCPHandler forwards raw TCP connections to an upstream.
 type TCPHandler struct {
-	upstreamNetwork string
-	upstreamAddress string
-	dialTimeout     time.Duration
+	upstream    *Balancer
+	dialTimeout time.Duration
+
+	// whoIs and access gate connections by peer identity; see Restrict.
+	whoIs  WhoIsFunc
+	access *access.Policy
+
+	// metrics records connections and bytes; nil records nothing.
+	metrics *metrics.Handler
+
+	// accessLog gets one record per session; nil logs nothing.
+	accessLog *accesslog.Handler
 
 	// acceptErrorLogEvery is how often permanent Accept failures may be
 	// logged. Zero means acceptErrorLogInterval. Tests may set a short
@@ -54,6 +69,10 @@ type TCPHandler struct {
 	mu     sync.Mutex
 	active map[net.Conn]struct{}
 
+	// clients counts open client connections; active also holds the
+	// upstream side of each session.
+	clients atomic.Int64
+
 	// sessions tracks in-flight handleConn goroutines. Serve waits on it
 	// after shutdown so the caller does not tear down tsnet while copies
 	// are still running.
@@ -66,20 +85,78 @@ type TCPHandler struct {
 
 // NewTCP creates a handler that forwards raw TCP connections.
 func NewTCP(upstreamNetwork, upstreamAddress string) *TCPHandler {
+	return NewTCPBalanced(singleUpstream(upstreamNetwork, upstreamAddress))
+}
+
+// NewTCPBalanced creates a handler that spreads connections over the
+// balancer's backends.
+func NewTCPBalanced(upstream *Balancer) *TCPHandler {
 	return &TCPHandler{
-		upstreamNetwork: upstreamNetwork,
-		upstreamAddress: upstreamAddress,
-		dialTimeout:     DefaultTCPDialTimeout,
-		active:          make(map[net.Conn]struct{}),
+		upstream:    upstream,
+		dialTimeout: DefaultTCPDialTimeout,
+		active:      make(map[net.Conn]struct{}),
 	}
 }
 
+// Restrict makes the handler close connections from peers the policy does
+// not allow. Peers that WhoIs cannot identify are treated as anonymous.
+func (h *TCPHandler) Restrict(whoIs WhoIsFunc, policy *access.Policy) *TCPHandler {
+	h.whoIs = whoIs
+	h.access = policy
+	return h
+}
+
+// Instrument makes the handler record its traffic in m.
+func (h *TCPHandler) Instrument(m *metrics.Handler) *TCPHandler {
+	h.metrics = m
+	return h
+}
+
+// LogAccess makes the handler write a record for every session to l.
+func (h *TCPHandler) LogAccess(l *accesslog.Handler) *TCPHandler {
+	h.accessLog = l
+	return h
+}
+
+// permitted reports whether the peer behind conn passes the access policy,
+// along with who the peer is when that was looked up. WhoIs is only asked
+// when a policy or the access log needs the answer. WhoIs failures other
+// than "peer not found" deny under a policy: a broken LocalAPI must not
+// silently open a restricted service.
+func (h *TCPHandler) permitted(ctx context.Context, conn net.Conn) (*apitype.WhoIsResponse, bool) {
+	if h.access == nil && h.accessLog == nil {
+		return nil, true
+	}
+	var who *apitype.WhoIsResponse
+	if h.whoIs != nil {
+		var err error
+		who, err = h.whoIs(ctx, conn.RemoteAddr().String())
+		if err != nil && !errors.Is(err, local.ErrPeerNotFound) {
+			if ctx.Err() == nil {
+				tsproxy.ReportError(err, "context", "tcp whois error")
+			}
+			return nil, h.access == nil
+		}
+	}
+	if h.access == nil || h.access.Allows(who) {
+		return who, true
+	}
+	login, node := access.Describe(who)
+	slog.Info("access denied", "user", login, "node", node, "remote", conn.RemoteAddr())
+	return who, false
+}
+
 func (h *TCPHandler) track(c net.Conn) {
 	h.mu.Lock()
 	h.active[c] = struct{}{}
 	h.mu.Unlock()
 }
 
+// ActiveConnections returns the number of open client connections.
+func (h *TCPHandler) ActiveConnections() int {
+	return int(h.clients.Load())
+}
+
 func (h *TCPHandler) untrack(c net.Conn) {
 	h.mu.Lock()
 	delete(h.active, c)
@@ -105,6 +182,7 @@ func (h *TCPHandler) closeActive() {
 }
 
 func (h *TCPHandler) Serve(ctx context.Context, ln net.Listener) error {
+	go h.upstream.RunHealthChecks(ctx)
 	go func() {
 		<-ctx.Done()
 		if err := ln.Close(); err != nil {
@@ -123,6 +201,7 @@ func (h *TCPHandler) Serve(ctx context.Context, ln net.Listener) error {
 				h.sessions.Wait()
 				return nil
 			}
+			h.metrics.AcceptError()
 			// Rate-limit: first failure always logs; further failures while
 			// Accept stays broken log at most once per interval.
 			interval := h.acceptErrorLogEvery
@@ -144,10 +223,13 @@ func (h *TCPHandler) Serve(ctx context.Context, ln net.Listener) error {
 		}
 		// Successful accept: allow the next failure to log immediately.
 		h.lastAcceptErrorLog = time.Time{}
-		slog.Info("tcp connection", "remote", conn.RemoteAddr())
+		h.metrics.ConnAccepted()
+		h.clients.Add(1)
 		h.sessions.Add(1)
 		go func() {
 			defer h.sessions.Done()
+			defer h.metrics.ConnClosed()
+			defer h.clients.Add(-1)
 			h.handleConn(ctx, conn)
 		}()
 	}
@@ -163,16 +245,35 @@ func (h *TCPHandler) handleConn(ctx context.Context, downstream net.Conn) {
 	h.track(downstream)
 	defer h.untrack(downstream)
 
+	session := accesslog.Entry{Time: time.Now(), Protocol: "tcp"}
+	defer func() {
+		session.Duration = time.Since(session.Time)
+		h.accessLog.Log(session)
+	}()
+
+	who, ok := h.permitted(ctx, downstream)
+	identify(&session, downstream.RemoteAddr().String(), who)
+	if !ok {
+		session.Error = "access denied"
+		if err := downstream.Close(); err != nil {
+			tsproxy.ReportError(err, "context", "downstream close error")
+		}
+		return
+	}
+	// Logged once allowed; permitted logs denials itself.
+	slog.Info("tcp connection", "remote", downstream.RemoteAddr())
+
 	timeout := h.dialTimeout
 	if timeout <= 0 {
 		timeout = DefaultTCPDialTimeout
 	}
-	d := net.Dialer{Timeout: timeout}
-	upstream, err := d.DialContext(ctx, h.upstreamNetwork, h.upstreamAddress)
+	upstream, err := h.upstream.DialContext(ctx, timeout)
 	if err != nil {
+		session.Error = err.Error()
 		// Cancel during shutdown is expected; real dial failures are not.
 		if ctx.Err() == nil {
-			tsproxy.ReportError(err, "context", "tcp dial upstream", "upstream", h.upstreamAddress)
+			h.metrics.DialFailed()
+			tsproxy.ReportError(err, "context", "tcp dial upstream", "upstream", h.upstream.String())
 		}
 		if cerr := downstream.Close(); cerr != nil && ctx.Err() == nil {
 			tsproxy.ReportError(cerr, "context", "downstream close error")
@@ -181,6 +282,7 @@ func (h *TCPHandler) handleConn(ctx context.Context, downstream net.Conn) {
 	}
 	h.track(upstream)
 	defer h.untrack(upstream)
+	session.Upstream = upstream.RemoteAddr().String()
 
 	// Proxy each direction independently. When one side finishes writing we
 	// half-close (CloseWrite) the destination so the peer can still finish
@@ -188,11 +290,13 @@ func (h *TCPHandler) handleConn(ctx context.Context, downstream net.Conn) {
 	// would truncate responses for protocols that half-close after a request
 	// (and for any asymmetric transfer).
 	var wg sync.WaitGroup
-	cp := func(dst, src net.Conn) {
+	cp := func(dst, src net.Conn, total *int64, record func(int64)) {
 		defer wg.Done()
 		buf := bufferPool.Get().(*[]byte)
 		defer bufferPool.Put(buf)
-		_, err := io.CopyBuffer(dst, src, *buf)
+		n, err := io.CopyBuffer(dst, src, *buf)
+		*total = n
+		record(n)
 		// Context cancel force-closes both ends; copy errors then are expected.
 		shutdown := ctx.Err() != nil
 		if err != nil && !shutdown {
@@ -201,8 +305,8 @@ func (h *TCPHandler) handleConn(ctx context.Context, downstream net.Conn) {
 		closeWrite(dst)
 	}
 	wg.Add(2)
-	go cp(downstream, upstream)
-	go cp(upstream, downstream)
+	go cp(downstream, upstream, &session.BytesOut, h.metrics.BytesOut)
+	go cp(upstream, downstream, &session.BytesIn, h.metrics.BytesIn)
 	wg.Wait()
 
 	// Full close after both directions finish (or are aborted by cancel).
@@ -3,6 +3,7 @@ package handler
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"io"
 	"log/slog"
@@ -12,6 +13,11 @@ import (
 	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/lucasew/ts-proxy/pkg/access"
+	"github.com/lucasew/ts-proxy/pkg/accesslog"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
 )
 
 // ErrAcceptTransient is a non-closed Accept failure used to exercise the
@@ -522,3 +528,186 @@ func TestServeDrainsSessionsBeforeReturn(t *testing.T) {
 		t.Fatalf("after Serve return: %d active connections still tracked", left)
 	}
 }
+
+// TestServeAccessPolicyClosesDenied ensures a denied peer is disconnected
+// without the upstream ever being dialed, while an allowed peer is proxied.
+// lockedWriter serializes writes so tests can read a log that connection
+// goroutines write to.
+type lockedWriter struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (w *lockedWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.Write(p)
+}
+
+func (w *lockedWriter) String() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.String()
+}
+
+func TestServeAccessPolicyClosesDenied(t *testing.T) {
+	var log lockedWriter
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&log, nil)))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+
+	upLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("upstream listen: %v", err)
+	}
+	defer upLn.Close()
+	var upAccepts atomic.Int64
+	go func() {
+		for {
+			c, err := upLn.Accept()
+			if err != nil {
+				return
+			}
+			upAccepts.Add(1)
+			go func() {
+				defer c.Close()
+				_, _ = c.Write([]byte("hello"))
+			}()
+		}
+	}()
+
+	proxyLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("proxy listen: %v", err)
+	}
+	allowed := ""
+	var mu sync.Mutex
+	policy, err := access.NewPolicy([]string{"alice@example.com"}, nil, "")
+	if err != nil {
+		t.Fatalf("NewPolicy: %v", err)
+	}
+	h := NewTCP("tcp", upLn.Addr().String()).Restrict(func(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if remoteAddr == allowed {
+			return &apitype.WhoIsResponse{UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com"}}, nil
+		}
+		return &apitype.WhoIsResponse{UserProfile: &tailcfg.UserProfile{LoginName: "eve@example.com"}}, nil
+	}, policy)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	startServe(ctx, h, proxyLn)
+
+	denied, err := net.Dial("tcp", proxyLn.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer denied.Close()
+	if err := denied.SetReadDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		t.Fatalf("SetReadDeadline: %v", err)
+	}
+	if b, err := io.ReadAll(denied); err != nil || len(b) != 0 {
+		t.Fatalf("denied peer read = %q, %v; want immediate EOF", b, err)
+	}
+	if n := upAccepts.Load(); n != 0 {
+		t.Fatalf("upstream accepted %d conns for a denied peer, want 0", n)
+	}
+
+	ok, err := net.Dial("tcp", proxyLn.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ok.Close()
+	// The proxy sees the client's local address as its remote address.
+	mu.Lock()
+	allowed = ok.LocalAddr().String()
+	mu.Unlock()
+	if err := ok.SetReadDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		t.Fatalf("SetReadDeadline: %v", err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(ok, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("allowed peer read = %q, %v; want hello", buf, err)
+	}
+	// Only the allowed session is logged as a connection.
+	if out := log.String(); strings.Count(out, `msg="tcp connection"`) != 1 || strings.Count(out, `msg="access denied"`) != 1 {
+		t.Errorf("log = %q, want one tcp connection and one access denied line", out)
+	}
+}
+
+func TestServeAccessLogSessions(t *testing.T) {
+	upLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("upstream listen: %v", err)
+	}
+	defer upLn.Close()
+	go func() {
+		for {
+			c, err := upLn.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				_, _ = io.ReadFull(c, make([]byte, 4))
+				_, _ = c.Write([]byte("hello"))
+			}()
+		}
+	}()
+
+	proxyLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("proxy listen: %v", err)
+	}
+	var buf bytes.Buffer
+	logger, err := accesslog.NewWriter(&buf, accesslog.FormatJSON)
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+	h := NewTCP("tcp", upLn.Addr().String()).Restrict(func(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+		return &apitype.WhoIsResponse{UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com"}}, nil
+	}, nil).LogAccess(logger.ForHandler("db", ":5432"))
+
+	ctx, cancel := context.WithCancel(t.Context())
+	done := startServe(ctx, h, proxyLn)
+
+	c, err := net.Dial("tcp", proxyLn.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	if _, err := c.Write([]byte("ping")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := c.SetReadDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		t.Fatalf("SetReadDeadline: %v", err)
+	}
+	if b, err := io.ReadAll(c); err != nil || string(b) != "hello" {
+		t.Fatalf("read = %q, %v; want hello", b, err)
+	}
+	c.Close()
+	// Serve waits for sessions to finish, so the entry is written by now.
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Serve: %v", err)
+	}
+
+	var got map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("unmarshal %q: %v", buf.String(), err)
+	}
+	for key, want := range map[string]any{
+		"server":    "db",
+		"handler":   ":5432",
+		"protocol":  "tcp",
+		"origin":    accesslog.OriginTailnet,
+		"user":      "alice@example.com",
+		"upstream":  upLn.Addr().String(),
+		"bytes_in":  float64(4),
+		"bytes_out": float64(5),
+	} {
+		if got[key] != want {
+			t.Errorf("%s = %v, want %v", key, got[key], want)
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lucasew/ts-proxy/internal/ctxwait"
+	"github.com/lucasew/ts-proxy/pkg/tsproxy"
+)
+
+// DefaultUDPIdleTimeout is how long a peer session may go without traffic in
+// either direction before its upstream socket is closed. UDP has no close
+// handshake, so idle expiry is the only way sessions end.
+const DefaultUDPIdleTimeout = 60 * time.Second
+
+// maxDatagramSize fits any UDP payload, so reads never truncate.
+const maxDatagramSize = 64 * 1024
+
+// maxPendingDatagrams bounds what a session queues while its upstream is
+// still being dialed; later datagrams are dropped, as UDP allows.
+const maxPendingDatagrams = 16
+
+var datagramPool = sync.Pool{
+	New: func() any {
+		b := make([]byte, maxDatagramSize)
+		return &b
+	},
+}
+
+// UDPHandler relays datagrams between tailnet peers and an upstream. Each
+// peer address gets its own upstream socket (NAT-style), so replies from the
+// upstream are routed back to the peer that caused them.
+type UDPHandler struct {
+	upstreamNetwork string
+	upstreamAddress string
+	idleTimeout     time.Duration
+	// dial opens a session's upstream socket; a net.Dialer outside tests.
+	dial func(ctx context.Context, network, address string) (net.Conn, error)
+
+	mu       sync.Mutex
+	sessions map[string]*udpSession
+
+	// relays tracks per-session dial and upstream read goroutines so
+	// ServePacket does not return while they can still write to the
+	// packet conn.
+	relays sync.WaitGroup
+
+	// lastReadErrorLog rate-limits ReadFrom failures like TCPHandler does
+	// for Accept. Guarded by the ServePacket loop (single goroutine).
+	lastReadErrorLog time.Time
+}
+
+type udpSession struct {
+	peer net.Addr
+
+	// mu guards upstream, which is nil while it is being dialed, and the
+	// datagrams that arrived meanwhile.
+	mu       sync.Mutex
+	upstream net.Conn
+	pending  [][]byte
+
+	// lastActive is the UnixNano time of the last datagram in either direction.
+	lastActive atomic.Int64
+}
+
+func (s *udpSession) touch() {
+	s.lastActive.Store(time.Now().UnixNano())
+}
+
+func (s *udpSession) idleDeadline(idle time.Duration) time.Time {
+	return time.Unix(0, s.lastActive.Load()).Add(idle)
+}
+
+// NewUDP creates a handler that relays datagrams. A zero idleTimeout means
+// DefaultUDPIdleTimeout.
+func NewUDP(upstreamNetwork, upstreamAddress string, idleTimeout time.Duration) *UDPHandler {
+	if idleTimeout <= 0 {
+		idleTimeout = DefaultUDPIdleTimeout
+	}
+	d := &net.Dialer{Timeout: DefaultTCPDialTimeout}
+	return &UDPHandler{
+		upstreamNetwork: upstreamNetwork,
+		upstreamAddress: upstreamAddress,
+		idleTimeout:     idleTimeout,
+		dial:            d.DialContext,
+		sessions:        make(map[string]*udpSession),
+	}
+}
+
+func (h *UDPHandler) ServePacket(ctx context.Context, pc net.PacketConn) error {
+	go func() {
+		<-ctx.Done()
+		if err := pc.Close(); err != nil {
+			tsproxy.ReportError(err, "context", "packet conn close error")
+		}
+		h.closeSessions()
+	}()
+
+	buf := datagramPool.Get().(*[]byte)
+	defer datagramPool.Put(buf)
+	for {
+		n, peer, err := pc.ReadFrom(*buf)
+		if err != nil {
+			if ctx.Err() != nil || isListenerClosed(err) {
+				h.relays.Wait()
+				return nil
+			}
+			now := time.Now()
+			if h.lastReadErrorLog.IsZero() || now.Sub(h.lastReadErrorLog) >= acceptErrorLogInterval {
+				tsproxy.ReportError(err, "context", "udp read error")
+				h.lastReadErrorLog = now
+			}
+			if !ctxwait.Delay(ctx, acceptRetryDelay) {
+				h.relays.Wait()
+				return nil
+			}
+			continue
+		}
+		h.lastReadErrorLog = time.Time{}
+		h.forward(ctx, pc, peer, (*buf)[:n])
+	}
+}
+
+// forward sends a datagram from peer to its upstream. It never waits for a
+// dial, so one slow upstream does not stall the read loop for every peer.
+func (h *UDPHandler) forward(ctx context.Context, pc net.PacketConn, peer net.Addr, b []byte) {
+	// A session can expire between the lookup and the write; the second
+	// attempt then gets a fresh one.
+	for range 2 {
+		sess := h.session(ctx, pc, peer)
+		if sess == nil {
+			return
+		}
+		sess.touch()
+		sess.mu.Lock()
+		upstream := sess.upstream
+		if upstream == nil {
+			if len(sess.pending) < maxPendingDatagrams {
+				sess.pending = append(sess.pending, bytes.Clone(b))
+			}
+			sess.mu.Unlock()
+			return
+		}
+		sess.mu.Unlock()
+
+		_, err := upstream.Write(b)
+		if errors.Is(err, net.ErrClosed) && ctx.Err() == nil {
+			h.forget(sess)
+			continue
+		}
+		if err != nil && ctx.Err() == nil {
+			tsproxy.ReportError(err, "context", "udp write upstream", "upstream", h.upstreamAddress)
+		}
+		return
+	}
+}
+
+// session returns the session for peer. On first contact it registers a
+// new one and dials its upstream in the background, then relays replies.
+// It returns nil once ctx is cancelled.
+func (h *UDPHandler) session(ctx context.Context, pc net.PacketConn, peer net.Addr) *udpSession {
+	key := peer.String()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if sess, ok := h.sessions[key]; ok {
+		return sess
+	}
+	// closeSessions runs after cancel; refusing new entries under the same
+	// lock guarantees no session outlives shutdown.
+	if ctx.Err() != nil {
+		return nil
+	}
+	sess := &udpSession{peer: peer}
+	sess.touch()
+	h.sessions[key] = sess
+
+	slog.Info("udp session", "remote", peer)
+	h.relays.Add(1)
+	go func() {
+		defer h.relays.Done()
+		if h.connect(ctx, sess) {
+			h.relay(ctx, pc, sess)
+		}
+	}()
+	return sess
+}
+
+// connect dials the session's upstream and sends the datagrams queued
+// meanwhile. On failure the session is removed, so the peer's next datagram
+// dials again.
+func (h *UDPHandler) connect(ctx context.Context, sess *udpSession) bool {
+	upstream, err := h.dial(ctx, h.upstreamNetwork, h.upstreamAddress)
+	if err != nil {
+		if ctx.Err() == nil {
+			tsproxy.ReportError(err, "context", "udp dial upstream", "upstream", h.upstreamAddress)
+		}
+		h.remove(sess)
+		return false
+	}
+
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	// closeSessions found no upstream to close if it ran during the dial.
+	if ctx.Err() != nil {
+		closeUpstream(upstream)
+		h.forget(sess)
+		return false
+	}
+	sess.upstream = upstream
+	// Sent under mu so later datagrams cannot overtake them.
+	for _, b := range sess.pending {
+		if _, err := upstream.Write(b); err != nil {
+			tsproxy.ReportError(err, "context", "udp write upstream", "upstream", h.upstreamAddress)
+			break
+		}
+	}
+	sess.pending = nil
+	return true
+}
+
+// relay copies upstream replies back to the peer until the session has been
+// idle for idleTimeout or the upstream socket is closed.
+func (h *UDPHandler) relay(ctx context.Context, pc net.PacketConn, sess *udpSession) {
+	defer h.remove(sess)
+
+	buf := datagramPool.Get().(*[]byte)
+	defer datagramPool.Put(buf)
+	for {
+		// Deadline follows activity in both directions: downstream traffic
+		// keeps a session alive even if the upstream never answers.
+		if err := sess.upstream.SetReadDeadline(sess.idleDeadline(h.idleTimeout)); err != nil {
+			tsproxy.ReportError(err, "context", "udp set deadline")
+			return
+		}
+		n, err := sess.upstream.Read(*buf)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				if time.Now().Before(sess.idleDeadline(h.idleTimeout)) {
+					continue
+				}
+				slog.Info("udp session expired", "remote", sess.peer)
+				return
+			}
+			if ctx.Err() == nil && !isListenerClosed(err) {
+				tsproxy.ReportError(err, "context", "udp read upstream", "upstream", h.upstreamAddress)
+			}
+			return
+		}
+		sess.touch()
+		if _, err := pc.WriteTo((*buf)[:n], sess.peer); err != nil {
+			if ctx.Err() != nil || isListenerClosed(err) {
+				return
+			}
+			tsproxy.ReportError(err, "context", "udp write downstream", "remote", sess.peer.String())
+		}
+	}
+}
+
+// remove forgets sess and closes its upstream, if it got one.
+func (h *UDPHandler) remove(sess *udpSession) {
+	h.forget(sess)
+	sess.mu.Lock()
+	upstream := sess.upstream
+	sess.mu.Unlock()
+	if upstream != nil {
+		closeUpstream(upstream)
+	}
+}
+
+// forget drops sess from the session table unless a newer session for the
+// same peer already replaced it.
+func (h *UDPHandler) forget(sess *udpSession) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.sessions[sess.peer.String()] == sess {
+		delete(h.sessions, sess.peer.String())
+	}
+}
+
+// closeSessions closes every upstream socket, which unblocks their relays.
+// Sessions still dialing see the cancelled ctx and close their own.
+func (h *UDPHandler) closeSessions() {
+	h.mu.Lock()
+	sessions := make([]*udpSession, 0, len(h.sessions))
+	for _, s := range h.sessions {
+		sessions = append(sessions, s)
+	}
+	h.mu.Unlock()
+	for _, s := range sessions {
+		s.mu.Lock()
+		upstream := s.upstream
+		s.mu.Unlock()
+		if upstream != nil {
+			closeUpstream(upstream)
+		}
+	}
+}
+
+// SessionCount returns the number of live peer sessions.
+func (h *UDPHandler) SessionCount() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.sessions)
+}
+
+// ActiveConnections returns the number of live peer sessions.
+func (h *UDPHandler) ActiveConnections() int {
+	return h.SessionCount()
+}
+
+func closeUpstream(c net.Conn) {
+	if err := c.Close(); err != nil {
+		tsproxy.ReportError(err, "context", "udp upstream close")
+	}
+}
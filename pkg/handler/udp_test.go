@@ -0,0 +1,246 @@
+package handler
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startUDPEcho runs an upstream that echoes every datagram back prefixed
+// with "echo:". Returns its address.
+func startUDPEcho(t *testing.T) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen upstream: %v", err)
+	}
+	t.Cleanup(func() { _ = pc.Close() })
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if _, err := pc.WriteTo(append([]byte("echo:"), buf[:n]...), addr); err != nil {
+				return
+			}
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+// startUDPProxy serves h on a loopback packet conn standing in for the tsnet
+// listener. Returns the proxy address and a channel with ServePacket's result.
+func startUDPProxy(ctx context.Context, t *testing.T, h *UDPHandler) (string, <-chan error) {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen proxy: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- h.ServePacket(ctx, pc)
+	}()
+	return pc.LocalAddr().String(), done
+}
+
+func udpRoundTrip(t *testing.T, c net.Conn, msg string) string {
+	t.Helper()
+	if _, err := c.Write([]byte(msg)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := c.SetReadDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		t.Fatalf("set deadline: %v", err)
+	}
+	buf := make([]byte, 1024)
+	n, err := c.Read(buf)
+	if err != nil {
+		t.Fatalf("read reply to %q: %v", msg, err)
+	}
+	return string(buf[:n])
+}
+
+func TestUDPRelaysPerPeerSessions(t *testing.T) {
+	upstream := startUDPEcho(t)
+	h := NewUDP("udp", upstream, 0)
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	proxy, _ := startUDPProxy(ctx, t, h)
+
+	a, err := net.Dial("udp", proxy)
+	if err != nil {
+		t.Fatalf("dial a: %v", err)
+	}
+	defer a.Close()
+	b, err := net.Dial("udp", proxy)
+	if err != nil {
+		t.Fatalf("dial b: %v", err)
+	}
+	defer b.Close()
+
+	if got := udpRoundTrip(t, a, "from-a"); got != "echo:from-a" {
+		t.Errorf("peer a reply = %q, want echo:from-a", got)
+	}
+	if got := udpRoundTrip(t, b, "from-b"); got != "echo:from-b" {
+		t.Errorf("peer b reply = %q, want echo:from-b", got)
+	}
+	if got := udpRoundTrip(t, a, "again"); got != "echo:again" {
+		t.Errorf("peer a second reply = %q, want echo:again", got)
+	}
+	if n := h.SessionCount(); n != 2 {
+		t.Errorf("SessionCount = %d, want 2 (one per peer)", n)
+	}
+}
+
+func TestUDPSessionIdleExpiry(t *testing.T) {
+	upstream := startUDPEcho(t)
+	h := NewUDP("udp", upstream, 100*time.Millisecond)
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	proxy, _ := startUDPProxy(ctx, t, h)
+
+	c, err := net.Dial("udp", proxy)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer c.Close()
+	udpRoundTrip(t, c, "ping")
+
+	deadline := time.Now().Add(2 * time.Second)
+	for h.SessionCount() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("SessionCount = %d after idle timeout, want 0", h.SessionCount())
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// A new datagram from the same peer opens a fresh session.
+	if got := udpRoundTrip(t, c, "pong"); got != "echo:pong" {
+		t.Errorf("reply after expiry = %q, want echo:pong", got)
+	}
+}
+
+func TestUDPCancelClosesSessions(t *testing.T) {
+	upstream := startUDPEcho(t)
+	h := NewUDP("udp", upstream, time.Minute)
+	ctx, cancel := context.WithCancel(t.Context())
+	proxy, done := startUDPProxy(ctx, t, h)
+
+	c, err := net.Dial("udp", proxy)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer c.Close()
+	udpRoundTrip(t, c, "ping")
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("ServePacket after cancel = %v, want nil", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("ServePacket did not return after cancel")
+	}
+	if n := h.SessionCount(); n != 0 {
+		t.Errorf("SessionCount after shutdown = %d, want 0", n)
+	}
+}
+
+// A peer whose upstream is slow to dial must not hold up other peers, and
+// its datagrams wait for the dial instead of being lost.
+func TestUDPSlowDialDoesNotBlockOtherPeers(t *testing.T) {
+	upstream := startUDPEcho(t)
+	h := NewUDP("udp", upstream, 0)
+	release := make(chan struct{})
+	var d net.Dialer
+	var dials atomic.Int32
+	h.dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+		if dials.Add(1) == 1 {
+			select {
+			case <-release:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		return d.DialContext(ctx, network, address)
+	}
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	proxy, _ := startUDPProxy(ctx, t, h)
+
+	slow, err := net.Dial("udp", proxy)
+	if err != nil {
+		t.Fatalf("dial slow: %v", err)
+	}
+	defer slow.Close()
+	if _, err := slow.Write([]byte("queued")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	for dials.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	fast, err := net.Dial("udp", proxy)
+	if err != nil {
+		t.Fatalf("dial fast: %v", err)
+	}
+	defer fast.Close()
+	if got := udpRoundTrip(t, fast, "ping"); got != "echo:ping" {
+		t.Errorf("reply while another dial hangs = %q, want echo:ping", got)
+	}
+
+	close(release)
+	if err := slow.SetReadDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		t.Fatalf("set deadline: %v", err)
+	}
+	buf := make([]byte, 1024)
+	n, err := slow.Read(buf)
+	if err != nil || string(buf[:n]) != "echo:queued" {
+		t.Errorf("reply after slow dial = %q, %v; want echo:queued", buf[:n], err)
+	}
+}
+
+// A datagram that races its session's expiry goes out on a new session
+// instead of being dropped.
+func TestUDPForwardReplacesClosedSession(t *testing.T) {
+	upstream := startUDPEcho(t)
+	h := NewUDP("udp", upstream, 0)
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen proxy: %v", err)
+	}
+	defer pc.Close()
+	peer, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen peer: %v", err)
+	}
+	defer peer.Close()
+
+	// What relay leaves behind when it expires the session mid-forward.
+	closed, err := net.Dial("udp", upstream)
+	if err != nil {
+		t.Fatalf("dial upstream: %v", err)
+	}
+	_ = closed.Close()
+	h.sessions[peer.LocalAddr().String()] = &udpSession{peer: peer.LocalAddr(), upstream: closed}
+
+	h.forward(ctx, pc, peer.LocalAddr(), []byte("late"))
+	if err := peer.SetReadDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		t.Fatalf("set deadline: %v", err)
+	}
+	buf := make([]byte, 1024)
+	n, _, err := peer.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "echo:late" {
+		t.Errorf("reply = %q, %v; want echo:late", buf[:n], err)
+	}
+	cancel()
+	h.closeSessions()
+	h.relays.Wait()
+}
@@ -0,0 +1,153 @@
+// Package hooks runs commands and calls webhooks when servers change state,
+// so alerting and dashboards can react when a node drops or comes back.
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lucasew/ts-proxy/pkg/config"
+	"github.com/lucasew/ts-proxy/pkg/tsproxy"
+)
+
+// ErrWebhookStatus is returned when a webhook answers with a non-2xx status.
+var ErrWebhookStatus = errors.New("webhook returned an error status")
+
+// Event is what a hook is told: the JSON body of a webhook and the stdin of
+// a command.
+type Event struct {
+	Server string    `json:"server"`
+	From   string    `json:"from"`
+	To     string    `json:"to"`
+	Time   time.Time `json:"time"`
+	Error  string    `json:"error,omitempty"`
+}
+
+// env describes e to a command in TS_PROXY_* variables.
+func (e Event) env() []string {
+	return []string{
+		"TS_PROXY_SERVER=" + e.Server,
+		"TS_PROXY_STATE=" + e.To,
+		"TS_PROXY_PREVIOUS_STATE=" + e.From,
+		"TS_PROXY_TIME=" + e.Time.Format(time.RFC3339),
+		"TS_PROXY_ERROR=" + e.Error,
+	}
+}
+
+// Runner fires the configured hooks. Hooks run in the background, one
+// goroutine per run, so a slow webhook never holds up a state change.
+type Runner struct {
+	hooks  atomic.Pointer[[]config.HookConfig]
+	client *http.Client
+	wg     sync.WaitGroup
+}
+
+// New creates a runner for hooks.
+func New(hooks []config.HookConfig) *Runner {
+	r := &Runner{client: &http.Client{}}
+	r.Update(hooks)
+	return r
+}
+
+// Update replaces the hooks, e.g. after a config reload. Runs in flight
+// finish with the hooks they started with.
+func (r *Runner) Update(hooks []config.HookConfig) {
+	hooks = slices.Clone(hooks)
+	r.hooks.Store(&hooks)
+}
+
+// Fire starts every hook that matches e. Failures are reported, not
+// returned.
+func (r *Runner) Fire(e Event) {
+	for _, h := range *r.hooks.Load() {
+		if !matches(h, e) {
+			continue
+		}
+		r.wg.Add(1)
+		go func() {
+			defer r.wg.Done()
+			if err := r.run(h, e); err != nil {
+				tsproxy.ReportError(err, "context", "hook failed", "server", e.Server, "state", e.To)
+			}
+		}()
+	}
+}
+
+// Wait blocks until every started run has finished. Runs are bounded by
+// their timeout, so this lets a failure alert go out before the process
+// exits.
+func (r *Runner) Wait() {
+	r.wg.Wait()
+}
+
+func matches(h config.HookConfig, e Event) bool {
+	on := h.On
+	if len(on) == 0 {
+		on = []string{config.HookOnFailed, config.HookOnRunning}
+	}
+	if !slices.Contains(on, e.To) {
+		return false
+	}
+	return len(h.Servers) == 0 || slices.Contains(h.Servers, e.Server)
+}
+
+func (r *Runner) run(h config.HookConfig, e Event) error {
+	timeout := h.Timeout
+	if timeout <= 0 {
+		timeout = config.DefaultHookTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	body, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("encode event: %w", err)
+	}
+	if h.Webhook != "" {
+		return r.post(ctx, h.Webhook, body)
+	}
+	return runCommand(ctx, h.Command, e, body)
+}
+
+func (r *Runner) post(ctx context.Context, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "ts-proxy")
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("webhook: %w", err)
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			tsproxy.ReportError(err, "context", "webhook response body close")
+		}
+	}()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%w: %s", ErrWebhookStatus, resp.Status)
+	}
+	return nil
+}
+
+func runCommand(ctx context.Context, argv []string, e Event, body []byte) error {
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	cmd.Env = append(os.Environ(), e.env()...)
+	cmd.Stdin = bytes.NewReader(body)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("command %s: %w: %s", argv[0], err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
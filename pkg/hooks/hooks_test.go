@@ -0,0 +1,110 @@
+package hooks
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lucasew/ts-proxy/pkg/config"
+)
+
+var testEvent = Event{
+	Server: "web",
+	From:   "authenticating",
+	To:     "failed",
+	Time:   time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC),
+	Error:  "tailscale up: boom",
+}
+
+func TestFireWebhook(t *testing.T) {
+	got := make(chan []byte, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("request = %s %s", r.Method, r.Header.Get("Content-Type"))
+		}
+		b, _ := io.ReadAll(r.Body)
+		got <- b
+	}))
+	defer srv.Close()
+
+	r := New([]config.HookConfig{{Webhook: srv.URL}})
+	r.Fire(testEvent)
+	r.Wait()
+	var e Event
+	if err := json.Unmarshal(<-got, &e); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if e != testEvent {
+		t.Errorf("webhook event = %+v, want %+v", e, testEvent)
+	}
+}
+
+func TestFireCommand(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	script := `echo "$TS_PROXY_SERVER $TS_PROXY_PREVIOUS_STATE $TS_PROXY_STATE $TS_PROXY_ERROR" > "$1"; cat >> "$1"`
+	r := New([]config.HookConfig{{Command: []string{"sh", "-c", script, "sh", out}}})
+	r.Fire(testEvent)
+	r.Wait()
+	b, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	lines := strings.SplitN(string(b), "\n", 2)
+	if lines[0] != "web authenticating failed tailscale up: boom" {
+		t.Errorf("env line = %q", lines[0])
+	}
+	if !strings.Contains(lines[1], `"server":"web"`) {
+		t.Errorf("stdin = %q, want the event JSON", lines[1])
+	}
+}
+
+func TestFireMatches(t *testing.T) {
+	calls := make(chan string, 8)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls <- r.URL.Path
+	}))
+	defer srv.Close()
+
+	r := New([]config.HookConfig{
+		{Webhook: srv.URL + "/any"},
+		{Webhook: srv.URL + "/running", On: []string{config.HookOnRunning}},
+		{Webhook: srv.URL + "/api", Servers: []string{"api"}},
+	})
+	r.Fire(Event{Server: "web", To: "running"})
+	r.Fire(Event{Server: "web", To: "stopped"})
+	r.Wait()
+	close(calls)
+	var got []string
+	for p := range calls {
+		got = append(got, p)
+	}
+	if len(got) != 2 || !strings.Contains(strings.Join(got, ","), "/any") || !strings.Contains(strings.Join(got, ","), "/running") {
+		t.Errorf("called %v, want /any and /running once each", got)
+	}
+}
+
+func TestRunWebhookErrorStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+	r := New(nil)
+	if err := r.run(config.HookConfig{Webhook: srv.URL}, testEvent); !errors.Is(err, ErrWebhookStatus) {
+		t.Errorf("run = %v, want ErrWebhookStatus", err)
+	}
+}
+
+func TestRunCommandTimeout(t *testing.T) {
+	start := time.Now()
+	err := New(nil).run(config.HookConfig{Command: []string{"sleep", "10"}, Timeout: 50 * time.Millisecond}, testEvent)
+	if err == nil || time.Since(start) > 5*time.Second {
+		t.Errorf("run = %v after %v, want a timeout error", err, time.Since(start))
+	}
+}
@@ -0,0 +1,157 @@
+// Package identity renders configurable request headers from the identity
+// WhoIs reports for a tailnet peer, for upstreams running in auth-proxy mode
+// (Grafana, Gitea, Nextcloud, ...).
+package identity
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/lucasew/ts-proxy/pkg/access"
+	"tailscale.com/client/tailscale/apitype"
+)
+
+var (
+	// ErrInvalidHeader is returned for header names that are not valid
+	// HTTP field names.
+	ErrInvalidHeader = errors.New("invalid header name")
+	// ErrInvalidTemplate is returned for templates that do not parse or
+	// reference unknown fields.
+	ErrInvalidTemplate = errors.New("invalid header template")
+)
+
+// Fields are the values available to header templates, e.g. "{{.Login}}".
+type Fields struct {
+	// Login is the user's login name (alice@example.com); empty for
+	// tagged devices.
+	Login string
+	// User is the part of Login before the "@".
+	User string
+	// Name is the user's display name.
+	Name string
+	// Node is the peer's MagicDNS name without the trailing dot.
+	Node string
+	// NodeName is the first label of Node.
+	NodeName string
+	// Tags are the node's ACL tags, comma separated.
+	Tags string
+	// IP is the peer's tailnet IP address.
+	IP string
+}
+
+// FieldsFrom collects template fields from a WhoIs response and the peer's
+// remote address.
+func FieldsFrom(who *apitype.WhoIsResponse, remoteAddr string) Fields {
+	var f Fields
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		f.IP = host
+	}
+	if who == nil {
+		return f
+	}
+	// Tagged nodes are not users; their login stays empty.
+	if p := who.UserProfile; p != nil && p.LoginName != access.TaggedDevicesLogin {
+		f.Login = p.LoginName
+		f.User, _, _ = strings.Cut(p.LoginName, "@")
+		f.Name = p.DisplayName
+	}
+	if n := who.Node; n != nil {
+		f.Node = strings.TrimSuffix(n.Name, ".")
+		f.NodeName, _, _ = strings.Cut(f.Node, ".")
+		f.Tags = strings.Join(n.Tags, ",")
+	}
+	return f
+}
+
+// Headers is a compiled header name -> template mapping.
+type Headers struct {
+	names     []string
+	templates map[string]*template.Template
+}
+
+// ParseHeaders compiles a mapping from header name to template. It returns
+// nil when the mapping is empty. Every template is executed once against
+// empty Fields so typos like {{.Email}} fail at load time, not per request.
+func ParseHeaders(m map[string]string) (*Headers, error) {
+	if len(m) == 0 {
+		return nil, nil
+	}
+	h := &Headers{templates: make(map[string]*template.Template, len(m))}
+	var errs []error
+	for name, text := range m {
+		if !ValidHeaderName(name) {
+			errs = append(errs, fmt.Errorf("%w %q", ErrInvalidHeader, name))
+			continue
+		}
+		t, err := template.New(name).Option("missingkey=error").Parse(text)
+		if err == nil {
+			err = t.Execute(&strings.Builder{}, Fields{})
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%w for %q: %w", ErrInvalidTemplate, name, err))
+			continue
+		}
+		h.names = append(h.names, name)
+		h.templates[name] = t
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	sort.Strings(h.names)
+	return h, nil
+}
+
+// Names returns the configured header names in sorted order. Nil-safe.
+func (h *Headers) Names() []string {
+	if h == nil {
+		return nil
+	}
+	return h.names
+}
+
+// Render executes every template against f, calling set for each header
+// with a non-empty value. Values containing control characters are dropped
+// so a crafted display name cannot inject headers.
+func (h *Headers) Render(f Fields, set func(name, value string)) error {
+	if h == nil {
+		return nil
+	}
+	var errs []error
+	for _, name := range h.names {
+		var b strings.Builder
+		if err := h.templates[name].Execute(&b, f); err != nil {
+			errs = append(errs, fmt.Errorf("header %q: %w", name, err))
+			continue
+		}
+		v := strings.TrimSpace(b.String())
+		if v == "" || strings.ContainsFunc(v, isControl) {
+			continue
+		}
+		set(name, v)
+	}
+	return errors.Join(errs...)
+}
+
+func isControl(r rune) bool {
+	return r < 0x20 || r == 0x7f
+}
+
+// ValidHeaderName reports whether name is an RFC 7230 token.
+func ValidHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range []byte(name) {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,107 @@
+package identity
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/lucasew/ts-proxy/pkg/access"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+func TestFieldsFrom(t *testing.T) {
+	who := &apitype.WhoIsResponse{
+		Node: &tailcfg.Node{Name: "laptop.example.ts.net.", Tags: []string{"tag:a", "tag:b"}},
+		UserProfile: &tailcfg.UserProfile{
+			LoginName:   "alice@example.com",
+			DisplayName: "Alice Liddell",
+		},
+	}
+	got := FieldsFrom(who, "100.64.0.1:41234")
+	want := Fields{
+		Login:    "alice@example.com",
+		User:     "alice",
+		Name:     "Alice Liddell",
+		Node:     "laptop.example.ts.net",
+		NodeName: "laptop",
+		Tags:     "tag:a,tag:b",
+		IP:       "100.64.0.1",
+	}
+	if got != want {
+		t.Errorf("FieldsFrom = %+v, want %+v", got, want)
+	}
+
+	tagged := &apitype.WhoIsResponse{
+		Node:        &tailcfg.Node{Name: "ci.example.ts.net.", Tags: []string{"tag:ci"}},
+		UserProfile: &tailcfg.UserProfile{LoginName: access.TaggedDevicesLogin, DisplayName: "Tagged Devices"},
+	}
+	if f := FieldsFrom(tagged, "100.64.0.2:1"); f.Login != "" || f.Name != "" || f.Tags != "tag:ci" {
+		t.Errorf("tagged FieldsFrom = %+v, want no user fields", f)
+	}
+}
+
+func TestParseHeadersErrors(t *testing.T) {
+	if h, err := ParseHeaders(nil); h != nil || err != nil {
+		t.Fatalf("ParseHeaders(nil) = %v, %v; want nil, nil", h, err)
+	}
+	tests := []struct {
+		m    map[string]string
+		want error
+	}{
+		{map[string]string{"Bad Header": "{{.Login}}"}, ErrInvalidHeader},
+		{map[string]string{"X-User": "{{.Login"}, ErrInvalidTemplate},
+		{map[string]string{"X-User": "{{.Email}}"}, ErrInvalidTemplate},
+	}
+	for _, tt := range tests {
+		if _, err := ParseHeaders(tt.m); !errors.Is(err, tt.want) {
+			t.Errorf("ParseHeaders(%v) = %v, want %v", tt.m, err, tt.want)
+		}
+	}
+}
+
+func TestRender(t *testing.T) {
+	h, err := ParseHeaders(map[string]string{
+		"X-WEBAUTH-USER":    "{{.User}}",
+		"X-Forwarded-Email": "{{.Login}}",
+		"Remote-Name":       "{{.Name}}",
+		"X-Node":            "{{.NodeName}} ({{.IP}})",
+	})
+	if err != nil {
+		t.Fatalf("ParseHeaders: %v", err)
+	}
+	got := http.Header{}
+	err = h.Render(Fields{
+		Login:    "alice@example.com",
+		User:     "alice",
+		Name:     "Alice\r\nX-Admin: true",
+		NodeName: "laptop",
+		IP:       "100.64.0.1",
+	}, got.Set)
+	if err != nil {
+		t.Fatalf("Render: %v", err)
+	}
+	want := http.Header{
+		"X-Webauth-User":    {"alice"},
+		"X-Forwarded-Email": {"alice@example.com"},
+		"X-Node":            {"laptop (100.64.0.1)"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("headers = %v, want %v (control characters must drop the value)", got, want)
+	}
+	for k, v := range want {
+		if got.Get(k) != v[0] {
+			t.Errorf("%s = %q, want %q", k, got.Get(k), v[0])
+		}
+	}
+
+	// Empty values are not sent, so a tagged device never presents an
+	// empty user to an auth proxy.
+	empty := http.Header{}
+	if err := h.Render(Fields{IP: "100.64.0.2"}, empty.Set); err != nil {
+		t.Fatalf("Render: %v", err)
+	}
+	if v := empty.Get("X-Webauth-User"); v != "" {
+		t.Errorf("X-Webauth-User = %q for identity without a login, want unset", v)
+	}
+}
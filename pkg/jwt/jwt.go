@@ -0,0 +1,248 @@
+// Package jwt mints short-lived signed identity assertions (JWS compact
+// serialization) and publishes the matching public keys as a JWKS, so
+// upstreams can verify who a request came from instead of trusting headers.
+package jwt
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Signing algorithms accepted by LoadOrCreate.
+const (
+	AlgorithmEd25519 = "ed25519"
+	AlgorithmRS256   = "rs256"
+)
+
+// rsaKeyBits is the modulus size of generated RS256 keys.
+const rsaKeyBits = 2048
+
+var (
+	// ErrUnknownAlgorithm is returned for algorithms other than ed25519
+	// and rs256.
+	ErrUnknownAlgorithm = errors.New("unknown jwt algorithm")
+	// ErrKeyMismatch is returned when a persisted key does not match the
+	// requested algorithm.
+	ErrKeyMismatch = errors.New("jwt key does not match algorithm")
+)
+
+// Signer signs JWTs with one persisted private key.
+type Signer struct {
+	alg string // JWS "alg" header value
+	kid string
+	key crypto.Signer
+	jwk map[string]string
+}
+
+// KeyFile returns the path of the private key for algorithm inside dir.
+func KeyFile(dir, algorithm string) string {
+	return filepath.Join(dir, "identity-jwt-"+strings.ToLower(algorithm)+".pem")
+}
+
+// ValidateAlgorithm checks that algorithm is supported. Empty means ed25519.
+func ValidateAlgorithm(algorithm string) error {
+	switch strings.ToLower(algorithm) {
+	case "", AlgorithmEd25519, AlgorithmRS256:
+		return nil
+	default:
+		return fmt.Errorf("%w %q: want %s or %s", ErrUnknownAlgorithm, algorithm, AlgorithmEd25519, AlgorithmRS256)
+	}
+}
+
+// LoadOrCreate loads the algorithm's private key from dir, generating and
+// persisting a new one (mode 0600) on first use so tokens stay verifiable
+// across restarts. An empty algorithm means ed25519.
+func LoadOrCreate(dir, algorithm string) (*Signer, error) {
+	algorithm = strings.ToLower(algorithm)
+	if algorithm == "" {
+		algorithm = AlgorithmEd25519
+	}
+	if err := ValidateAlgorithm(algorithm); err != nil {
+		return nil, err
+	}
+	path := KeyFile(dir, algorithm)
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		return parseKey(algorithm, data)
+	case !errors.Is(err, os.ErrNotExist):
+		return nil, fmt.Errorf("read jwt key: %w", err)
+	}
+
+	var key crypto.Signer
+	if algorithm == AlgorithmRS256 {
+		key, err = rsa.GenerateKey(rand.Reader, rsaKeyBits)
+	} else {
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("generate jwt key: %w", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("marshal jwt key: %w", err)
+	}
+	data = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := writeFileAtomic(path, data); err != nil {
+		return nil, fmt.Errorf("write jwt key: %w", err)
+	}
+	return newSigner(algorithm, key)
+}
+
+func parseKey(algorithm string, data []byte) (*Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%w: no PEM block", ErrKeyMismatch)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse jwt key: %w", err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, ErrKeyMismatch
+	}
+	return newSigner(algorithm, signer)
+}
+
+// writeFileAtomic writes through a temp file so a crash never leaves a
+// truncated key behind.
+func writeFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), ".identity-jwt-*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer func() { _ = os.Remove(tmp) }() // no-op after a successful rename
+	if err := f.Chmod(0600); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func newSigner(algorithm string, key crypto.Signer) (*Signer, error) {
+	s := &Signer{key: key}
+	switch k := key.Public().(type) {
+	case ed25519.PublicKey:
+		if algorithm != AlgorithmEd25519 {
+			return nil, fmt.Errorf("%w: ed25519 key for %s", ErrKeyMismatch, algorithm)
+		}
+		s.alg = "EdDSA"
+		s.jwk = map[string]string{"kty": "OKP", "crv": "Ed25519", "x": b64(k)}
+	case *rsa.PublicKey:
+		if algorithm != AlgorithmRS256 {
+			return nil, fmt.Errorf("%w: rsa key for %s", ErrKeyMismatch, algorithm)
+		}
+		s.alg = "RS256"
+		s.jwk = map[string]string{"kty": "RSA", "n": b64(k.N.Bytes()), "e": b64(big.NewInt(int64(k.E)).Bytes())}
+	default:
+		return nil, fmt.Errorf("%w: unsupported key type %T", ErrKeyMismatch, k)
+	}
+	s.kid = thumbprint(s.jwk)
+	s.jwk["kid"] = s.kid
+	s.jwk["alg"] = s.alg
+	s.jwk["use"] = "sig"
+	return s, nil
+}
+
+// thumbprint is the RFC 7638 JWK thumbprint: SHA-256 over the required
+// members in lexicographic order. json.Marshal sorts map keys.
+func thumbprint(jwk map[string]string) string {
+	required := map[string]string{"kty": jwk["kty"]}
+	for _, k := range []string{"crv", "x", "n", "e"} {
+		if v, ok := jwk[k]; ok {
+			required[k] = v
+		}
+	}
+	b, _ := json.Marshal(required)
+	sum := sha256.Sum256(b)
+	return b64(sum[:])
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// KeyID returns the key's RFC 7638 thumbprint, sent as the "kid" header.
+func (s *Signer) KeyID() string {
+	return s.kid
+}
+
+// Algorithm returns the JWS "alg" value (EdDSA or RS256).
+func (s *Signer) Algorithm() string {
+	return s.alg
+}
+
+// Public returns the public key, for verification.
+func (s *Signer) Public() crypto.PublicKey {
+	return s.key.Public()
+}
+
+// JWKS returns the JSON Web Key Set holding the public key.
+func (s *Signer) JWKS() ([]byte, error) {
+	return json.Marshal(map[string]any{"keys": []map[string]string{s.jwk}})
+}
+
+// Sign returns a compact JWS over claims.
+func (s *Signer) Sign(claims any) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": s.alg, "typ": "JWT", "kid": s.kid})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := b64(header) + "." + b64(payload)
+
+	var sig []byte
+	if s.alg == "RS256" {
+		digest := sha256.Sum256([]byte(signingInput))
+		sig, err = s.key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	} else {
+		sig, err = s.key.Sign(rand.Reader, []byte(signingInput), crypto.Hash(0))
+	}
+	if err != nil {
+		return "", fmt.Errorf("sign jwt: %w", err)
+	}
+	return signingInput + "." + b64(sig), nil
+}
+
+// Claims is the payload of an identity assertion.
+type Claims struct {
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub"`
+	Audience  string `json:"aud,omitempty"`
+	IssuedAt  int64  `json:"iat"`
+	NotBefore int64  `json:"nbf"`
+	Expiry    int64  `json:"exp"`
+
+	// Login and Name are empty for tagged devices; Subject then falls back
+	// to the node name.
+	Login string   `json:"login,omitempty"`
+	Name  string   `json:"name,omitempty"`
+	Node  string   `json:"node,omitempty"`
+	Tags  []string `json:"tags,omitempty"`
+	IP    string   `json:"ip,omitempty"`
+}
@@ -0,0 +1,150 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+// verify checks a compact JWS against s's public key and decodes its claims.
+func verify(t *testing.T, s *Signer, token string) Claims {
+	t.Helper()
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("token has %d parts, want 3", len(parts))
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		t.Fatalf("decode signature: %v", err)
+	}
+	input := []byte(parts[0] + "." + parts[1])
+	switch pub := s.Public().(type) {
+	case ed25519.PublicKey:
+		if !ed25519.Verify(pub, input, sig) {
+			t.Fatal("ed25519 signature does not verify")
+		}
+	case *rsa.PublicKey:
+		digest := sha256.Sum256(input)
+		if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig); err != nil {
+			t.Fatalf("rs256 signature does not verify: %v", err)
+		}
+	}
+
+	var header map[string]string
+	decodeSegment(t, parts[0], &header)
+	if header["alg"] != s.Algorithm() || header["kid"] != s.KeyID() || header["typ"] != "JWT" {
+		t.Errorf("header = %v, want alg %s kid %s typ JWT", header, s.Algorithm(), s.KeyID())
+	}
+	var claims Claims
+	decodeSegment(t, parts[1], &claims)
+	return claims
+}
+
+func decodeSegment(t *testing.T, seg string, v any) {
+	t.Helper()
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		t.Fatalf("decode segment: %v", err)
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		t.Fatalf("unmarshal segment: %v", err)
+	}
+}
+
+func TestSignAndVerify(t *testing.T) {
+	for _, alg := range []string{AlgorithmEd25519, AlgorithmRS256} {
+		t.Run(alg, func(t *testing.T) {
+			s, err := LoadOrCreate(t.TempDir(), alg)
+			if err != nil {
+				t.Fatalf("LoadOrCreate: %v", err)
+			}
+			token, err := s.Sign(Claims{Issuer: "https://app.example.ts.net", Subject: "alice@example.com", Expiry: 42})
+			if err != nil {
+				t.Fatalf("Sign: %v", err)
+			}
+			c := verify(t, s, token)
+			if c.Subject != "alice@example.com" || c.Expiry != 42 {
+				t.Errorf("claims = %+v", c)
+			}
+		})
+	}
+}
+
+func TestLoadOrCreatePersistsKey(t *testing.T) {
+	dir := t.TempDir()
+	first, err := LoadOrCreate(dir, "")
+	if err != nil {
+		t.Fatalf("LoadOrCreate: %v", err)
+	}
+	if first.Algorithm() != "EdDSA" {
+		t.Errorf("default algorithm = %s, want EdDSA", first.Algorithm())
+	}
+	fi, err := os.Stat(KeyFile(dir, AlgorithmEd25519))
+	if err != nil {
+		t.Fatalf("key file: %v", err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0600 {
+		t.Errorf("key file mode = %o, want 600", perm)
+	}
+
+	second, err := LoadOrCreate(dir, AlgorithmEd25519)
+	if err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if first.KeyID() != second.KeyID() {
+		t.Errorf("kid changed across reload: %s != %s", first.KeyID(), second.KeyID())
+	}
+}
+
+func TestLoadOrCreateErrors(t *testing.T) {
+	if _, err := LoadOrCreate(t.TempDir(), "hs256"); !errors.Is(err, ErrUnknownAlgorithm) {
+		t.Errorf("LoadOrCreate(hs256) = %v, want ErrUnknownAlgorithm", err)
+	}
+
+	// An Ed25519 key stored under the rs256 name must not be used for RS256.
+	dir := t.TempDir()
+	if _, err := LoadOrCreate(dir, AlgorithmEd25519); err != nil {
+		t.Fatalf("LoadOrCreate: %v", err)
+	}
+	if err := os.Rename(KeyFile(dir, AlgorithmEd25519), KeyFile(dir, AlgorithmRS256)); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+	if _, err := LoadOrCreate(dir, AlgorithmRS256); !errors.Is(err, ErrKeyMismatch) {
+		t.Errorf("LoadOrCreate with mismatched key = %v, want ErrKeyMismatch", err)
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	s, err := LoadOrCreate(t.TempDir(), AlgorithmEd25519)
+	if err != nil {
+		t.Fatalf("LoadOrCreate: %v", err)
+	}
+	b, err := s.JWKS()
+	if err != nil {
+		t.Fatalf("JWKS: %v", err)
+	}
+	var set struct {
+		Keys []map[string]string `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &set); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if len(set.Keys) != 1 {
+		t.Fatalf("keys = %d, want 1", len(set.Keys))
+	}
+	k := set.Keys[0]
+	if k["kty"] != "OKP" || k["crv"] != "Ed25519" || k["kid"] != s.KeyID() || k["alg"] != "EdDSA" {
+		t.Errorf("jwk = %v", k)
+	}
+	x, err := base64.RawURLEncoding.DecodeString(k["x"])
+	if err != nil || !ed25519.PublicKey(x).Equal(s.Public()) {
+		t.Errorf("jwk x does not match the public key (err %v)", err)
+	}
+}
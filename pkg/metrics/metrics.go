@@ -0,0 +1,226 @@
+// Package metrics holds the Prometheus collectors for proxied traffic and
+// server lifecycles, and serves them in the text exposition format.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Path is where metrics are served.
+const Path = "/metrics"
+
+const namespace = "ts_proxy"
+
+// Label values for peers without a user login.
+const (
+	// UserAnonymous labels requests from clients WhoIs cannot identify,
+	// i.e. Funnel traffic.
+	UserAnonymous = "anonymous"
+	// UserTagged labels requests from tagged devices.
+	UserTagged = "tagged"
+)
+
+// Registry holds every ts-proxy collector plus the Go runtime and process
+// collectors. It is private to ts-proxy so embedding tsnet does not mix in
+// foreign metrics.
+var Registry = prometheus.NewRegistry()
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "http", Name: "requests_total",
+		Help: "HTTP requests by server, handler, status code and tailnet user.",
+	}, []string{"server", "handler", "code", "user"})
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace, Subsystem: "http", Name: "request_duration_seconds",
+		Help:    "Time to serve HTTP requests, including the upstream round trip.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"server", "handler"})
+	upstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace, Subsystem: "http", Name: "upstream_duration_seconds",
+		Help:    "Time until the upstream returned response headers.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"server", "handler"})
+
+	tcpAccepted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "tcp", Name: "connections_accepted_total",
+		Help: "TCP connections accepted.",
+	}, []string{"server", "handler"})
+	tcpActive = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace, Subsystem: "tcp", Name: "connections_active",
+		Help: "TCP connections currently open.",
+	}, []string{"server", "handler"})
+	tcpBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "tcp", Name: "bytes_total",
+		Help: "Bytes proxied over TCP; direction in is client to upstream.",
+	}, []string{"server", "handler", "direction"})
+	tcpDialFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "tcp", Name: "dial_failures_total",
+		Help: "Failed upstream dials of tcp and http handlers.",
+	}, []string{"server", "handler"})
+	tcpAcceptErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "tcp", Name: "accept_errors_total",
+		Help: "Listener accept errors, counted even when their logging is rate limited.",
+	}, []string{"server", "handler"})
+
+	restarts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "supervisor", Name: "restarts_total",
+		Help: "Server restarts, automatic or requested.",
+	}, []string{"server"})
+	serverState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace, Subsystem: "server", Name: "state",
+		Help: "Current lifecycle state of each server: 1 for the current state, 0 otherwise.",
+	}, []string{"server", "state"})
+)
+
+// perServer are the collectors with a "server" label, cleared by
+// ForgetServer.
+var perServer = []interface {
+	DeletePartialMatch(prometheus.Labels) int
+}{
+	httpRequests, httpDuration, upstreamDuration,
+	tcpAccepted, tcpActive, tcpBytes, tcpDialFailures, tcpAcceptErrors,
+	restarts, serverState,
+}
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequests, httpDuration, upstreamDuration,
+		tcpAccepted, tcpActive, tcpBytes, tcpDialFailures, tcpAcceptErrors,
+		restarts, serverState,
+	)
+}
+
+// HTTPHandler serves Registry.
+func HTTPHandler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// Handler records one proxy handler's traffic. A nil *Handler records
+// nothing, so handlers built without metrics need no checks.
+type Handler struct {
+	server, handler string
+
+	httpDuration     prometheus.Observer
+	upstreamDuration prometheus.Observer
+	tcpAccepted      prometheus.Counter
+	tcpActive        prometheus.Gauge
+	tcpBytesIn       prometheus.Counter
+	tcpBytesOut      prometheus.Counter
+	tcpDialFailures  prometheus.Counter
+	tcpAcceptErrors  prometheus.Counter
+}
+
+// ForHandler returns the recorder for the handler listening on listen in
+// server.
+func ForHandler(server, listen string) *Handler {
+	return &Handler{
+		server:           server,
+		handler:          listen,
+		httpDuration:     httpDuration.WithLabelValues(server, listen),
+		upstreamDuration: upstreamDuration.WithLabelValues(server, listen),
+		tcpAccepted:      tcpAccepted.WithLabelValues(server, listen),
+		tcpActive:        tcpActive.WithLabelValues(server, listen),
+		tcpBytesIn:       tcpBytes.WithLabelValues(server, listen, "in"),
+		tcpBytesOut:      tcpBytes.WithLabelValues(server, listen, "out"),
+		tcpDialFailures:  tcpDialFailures.WithLabelValues(server, listen),
+		tcpAcceptErrors:  tcpAcceptErrors.WithLabelValues(server, listen),
+	}
+}
+
+// ObserveHTTP records a completed request.
+func (h *Handler) ObserveHTTP(code int, user string, d time.Duration) {
+	if h == nil {
+		return
+	}
+	httpRequests.WithLabelValues(h.server, h.handler, strconv.Itoa(code), user).Inc()
+	h.httpDuration.Observe(d.Seconds())
+}
+
+// ObserveUpstream records the upstream's time to response headers.
+func (h *Handler) ObserveUpstream(d time.Duration) {
+	if h == nil {
+		return
+	}
+	h.upstreamDuration.Observe(d.Seconds())
+}
+
+// ConnAccepted records a new TCP connection.
+func (h *Handler) ConnAccepted() {
+	if h == nil {
+		return
+	}
+	h.tcpAccepted.Inc()
+	h.tcpActive.Inc()
+}
+
+// ConnClosed records the end of a TCP connection accepted with
+// ConnAccepted.
+func (h *Handler) ConnClosed() {
+	if h == nil {
+		return
+	}
+	h.tcpActive.Dec()
+}
+
+// BytesIn records bytes copied from the client to the upstream.
+func (h *Handler) BytesIn(n int64) {
+	if h == nil {
+		return
+	}
+	h.tcpBytesIn.Add(float64(n))
+}
+
+// BytesOut records bytes copied from the upstream to the client.
+func (h *Handler) BytesOut(n int64) {
+	if h == nil {
+		return
+	}
+	h.tcpBytesOut.Add(float64(n))
+}
+
+// DialFailed records a failed upstream dial.
+func (h *Handler) DialFailed() {
+	if h == nil {
+		return
+	}
+	h.tcpDialFailures.Inc()
+}
+
+// AcceptError records a listener accept error.
+func (h *Handler) AcceptError() {
+	if h == nil {
+		return
+	}
+	h.tcpAcceptErrors.Inc()
+}
+
+// ServerRestarted records a restart of server.
+func ServerRestarted(server string) {
+	restarts.WithLabelValues(server).Inc()
+}
+
+// SetServerState marks current as the server's state among states.
+func SetServerState(server, current string, states []string) {
+	for _, s := range states {
+		v := 0.0
+		if s == current {
+			v = 1
+		}
+		serverState.WithLabelValues(server, s).Set(v)
+	}
+}
+
+// ForgetServer drops every series of a server removed from the config.
+func ForgetServer(server string) {
+	for _, c := range perServer {
+		c.DeletePartialMatch(prometheus.Labels{"server": server})
+	}
+}
@@ -0,0 +1,88 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// scrape returns the exposition text served by HTTPHandler.
+func scrape(t *testing.T) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	HTTPHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, Path, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("scrape status = %d", rec.Code)
+	}
+	return rec.Body.String()
+}
+
+func wantLine(t *testing.T, body, line string) {
+	t.Helper()
+	for _, l := range strings.Split(body, "\n") {
+		if l == line {
+			return
+		}
+	}
+	t.Errorf("metrics missing line %q", line)
+}
+
+func TestNilHandlerRecordsNothing(t *testing.T) {
+	var h *Handler
+	h.ObserveHTTP(200, "alice@example.com", time.Second)
+	h.ObserveUpstream(time.Second)
+	h.ConnAccepted()
+	h.ConnClosed()
+	h.BytesIn(1)
+	h.BytesOut(1)
+	h.DialFailed()
+	h.AcceptError()
+}
+
+func TestHandlerMetrics(t *testing.T) {
+	h := ForHandler("metrics_test", ":8443")
+	h.ObserveHTTP(200, "alice@example.com", 20*time.Millisecond)
+	h.ObserveHTTP(200, "alice@example.com", 20*time.Millisecond)
+	h.ObserveHTTP(403, UserAnonymous, time.Millisecond)
+	h.ObserveUpstream(10 * time.Millisecond)
+	h.ConnAccepted()
+	h.ConnAccepted()
+	h.ConnClosed()
+	h.BytesIn(100)
+	h.BytesOut(2048)
+	h.DialFailed()
+	h.AcceptError()
+
+	body := scrape(t)
+	for _, line := range []string{
+		`ts_proxy_http_requests_total{code="200",handler=":8443",server="metrics_test",user="alice@example.com"} 2`,
+		`ts_proxy_http_requests_total{code="403",handler=":8443",server="metrics_test",user="anonymous"} 1`,
+		`ts_proxy_http_request_duration_seconds_count{handler=":8443",server="metrics_test"} 3`,
+		`ts_proxy_http_upstream_duration_seconds_count{handler=":8443",server="metrics_test"} 1`,
+		`ts_proxy_tcp_connections_accepted_total{handler=":8443",server="metrics_test"} 2`,
+		`ts_proxy_tcp_connections_active{handler=":8443",server="metrics_test"} 1`,
+		`ts_proxy_tcp_bytes_total{direction="in",handler=":8443",server="metrics_test"} 100`,
+		`ts_proxy_tcp_bytes_total{direction="out",handler=":8443",server="metrics_test"} 2048`,
+		`ts_proxy_tcp_dial_failures_total{handler=":8443",server="metrics_test"} 1`,
+		`ts_proxy_tcp_accept_errors_total{handler=":8443",server="metrics_test"} 1`,
+	} {
+		wantLine(t, body, line)
+	}
+}
+
+func TestServerStateAndForget(t *testing.T) {
+	states := []string{"running", "failed"}
+	SetServerState("forget_test", "running", states)
+	ServerRestarted("forget_test")
+	body := scrape(t)
+	wantLine(t, body, `ts_proxy_server_state{server="forget_test",state="running"} 1`)
+	wantLine(t, body, `ts_proxy_server_state{server="forget_test",state="failed"} 0`)
+	wantLine(t, body, `ts_proxy_supervisor_restarts_total{server="forget_test"} 1`)
+
+	ForgetServer("forget_test")
+	if body := scrape(t); strings.Contains(body, `server="forget_test"`) {
+		t.Error("series of a forgotten server are still exported")
+	}
+}
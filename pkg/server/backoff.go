@@ -0,0 +1,63 @@
+package server
+
+import (
+	"math/rand/v2"
+	"time"
+
+	"github.com/lucasew/ts-proxy/pkg/config"
+)
+
+// backoff paces the restarts of one supervised server: delays grow
+// exponentially with jitter, reset once the server has run for
+// StableAfter, and too many failures within Window mark a crash loop.
+type backoff struct {
+	attempt  int
+	failures []time.Time
+	// jitter returns a value in [0, 1); rand.Float64 outside tests.
+	jitter func() float64
+}
+
+func newBackoff() *backoff {
+	return &backoff{jitter: rand.Float64}
+}
+
+// failed records a failure at now, after the server had been running for
+// ranFor, and returns the delay before the next start. crashLoop is true
+// when the failure exceeds MaxRestarts within Window.
+func (b *backoff) failed(p config.RestartPolicyConfig, now time.Time, ranFor time.Duration) (delay time.Duration, crashLoop bool) {
+	if ranFor >= p.StableAfter {
+		b.attempt = 0
+	}
+	if p.MaxRestarts > 0 {
+		cutoff := now.Add(-p.Window)
+		kept := b.failures[:0]
+		for _, t := range b.failures {
+			if t.After(cutoff) {
+				kept = append(kept, t)
+			}
+		}
+		b.failures = append(kept, now)
+		if len(b.failures) > p.MaxRestarts {
+			return 0, true
+		}
+	}
+	delay = b.delay(p)
+	b.attempt++
+	return delay, false
+}
+
+// delay is InitialDelay * Multiplier^attempt, capped at MaxDelay and then
+// spread by ±Jitter so servers failing together do not restart in step.
+func (b *backoff) delay(p config.RestartPolicyConfig) time.Duration {
+	d := float64(p.InitialDelay)
+	for range b.attempt {
+		d *= p.Multiplier
+		if d >= float64(p.MaxDelay) {
+			break
+		}
+	}
+	d = min(d, float64(p.MaxDelay))
+	j := *p.Jitter
+	d *= 1 - j + 2*j*b.jitter()
+	return time.Duration(d)
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lucasew/ts-proxy/pkg/config"
+)
+
+func testPolicy() config.RestartPolicyConfig {
+	c := config.Config{}
+	c.SetDefaults()
+	return c.RestartPolicy
+}
+
+func TestBackoffGrowsAndCaps(t *testing.T) {
+	p := testPolicy()
+	p.Jitter = new(0.0)
+	b := newBackoff()
+	now := time.Now()
+	var got []time.Duration
+	for range 9 {
+		d, crashLoop := b.failed(p, now, 0)
+		if crashLoop {
+			t.Fatal("crash loop reported with max_restarts unset")
+		}
+		got = append(got, d)
+	}
+	want := []time.Duration{5 * time.Second, 10 * time.Second, 20 * time.Second, 40 * time.Second,
+		80 * time.Second, 160 * time.Second, 5 * time.Minute, 5 * time.Minute, 5 * time.Minute}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("delay[%d] = %v, want %v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestBackoffJitter(t *testing.T) {
+	p := testPolicy()
+	b := newBackoff()
+	for _, tc := range []struct {
+		r    float64
+		want time.Duration
+	}{
+		{0, 4 * time.Second},
+		{0.5, 5 * time.Second},
+		{0.999999, 6 * time.Second},
+	} {
+		b.attempt = 0
+		b.jitter = func() float64 { return tc.r }
+		d, _ := b.failed(p, time.Now(), 0)
+		if d.Round(time.Millisecond) != tc.want {
+			t.Errorf("jitter %v: delay = %v, want %v", tc.r, d, tc.want)
+		}
+	}
+}
+
+func TestBackoffResetsAfterStableRun(t *testing.T) {
+	p := testPolicy()
+	p.Jitter = new(0.0)
+	b := newBackoff()
+	now := time.Now()
+	b.failed(p, now, 0)
+	b.failed(p, now, 0)
+	if d, _ := b.failed(p, now, p.StableAfter-time.Second); d != 20*time.Second {
+		t.Errorf("delay after short run = %v, want 20s", d)
+	}
+	if d, _ := b.failed(p, now, p.StableAfter); d != p.InitialDelay {
+		t.Errorf("delay after stable run = %v, want %v", d, p.InitialDelay)
+	}
+}
+
+func TestBackoffCrashLoop(t *testing.T) {
+	p := testPolicy()
+	p.MaxRestarts = 3
+	p.Window = time.Minute
+	b := newBackoff()
+	start := time.Now()
+	// Failures spread wider than the window never trip the threshold.
+	for i := range 6 {
+		if _, crashLoop := b.failed(p, start.Add(time.Duration(i)*30*time.Second), 0); crashLoop {
+			t.Fatalf("failure %d: crash loop with 2 failures per window", i)
+		}
+	}
+	b = newBackoff()
+	for i := range 3 {
+		if _, crashLoop := b.failed(p, start.Add(time.Duration(i)*time.Second), 0); crashLoop {
+			t.Fatalf("failure %d: crash loop before max_restarts", i)
+		}
+	}
+	if _, crashLoop := b.failed(p, start.Add(3*time.Second), 0); !crashLoop {
+		t.Fatal("4th failure within the window: want crash loop")
+	}
+}
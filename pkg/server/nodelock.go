@@ -0,0 +1,47 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ErrNodeLocked is returned when another server or process holds a node's
+// state dir.
+var ErrNodeLocked = errors.New("node state dir is in use")
+
+// lockFile is locked by whoever runs a node from its state dir, since two
+// tsnet nodes on one dir corrupt it.
+const lockFile = ".lock"
+
+// NodeLock is an exclusive lock on a node's state dir.
+type NodeLock struct {
+	f *os.File
+}
+
+// LockNode takes the lock on the state dir dir without waiting. It returns
+// ErrNodeLocked when a server or another logout holds it.
+func LockNode(dir string) (*NodeLock, error) {
+	f, err := os.OpenFile(filepath.Join(dir, lockFile), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("open lock: %w", err)
+	}
+	ok, err := tryLock(f)
+	if err != nil || !ok {
+		_ = f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("lock %s: %w", dir, err)
+		}
+		return nil, fmt.Errorf("%w: %s", ErrNodeLocked, dir)
+	}
+	return &NodeLock{f: f}, nil
+}
+
+// Unlock releases the lock. It is safe on a nil lock.
+func (l *NodeLock) Unlock() error {
+	if l == nil {
+		return nil
+	}
+	return l.f.Close()
+}
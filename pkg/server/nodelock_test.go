@@ -0,0 +1,46 @@
+package server
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestLockNode(t *testing.T) {
+	dir := t.TempDir()
+	lock, err := LockNode(dir)
+	if err != nil {
+		t.Fatalf("LockNode: %v", err)
+	}
+	if _, err := LockNode(dir); !errors.Is(err, ErrNodeLocked) {
+		t.Errorf("second LockNode = %v, want ErrNodeLocked", err)
+	}
+	if err := lock.Unlock(); err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+	lock, err = LockNode(dir)
+	if err != nil {
+		t.Fatalf("LockNode after Unlock: %v", err)
+	}
+	if err := lock.Unlock(); err != nil {
+		t.Errorf("Unlock: %v", err)
+	}
+}
+
+// A server does not start on a state dir someone else holds, such as a
+// running `state logout`.
+func TestServerStartLockedDir(t *testing.T) {
+	dir := t.TempDir()
+	lock, err := LockNode(dir)
+	if err != nil {
+		t.Fatalf("LockNode: %v", err)
+	}
+	defer func() { _ = lock.Unlock() }()
+
+	srv := NewServer("web", Options{Hostname: "web", StateDir: dir})
+	if err := srv.Start(t.Context()); !errors.Is(err, ErrNodeLocked) {
+		t.Fatalf("Start = %v, want ErrNodeLocked", err)
+	}
+	if st := srv.Status(); st.State != StateFailed {
+		t.Errorf("state = %v, want failed", st.State)
+	}
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/lucasew/ts-proxy/pkg/tsproxy"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tsnet"
+)
+
+// Sentinel errors for node state directories.
+var (
+	ErrNoNodeState  = errors.New("no node state")
+	ErrInvalidState = errors.New("invalid node state")
+)
+
+// nodeFile records what tsnet's state does not keep, such as the node key
+// expiry, inside a node's state dir. It is rewritten after every login.
+const nodeFile = "ts-proxy-node.json"
+
+// nodeRecord is the content of nodeFile.
+type nodeRecord struct {
+	FQDN string `json:"fqdn,omitempty"`
+	// KeyExpiry is zero when key expiry is disabled for the node.
+	KeyExpiry time.Time `json:"key_expiry,omitzero"`
+	Updated   time.Time `json:"updated"`
+}
+
+// NodeInfo describes a node from its state dir, read without starting it.
+type NodeInfo struct {
+	// Name is the state dir's name, which is the server's name.
+	Name       string
+	Dir        string
+	Hostname   string
+	NodeID     string
+	Tailnet    string
+	ControlURL string
+	// LoggedIn is false when the node has no node key, e.g. after a logout
+	// or before its first login completed.
+	LoggedIn bool
+	// FQDN and KeyExpiry are as of Recorded, the last time the node came
+	// up; Recorded is zero when ts-proxy never recorded it. A zero
+	// KeyExpiry with a Recorded time means key expiry is disabled.
+	FQDN      string
+	KeyExpiry time.Time
+	Recorded  time.Time
+}
+
+// ReadNode reads the node kept in the state dir dir. It returns
+// ErrNoNodeState when dir holds no tsnet state.
+func ReadNode(dir string) (NodeInfo, error) {
+	info := NodeInfo{Name: filepath.Base(dir), Dir: dir}
+	b, err := os.ReadFile(filepath.Join(dir, stateFile))
+	if errors.Is(err, fs.ErrNotExist) || err == nil && len(b) == 0 {
+		return info, fmt.Errorf("%w in %s", ErrNoNodeState, dir)
+	}
+	if err != nil {
+		return info, err
+	}
+	var store map[ipn.StateKey][]byte
+	if err := json.Unmarshal(b, &store); err != nil {
+		return info, fmt.Errorf("%w: %s: %w", ErrInvalidState, stateFile, err)
+	}
+	if current := ipn.StateKey(store[ipn.CurrentProfileStateKey]); current != "" {
+		var profiles map[ipn.ProfileID]ipn.LoginProfile
+		if raw := store[ipn.KnownProfilesStateKey]; len(raw) > 0 {
+			if err := json.Unmarshal(raw, &profiles); err != nil {
+				return info, fmt.Errorf("%w: profiles: %w", ErrInvalidState, err)
+			}
+		}
+		for _, p := range profiles {
+			if p.Key == current {
+				info.Tailnet = p.NetworkProfile.DomainName
+				info.ControlURL = p.ControlURL
+			}
+		}
+		if raw := store[current]; len(raw) > 0 {
+			var prefs ipn.Prefs
+			if err := json.Unmarshal(raw, &prefs); err != nil {
+				return info, fmt.Errorf("%w: prefs: %w", ErrInvalidState, err)
+			}
+			info.Hostname = prefs.Hostname
+			if info.ControlURL == "" {
+				info.ControlURL = prefs.ControlURL
+			}
+			if p := prefs.Persist; p != nil && !p.PrivateNodeKey.IsZero() {
+				info.LoggedIn = true
+				info.NodeID = string(p.NodeID)
+			}
+		}
+	}
+
+	rec, err := readNodeRecord(dir)
+	if err != nil {
+		return info, err
+	}
+	info.FQDN, info.KeyExpiry, info.Recorded = rec.FQDN, rec.KeyExpiry, rec.Updated
+	return info, nil
+}
+
+// ListNodes returns the nodes in the subdirectories of stateDir, sorted by
+// name. Subdirectories without tsnet state are skipped.
+func ListNodes(stateDir string) ([]NodeInfo, error) {
+	entries, err := os.ReadDir(stateDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read state dir: %w", err)
+	}
+	var nodes []NodeInfo
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		info, err := ReadNode(filepath.Join(stateDir, e.Name()))
+		if errors.Is(err, ErrNoNodeState) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("node %s: %w", e.Name(), err)
+		}
+		nodes = append(nodes, info)
+	}
+	slices.SortFunc(nodes, func(a, b NodeInfo) int { return cmp.Compare(a.Name, b.Name) })
+	return nodes, nil
+}
+
+// LogoutNode brings up the node in info.Dir long enough to log it out,
+// which removes it from the tailnet. The caller holds the dir's lock (see
+// LockNode). The state dir is left in place; a node that is not logged in
+// is left alone.
+func LogoutNode(ctx context.Context, info NodeInfo) error {
+	if !info.LoggedIn {
+		return nil
+	}
+	ts := &tsnet.Server{
+		Hostname:   info.Hostname,
+		Dir:        info.Dir,
+		ControlURL: info.ControlURL,
+	}
+	defer func() {
+		if err := ts.Close(); err != nil {
+			tsproxy.ReportError(err, "context", "tailscale close error")
+		}
+	}()
+	if err := ts.Start(); err != nil {
+		return fmt.Errorf("start node: %w", err)
+	}
+	lc, err := ts.LocalClient()
+	if err != nil {
+		return fmt.Errorf("local client: %w", err)
+	}
+	if err := lc.Logout(ctx); err != nil {
+		return fmt.Errorf("logout: %w", err)
+	}
+	return nil
+}
+
+// recordNode saves the node's FQDN and key expiry from the status Up
+// returned, so ReadNode can report them while the node is down.
+func recordNode(dir, fqdn string, st *ipnstate.Status) error {
+	rec := nodeRecord{FQDN: fqdn, Updated: time.Now().UTC()}
+	if st != nil && st.Self != nil && st.Self.KeyExpiry != nil {
+		rec.KeyExpiry = st.Self.KeyExpiry.UTC()
+	}
+	b, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, nodeFile+".tmp")
+	if err := os.WriteFile(tmp, append(b, '\n'), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, nodeFile))
+}
+
+// readNodeRecord returns the zero record when none was written yet.
+func readNodeRecord(dir string) (nodeRecord, error) {
+	var rec nodeRecord
+	b, err := os.ReadFile(filepath.Join(dir, nodeFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return rec, nil
+	}
+	if err != nil {
+		return rec, err
+	}
+	if err := json.Unmarshal(b, &rec); err != nil {
+		return rec, fmt.Errorf("%w: %s: %w", ErrInvalidState, nodeFile, err)
+	}
+	return rec, nil
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+	"tailscale.com/types/persist"
+)
+
+// writeNodeState writes a tsnet state file like the one a node leaves in
+// dir after logging in, or after logging out when nodeID is empty.
+func writeNodeState(t *testing.T, dir, hostname string, nodeID tailcfg.StableNodeID) {
+	t.Helper()
+	prefs := ipn.NewPrefs()
+	prefs.Hostname = hostname
+	if nodeID != "" {
+		prefs.Persist = &persist.Persist{PrivateNodeKey: key.NewNode(), NodeID: nodeID}
+	}
+	const profileKey = ipn.StateKey("profile-1a2b")
+	profiles := map[ipn.ProfileID]ipn.LoginProfile{
+		"1a2b": {
+			ID:             "1a2b",
+			Key:            profileKey,
+			NetworkProfile: ipn.NetworkProfile{DomainName: "example.ts.net"},
+			ControlURL:     "https://control.example.com",
+		},
+	}
+	store := map[ipn.StateKey][]byte{
+		ipn.CurrentProfileStateKey: []byte(profileKey),
+		ipn.KnownProfilesStateKey:  mustJSON(t, profiles),
+		profileKey:                 mustJSON(t, prefs),
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, stateFile), mustJSON(t, store), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+}
+
+func mustJSON(t *testing.T, v any) []byte {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	return b
+}
+
+func TestReadNode(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "api")
+	writeNodeState(t, dir, "api", "nAPI1CNTRL")
+
+	info, err := ReadNode(dir)
+	if err != nil {
+		t.Fatalf("ReadNode: %v", err)
+	}
+	want := NodeInfo{
+		Name:       "api",
+		Dir:        dir,
+		Hostname:   "api",
+		NodeID:     "nAPI1CNTRL",
+		Tailnet:    "example.ts.net",
+		ControlURL: "https://control.example.com",
+		LoggedIn:   true,
+	}
+	if info != want {
+		t.Errorf("ReadNode = %+v, want %+v", info, want)
+	}
+
+	expiry := time.Date(2027, 4, 1, 12, 0, 0, 0, time.UTC)
+	st := &ipnstate.Status{Self: &ipnstate.PeerStatus{KeyExpiry: &expiry}}
+	if err := recordNode(dir, "api.example.ts.net", st); err != nil {
+		t.Fatalf("recordNode: %v", err)
+	}
+	info, err = ReadNode(dir)
+	if err != nil {
+		t.Fatalf("ReadNode after recordNode: %v", err)
+	}
+	if info.FQDN != "api.example.ts.net" || !info.KeyExpiry.Equal(expiry) || info.Recorded.IsZero() {
+		t.Errorf("recorded fqdn %q, expiry %v at %v; want api.example.ts.net, %v", info.FQDN, info.KeyExpiry, info.Recorded, expiry)
+	}
+
+	// Key expiry disabled.
+	if err := recordNode(dir, "api.example.ts.net", &ipnstate.Status{Self: &ipnstate.PeerStatus{}}); err != nil {
+		t.Fatalf("recordNode: %v", err)
+	}
+	if info, _ = ReadNode(dir); !info.KeyExpiry.IsZero() || info.Recorded.IsZero() {
+		t.Errorf("without expiry: expiry %v at %v, want zero expiry with a record time", info.KeyExpiry, info.Recorded)
+	}
+
+	out := filepath.Join(t.TempDir(), "old")
+	writeNodeState(t, out, "old", "")
+	if info, err := ReadNode(out); err != nil || info.LoggedIn || info.NodeID != "" {
+		t.Errorf("logged out node = %+v, %v; want not logged in", info, err)
+	}
+}
+
+func TestReadNodeErrors(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := ReadNode(dir); !errors.Is(err, ErrNoNodeState) {
+		t.Errorf("ReadNode without state = %v, want ErrNoNodeState", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, stateFile), []byte("not json"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if _, err := ReadNode(dir); !errors.Is(err, ErrInvalidState) {
+		t.Errorf("ReadNode with a corrupt state = %v, want ErrInvalidState", err)
+	}
+}
+
+func TestListNodes(t *testing.T) {
+	stateDir := t.TempDir()
+	writeNodeState(t, filepath.Join(stateDir, "web"), "web", "nWEB1CNTRL")
+	writeNodeState(t, filepath.Join(stateDir, "api"), "api", "nAPI1CNTRL")
+	// Neither a directory without state nor the admin socket is a node.
+	if err := os.Mkdir(filepath.Join(stateDir, "empty"), 0700); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(stateDir, "admin.sock"), nil, 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	nodes, err := ListNodes(stateDir)
+	if err != nil {
+		t.Fatalf("ListNodes: %v", err)
+	}
+	var names []string
+	for _, n := range nodes {
+		names = append(names, n.Name)
+	}
+	if len(names) != 2 || names[0] != "api" || names[1] != "web" {
+		t.Errorf("ListNodes names = %v, want [api web]", names)
+	}
+
+	if nodes, err := ListNodes(filepath.Join(stateDir, "missing")); err != nil || len(nodes) != 0 {
+		t.Errorf("ListNodes of a missing dir = %v, %v; want none", nodes, err)
+	}
+}
+
+func TestLogoutNodeNotLoggedIn(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "old")
+	writeNodeState(t, dir, "old", "")
+	info, err := ReadNode(dir)
+	if err != nil {
+		t.Fatalf("ReadNode: %v", err)
+	}
+	// Nothing to deregister, so no node is started.
+	if err := LogoutNode(t.Context(), info); err != nil {
+		t.Errorf("LogoutNode = %v, want nil", err)
+	}
+}
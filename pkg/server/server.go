@@ -4,15 +4,30 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net"
+	"net/netip"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"time"
 
+	"github.com/lucasew/ts-proxy/pkg/access"
+	"github.com/lucasew/ts-proxy/pkg/accesslog"
+	"github.com/lucasew/ts-proxy/pkg/authkey"
 	"github.com/lucasew/ts-proxy/pkg/config"
 	"github.com/lucasew/ts-proxy/pkg/handler"
+	"github.com/lucasew/ts-proxy/pkg/identity"
+	"github.com/lucasew/ts-proxy/pkg/jwt"
+	"github.com/lucasew/ts-proxy/pkg/metrics"
+	"github.com/lucasew/ts-proxy/pkg/tracing"
 	"github.com/lucasew/ts-proxy/pkg/tsproxy"
+	"github.com/skip2/go-qrcode"
 	"golang.org/x/sync/errgroup"
 	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/ipn"
 	"tailscale.com/tsnet"
 )
 
@@ -20,6 +35,9 @@ import (
 var (
 	ErrNotStarted         = errors.New("server not started")
 	ErrUnknownHandlerType = errors.New("unknown handler type")
+	ErrNoTailscaleIP      = errors.New("node has no tailscale ip to bind")
+	ErrNotReady           = errors.New("not ready")
+	ErrAuthTimeout        = errors.New("login not completed in time")
 )
 
 // Options for creating a Server.
@@ -27,7 +45,16 @@ type Options struct {
 	Hostname string
 	StateDir string
 	AuthKey  string
-	Handlers []config.HandlerConfig
+	// OAuth, when set, mints the auth key at Start instead of AuthKey.
+	OAuth *config.OAuthConfig
+	// Ephemeral, AdvertiseTags and ControlURL are passed to tsnet.
+	Ephemeral     bool
+	AdvertiseTags []string
+	ControlURL    string
+	// AuthTimeout fails Start with ErrAuthTimeout when the node has not
+	// logged in after this long; zero waits forever.
+	AuthTimeout time.Duration
+	Handlers    []config.HandlerConfig
 }
 
 // Server manages a single Tailscale node and its handlers.
@@ -36,15 +63,58 @@ type Server struct {
 	opts Options
 	sm   *StateMachine
 	ts   *tsnet.Server
+	// lock holds the state dir from Start until Close.
+	lock *NodeLock
+
+	// handlersMu guards opts.Handlers, serving and handlers, which
+	// UpdateHandlers changes while Serve runs.
+	handlersMu sync.Mutex
+	serving    *serving
+	handlers   map[string]*runningHandler
+
+	// signers caches identity JWT signers by algorithm so handlers sharing
+	// an algorithm share one key.
+	signersMu sync.Mutex
+	signers   map[string]*jwt.Signer
+
+	// minter creates auth keys when opts.OAuth is set.
+	minter *authkey.Minter
+
+	// accessLog receives handler traffic records; nil logs nothing. Set by
+	// the supervisor before the server starts.
+	accessLog *accesslog.Logger
+	// tracing exports HTTP handler spans; nil traces nothing. Set by the
+	// supervisor before the server starts.
+	tracing *tracing.Provider
+	// loginQR, when set, receives the login URL as a QR code. Set by the
+	// supervisor before the server starts.
+	loginQR io.Writer
+
+	// statusMu guards the fields reported by Status.
+	statusMu sync.Mutex
+	fqdn     string
+	authURL  string
+	starts   int
+	lastErr  error
+	since    time.Time
+	// uptime is how long the last Serve ran; crashLoop is set when the
+	// supervisor gave up restarting the server.
+	uptime    time.Duration
+	crashLoop bool
 }
 
 // NewServer creates a server from options.
 func NewServer(name string, opts Options) *Server {
-	return &Server{
+	s := &Server{
 		name: name,
 		opts: opts,
 		sm:   NewStateMachine(),
 	}
+	if opts.OAuth != nil {
+		s.minter = authkey.New(opts.OAuth.Options())
+	}
+	s.recordState()
+	return s
 }
 
 // Name returns the server's slug name.
@@ -60,10 +130,10 @@ func (s *Server) State() State {
 // FQDN returns the fully qualified domain name after authentication,
 // falling back to the configured hostname.
 func (s *Server) FQDN() string {
-	if s.ts != nil {
-		for _, domain := range s.ts.CertDomains() {
-			return domain
-		}
+	s.statusMu.Lock()
+	defer s.statusMu.Unlock()
+	if s.fqdn != "" {
+		return s.fqdn
 	}
 	return s.opts.Hostname
 }
@@ -73,43 +143,202 @@ func (s *Server) FQDN() string {
 func (s *Server) mustTransition(to State) {
 	if err := s.sm.Transition(to); err != nil {
 		slog.Warn("state transition rejected", "server", s.name, "to", to, "current", s.sm.Current(), "err", err)
+		return
+	}
+	s.recordState()
+}
+
+// mustFail moves the server to StateFailed because of cause, like
+// mustTransition.
+func (s *Server) mustFail(cause error) {
+	if err := s.sm.Fail(cause); err != nil {
+		slog.Warn("state transition rejected", "server", s.name, "to", StateFailed, "current", s.sm.Current(), "err", err)
+		return
 	}
+	s.recordState()
+}
+
+// Subscribe calls fn for every later state transition of the server until
+// the returned function is called; see StateMachine.Subscribe.
+func (s *Server) Subscribe(fn func(Event)) (unsubscribe func()) {
+	return s.sm.Subscribe(func(e Event) {
+		e.Server = s.name
+		fn(e)
+	})
+}
+
+// recordState exports the current state as a metric.
+func (s *Server) recordState() {
+	metrics.SetServerState(s.name, string(s.sm.Current()), stateLabels)
 }
 
 // Start initializes the Tailscale node and authenticates.
 func (s *Server) Start(ctx context.Context) error {
 	s.mustTransition(StateStarting)
+	s.statusMu.Lock()
+	s.starts++
+	restart := s.starts > 1
+	s.uptime, s.crashLoop = 0, false
+	s.statusMu.Unlock()
+	if restart {
+		metrics.ServerRestarted(s.name)
+	}
 
 	if err := os.MkdirAll(s.opts.StateDir, 0700); err != nil {
-		s.mustTransition(StateFailed)
-		return fmt.Errorf("create state dir %s: %w", s.opts.StateDir, err)
+		err = fmt.Errorf("create state dir %s: %w", s.opts.StateDir, err)
+		s.mustFail(err)
+		return err
 	}
+	lock, err := LockNode(s.opts.StateDir)
+	if err != nil {
+		s.mustFail(err)
+		return err
+	}
+	s.lock = lock
 
-	s.ts = &tsnet.Server{
-		Hostname: s.opts.Hostname,
-		Dir:      s.opts.StateDir,
+	authKey, err := s.authKey(ctx)
+	if err != nil {
+		s.mustFail(err)
+		s.unlock()
+		return err
 	}
-	if s.opts.AuthKey != "" {
-		s.ts.AuthKey = s.opts.AuthKey
+	s.ts = &tsnet.Server{
+		Hostname:      s.opts.Hostname,
+		Dir:           s.opts.StateDir,
+		AuthKey:       authKey,
+		Ephemeral:     s.opts.Ephemeral,
+		AdvertiseTags: s.opts.AdvertiseTags,
+		ControlURL:    s.opts.ControlURL,
 	}
 
 	s.mustTransition(StateAuthenticating)
 	slog.Info("authenticating", "server", s.name)
 
-	_, err := s.ts.Up(ctx)
+	upCtx, cancel := ctx, context.CancelFunc(func() {})
+	if s.opts.AuthTimeout > 0 {
+		upCtx, cancel = context.WithTimeout(ctx, s.opts.AuthTimeout)
+	}
+	defer cancel()
+	stopWatch := s.watchLogin(upCtx)
+	st, err := s.ts.Up(upCtx)
+	authURL := stopWatch()
 	if err != nil {
-		s.mustTransition(StateFailed)
+		if ctx.Err() == nil && errors.Is(upCtx.Err(), context.DeadlineExceeded) {
+			err = fmt.Errorf("%w: not logged in after %s", ErrAuthTimeout, s.opts.AuthTimeout)
+			if authURL != "" {
+				err = fmt.Errorf("%w; log in at %s", err, authURL)
+			}
+		} else {
+			err = fmt.Errorf("tailscale up: %w", err)
+		}
+		s.mustFail(err)
 		if cerr := s.ts.Close(); cerr != nil {
 			tsproxy.ReportError(cerr, "context", "tailscale close error")
 		}
 		s.ts = nil
-		return fmt.Errorf("tailscale up: %w", err)
+		s.unlock()
+		return err
+	}
+	if domains := s.ts.CertDomains(); len(domains) > 0 {
+		s.statusMu.Lock()
+		s.fqdn = domains[0]
+		s.statusMu.Unlock()
+	}
+
+	if err := recordNode(s.opts.StateDir, s.FQDN(), st); err != nil {
+		tsproxy.ReportError(err, "context", "record node", "server", s.name)
 	}
 
 	slog.Info("authenticated", "server", s.name, "fqdn", s.FQDN())
 	return nil
 }
 
+// stateFile is where tsnet keeps a node's login inside its state dir.
+const stateFile = "tailscaled.state"
+
+// authKey returns the key for tsnet. With OAuth it mints a fresh key, but
+// only when the node has never logged in: tsnet ignores keys once it has
+// state, and minting anyway would leave an unused key per restart.
+// Ephemeral nodes always get one, since control may have removed them
+// while they were offline. The key carries the advertised tags, if any.
+func (s *Server) authKey(ctx context.Context) (string, error) {
+	if s.minter == nil {
+		return s.opts.AuthKey, nil
+	}
+	if !s.opts.Ephemeral {
+		if fi, err := os.Stat(filepath.Join(s.opts.StateDir, stateFile)); err == nil && fi.Size() > 0 {
+			return "", nil
+		}
+	}
+	k := authkey.Key{Ephemeral: s.opts.Ephemeral, Tags: s.opts.AdvertiseTags}
+	slog.Info("minting auth key", "server", s.name, "ephemeral", k.Ephemeral)
+	key, err := s.minter.Mint(ctx, k)
+	if err != nil {
+		return "", fmt.Errorf("mint auth key: %w", err)
+	}
+	return key, nil
+}
+
+// watchLogin reports login URLs the backend asks the user to visit until
+// the returned function is called, which returns the last URL and clears
+// it from the status.
+func (s *Server) watchLogin(ctx context.Context) (stop func() string) {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// Up fails with the same error if the backend cannot start.
+		lc, err := s.ts.LocalClient()
+		if err != nil {
+			return
+		}
+		watcher, err := lc.WatchIPNBus(ctx, ipn.NotifyInitialState)
+		if err != nil {
+			return
+		}
+		defer watcher.Close()
+		for {
+			n, err := watcher.Next()
+			if err != nil {
+				return
+			}
+			if n.BrowseToURL != nil && *n.BrowseToURL != "" {
+				s.setAuthURL(*n.BrowseToURL)
+			}
+		}
+	}()
+	return func() string {
+		cancel()
+		<-done
+		s.statusMu.Lock()
+		defer s.statusMu.Unlock()
+		url := s.authURL
+		s.authURL = ""
+		return url
+	}
+}
+
+// setAuthURL records a login URL and announces it once.
+func (s *Server) setAuthURL(url string) {
+	s.statusMu.Lock()
+	seen := s.authURL == url
+	s.authURL = url
+	s.statusMu.Unlock()
+	if seen {
+		return
+	}
+	slog.Warn("login required: open the URL to add the node to the tailnet", "server", s.name, "url", url)
+	if s.loginQR == nil {
+		return
+	}
+	q, err := qrcode.New(url, qrcode.Medium)
+	if err != nil {
+		tsproxy.ReportError(err, "context", "login qr code", "server", s.name)
+		return
+	}
+	fmt.Fprintf(s.loginQR, "\nLog in %s by scanning this code or opening %s\n%s\n", s.name, url, q.ToSmallString(false))
+}
+
 // Serve starts all handlers. Must be called after Start.
 func (s *Server) Serve(ctx context.Context) error {
 	if s.ts == nil {
@@ -118,8 +347,9 @@ func (s *Server) Serve(ctx context.Context) error {
 
 	lc, err := s.ts.LocalClient()
 	if err != nil {
-		s.mustTransition(StateFailed)
-		return fmt.Errorf("local client: %w", err)
+		err = fmt.Errorf("local client: %w", err)
+		s.mustFail(err)
+		return err
 	}
 
 	whoIs := func(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
@@ -128,42 +358,283 @@ func (s *Server) Serve(ctx context.Context) error {
 
 	fqdn := s.FQDN()
 	s.mustTransition(StateRunning)
+	s.statusMu.Lock()
+	s.since = time.Now()
+	s.statusMu.Unlock()
+	defer func() {
+		s.statusMu.Lock()
+		s.uptime = time.Since(s.since)
+		s.since = time.Time{}
+		s.statusMu.Unlock()
+	}()
 
-	g, gCtx := errgroup.WithContext(ctx)
+	// A failing handler takes the whole server down (and the Supervisor
+	// restarts it); handlers stopped by UpdateHandlers do not.
+	serveCtx, fail := context.WithCancelCause(ctx)
+	defer fail(nil)
+	s.handlersMu.Lock()
+	s.serving = &serving{ctx: serveCtx, fail: fail, fqdn: fqdn, whoIs: whoIs}
+	s.handlers = make(map[string]*runningHandler)
 	for _, hc := range s.opts.Handlers {
-		hc := hc
-		g.Go(func() error {
-			h, err := s.createHandler(hc, fqdn, whoIs)
-			if err != nil {
-				return fmt.Errorf("create handler %s %s: %w", hc.Type, hc.Listen, err)
-			}
+		s.startHandler(hc)
+	}
+	s.handlersMu.Unlock()
 
-			lf := s.listenerFunc(hc.TLS, hc.Funnel)
-			ln, err := lf("tcp", hc.Listen)
-			if err != nil {
-				return fmt.Errorf("listen %s: %w", hc.Listen, err)
-			}
-			defer func() { reportClose(ln.Close(), "listener close error") }()
-
-			slog.Info("handler listening",
-				"server", s.name,
-				"type", hc.Type,
-				"listen", hc.Listen,
-				"upstream", hc.UpstreamAddress,
-			)
-			return h.Serve(gCtx, ln)
-		})
+	<-serveCtx.Done()
+
+	s.handlersMu.Lock()
+	s.serving = nil
+	running := s.handlers
+	s.handlers = nil
+	s.handlersMu.Unlock()
+	for _, rh := range running {
+		rh.cancel()
+		<-rh.done
 	}
 
-	err = g.Wait()
+	err = context.Cause(serveCtx)
+	if errors.Is(err, context.Canceled) && ctx.Err() != nil {
+		err = nil
+	}
 	if err != nil {
-		s.mustTransition(StateFailed)
+		s.mustFail(err)
 	} else {
 		s.mustTransition(StateStopped)
 	}
 	return err
 }
 
+// serving holds what handlers need while Serve runs.
+type serving struct {
+	ctx   context.Context
+	fail  context.CancelCauseFunc
+	fqdn  string
+	whoIs handler.WhoIsFunc
+}
+
+// runningHandler is one handler goroutine started by Serve or UpdateHandlers.
+type runningHandler struct {
+	cfg    config.HandlerConfig
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	// counters are the handler instances serving cfg; a wildcard UDP
+	// listen has one per Tailscale IP. bound is set once every listener
+	// is open.
+	mu       sync.Mutex
+	counters []handler.ConnCounter
+	bound    bool
+}
+
+func (rh *runningHandler) track(h any) {
+	if c, ok := h.(handler.ConnCounter); ok {
+		rh.mu.Lock()
+		rh.counters = append(rh.counters, c)
+		rh.mu.Unlock()
+	}
+}
+
+func (rh *runningHandler) setBound() {
+	rh.mu.Lock()
+	rh.bound = true
+	rh.mu.Unlock()
+}
+
+func (rh *runningHandler) isBound() bool {
+	rh.mu.Lock()
+	defer rh.mu.Unlock()
+	return rh.bound
+}
+
+// connections sums live connections across the handler's instances.
+func (rh *runningHandler) connections() int {
+	rh.mu.Lock()
+	defer rh.mu.Unlock()
+	n := 0
+	for _, c := range rh.counters {
+		n += c.ActiveConnections()
+	}
+	return n
+}
+
+// handlerKey identifies a handler across config reloads: its listen address,
+// with UDP kept apart since a tcp and a udp handler may share a port.
+func handlerKey(hc config.HandlerConfig) string {
+	if hc.Type == "udp" {
+		return "udp/" + hc.Listen
+	}
+	return hc.Listen
+}
+
+// startHandler runs hc until its context is cancelled. Caller holds
+// handlersMu and s.serving is set.
+func (s *Server) startHandler(hc config.HandlerConfig) {
+	ctx, cancel := context.WithCancel(s.serving.ctx)
+	rh := &runningHandler{cfg: hc, cancel: cancel, done: make(chan struct{})}
+	s.handlers[handlerKey(hc)] = rh
+	fail, fqdn, whoIs := s.serving.fail, s.serving.fqdn, s.serving.whoIs
+	go func() {
+		defer close(rh.done)
+		defer cancel()
+		err := s.serveHandler(ctx, rh, fqdn, whoIs)
+		// Only a handler that fails on its own fails the server; one
+		// stopped for a reload returns with its context cancelled.
+		if err != nil && ctx.Err() == nil {
+			fail(err)
+		}
+	}()
+}
+
+func (s *Server) serveHandler(ctx context.Context, rh *runningHandler, fqdn string, whoIs handler.WhoIsFunc) error {
+	hc := rh.cfg
+	if hc.Type == "udp" {
+		return s.servePacket(ctx, rh)
+	}
+	h, err := s.createHandler(hc, fqdn, whoIs)
+	if err != nil {
+		return fmt.Errorf("create handler %s %s: %w", hc.Type, hc.Listen, err)
+	}
+	rh.track(h)
+
+	lf := s.listenerFunc(hc.TLS, hc.Funnel)
+	ln, err := lf("tcp", hc.Listen)
+	if err != nil {
+		return fmt.Errorf("listen %s: %w", hc.Listen, err)
+	}
+	defer func() { reportClose(ln.Close(), "listener close error") }()
+	rh.setBound()
+
+	slog.Info("handler listening",
+		"server", s.name,
+		"type", hc.Type,
+		"listen", hc.Listen,
+		"upstream", hc.Target(),
+	)
+	return h.Serve(ctx, ln)
+}
+
+// UpdateHandlers replaces the server's handler set. While serving, only
+// handlers that were added, removed or changed are started or stopped;
+// identical handlers keep their listeners and connections. Otherwise the
+// new set is used by the next Serve.
+func (s *Server) UpdateHandlers(handlers []config.HandlerConfig) {
+	s.handlersMu.Lock()
+	s.opts.Handlers = handlers
+	if s.serving == nil {
+		s.handlersMu.Unlock()
+		return
+	}
+	want := make(map[string]config.HandlerConfig, len(handlers))
+	for _, hc := range handlers {
+		want[handlerKey(hc)] = hc
+	}
+	var stopped []*runningHandler
+	for key, rh := range s.handlers {
+		if hc, ok := want[key]; ok && reflect.DeepEqual(hc, rh.cfg) {
+			delete(want, key)
+			continue
+		}
+		rh.cancel()
+		stopped = append(stopped, rh)
+		delete(s.handlers, key)
+		slog.Info("handler stopped", "server", s.name, "type", rh.cfg.Type, "listen", rh.cfg.Listen)
+	}
+	// Listeners must be closed before a changed handler binds the same
+	// address again.
+	for _, rh := range stopped {
+		<-rh.done
+	}
+	for _, hc := range handlers {
+		if _, ok := want[handlerKey(hc)]; ok && s.serving.ctx.Err() == nil {
+			s.startHandler(hc)
+		}
+	}
+	s.handlersMu.Unlock()
+}
+
+// Ready reports whether the server is running with every handler
+// listening, wrapping ErrNotReady when it is not.
+func (s *Server) Ready() error {
+	if state := s.State(); state != StateRunning {
+		return fmt.Errorf("%w: %s", ErrNotReady, state)
+	}
+	s.handlersMu.Lock()
+	defer s.handlersMu.Unlock()
+	for _, hc := range s.opts.Handlers {
+		if rh := s.handlers[handlerKey(hc)]; rh == nil || !rh.isBound() {
+			return fmt.Errorf("%w: handler %s %s is not listening", ErrNotReady, hc.Type, hc.Listen)
+		}
+	}
+	return nil
+}
+
+// Handlers returns the configured handler set.
+func (s *Server) Handlers() []config.HandlerConfig {
+	s.handlersMu.Lock()
+	defer s.handlersMu.Unlock()
+	return s.opts.Handlers
+}
+
+// servePacket runs a UDP handler. tsnet packet listeners must bind a concrete
+// address, so a wildcard listen (":53") is expanded to one listener per
+// Tailscale IP (v4 and v6), each with its own session table.
+func (s *Server) servePacket(ctx context.Context, rh *runningHandler) error {
+	hc := rh.cfg
+	addrs, err := s.packetListenAddrs(hc.Listen)
+	if err != nil {
+		return fmt.Errorf("listen %s: %w", hc.Listen, err)
+	}
+
+	g, gCtx := errgroup.WithContext(ctx)
+	opened := 0
+	for _, addr := range addrs {
+		pc, err := s.ts.ListenPacket("udp", addr)
+		if err != nil {
+			// Already-opened listeners are closed by their ServePacket
+			// once the group context is cancelled.
+			g.Go(func() error { return fmt.Errorf("listen %s: %w", addr, err) })
+			break
+		}
+		opened++
+		h := handler.NewUDP(hc.UpstreamNetwork, hc.UpstreamAddress, hc.IdleTimeout)
+		rh.track(h)
+		slog.Info("handler listening",
+			"server", s.name,
+			"type", hc.Type,
+			"listen", addr,
+			"upstream", hc.Target(),
+		)
+		g.Go(func() error { return h.ServePacket(gCtx, pc) })
+	}
+	if opened == len(addrs) {
+		rh.setBound()
+	}
+	return g.Wait()
+}
+
+// packetListenAddrs resolves a handler listen address to the concrete
+// host:port pairs ListenPacket accepts.
+func (s *Server) packetListenAddrs(listen string) ([]string, error) {
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return nil, err
+	}
+	if host != "" {
+		return []string{listen}, nil
+	}
+	var addrs []string
+	ip4, ip6 := s.ts.TailscaleIPs()
+	for _, ip := range []netip.Addr{ip4, ip6} {
+		if ip.IsValid() {
+			addrs = append(addrs, net.JoinHostPort(ip.String(), port))
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, ErrNoTailscaleIP
+	}
+	return addrs, nil
+}
+
 // reportClose funnels Close errors through ReportError (which filters expected
 // net.ErrClosed / context cancel noise).
 func reportClose(err error, msg string) {
@@ -172,8 +643,16 @@ func reportClose(err error, msg string) {
 	}
 }
 
-// Run performs the full lifecycle: start, serve, close.
-func (s *Server) Run(ctx context.Context) error {
+// Run performs the full lifecycle: start, serve, close. A failure is kept
+// as the server's last error.
+func (s *Server) Run(ctx context.Context) (err error) {
+	defer func() {
+		if err != nil && ctx.Err() == nil {
+			s.statusMu.Lock()
+			s.lastErr = err
+			s.statusMu.Unlock()
+		}
+	}()
 	if err := s.Start(ctx); err != nil {
 		return err
 	}
@@ -181,8 +660,9 @@ func (s *Server) Run(ctx context.Context) error {
 	return s.Serve(ctx)
 }
 
-// Close shuts down the Tailscale node.
+// Close shuts down the Tailscale node and releases its state dir.
 func (s *Server) Close() error {
+	defer s.unlock()
 	if s.ts != nil {
 		err := s.ts.Close()
 		s.ts = nil
@@ -191,15 +671,64 @@ func (s *Server) Close() error {
 	return nil
 }
 
+// unlock releases the state dir lock taken by Start.
+func (s *Server) unlock() {
+	reportClose(s.lock.Unlock(), "state lock release error")
+	s.lock = nil
+}
+
+// lastUptime returns how long the server last ran; zero if the last start
+// never reached StateRunning.
+func (s *Server) lastUptime() time.Duration {
+	s.statusMu.Lock()
+	defer s.statusMu.Unlock()
+	return s.uptime
+}
+
+// setCrashLoop marks the server as given up on by the supervisor.
+func (s *Server) setCrashLoop() {
+	s.statusMu.Lock()
+	defer s.statusMu.Unlock()
+	s.crashLoop = true
+}
+
 // ResetState prepares the server for a restart by resetting the state machine.
 func (s *Server) ResetState() {
-	s.sm = NewStateMachine()
+	s.sm.Reset()
+	s.recordState()
 }
 
 func (s *Server) createHandler(hc config.HandlerConfig, fqdn string, whoIs handler.WhoIsFunc) (handler.Handler, error) {
+	policy, err := access.NewPolicy(hc.Allow, hc.Deny, hc.RequireCapability)
+	if err != nil {
+		return nil, err
+	}
+	identityHeaders, err := identity.ParseHeaders(hc.IdentityHeaders)
+	if err != nil {
+		return nil, err
+	}
+	m := metrics.ForHandler(s.name, hc.Listen)
+	al := s.accessLog.ForHandler(s.name, hc.Listen)
+	var identityJWT *handler.IdentityJWT
+	if j := hc.IdentityJWT; j != nil {
+		signer, err := s.signer(j.Algorithm)
+		if err != nil {
+			return nil, err
+		}
+		identityJWT = &handler.IdentityJWT{
+			Signer:   signer,
+			Header:   j.Header,
+			TTL:      j.TTL,
+			Audience: j.Audience,
+		}
+	}
 	switch hc.Type {
 	case "tcp":
-		return handler.NewTCP(hc.UpstreamNetwork, hc.UpstreamAddress), nil
+		h := handler.NewTCP(hc.UpstreamNetwork, hc.UpstreamAddress)
+		if lb := newBalancer(hc); lb != nil {
+			h = handler.NewTCPBalanced(lb)
+		}
+		return h.Restrict(whoIs, policy).Instrument(m).LogAccess(al), nil
 	case "http":
 		// Funnel always serves TLS at the edge; honor that even if the
 		// handler config omitted tls (SetDefaults also normalizes this).
@@ -209,12 +738,108 @@ func (s *Server) createHandler(hc config.HandlerConfig, fqdn string, whoIs handl
 			UpstreamAddress: hc.UpstreamAddress,
 			UpstreamNetwork: hc.UpstreamNetwork,
 			WhoIs:           whoIs,
+			Routes:          httpRoutes(hc.Routes),
+			Upstream:        newBalancer(hc),
+			Access:          policy,
+			AppCapability:   hc.RequireCapability,
+			IdentityHeaders: identityHeaders,
+			IdentityJWT:     identityJWT,
+			ForwardAuth:     forwardAuth(hc.ForwardAuth),
+			FunnelPaths:     hc.FunnelPaths,
+			Metrics:         m,
+			AccessLog:       al,
+			Tracing:         s.tracing.ForHandler(s.name, hc.Listen),
 		}), nil
+	case "static":
+		return handler.NewStatic(handler.StaticOptions{
+			Root:             hc.Root,
+			SPA:              hc.SPA,
+			DirectoryListing: hc.DirectoryListing,
+			CacheMaxAge:      hc.CacheMaxAge,
+			WhoIs:            whoIs,
+			Metrics:          m,
+			AccessLog:        al,
+			Tracing:          s.tracing.ForHandler(s.name, hc.Listen),
+		}), nil
+	case "metrics":
+		return handler.NewMetrics().Restrict(whoIs, policy), nil
 	default:
 		return nil, fmt.Errorf("%w: %s", ErrUnknownHandlerType, hc.Type)
 	}
 }
 
+// signer returns the identity JWT signer for algorithm, loading or creating
+// its key under the server's state directory.
+func (s *Server) signer(algorithm string) (*jwt.Signer, error) {
+	s.signersMu.Lock()
+	defer s.signersMu.Unlock()
+	if signer, ok := s.signers[algorithm]; ok {
+		return signer, nil
+	}
+	signer, err := jwt.LoadOrCreate(s.opts.StateDir, algorithm)
+	if err != nil {
+		return nil, err
+	}
+	if s.signers == nil {
+		s.signers = make(map[string]*jwt.Signer)
+	}
+	s.signers[algorithm] = signer
+	return signer, nil
+}
+
+// forwardAuth converts the handler's forward_auth block; nil disables it.
+func forwardAuth(fa *config.ForwardAuthConfig) *handler.ForwardAuth {
+	if fa == nil {
+		return nil
+	}
+	return &handler.ForwardAuth{
+		Address:         fa.Address,
+		ResponseHeaders: fa.ResponseHeaders,
+		Timeout:         fa.Timeout,
+	}
+}
+
+// newBalancer returns a balancer when the handler needs one (several
+// upstreams or health checks), or nil for the plain single-address path.
+func newBalancer(hc config.HandlerConfig) *handler.Balancer {
+	if len(hc.UpstreamAddresses) == 0 && hc.HealthCheck == nil {
+		return nil
+	}
+	addrs := hc.Upstreams()
+	if len(addrs) == 0 {
+		return nil
+	}
+	opts := handler.BalancerOptions{
+		Network:   hc.UpstreamNetwork,
+		Addresses: addrs,
+		Strategy:  hc.LoadBalancing,
+	}
+	if c := hc.HealthCheck; c != nil {
+		opts.HealthCheck = &handler.HealthCheck{
+			Interval:           c.Interval,
+			Timeout:            c.Timeout,
+			Path:               c.Path,
+			UnhealthyThreshold: c.UnhealthyThreshold,
+			HealthyThreshold:   c.HealthyThreshold,
+		}
+	}
+	return handler.NewBalancer(opts)
+}
+
+func httpRoutes(routes []config.RouteConfig) []handler.HTTPRoute {
+	out := make([]handler.HTTPRoute, 0, len(routes))
+	for _, r := range routes {
+		out = append(out, handler.HTTPRoute{
+			Path:            r.Path,
+			Host:            r.Host,
+			StripPrefix:     r.StripPrefix,
+			UpstreamAddress: r.UpstreamAddress,
+			UpstreamNetwork: r.UpstreamNetwork,
+		})
+	}
+	return out
+}
+
 func (s *Server) listenerFunc(tls, funnel bool) func(string, string) (net.Listener, error) {
 	if funnel {
 		return func(network, addr string) (net.Listener, error) {
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lucasew/ts-proxy/pkg/config"
+)
+
+func TestServerAuthKey(t *testing.T) {
+	if key, err := NewServer("web", Options{AuthKey: "tskey-static"}).authKey(t.Context()); err != nil || key != "tskey-static" {
+		t.Errorf("authKey without oauth = %q, %v; want the static key", key, err)
+	}
+
+	var minted atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/v2/oauth/token", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"access_token":"tskey-api","expires_in":3600}`))
+	})
+	mux.HandleFunc("POST /api/v2/tailnet/-/keys", func(w http.ResponseWriter, r *http.Request) {
+		minted.Add(1)
+		_, _ = w.Write([]byte(`{"key":"tskey-auth-minted"}`))
+	})
+	api := httptest.NewServer(mux)
+	defer api.Close()
+
+	stateDir := t.TempDir()
+	srv := NewServer("web", Options{
+		StateDir: stateDir,
+		OAuth: &config.OAuthConfig{
+			ClientID: "client", ClientSecret: "secret", Tags: []string{"tag:proxy"}, APIURL: api.URL,
+		},
+	})
+	if key, err := srv.authKey(t.Context()); err != nil || key != "tskey-auth-minted" {
+		t.Fatalf("authKey = %q, %v; want a minted key", key, err)
+	}
+
+	// A node that already logged in needs no key.
+	if err := os.WriteFile(filepath.Join(stateDir, stateFile), []byte("{}"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if key, err := srv.authKey(t.Context()); err != nil || key != "" {
+		t.Errorf("authKey with state = %q, %v; want no key", key, err)
+	}
+	if n := minted.Load(); n != 1 {
+		t.Errorf("minted %d keys, want 1", n)
+	}
+
+	// Control may have dropped an ephemeral node while it was offline.
+	srv.opts.Ephemeral = true
+	if key, err := srv.authKey(t.Context()); err != nil || key != "tskey-auth-minted" {
+		t.Errorf("ephemeral authKey with state = %q, %v; want a minted key", key, err)
+	}
+}
+
+func TestServerLoginURL(t *testing.T) {
+	var qr strings.Builder
+	srv := NewServer("web", Options{})
+	srv.loginQR = &qr
+	url := "https://login.tailscale.com/a/abc123"
+	srv.setAuthURL(url)
+	srv.setAuthURL(url)
+	if got := srv.Status().AuthURL; got != url {
+		t.Errorf("Status().AuthURL = %q, want %q", got, url)
+	}
+	if n := strings.Count(qr.String(), url); n != 1 {
+		t.Errorf("login announced %d times, want once:\n%s", n, qr.String())
+	}
+	if !strings.Contains(qr.String(), "█") {
+		t.Errorf("no QR code drawn:\n%s", qr.String())
+	}
+}
+
+// A node that cannot log in fails after auth_timeout instead of waiting
+// forever.
+func TestServerAuthTimeout(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a tsnet node")
+	}
+	dir := t.TempDir()
+	srv := NewServer("web", Options{
+		Hostname:    "web",
+		StateDir:    dir,
+		ControlURL:  "http://127.0.0.1:1",
+		AuthTimeout: 500 * time.Millisecond,
+	})
+	err := srv.Start(t.Context())
+	if !errors.Is(err, ErrAuthTimeout) {
+		t.Fatalf("Start = %v, want ErrAuthTimeout", err)
+	}
+	if st := srv.Status(); st.State != StateFailed || st.AuthURL != "" {
+		t.Errorf("status = %+v, want failed without a stale login URL", st)
+	}
+	lock, err := LockNode(dir)
+	if err != nil {
+		t.Fatalf("state dir still locked after a failed Start: %v", err)
+	}
+	_ = lock.Unlock()
+}
@@ -3,7 +3,9 @@ package server
 import (
 	"errors"
 	"fmt"
+	"slices"
 	"sync"
+	"time"
 )
 
 // State represents a server lifecycle state.
@@ -18,6 +20,12 @@ const (
 	StateStopped        State = "stopped"
 )
 
+// stateLabels lists every state, for the per-state metric.
+var stateLabels = []string{
+	string(StateInit), string(StateStarting), string(StateAuthenticating),
+	string(StateRunning), string(StateFailed), string(StateStopped),
+}
+
 // ErrInvalidStateTransition is returned when Transition rejects a change.
 var ErrInvalidStateTransition = errors.New("invalid state transition")
 
@@ -30,10 +38,26 @@ var validTransitions = map[State][]State{
 	StateStopped:        {StateStarting},
 }
 
+// Event describes one state transition.
+type Event struct {
+	// Server is the server's name; empty for a bare StateMachine.
+	Server string
+	From   State
+	To     State
+	Time   time.Time
+	// Err is why the server failed, for transitions to StateFailed.
+	Err error
+}
+
 // StateMachine tracks server lifecycle state with enforced transitions.
 type StateMachine struct {
-	state State
-	mu    sync.RWMutex
+	state     State
+	mu        sync.RWMutex
+	listeners []*listener
+}
+
+type listener struct {
+	fn func(Event)
 }
 
 // NewStateMachine creates a state machine in the Init state.
@@ -50,15 +74,54 @@ func (sm *StateMachine) Current() State {
 
 // Transition moves to a new state if the transition is valid.
 func (sm *StateMachine) Transition(to State) error {
+	return sm.transition(to, nil)
+}
+
+// Fail moves to StateFailed, recording cause in the event.
+func (sm *StateMachine) Fail(cause error) error {
+	return sm.transition(StateFailed, cause)
+}
+
+func (sm *StateMachine) transition(to State, cause error) error {
 	sm.mu.Lock()
-	defer sm.mu.Unlock()
 	if !isValidTransition(sm.state, to) {
-		return fmt.Errorf("%w: %s -> %s", ErrInvalidStateTransition, sm.state, to)
+		from := sm.state
+		sm.mu.Unlock()
+		return fmt.Errorf("%w: %s -> %s", ErrInvalidStateTransition, from, to)
 	}
+	e := Event{From: sm.state, To: to, Time: time.Now(), Err: cause}
 	sm.state = to
+	listeners := slices.Clone(sm.listeners)
+	sm.mu.Unlock()
+	for _, l := range listeners {
+		l.fn(e)
+	}
 	return nil
 }
 
+// Subscribe calls fn for every later transition until the returned
+// function is called. fn runs on the goroutine making the transition, after
+// the state has changed, so it must not block.
+func (sm *StateMachine) Subscribe(fn func(Event)) (unsubscribe func()) {
+	l := &listener{fn: fn}
+	sm.mu.Lock()
+	sm.listeners = append(sm.listeners, l)
+	sm.mu.Unlock()
+	return func() {
+		sm.mu.Lock()
+		defer sm.mu.Unlock()
+		sm.listeners = slices.DeleteFunc(sm.listeners, func(x *listener) bool { return x == l })
+	}
+}
+
+// Reset returns the state machine to Init, e.g. before a restart. It is
+// not a transition and notifies no one.
+func (sm *StateMachine) Reset() {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.state = StateInit
+}
+
 func isValidTransition(from, to State) bool {
 	for _, valid := range validTransitions[from] {
 		if valid == to {
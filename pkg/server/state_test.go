@@ -1,6 +1,7 @@
 package server
 
 import (
+	"errors"
 	"testing"
 )
 
@@ -115,3 +116,37 @@ func TestStateMachineConcurrent(t *testing.T) {
 		}
 	}
 }
+
+func TestStateMachineSubscribe(t *testing.T) {
+	sm := NewStateMachine()
+	var got []Event
+	unsubscribe := sm.Subscribe(func(e Event) { got = append(got, e) })
+
+	boom := errors.New("boom")
+	if err := sm.Transition(StateStarting); err != nil {
+		t.Fatalf("Transition: %v", err)
+	}
+	if err := sm.Fail(boom); err != nil {
+		t.Fatalf("Fail: %v", err)
+	}
+	if err := sm.Transition(StateRunning); err == nil {
+		t.Fatal("Failed -> Running accepted")
+	}
+	if len(got) != 2 {
+		t.Fatalf("got %d events, want 2 (rejected transitions are not events): %+v", len(got), got)
+	}
+	if got[0].From != StateInit || got[0].To != StateStarting || got[0].Err != nil || got[0].Time.IsZero() {
+		t.Errorf("event 0 = %+v", got[0])
+	}
+	if got[1].From != StateStarting || got[1].To != StateFailed || !errors.Is(got[1].Err, boom) {
+		t.Errorf("event 1 = %+v", got[1])
+	}
+
+	unsubscribe()
+	if err := sm.Transition(StateStopped); err != nil {
+		t.Fatalf("Transition: %v", err)
+	}
+	if len(got) != 2 {
+		t.Errorf("event delivered after unsubscribe: %+v", got[2:])
+	}
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"time"
+)
+
+// Status is a point-in-time snapshot of a Server, as served by the admin API.
+type Status struct {
+	Name  string `json:"name"`
+	FQDN  string `json:"fqdn"`
+	State State  `json:"state"`
+	// Restarts counts starts after the first one, automatic or requested.
+	Restarts  int    `json:"restarts"`
+	LastError string `json:"last_error,omitempty"`
+	// AuthURL is where to log in while the node waits for an interactive
+	// login.
+	AuthURL string `json:"auth_url,omitempty"`
+	// CrashLoop is set when the server failed too often and is no longer
+	// restarted automatically.
+	CrashLoop bool `json:"crash_loop,omitempty"`
+	// RunningSince is when the server last entered StateRunning; zero
+	// while it is not running.
+	RunningSince time.Time       `json:"running_since,omitzero"`
+	Handlers     []HandlerStatus `json:"handlers"`
+}
+
+// HandlerStatus describes one configured handler and its live connections:
+// TCP sessions, HTTP client connections or UDP peer sessions.
+type HandlerStatus struct {
+	Type        string `json:"type"`
+	Listen      string `json:"listen"`
+	Upstream    string `json:"upstream,omitempty"`
+	TLS         bool   `json:"tls,omitempty"`
+	Funnel      bool   `json:"funnel,omitempty"`
+	Active      bool   `json:"active"`
+	Connections int    `json:"connections"`
+}
+
+// Status returns a snapshot of the server's lifecycle and handlers.
+func (s *Server) Status() Status {
+	st := Status{
+		Name:  s.name,
+		FQDN:  s.FQDN(),
+		State: s.State(),
+	}
+	s.statusMu.Lock()
+	st.Restarts = max(s.starts-1, 0)
+	if s.lastErr != nil {
+		st.LastError = s.lastErr.Error()
+	}
+	st.RunningSince = s.since
+	st.CrashLoop = s.crashLoop
+	st.AuthURL = s.authURL
+	s.statusMu.Unlock()
+
+	s.handlersMu.Lock()
+	defer s.handlersMu.Unlock()
+	st.Handlers = make([]HandlerStatus, 0, len(s.opts.Handlers))
+	for _, hc := range s.opts.Handlers {
+		hs := HandlerStatus{
+			Type:     hc.Type,
+			Listen:   hc.Listen,
+			Upstream: hc.Target(),
+			TLS:      hc.TLS,
+			Funnel:   hc.Funnel,
+		}
+		if rh, ok := s.handlers[handlerKey(hc)]; ok {
+			hs.Active = true
+			hs.Connections = rh.connections()
+		}
+		st.Handlers = append(st.Handlers, hs)
+	}
+	return st
+}
@@ -2,57 +2,245 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"path/filepath"
+	"reflect"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/lucasew/ts-proxy/internal/ctxwait"
+	"github.com/lucasew/ts-proxy/pkg/accesslog"
 	"github.com/lucasew/ts-proxy/pkg/config"
+	"github.com/lucasew/ts-proxy/pkg/hooks"
+	"github.com/lucasew/ts-proxy/pkg/metrics"
+	"github.com/lucasew/ts-proxy/pkg/tracing"
 	"github.com/lucasew/ts-proxy/pkg/tsproxy"
 )
 
-// restartDelay is how long runWithRestart waits before starting a failed
-// server again when StopOnFail is false.
-const restartDelay = 5 * time.Second
+// Errors returned by the per-server actions used by the admin API.
+var (
+	ErrUnknownServer  = errors.New("unknown server")
+	ErrNotSupervising = errors.New("supervisor is not running")
+	ErrServerRunning  = errors.New("server is already running")
+)
 
 // Supervisor manages multiple servers and their lifecycles.
 type Supervisor struct {
+	// mu guards cfg, servers and running, which Reload replaces while Run
+	// is supervising.
+	mu      sync.Mutex
 	cfg     *config.Config
 	servers []*Server
+
+	// policies mirrors how cfg wants server exits handled without mu, so
+	// server goroutines never block on a Reload that is waiting for them
+	// to stop.
+	policies atomic.Pointer[exitPolicies]
+	// required mirrors the servers Ready checks, those not marked optional,
+	// so readiness probes do not hang while Reload stops a server.
+	required atomic.Pointer[[]*Server]
+
+	// accessLog and tracing are handed to every server; see SetAccessLog
+	// and SetTracing.
+	accessLog *accesslog.Logger
+	tracing   *tracing.Provider
+	// loginQR receives login QR codes; see SetLoginQR.
+	loginQR io.Writer
+
+	// listeners get the transitions of every server; see Subscribe. They
+	// have their own lock because transitions happen while Reload holds mu.
+	listenersMu sync.Mutex
+	listeners   []*listener
+	hooks       *hooks.Runner
+
+	// live is set while Run is supervising; see Live.
+	live atomic.Bool
+
+	// Set while Run is active.
+	runCtx  context.Context
+	fail    func(error)
+	wg      sync.WaitGroup
+	running map[string]*supervised
+}
+
+// supervised is a server goroutine started by Run or Reload.
+type supervised struct {
+	srv    *Server
+	cancel context.CancelFunc
+	done   chan struct{}
 }
 
 // NewSupervisor creates a supervisor from a validated config.
 func NewSupervisor(cfg *config.Config) *Supervisor {
-	var servers []*Server
+	sup := &Supervisor{
+		cfg:   cfg,
+		hooks: hooks.New(cfg.Hooks),
+	}
 	for _, name := range cfg.ServerNames() {
-		scfg := cfg.Servers[name]
-		authKey := ""
-		if scfg.Token != "" {
-			if tok, ok := cfg.Tokens[scfg.Token]; ok {
-				authKey = tok.AuthKey
-			}
+		sup.servers = append(sup.servers, sup.newServerLocked(name, serverOptions(cfg, name)))
+	}
+	sup.policies.Store(newExitPolicies(cfg))
+	sup.required.Store(requiredServers(cfg, sup.servers))
+	sup.Subscribe(sup.fireHooks)
+	return sup
+}
+
+// serverOptions resolves the server's token and state directory.
+func serverOptions(cfg *config.Config, name string) Options {
+	scfg := cfg.Servers[name]
+	opts := Options{
+		Hostname:      scfg.Hostname,
+		StateDir:      filepath.Join(cfg.StateDir, name),
+		Ephemeral:     scfg.Ephemeral,
+		AdvertiseTags: scfg.AdvertiseTags,
+		ControlURL:    scfg.ControlURL,
+		AuthTimeout:   scfg.AuthTimeout,
+		Handlers:      scfg.Handlers,
+	}
+	if scfg.Token != "" {
+		if tok, ok := cfg.Tokens[scfg.Token]; ok {
+			opts.AuthKey, opts.OAuth = tok.AuthKey, tok.OAuth
+		}
+	}
+	return opts
+}
+
+// SetAccessLog makes every server, including ones added by later reloads,
+// write access records to l. Call it before Run or StartAll.
+func (s *Supervisor) SetAccessLog(l *accesslog.Logger) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.accessLog = l
+	for _, srv := range s.servers {
+		srv.accessLog = l
+	}
+}
+
+// SetTracing makes every server, including ones added by later reloads,
+// export HTTP spans to p. Call it before Run or StartAll.
+func (s *Supervisor) SetTracing(p *tracing.Provider) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tracing = p
+	for _, srv := range s.servers {
+		srv.tracing = p
+	}
+}
+
+// SetLoginQR makes every server, including ones added by later reloads,
+// draw its login URL as a QR code on w. Call it before Run or StartAll.
+func (s *Supervisor) SetLoginQR(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.loginQR = w
+	for _, srv := range s.servers {
+		srv.loginQR = w
+	}
+}
+
+// newServerLocked creates a server that shares the supervisor's access log,
+// tracing and login QR output and reports its transitions to the
+// supervisor's listeners.
+func (s *Supervisor) newServerLocked(name string, opts Options) *Server {
+	srv := NewServer(name, opts)
+	srv.accessLog = s.accessLog
+	srv.tracing = s.tracing
+	srv.loginQR = s.loginQR
+	srv.Subscribe(s.emit)
+	return srv
+}
+
+// Subscribe calls fn for every state transition of every server, including
+// servers added by later reloads, until the returned function is called.
+// fn runs on the goroutine making the transition, so it must not block.
+func (s *Supervisor) Subscribe(fn func(Event)) (unsubscribe func()) {
+	l := &listener{fn: fn}
+	s.listenersMu.Lock()
+	s.listeners = append(s.listeners, l)
+	s.listenersMu.Unlock()
+	return func() {
+		s.listenersMu.Lock()
+		defer s.listenersMu.Unlock()
+		s.listeners = slices.DeleteFunc(s.listeners, func(x *listener) bool { return x == l })
+	}
+}
+
+func (s *Supervisor) emit(e Event) {
+	s.listenersMu.Lock()
+	listeners := slices.Clone(s.listeners)
+	s.listenersMu.Unlock()
+	for _, l := range listeners {
+		l.fn(e)
+	}
+}
+
+// fireHooks hands transitions to the configured hooks.
+func (s *Supervisor) fireHooks(e Event) {
+	he := hooks.Event{Server: e.Server, From: string(e.From), To: string(e.To), Time: e.Time}
+	if e.Err != nil {
+		he.Error = e.Err.Error()
+	}
+	s.hooks.Fire(he)
+}
+
+// exitPolicies is what the supervisor does when a server exits: the
+// shared backoff plus each server's restart mode and criticality.
+type exitPolicies struct {
+	backoff config.RestartPolicyConfig
+	servers map[string]exitPolicy
+}
+
+type exitPolicy struct {
+	restart  string
+	critical bool
+}
+
+// requiredServers returns the servers of cfg not marked optional.
+func requiredServers(cfg *config.Config, servers []*Server) *[]*Server {
+	var required []*Server
+	for _, srv := range servers {
+		if !cfg.Servers[srv.Name()].Optional {
+			required = append(required, srv)
 		}
-		stateDir := filepath.Join(cfg.StateDir, name)
-		srv := NewServer(name, Options{
-			Hostname: scfg.Hostname,
-			StateDir: stateDir,
-			AuthKey:  authKey,
-			Handlers: scfg.Handlers,
-		})
-		servers = append(servers, srv)
 	}
-	return &Supervisor{
-		cfg:     cfg,
-		servers: servers,
+	return &required
+}
+
+// newExitPolicies resolves cfg's policies, filling in defaults so configs
+// built without SetDefaults still back off sensibly. stop_on_fail makes
+// every server critical.
+func newExitPolicies(cfg *config.Config) *exitPolicies {
+	c := config.Config{RestartPolicy: cfg.RestartPolicy}
+	c.SetDefaults()
+	p := &exitPolicies{backoff: c.RestartPolicy, servers: make(map[string]exitPolicy, len(cfg.Servers))}
+	for name, scfg := range cfg.Servers {
+		restart := scfg.Restart
+		if restart == "" {
+			restart = config.RestartOnFailure
+		}
+		p.servers[name] = exitPolicy{restart: restart, critical: scfg.Critical || cfg.StopOnFail}
 	}
+	return p
+}
+
+// sameNode reports whether two option sets describe the same tailnet node,
+// i.e. whether a change can be applied without running tsnet Up again.
+func sameNode(a, b Options) bool {
+	a.Handlers, b.Handlers = nil, nil
+	return reflect.DeepEqual(a, b)
 }
 
 // Servers returns all managed servers.
 func (s *Supervisor) Servers() []*Server {
-	return s.servers
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.servers)
 }
 
 // StartAll authenticates all servers without serving traffic.
@@ -60,11 +248,12 @@ func (s *Supervisor) Servers() []*Server {
 // If any server fails to start, servers that already authenticated are closed
 // before the error is returned so tsnet nodes are not left running.
 func (s *Supervisor) StartAll(ctx context.Context) error {
-	for i, srv := range s.servers {
+	servers := s.Servers()
+	for i, srv := range servers {
 		if err := srv.Start(ctx); err != nil {
 			for j := 0; j < i; j++ {
-				if cerr := s.servers[j].Close(); cerr != nil {
-					tsproxy.ReportError(cerr, "context", "close error after start failure", "server", s.servers[j].Name())
+				if cerr := servers[j].Close(); cerr != nil {
+					tsproxy.ReportError(cerr, "context", "close error after start failure", "server", servers[j].Name())
 				}
 			}
 			return fmt.Errorf("server %s: %w", srv.Name(), err)
@@ -75,7 +264,7 @@ func (s *Supervisor) StartAll(ctx context.Context) error {
 
 // CloseAll shuts down all servers.
 func (s *Supervisor) CloseAll() {
-	for _, srv := range s.servers {
+	for _, srv := range s.Servers() {
 		if err := srv.Close(); err != nil {
 			tsproxy.ReportError(err, "context", "close error", "server", srv.Name())
 		}
@@ -84,6 +273,8 @@ func (s *Supervisor) CloseAll() {
 
 // DisplayAuthenticated prints server info including FQDN (after authentication).
 func (s *Supervisor) DisplayAuthenticated() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	var b strings.Builder
 
 	var all []config.HandlerConfig
@@ -102,55 +293,341 @@ func (s *Supervisor) DisplayAuthenticated() string {
 	return b.String()
 }
 
-// Run starts all servers and supervises them.
-// If StopOnFail is true, any server failure stops all servers.
-// Otherwise, failed servers are restarted with a delay.
+// Run starts all servers and supervises them until ctx is cancelled.
+// A failure of a critical server (every server with StopOnFail) stops all
+// servers; other servers are restarted as their restart mode allows.
 func (s *Supervisor) Run(ctx context.Context) error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	var wg sync.WaitGroup
 	var firstErr error
 	var errOnce sync.Once
-
+	s.mu.Lock()
+	s.runCtx = ctx
+	s.fail = func(err error) {
+		errOnce.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+	s.running = make(map[string]*supervised)
 	for _, srv := range s.servers {
-		srv := srv
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			err := s.runWithRestart(ctx, srv)
-			if err != nil {
-				errOnce.Do(func() {
-					firstErr = err
-					cancel()
-				})
-			}
-		}()
+		s.startLocked(srv)
 	}
+	s.mu.Unlock()
+	s.live.Store(true)
 
-	wg.Wait()
+	<-ctx.Done()
+	s.live.Store(false)
+	// Detach before waiting so a concurrent Reload cannot add goroutines
+	// to the WaitGroup being waited on.
+	s.mu.Lock()
+	s.runCtx, s.fail, s.running = nil, nil, nil
+	s.mu.Unlock()
+	s.wg.Wait()
+	// Let alerts about the failure that stopped us go out.
+	s.hooks.Wait()
 	return firstErr
 }
 
+// startLocked supervises srv in its own goroutine. Caller holds mu and Run
+// is active.
+func (s *Supervisor) startLocked(srv *Server) {
+	s.startAfterLocked(srv, nil)
+}
+
+// startAfterLocked is startLocked for a server replacing one that is still
+// shutting down: it waits for prev, when not nil, so the new node does not
+// find the state dir locked. Caller holds mu and Run is active.
+func (s *Supervisor) startAfterLocked(srv *Server, prev <-chan struct{}) {
+	ctx, cancel := context.WithCancel(s.runCtx)
+	sv := &supervised{srv: srv, cancel: cancel, done: make(chan struct{})}
+	s.running[srv.Name()] = sv
+	fail := s.fail
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer close(sv.done)
+		defer cancel()
+		if prev != nil {
+			select {
+			case <-prev:
+			case <-ctx.Done():
+				return
+			}
+		}
+		if err := s.runWithRestart(ctx, srv); err != nil {
+			fail(err)
+		}
+	}()
+}
+
+// stopLocked cancels a supervised server and waits for it to close its
+// tsnet node. Caller holds mu.
+func (s *Supervisor) stopLocked(name string) {
+	if done := s.detachLocked(name); done != nil {
+		<-done
+	}
+}
+
+// detachLocked cancels a supervised server without waiting for it and
+// returns a channel closed once it has closed its tsnet node, or nil if it
+// was not running. Caller holds mu.
+func (s *Supervisor) detachLocked(name string) <-chan struct{} {
+	sv, ok := s.running[name]
+	if !ok {
+		return nil
+	}
+	sv.cancel()
+	delete(s.running, name)
+	return sv.done
+}
+
+// runWithRestart runs srv until ctx is cancelled. A critical server's
+// failure is returned, which stops the whole process. Otherwise the
+// server's restart mode decides: on-failure restarts it until it crash
+// loops, always restarts it without ever giving up, and never leaves it
+// failed. Restarts are paced by the backoff. A server only exits cleanly
+// when ctx is cancelled, so every mode acts on failures alone.
 func (s *Supervisor) runWithRestart(ctx context.Context, srv *Server) error {
+	b := newBackoff()
 	for {
 		slog.Info("starting server", "name", srv.Name())
 		err := srv.Run(ctx)
 		if ctx.Err() != nil {
 			return nil
 		}
-		if err != nil {
-			tsproxy.ReportError(err, "context", "server failed", "name", srv.Name())
-			if s.cfg.StopOnFail {
-				return fmt.Errorf("server %s: %w", srv.Name(), err)
+		if err == nil {
+			return nil
+		}
+		policies := s.policies.Load()
+		policy := policies.servers[srv.Name()]
+		tsproxy.ReportError(err, "context", "server failed", "name", srv.Name())
+		if policy.critical {
+			return fmt.Errorf("server %s: %w", srv.Name(), err)
+		}
+		if policy.restart == config.RestartNever {
+			slog.Info("not restarting server", "name", srv.Name(), "restart", policy.restart)
+			return nil
+		}
+		backoff := policies.backoff
+		if policy.restart == config.RestartAlways {
+			backoff.MaxRestarts = 0
+		}
+		delay, crashLoop := b.failed(backoff, time.Now(), srv.lastUptime())
+		if crashLoop {
+			tsproxy.ReportError(err, "context", "server is crash looping, giving up",
+				"name", srv.Name(), "max_restarts", backoff.MaxRestarts, "window", backoff.Window.String())
+			srv.setCrashLoop()
+			return nil
+		}
+		slog.Info("restarting server", "name", srv.Name(), "delay", delay.Round(time.Millisecond).String())
+		// Stay Failed while waiting so the admin API shows why.
+		if !ctxwait.Delay(ctx, delay) {
+			return nil
+		}
+		srv.ResetState()
+	}
+}
+
+// Reload applies a new config. Servers that were removed are stopped, new
+// ones started, and servers whose node settings (hostname, token, state
+// dir) changed are restarted. Servers whose handlers alone changed keep
+// their tsnet node and only swap the affected handlers; untouched servers
+// are not disturbed at all. Top-level settings read only at startup, like
+// metrics_listen, are logged and left as they were. An invalid config is
+// rejected and nothing changes.
+//
+// Reload returns once the stopped servers have closed their nodes, but
+// waits for them without holding mu, so the admin API keeps answering.
+func (s *Supervisor) Reload(cfg *config.Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	for _, field := range s.cfg.RestartOnly(cfg) {
+		slog.Warn("reload: change needs a restart to apply", "field", field)
+	}
+
+	current := make(map[string]*Server, len(s.servers))
+	for _, srv := range s.servers {
+		current[srv.Name()] = srv
+	}
+	var stopping []<-chan struct{}
+	servers := make([]*Server, 0, len(cfg.Servers))
+	for _, name := range cfg.ServerNames() {
+		opts := serverOptions(cfg, name)
+		srv, ok := current[name]
+		delete(current, name)
+		switch {
+		case !ok:
+			srv = s.newServerLocked(name, opts)
+			slog.Info("reload: adding server", "name", name)
+			if s.running != nil {
+				s.startLocked(srv)
 			}
-			slog.Info("restarting server", "name", srv.Name(), "delay", restartDelay.String())
-			srv.ResetState()
-			if !ctxwait.Delay(ctx, restartDelay) {
-				return nil
+		case !sameNode(srv.opts, opts):
+			slog.Info("reload: restarting server", "name", name)
+			prev := s.detachLocked(name)
+			if prev != nil {
+				stopping = append(stopping, prev)
 			}
-			continue
+			srv = s.newServerLocked(name, opts)
+			if s.running != nil {
+				s.startAfterLocked(srv, prev)
+			}
+		case !reflect.DeepEqual(srv.Handlers(), opts.Handlers):
+			slog.Info("reload: updating handlers", "name", name)
+			srv.UpdateHandlers(opts.Handlers)
 		}
-		return nil
+		servers = append(servers, srv)
+	}
+	removed := make([]string, 0, len(current))
+	for name := range current {
+		slog.Info("reload: removing server", "name", name)
+		if done := s.detachLocked(name); done != nil {
+			stopping = append(stopping, done)
+		}
+		removed = append(removed, name)
+	}
+	s.cfg = cfg
+	s.servers = servers
+	s.policies.Store(newExitPolicies(cfg))
+	s.required.Store(requiredServers(cfg, servers))
+	s.hooks.Update(cfg.Hooks)
+	s.mu.Unlock()
+
+	for _, done := range stopping {
+		<-done
+	}
+	// After the stop, so a closing server does not bring them back.
+	for _, name := range removed {
+		metrics.ForgetServer(name)
+	}
+	return nil
+}
+
+// Live reports whether Run is supervising. It fails once Run is shutting
+// down, including after a critical server failed. It never takes mu, so a
+// slow Reload does not fail liveness probes.
+func (s *Supervisor) Live() error {
+	if !s.live.Load() {
+		return ErrNotSupervising
+	}
+	return nil
+}
+
+// Ready reports whether every server not marked optional is running with
+// all its handlers listening. The error lists each server that is not.
+// Like Live it never takes mu; during a Reload it checks the servers of
+// the previous config.
+func (s *Supervisor) Ready() error {
+	if err := s.Live(); err != nil {
+		return err
+	}
+	var errs []error
+	for _, srv := range *s.required.Load() {
+		if err := srv.Ready(); err != nil {
+			errs = append(errs, fmt.Errorf("server %s: %w", srv.Name(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Status returns a snapshot of every server, in name order.
+func (s *Supervisor) Status() []Status {
+	servers := s.Servers()
+	out := make([]Status, 0, len(servers))
+	for _, srv := range servers {
+		out = append(out, srv.Status())
+	}
+	return out
+}
+
+// ServerStatus returns a snapshot of the named server.
+func (s *Supervisor) ServerStatus(name string) (Status, error) {
+	s.mu.Lock()
+	srv := s.lookupLocked(name)
+	s.mu.Unlock()
+	if srv == nil {
+		return Status{}, fmt.Errorf("%w %q", ErrUnknownServer, name)
+	}
+	return srv.Status(), nil
+}
+
+// StopServer stops the named server and closes its tsnet node. It stays
+// stopped until StartServer or RestartServer, or a Reload that changes its
+// node settings.
+func (s *Supervisor) StopServer(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	srv, err := s.actionTargetLocked(name)
+	if err != nil {
+		return err
+	}
+	slog.Info("stopping server", "name", name)
+	s.stopLocked(name)
+	// Stopped while authenticating or waiting to restart.
+	if srv.State() == StateFailed {
+		srv.mustTransition(StateStopped)
+	}
+	return nil
+}
+
+// StartServer starts a server stopped by StopServer.
+func (s *Supervisor) StartServer(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	srv, err := s.actionTargetLocked(name)
+	if err != nil {
+		return err
 	}
+	if sv, ok := s.running[name]; ok {
+		select {
+		case <-sv.done:
+			// Gave up after a crash loop; start it afresh.
+			delete(s.running, name)
+		default:
+			return fmt.Errorf("%w: %s", ErrServerRunning, name)
+		}
+	}
+	s.startLocked(srv)
+	return nil
+}
+
+// RestartServer stops the named server, if running, and starts it again,
+// running tsnet Up anew.
+func (s *Supervisor) RestartServer(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	srv, err := s.actionTargetLocked(name)
+	if err != nil {
+		return err
+	}
+	slog.Info("restarting server", "name", name)
+	s.stopLocked(name)
+	s.startLocked(srv)
+	return nil
+}
+
+// actionTargetLocked returns the named server for an admin action. Caller
+// holds mu.
+func (s *Supervisor) actionTargetLocked(name string) (*Server, error) {
+	srv := s.lookupLocked(name)
+	if srv == nil {
+		return nil, fmt.Errorf("%w %q", ErrUnknownServer, name)
+	}
+	if s.running == nil {
+		return nil, ErrNotSupervising
+	}
+	return srv, nil
+}
+
+func (s *Supervisor) lookupLocked(name string) *Server {
+	for _, srv := range s.servers {
+		if srv.Name() == name {
+			return srv
+		}
+	}
+	return nil
 }
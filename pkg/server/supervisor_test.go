@@ -1,10 +1,21 @@
 package server
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/lucasew/ts-proxy/pkg/config"
+	"github.com/lucasew/ts-proxy/pkg/hooks"
 )
 
 func TestNewSupervisorResolvesTokensAndStateDir(t *testing.T) {
@@ -50,6 +61,31 @@ func TestNewSupervisorResolvesTokensAndStateDir(t *testing.T) {
 	}
 }
 
+func TestServerOptionsNodeSettings(t *testing.T) {
+	cfg := &config.Config{
+		StateDir: "/var/lib/ts-proxy",
+		Servers: map[string]config.ServerConfig{
+			"preview": {
+				Hostname:      "pr-123",
+				Ephemeral:     true,
+				AdvertiseTags: []string{"tag:preview"},
+				ControlURL:    "https://headscale.example.com",
+				Handlers:      []config.HandlerConfig{{Type: "http", Listen: ":80", UpstreamAddress: "127.0.0.1:8080"}},
+			},
+		},
+	}
+	opts := serverOptions(cfg, "preview")
+	if !opts.Ephemeral || !slices.Equal(opts.AdvertiseTags, []string{"tag:preview"}) || opts.ControlURL != "https://headscale.example.com" {
+		t.Errorf("options = %+v, want ephemeral, tag:preview and the headscale control url", opts)
+	}
+	// They describe the node, so changing one means a new node.
+	changed := opts
+	changed.Ephemeral = false
+	if sameNode(opts, changed) {
+		t.Error("sameNode ignores ephemeral")
+	}
+}
+
 func TestDisplayAuthenticatedUsesFQDNFallback(t *testing.T) {
 	cfg := &config.Config{
 		StateDir: "/tmp/ts-proxy-test",
@@ -73,3 +109,424 @@ func TestDisplayAuthenticatedUsesFQDNFallback(t *testing.T) {
 		}
 	}
 }
+
+func reloadTestConfig() *config.Config {
+	return &config.Config{
+		StateDir: "/tmp/ts-proxy-test",
+		Tokens:   map[string]config.TokenConfig{"prod": {AuthKey: "tskey-test"}},
+		Servers: map[string]config.ServerConfig{
+			"web": {
+				Hostname: "web",
+				Token:    "prod",
+				Handlers: []config.HandlerConfig{
+					{Type: "http", Listen: ":80", UpstreamAddress: "127.0.0.1:8080", UpstreamNetwork: "tcp"},
+				},
+			},
+			"api": {
+				Hostname: "api",
+				Handlers: []config.HandlerConfig{
+					{Type: "tcp", Listen: ":22", UpstreamAddress: "127.0.0.1:22", UpstreamNetwork: "tcp"},
+				},
+			},
+			"old": {
+				Hostname: "old",
+				Handlers: []config.HandlerConfig{
+					{Type: "tcp", Listen: ":5432", UpstreamAddress: "127.0.0.1:5432", UpstreamNetwork: "tcp"},
+				},
+			},
+		},
+	}
+}
+
+func serversByName(sup *Supervisor) map[string]*Server {
+	out := make(map[string]*Server)
+	for _, srv := range sup.Servers() {
+		out[srv.Name()] = srv
+	}
+	return out
+}
+
+func TestReloadDiffsServers(t *testing.T) {
+	sup := NewSupervisor(reloadTestConfig())
+	before := serversByName(sup)
+
+	cfg := reloadTestConfig()
+	delete(cfg.Servers, "old")
+	web := cfg.Servers["web"]
+	web.Handlers = append(web.Handlers, config.HandlerConfig{Type: "tcp", Listen: ":2222", UpstreamAddress: "127.0.0.1:22", UpstreamNetwork: "tcp"})
+	cfg.Servers["web"] = web
+	api := cfg.Servers["api"]
+	api.Hostname = "api-renamed"
+	cfg.Servers["api"] = api
+	cfg.Servers["new"] = config.ServerConfig{
+		Hostname: "new",
+		Handlers: []config.HandlerConfig{{Type: "http", Listen: ":80", UpstreamAddress: "127.0.0.1:9000", UpstreamNetwork: "tcp"}},
+	}
+
+	if err := sup.Reload(cfg); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	after := serversByName(sup)
+
+	if _, ok := after["old"]; ok {
+		t.Error("removed server still managed")
+	}
+	if after["new"] == nil {
+		t.Error("added server not managed")
+	}
+	if after["web"] != before["web"] {
+		t.Error("handler-only change replaced the server; want the same node kept")
+	}
+	if n := len(after["web"].Handlers()); n != 2 {
+		t.Errorf("web handlers = %d, want 2 after reload", n)
+	}
+	if after["api"] == before["api"] {
+		t.Error("hostname change kept the old server; want a new node")
+	}
+	if after["api"].opts.Hostname != "api-renamed" {
+		t.Errorf("api hostname = %q, want api-renamed", after["api"].opts.Hostname)
+	}
+}
+
+func TestReloadKeepsUnchangedServers(t *testing.T) {
+	sup := NewSupervisor(reloadTestConfig())
+	before := serversByName(sup)
+	if err := sup.Reload(reloadTestConfig()); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	for name, srv := range serversByName(sup) {
+		if srv != before[name] {
+			t.Errorf("server %s replaced by a no-op reload", name)
+		}
+	}
+}
+
+func TestReloadRejectsInvalidConfig(t *testing.T) {
+	sup := NewSupervisor(reloadTestConfig())
+	before := serversByName(sup)
+
+	cfg := reloadTestConfig()
+	web := cfg.Servers["web"]
+	web.Token = "missing"
+	cfg.Servers["web"] = web
+	delete(cfg.Servers, "old")
+
+	if err := sup.Reload(cfg); !errors.Is(err, config.ErrUndefinedToken) {
+		t.Fatalf("Reload = %v, want ErrUndefinedToken", err)
+	}
+	after := serversByName(sup)
+	if len(after) != len(before) {
+		t.Fatalf("servers = %d after rejected reload, want %d", len(after), len(before))
+	}
+	for name, srv := range after {
+		if srv != before[name] {
+			t.Errorf("server %s changed by a rejected reload", name)
+		}
+	}
+}
+
+// Reload waits for removed servers to close without holding mu, so the
+// admin API can still read status.
+func TestReloadWaitsOutsideLock(t *testing.T) {
+	sup := NewSupervisor(reloadTestConfig())
+	closing := make(chan struct{})
+	sup.running = map[string]*supervised{
+		"old": {srv: serversByName(sup)["old"], cancel: func() {}, done: closing},
+	}
+	cfg := reloadTestConfig()
+	delete(cfg.Servers, "old")
+	reloaded := make(chan error, 1)
+	go func() { reloaded <- sup.Reload(cfg) }()
+
+	status := make(chan error, 1)
+	go func() {
+		// Wait until Reload has swapped the servers and is waiting.
+		for serversByName(sup)["old"] != nil {
+			time.Sleep(time.Millisecond)
+		}
+		_, err := sup.ServerStatus("web")
+		status <- err
+	}()
+	select {
+	case err := <-status:
+		if err != nil {
+			t.Errorf("ServerStatus during reload: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServerStatus blocked while Reload waited for a server to stop")
+	}
+	select {
+	case err := <-reloaded:
+		t.Fatalf("Reload returned %v before the removed server closed", err)
+	default:
+	}
+	close(closing)
+	if err := <-reloaded; err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+}
+
+func TestStatusSnapshot(t *testing.T) {
+	sup := NewSupervisor(reloadTestConfig())
+	statuses := sup.Status()
+	if len(statuses) != 3 {
+		t.Fatalf("Status() len = %d, want 3", len(statuses))
+	}
+	st, err := sup.ServerStatus("web")
+	if err != nil {
+		t.Fatalf("ServerStatus: %v", err)
+	}
+	if st.State != StateInit || st.Restarts != 0 || st.LastError != "" || !st.RunningSince.IsZero() {
+		t.Errorf("fresh status = %+v", st)
+	}
+	if len(st.Handlers) != 1 || st.Handlers[0].Active || st.Handlers[0].Connections != 0 {
+		t.Errorf("handlers of a server that is not serving = %+v", st.Handlers)
+	}
+	if _, err := sup.ServerStatus("nope"); !errors.Is(err, ErrUnknownServer) {
+		t.Errorf("ServerStatus(nope) = %v, want ErrUnknownServer", err)
+	}
+}
+
+func TestServerActionsRequireRun(t *testing.T) {
+	sup := NewSupervisor(reloadTestConfig())
+	for name, fn := range map[string]func(string) error{
+		"start":   sup.StartServer,
+		"stop":    sup.StopServer,
+		"restart": sup.RestartServer,
+	} {
+		if err := fn("web"); !errors.Is(err, ErrNotSupervising) {
+			t.Errorf("%s before Run = %v, want ErrNotSupervising", name, err)
+		}
+		if err := fn("nope"); !errors.Is(err, ErrUnknownServer) {
+			t.Errorf("%s unknown server = %v, want ErrUnknownServer", name, err)
+		}
+	}
+}
+
+// failingConfig returns a config whose servers fail every start at once,
+// before tsnet is involved: their state dirs lie below a regular file.
+func failingConfig(t *testing.T, servers map[string]config.ServerConfig) *config.Config {
+	t.Helper()
+	blocker := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(blocker, nil, 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	for name, scfg := range servers {
+		scfg.Hostname = name
+		scfg.Handlers = []config.HandlerConfig{{Type: "tcp", Listen: ":22", UpstreamAddress: "127.0.0.1:22"}}
+		servers[name] = scfg
+	}
+	return &config.Config{
+		StateDir: blocker,
+		RestartPolicy: config.RestartPolicyConfig{
+			InitialDelay: time.Millisecond,
+			MaxDelay:     time.Millisecond,
+		},
+		Servers: servers,
+	}
+}
+
+// runSupervisor runs sup in the background and returns Run's result channel.
+func runSupervisor(ctx context.Context, sup *Supervisor) <-chan error {
+	done := make(chan error, 1)
+	go func() { done <- sup.Run(ctx) }()
+	return done
+}
+
+// waitStatus polls the named server until cond holds or 5s pass.
+func waitStatus(t *testing.T, sup *Supervisor, name string, cond func(Status) bool) Status {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		st, err := sup.ServerStatus(name)
+		if err != nil {
+			t.Fatalf("ServerStatus: %v", err)
+		}
+		if cond(st) || time.Now().After(deadline) {
+			return st
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRunGivesUpOnCrashLoop(t *testing.T) {
+	cfg := failingConfig(t, map[string]config.ServerConfig{"web": {}})
+	cfg.RestartPolicy.MaxRestarts = 2
+	sup := NewSupervisor(cfg)
+	ctx, cancel := context.WithCancel(t.Context())
+	done := runSupervisor(ctx, sup)
+
+	st := waitStatus(t, sup, "web", func(st Status) bool { return st.CrashLoop })
+	if !st.CrashLoop || st.State != StateFailed || st.Restarts != 2 {
+		t.Fatalf("status = %+v, want failed crash loop after 2 restarts", st)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("Run returned %v after a crash loop; want it to keep supervising", err)
+	default:
+	}
+	// An explicit start tries again.
+	if err := sup.StartServer("web"); err != nil {
+		t.Fatalf("StartServer after crash loop: %v", err)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+}
+
+func TestRunRestartModes(t *testing.T) {
+	cfg := failingConfig(t, map[string]config.ServerConfig{
+		"never":      {Restart: config.RestartNever},
+		"always":     {Restart: config.RestartAlways},
+		"on-failure": {Restart: config.RestartOnFailure},
+	})
+	// always ignores max_restarts; on-failure gives up at it.
+	cfg.RestartPolicy.MaxRestarts = 1
+	sup := NewSupervisor(cfg)
+	ctx, cancel := context.WithCancel(t.Context())
+	done := runSupervisor(ctx, sup)
+
+	st := waitStatus(t, sup, "always", func(st Status) bool { return st.Restarts >= 3 })
+	if st.Restarts < 3 || st.CrashLoop {
+		t.Errorf("always: status = %+v, want restarts past max_restarts", st)
+	}
+	st = waitStatus(t, sup, "on-failure", func(st Status) bool { return st.CrashLoop })
+	if !st.CrashLoop || st.Restarts != 1 {
+		t.Errorf("on-failure: status = %+v, want crash loop after max_restarts", st)
+	}
+	st = waitStatus(t, sup, "never", func(st Status) bool { return st.State == StateFailed })
+	if st.State != StateFailed || st.Restarts != 0 || st.CrashLoop {
+		t.Errorf("never: status = %+v, want failed without restarts", st)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+}
+
+func TestRunCriticalFailureStopsAll(t *testing.T) {
+	cfg := failingConfig(t, map[string]config.ServerConfig{
+		"dev":     {},
+		"ingress": {Critical: true},
+	})
+	sup := NewSupervisor(cfg)
+	select {
+	case err := <-runSupervisor(t.Context(), sup):
+		if err == nil || !strings.Contains(err.Error(), "server ingress") {
+			t.Fatalf("Run = %v, want the ingress failure", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run kept going after a critical server failed")
+	}
+}
+
+func TestSupervisorHealth(t *testing.T) {
+	cfg := failingConfig(t, map[string]config.ServerConfig{
+		"web": {Restart: config.RestartNever},
+		"lab": {Restart: config.RestartNever, Optional: true},
+	})
+	sup := NewSupervisor(cfg)
+	if err := sup.Live(); !errors.Is(err, ErrNotSupervising) {
+		t.Errorf("Live before Run = %v, want ErrNotSupervising", err)
+	}
+	if err := sup.Ready(); !errors.Is(err, ErrNotSupervising) {
+		t.Errorf("Ready before Run = %v, want ErrNotSupervising", err)
+	}
+	ctx, cancel := context.WithCancel(t.Context())
+	done := runSupervisor(ctx, sup)
+
+	for _, name := range []string{"web", "lab"} {
+		waitStatus(t, sup, name, func(st Status) bool { return st.State == StateFailed })
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for sup.Live() != nil && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err := sup.Live(); err != nil {
+		t.Errorf("Live while supervising = %v", err)
+	}
+	err := sup.Ready()
+	if !errors.Is(err, ErrNotReady) || !strings.Contains(err.Error(), "server web") {
+		t.Errorf("Ready = %v, want web not ready", err)
+	}
+	if strings.Contains(err.Error(), "server lab") {
+		t.Errorf("Ready = %v, want optional lab ignored", err)
+	}
+
+	// A Reload holding mu while a node shuts down must not stall probes.
+	sup.mu.Lock()
+	ready := make(chan error, 1)
+	go func() { ready <- sup.Ready() }()
+	select {
+	case err := <-ready:
+		if !errors.Is(err, ErrNotReady) {
+			t.Errorf("Ready during reload = %v, want web not ready", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Ready blocked on the supervisor lock")
+	}
+	sup.mu.Unlock()
+
+	// Marking web optional leaves nothing to wait for.
+	next := failingConfig(t, map[string]config.ServerConfig{
+		"web": {Restart: config.RestartNever, Optional: true},
+		"lab": {Restart: config.RestartNever, Optional: true},
+	})
+	next.StateDir = cfg.StateDir
+	if err := sup.Reload(next); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if err := sup.Ready(); err != nil {
+		t.Errorf("Ready with only optional servers = %v", err)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if err := sup.Live(); !errors.Is(err, ErrNotSupervising) {
+		t.Errorf("Live after Run = %v, want ErrNotSupervising", err)
+	}
+}
+
+func TestSupervisorEventsAndHooks(t *testing.T) {
+	posted := make(chan hooks.Event, 4)
+	hookServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e hooks.Event
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			t.Errorf("decode hook body: %v", err)
+		}
+		posted <- e
+	}))
+	defer hookServer.Close()
+
+	cfg := failingConfig(t, map[string]config.ServerConfig{"ingress": {Critical: true}})
+	cfg.Hooks = []config.HookConfig{{On: []string{config.HookOnFailed}, Webhook: hookServer.URL}}
+	sup := NewSupervisor(cfg)
+	var mu sync.Mutex
+	var events []Event
+	sup.Subscribe(func(e Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, e)
+	})
+
+	if err := <-runSupervisor(t.Context(), sup); err == nil {
+		t.Fatal("Run = nil, want the critical failure")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) != 2 || events[1].Server != "ingress" || events[1].To != StateFailed || events[1].Err == nil {
+		t.Fatalf("events = %+v, want starting then failed with the cause", events)
+	}
+	// Run waits for hooks, so the webhook has been called by now.
+	select {
+	case e := <-posted:
+		if e.Server != "ingress" || e.From != "starting" || e.To != "failed" || !strings.Contains(e.Error, "create state dir") {
+			t.Errorf("webhook event = %+v", e)
+		}
+	default:
+		t.Fatal("webhook not called before Run returned")
+	}
+}
@@ -0,0 +1,249 @@
+// Package tracing exports OpenTelemetry spans for proxied HTTP requests over
+// OTLP, continuing W3C trace context from clients and passing it on to
+// upstreams.
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Protocols accepted by Options.Protocol.
+const (
+	ProtocolGRPC = "grpc"
+	ProtocolHTTP = "http"
+)
+
+// DefaultServiceName is the service.name resource attribute when
+// Options.ServiceName is empty.
+const DefaultServiceName = "ts-proxy"
+
+// Span attributes specific to ts-proxy.
+const (
+	AttrServer  = attribute.Key("ts_proxy.server")
+	AttrHandler = attribute.Key("ts_proxy.handler")
+	// AttrUser is the tailnet login, "tagged" or "anonymous".
+	AttrUser     = attribute.Key("ts_proxy.user")
+	AttrNode     = attribute.Key("ts_proxy.node")
+	AttrOrigin   = attribute.Key("ts_proxy.origin")
+	AttrUpstream = attribute.Key("ts_proxy.upstream")
+)
+
+// ErrUnknownProtocol is returned for protocols other than grpc and http.
+var ErrUnknownProtocol = errors.New("unknown otlp protocol")
+
+// Options configures the OTLP exporter.
+type Options struct {
+	// Endpoint is the collector as host:port, or a URL (http:// implies
+	// Insecure).
+	Endpoint string
+	// Protocol is ProtocolGRPC (default) or ProtocolHTTP.
+	Protocol string
+	// Insecure disables TLS to the collector.
+	Insecure bool
+	// Headers are sent with every export, e.g. for collector auth.
+	Headers map[string]string
+	// SampleRatio is the fraction of new traces recorded; 1 when nil and
+	// none when 0. Requests that arrive with a sampled parent are always
+	// recorded.
+	SampleRatio *float64
+	// ServiceName is the service.name resource attribute;
+	// DefaultServiceName when empty.
+	ServiceName string
+}
+
+// ValidateProtocol checks that protocol is supported. Empty means grpc.
+func ValidateProtocol(protocol string) error {
+	switch protocol {
+	case "", ProtocolGRPC, ProtocolHTTP:
+		return nil
+	default:
+		return fmt.Errorf("%w %q: want %s or %s", ErrUnknownProtocol, protocol, ProtocolGRPC, ProtocolHTTP)
+	}
+}
+
+// noopSpan is returned when there is nothing to trace; ending it is safe.
+var noopSpan = trace.SpanFromContext(context.Background())
+
+// Provider owns the exporter and hands out per-handler tracers.
+type Provider struct {
+	tp         *sdktrace.TracerProvider
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+}
+
+// New creates a provider exporting to the collector in opts. The exporter
+// connects lazily, so an unreachable collector does not fail startup.
+func New(ctx context.Context, opts Options) (*Provider, error) {
+	exporter, err := newExporter(ctx, opts)
+	if err != nil {
+		return nil, fmt.Errorf("otlp exporter: %w", err)
+	}
+	name := opts.ServiceName
+	if name == "" {
+		name = DefaultServiceName
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(semconv.ServiceName(name)))
+	if err != nil {
+		return nil, fmt.Errorf("otel resource: %w", err)
+	}
+	ratio := 1.0
+	if opts.SampleRatio != nil {
+		ratio = *opts.SampleRatio
+	}
+	return newProvider(sdktrace.NewBatchSpanProcessor(exporter), res, ratio), nil
+}
+
+// NewWithProcessor creates a provider that hands spans to sp, for tests and
+// embedding.
+func NewWithProcessor(sp sdktrace.SpanProcessor) *Provider {
+	return newProvider(sp, resource.Default(), 1)
+}
+
+func newProvider(sp sdktrace.SpanProcessor, res *resource.Resource, ratio float64) *Provider {
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithSpanProcessor(sp),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	)
+	return &Provider{
+		tp:         tp,
+		tracer:     tp.Tracer("github.com/lucasew/ts-proxy"),
+		propagator: propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}),
+	}
+}
+
+func newExporter(ctx context.Context, opts Options) (sdktrace.SpanExporter, error) {
+	if err := ValidateProtocol(opts.Protocol); err != nil {
+		return nil, err
+	}
+	isURL := strings.Contains(opts.Endpoint, "://")
+	if opts.Protocol == ProtocolHTTP {
+		o := []otlptracehttp.Option{otlptracehttp.WithHeaders(opts.Headers)}
+		if isURL {
+			o = append(o, otlptracehttp.WithEndpointURL(opts.Endpoint))
+		} else {
+			o = append(o, otlptracehttp.WithEndpoint(opts.Endpoint))
+		}
+		if opts.Insecure {
+			o = append(o, otlptracehttp.WithInsecure())
+		}
+		return otlptracehttp.New(ctx, o...)
+	}
+	o := []otlptracegrpc.Option{otlptracegrpc.WithHeaders(opts.Headers)}
+	if isURL {
+		o = append(o, otlptracegrpc.WithEndpointURL(opts.Endpoint))
+	} else {
+		o = append(o, otlptracegrpc.WithEndpoint(opts.Endpoint))
+	}
+	if opts.Insecure {
+		o = append(o, otlptracegrpc.WithInsecure())
+	}
+	return otlptracegrpc.New(ctx, o...)
+}
+
+// Shutdown flushes buffered spans and stops the exporter.
+func (p *Provider) Shutdown(ctx context.Context) error {
+	return p.tp.Shutdown(ctx)
+}
+
+// Handler traces requests for one proxy handler. A nil *Handler traces
+// nothing, so handlers built without tracing need no checks.
+type Handler struct {
+	p               *Provider
+	server, handler string
+}
+
+// ForHandler returns the tracer for the handler listening on listen in
+// server. It returns nil when p is nil.
+func (p *Provider) ForHandler(server, listen string) *Handler {
+	if p == nil {
+		return nil
+	}
+	return &Handler{p: p, server: server, handler: listen}
+}
+
+// Start begins the server span for r, continuing a trace the client sent
+// in traceparent. The returned request carries the span; without tracing
+// it is r itself and the span is a no-op.
+func (h *Handler) Start(r *http.Request) (*http.Request, trace.Span) {
+	if h == nil {
+		return r, noopSpan
+	}
+	ctx := h.p.propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := h.p.tracer.Start(ctx, r.Method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(r.Method),
+			semconv.URLPath(r.URL.Path),
+			semconv.ServerAddress(r.Host),
+			semconv.ClientAddress(r.RemoteAddr),
+			semconv.UserAgentOriginal(r.UserAgent()),
+			AttrServer.String(h.server),
+			AttrHandler.String(h.handler),
+		),
+	)
+	return r.WithContext(ctx), span
+}
+
+// End records the response status and ends a span from Start or
+// StartUpstream. 5xx statuses mark the span as failed.
+func End(span trace.Span, status int) {
+	span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+	if status >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+	span.End()
+}
+
+// StartUpstream begins the client span for an outgoing upstream request,
+// injects traceparent into its headers and records connection, request
+// written and first response byte as span events.
+func (h *Handler) StartUpstream(req *http.Request, upstream string) (*http.Request, trace.Span) {
+	if h == nil || !trace.SpanFromContext(req.Context()).SpanContext().IsValid() {
+		return req, noopSpan
+	}
+	ctx, span := h.p.tracer.Start(req.Context(), "upstream "+req.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(req.Method),
+			AttrUpstream.String(upstream),
+		),
+	)
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			span.AddEvent("connection obtained", trace.WithAttributes(attribute.Bool("reused", info.Reused)))
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			span.AddEvent("request written")
+		},
+		GotFirstResponseByte: func() {
+			span.AddEvent("first response byte")
+		},
+	})
+	// RoundTrippers must not modify the caller's request, headers included.
+	req = req.Clone(ctx)
+	h.p.propagator.Inject(ctx, propagation.HeaderCarrier(req.Header))
+	return req, span
+}
+
+// Fail marks a span from StartUpstream as failed by err and ends it.
+func Fail(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+	span.End()
+}
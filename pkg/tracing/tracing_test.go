@@ -0,0 +1,73 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel/sdk/resource"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestNilHandlerTracesNothing(t *testing.T) {
+	var p *Provider
+	h := p.ForHandler("web", ":443")
+	if h != nil {
+		t.Fatalf("ForHandler on nil provider = %v, want nil", h)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	got, span := h.Start(r)
+	if got != r {
+		t.Errorf("Start without tracing returned a new request")
+	}
+	if span.SpanContext().IsValid() {
+		t.Errorf("Start without tracing returned a real span")
+	}
+	End(span, http.StatusOK)
+
+	up, span := h.StartUpstream(r, "127.0.0.1:8080")
+	if up.Header.Get("Traceparent") != "" || span.SpanContext().IsValid() {
+		t.Errorf("StartUpstream without tracing injected a trace")
+	}
+}
+
+func TestNewLazyExporter(t *testing.T) {
+	for _, opts := range []Options{
+		{Endpoint: "127.0.0.1:1", Insecure: true},
+		{Endpoint: "http://127.0.0.1:1/v1/traces", Protocol: ProtocolHTTP},
+	} {
+		p, err := New(t.Context(), opts)
+		if err != nil {
+			t.Fatalf("New(%+v): %v", opts, err)
+		}
+		// Nothing was recorded, so shutdown has nothing to send.
+		ctx, cancel := context.WithCancel(t.Context())
+		cancel()
+		_ = p.Shutdown(ctx)
+	}
+	if _, err := New(t.Context(), Options{Endpoint: "x:1", Protocol: "thrift"}); !errors.Is(err, ErrUnknownProtocol) {
+		t.Errorf("New(thrift) = %v, want ErrUnknownProtocol", err)
+	}
+}
+
+func TestSampleRatioZero(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	h := newProvider(recorder, resource.Default(), 0).ForHandler("web", ":443")
+
+	_, span := h.Start(httptest.NewRequest(http.MethodGet, "/", nil))
+	End(span, http.StatusOK)
+	if n := len(recorder.Ended()); n != 0 {
+		t.Errorf("recorded %d new traces at ratio 0, want none", n)
+	}
+
+	// A caller that sampled its trace still gets the span.
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	_, span = h.Start(r)
+	End(span, http.StatusOK)
+	if n := len(recorder.Ended()); n != 1 {
+		t.Errorf("recorded %d sampled-parent traces at ratio 0, want 1", n)
+	}
+}